@@ -1,11 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/textproto"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
 )
 
 // DetectContentType needs at most 512 bytes
@@ -21,20 +29,103 @@ type writeWrapper interface {
 
 type attachment struct {
 	filename string
-	content  io.Reader
+	content  AttachmentSource
 	inline   bool
 	mimeType string
 }
 
+// AttachmentSource provides the contents of an attachment.
+//
+// Open is called every time the message is built, so a message using only
+// re-openable sources can be sent any number of times with identical content.
+type AttachmentSource interface {
+	Open() (io.ReadCloser, error)
+}
+
+// BytesSource is an AttachmentSource holding the attachment data in memory.
+type BytesSource []byte
+
+// Open returns a reader over the data.
+func (b BytesSource) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// FileSource is an AttachmentSource reading the named file each time the
+// message is built.
+type FileSource string
+
+// Open opens the file for reading.
+func (f FileSource) Open() (io.ReadCloser, error) {
+	return os.Open(string(f))
+}
+
+// OpenerFunc adapts an ordinary function to an AttachmentSource.
+type OpenerFunc func() (io.ReadCloser, error)
+
+// Open calls f().
+func (f OpenerFunc) Open() (io.ReadCloser, error) {
+	return f()
+}
+
+// readerSource wraps the io.Reader given to Attach and friends.
+//
+// A reader implementing io.Seeker is rewound to its initial offset on every
+// Open. Any other reader is read into memory on the first Open, as building a
+// message may read the attachments more than once, e.g. to sign it with DKIM.
+type readerSource struct {
+	r      io.Reader
+	opened bool
+	offset int64
+	data   []byte // contents of a reader not implementing io.Seeker
+}
+
+func newReaderSource(r io.Reader) *readerSource {
+	return &readerSource{r: r}
+}
+
+// Open returns the wrapped reader, rewinding it if it was read before, or a
+// reader over its buffered contents.
+func (s *readerSource) Open() (io.ReadCloser, error) {
+	seeker, canSeek := s.r.(io.Seeker)
+
+	if !s.opened {
+		if canSeek {
+			offset, err := seeker.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			s.offset = offset
+		} else {
+			data, err := ioutil.ReadAll(s.r)
+			if err != nil {
+				return nil, err
+			}
+			s.data = data
+		}
+		s.opened = true
+	}
+
+	if !canSeek {
+		return ioutil.NopCloser(bytes.NewReader(s.data)), nil
+	}
+	if _, err := seeker.Seek(s.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(s.r), nil
+}
+
 // Attach adds the contents of r to the email as an attachment with name as the
 // filename.
 //
 // r is not read until Send is called and the MIME type will be detected
 // using https://golang.org/pkg/net/http/#DetectContentType
+//
+// Unless r implements io.Seeker it is read into memory when the email is first
+// built - use AttachSource to stream large files.
 func (m *MailYak) Attach(name string, r io.Reader) {
 	m.attachments = append(m.attachments, attachment{
 		filename: name,
-		content:  r,
+		content:  newReaderSource(r),
 		inline:   false,
 	})
 }
@@ -47,7 +138,7 @@ func (m *MailYak) Attach(name string, r io.Reader) {
 func (m *MailYak) AttachWithMimeType(name string, r io.Reader, mimeType string) {
 	m.attachments = append(m.attachments, attachment{
 		filename: name,
-		content:  r,
+		content:  newReaderSource(r),
 		inline:   false,
 		mimeType: mimeType,
 	})
@@ -58,7 +149,7 @@ func (m *MailYak) AttachWithMimeType(name string, r io.Reader, mimeType string)
 // or header image. It is up to the user to ensure name is unique.
 //
 // Files can be referenced by their name within the email using the cid URL
-// protocol:
+// protocol, the URL is pointed at the Content-ID of the part when sent:
 //
 // 		<img src="cid:myFileName"/>
 //
@@ -67,7 +158,7 @@ func (m *MailYak) AttachWithMimeType(name string, r io.Reader, mimeType string)
 func (m *MailYak) AttachInline(name string, r io.Reader) {
 	m.attachments = append(m.attachments, attachment{
 		filename: name,
-		content:  r,
+		content:  newReaderSource(r),
 		inline:   true,
 	})
 }
@@ -78,7 +169,7 @@ func (m *MailYak) AttachInline(name string, r io.Reader) {
 // user to ensure name is unique and the specified mimeType is correct.
 //
 // Files can be referenced by their name within the email using the cid URL
-// protocol:
+// protocol, the URL is pointed at the Content-ID of the part when sent:
 //
 // 		<img src="cid:myFileName"/>
 //
@@ -86,7 +177,54 @@ func (m *MailYak) AttachInline(name string, r io.Reader) {
 func (m *MailYak) AttachInlineWithMimeType(name string, r io.Reader, mimeType string) {
 	m.attachments = append(m.attachments, attachment{
 		filename: name,
-		content:  r,
+		content:  newReaderSource(r),
+		inline:   true,
+		mimeType: mimeType,
+	})
+}
+
+// AttachSource adds an attachment with name as the filename, reading the
+// contents from src each time the email is built.
+//
+// The MIME type will be detected using
+// https://golang.org/pkg/net/http/#DetectContentType
+func (m *MailYak) AttachSource(name string, src AttachmentSource) {
+	m.attachments = append(m.attachments, attachment{
+		filename: name,
+		content:  src,
+		inline:   false,
+	})
+}
+
+// AttachSourceWithMimeType adds an attachment with name as the filename and
+// mimeType as the specified MIME type, reading the contents from src each time
+// the email is built.
+func (m *MailYak) AttachSourceWithMimeType(name string, src AttachmentSource, mimeType string) {
+	m.attachments = append(m.attachments, attachment{
+		filename: name,
+		content:  src,
+		inline:   false,
+		mimeType: mimeType,
+	})
+}
+
+// AttachInlineSource adds an inline attachment, reading the contents from src
+// each time the email is built. See AttachInline.
+func (m *MailYak) AttachInlineSource(name string, src AttachmentSource) {
+	m.attachments = append(m.attachments, attachment{
+		filename: name,
+		content:  src,
+		inline:   true,
+	})
+}
+
+// AttachInlineSourceWithMimeType adds an inline attachment with mimeType as
+// the specified MIME type, reading the contents from src each time the email
+// is built. See AttachInline.
+func (m *MailYak) AttachInlineSourceWithMimeType(name string, src AttachmentSource, mimeType string) {
+	m.attachments = append(m.attachments, attachment{
+		filename: name,
+		content:  src,
 		inline:   true,
 		mimeType: mimeType,
 	})
@@ -103,63 +241,132 @@ func (m *MailYak) writeAttachments(mixed partCreator, splitter writeWrapper) err
 	h := make([]byte, sniffLen)
 
 	for _, item := range m.attachments {
-		hLen, err := io.ReadFull(item.content, h)
-		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-			return err
+		cid := ""
+		if item.inline {
+			cid = m.contentID(item.filename)
 		}
-
-		if item.mimeType == "" {
-			item.mimeType = http.DetectContentType(h[:hLen])
+		if err := writeAttachment(mixed, splitter, item, cid, h); err != nil {
+			return fmt.Errorf("attachment %q: %v", item.filename, err)
 		}
+	}
 
-		ctype := fmt.Sprintf("%s;\n\tfilename=%q", item.mimeType, item.filename)
+	return nil
+}
 
-		part, err := mixed.CreatePart(getMIMEHeader(item, ctype))
-		if err != nil {
-			return err
-		}
+// writeAttachment opens the source of item and writes it as a single part
+// identified by cid, using h as the content sniffing buffer.
+func writeAttachment(mixed partCreator, splitter writeWrapper, item attachment, cid string, h []byte) error {
+	content, err := item.content.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
 
-		encoder := base64.NewEncoder(base64.StdEncoding, splitter.new(part))
-		if _, err := encoder.Write(h[:hLen]); err != nil {
-			return err
-		}
+	hLen, err := io.ReadFull(content, h)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
 
-		// More to write?
-		if hLen == sniffLen {
-			if _, err := io.Copy(encoder, item.content); err != nil {
-				return err
-			}
-		}
+	if item.mimeType == "" {
+		item.mimeType = http.DetectContentType(h[:hLen])
+	}
+
+	ctype := fmt.Sprintf("%s;\n\t%s", item.mimeType, filenameParam(item.filename))
+
+	part, err := mixed.CreatePart(getMIMEHeader(item, ctype, cid))
+	if err != nil {
+		return err
+	}
+
+	encoder := base64.NewEncoder(base64.StdEncoding, splitter.new(part))
+	if _, err := encoder.Write(h[:hLen]); err != nil {
+		return err
+	}
 
-		if err := encoder.Close(); err != nil {
+	// More to write?
+	if hLen == len(h) {
+		if _, err := io.Copy(encoder, content); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return encoder.Close()
 }
 
-func getMIMEHeader(a attachment, ctype string) textproto.MIMEHeader {
-	var disp string
-	var header textproto.MIMEHeader
-
+// getMIMEHeader returns the part header of a. Only inline parts are
+// referenced by the HTML body, so only they get the Content-ID cid.
+func getMIMEHeader(a attachment, ctype, cid string) textproto.MIMEHeader {
+	header := textproto.MIMEHeader{
+		"Content-Type":              {ctype},
+		"Content-Disposition":       {fmt.Sprintf("attachment;\n\t%s", filenameParam(a.filename))},
+		"Content-Transfer-Encoding": {"base64"},
+	}
 	if a.inline {
-		disp = fmt.Sprintf("inline;\n\tfilename=%q", a.filename)
-		header = textproto.MIMEHeader{
-			"Content-Type":              {ctype},
-			"Content-Disposition":       {disp},
-			"Content-Transfer-Encoding": {"base64"},
-		}
-	} else {
-		disp = fmt.Sprintf("attachment;\n\tfilename=%q", a.filename)
-		cid := fmt.Sprintf("<%s>", a.filename)
-		header = textproto.MIMEHeader{
-			"Content-Type":              {ctype},
-			"Content-Disposition":       {disp},
-			"Content-Transfer-Encoding": {"base64"},
-			"Content-ID":                {cid},
+		header.Set("Content-Disposition", fmt.Sprintf("inline;\n\t%s", filenameParam(a.filename)))
+		header.Set("Content-ID", fmt.Sprintf("<%s>", cid))
+	}
+	return header
+}
+
+// contentIDDomain matches the domains usable as they are in a Content-ID.
+var contentIDDomain = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?$`)
+
+// contentID returns the Content-ID of the inline attachment called name: a
+// hash of the name at the domain of the sender, as names are free text, e.g.
+// "Счёт №42.png", and a Content-ID is ASCII (RFC 2392).
+func (m *MailYak) contentID(name string) string {
+	domain := m.fromAddr[strings.LastIndexByte(m.fromAddr, '@')+1:]
+	if !contentIDDomain.MatchString(domain) {
+		domain = "localhost"
+	}
+	sum := sha256.Sum256([]byte(name))
+	return fmt.Sprintf("%x@%s", sum[:8], domain)
+}
+
+// withContentIDs returns html with the cid:name URLs of the inline
+// attachments, name either as it is or URL escaped, pointing at their
+// Content-ID.
+func (m *MailYak) withContentIDs(html []byte) []byte {
+	ids := map[string]string{}
+	for _, a := range m.attachments {
+		if a.inline {
+			ids[a.filename] = m.contentID(a.filename)
+			ids[url.PathEscape(a.filename)] = ids[a.filename]
 		}
 	}
+	return replaceContentIDs(html, ids)
+}
 
-	return header
+// cidURL matches the cid: URLs of an HTML body, up to the end of the attribute
+// value or CSS url(), so names may hold spaces.
+var cidURL = regexp.MustCompile(`\b(?i:cid):[^"'<>()\s][^"'<>()]*`)
+
+// replaceContentIDs returns html with the cid: URLs of the keys of ids
+// replaced by the ones of their values.
+func replaceContentIDs(html []byte, ids map[string]string) []byte {
+	if len(ids) == 0 {
+		return html
+	}
+	return cidURL.ReplaceAllFunc(html, func(match []byte) []byte {
+		name := string(match[len("cid:"):])
+		if id, ok := ids[name]; ok {
+			return []byte("cid:" + id)
+		}
+		// Unquoted, the URL ends with the first space
+		if i := strings.IndexAny(name, " \t\r\n"); i > 0 {
+			if id, ok := ids[name[:i]]; ok {
+				return []byte("cid:" + id + name[i:])
+			}
+		}
+		return match
+	})
+}
+
+// filenameParam returns the filename parameter of the part headers, RFC 2231
+// encoded when name is not ASCII, e.g. the rendered "Счёт №42.html".
+func filenameParam(name string) string {
+	if !isASCII(name) {
+		return strings.TrimPrefix(mime.FormatMediaType("x", map[string]string{"filename": name}), "x; ")
+	}
+	return fmt.Sprintf("filename=%q", name)
 }
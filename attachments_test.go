@@ -4,14 +4,17 @@ import (
 	"bytes"
 	"encoding/base64"
 	"io"
+	"io/ioutil"
 	"net/textproto"
 	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 type testAttachment struct {
 	contentType string
 	disposition string
+	contentID   string
 	data        bytes.Buffer
 }
 
@@ -24,6 +27,7 @@ func (t *testPartCreator) CreatePart(header textproto.MIMEHeader) (io.Writer, er
 	a := &testAttachment{
 		contentType: header.Get("Content-Type"),
 		disposition: header.Get("Content-Disposition"),
+		contentID:   header.Get("Content-ID"),
 	}
 
 	t.attachments = append(t.attachments, a)
@@ -71,7 +75,7 @@ func TestMailYakAttach(t *testing.T) {
 		},
 		{
 			"From one",
-			[]attachment{{"Existing", &bytes.Buffer{}, false, ""}},
+			[]attachment{{"Existing", BytesSource(nil), false, ""}},
 			"test",
 			&bytes.Buffer{},
 			2,
@@ -117,7 +121,7 @@ func TestMailYakAttachInline(t *testing.T) {
 		},
 		{
 			"From one",
-			[]attachment{{"Existing", &bytes.Buffer{}, false, ""}},
+			[]attachment{{"Existing", BytesSource(nil), false, ""}},
 			"test",
 			&bytes.Buffer{},
 			2,
@@ -165,7 +169,7 @@ func TestMailYakAttachWithMimeType(t *testing.T) {
 		},
 		{
 			"From one",
-			[]attachment{{"Existing", &bytes.Buffer{}, false, "text/csv; charset=utf-8"}},
+			[]attachment{{"Existing", BytesSource(nil), false, "text/csv; charset=utf-8"}},
 			"test",
 			&bytes.Buffer{},
 			"text/csv; charset=utf-8",
@@ -214,7 +218,7 @@ func TestMailYakAttachInlineWithMimeType(t *testing.T) {
 		},
 		{
 			"From one",
-			[]attachment{{"Existing", &bytes.Buffer{}, false, "text/csv; charset=utf-8"}},
+			[]attachment{{"Existing", BytesSource(nil), false, "text/csv; charset=utf-8"}},
 			"test",
 			&bytes.Buffer{},
 			"text/csv; charset=utf-8",
@@ -254,7 +258,7 @@ func TestMailYakWriteAttachments(t *testing.T) {
 	}{
 		{
 			"Empty",
-			[]attachment{{"Empty", &bytes.Buffer{}, false, ""}},
+			[]attachment{{"Empty", BytesSource(nil), false, ""}},
 			"text/plain; charset=utf-8;\n\tfilename=\"Empty\"",
 			"attachment;\n\tfilename=\"Empty\"",
 			"",
@@ -262,7 +266,7 @@ func TestMailYakWriteAttachments(t *testing.T) {
 		},
 		{
 			"Short string",
-			[]attachment{{"advice", strings.NewReader("Don't Panic"), false, ""}},
+			[]attachment{{"advice", BytesSource("Don't Panic"), false, ""}},
 			"text/plain; charset=utf-8;\n\tfilename=\"advice\"",
 			"attachment;\n\tfilename=\"advice\"",
 			"RG9uJ3QgUGFuaWM=",
@@ -270,7 +274,7 @@ func TestMailYakWriteAttachments(t *testing.T) {
 		},
 		{
 			"Space in filename",
-			[]attachment{{"Empty with spaces", &bytes.Buffer{}, false, ""}},
+			[]attachment{{"Empty with spaces", BytesSource(nil), false, ""}},
 			"text/plain; charset=utf-8;\n\tfilename=\"Empty with spaces\"",
 			"attachment;\n\tfilename=\"Empty with spaces\"",
 			"",
@@ -278,7 +282,7 @@ func TestMailYakWriteAttachments(t *testing.T) {
 		},
 		{
 			"With specified MIME type",
-			[]attachment{{"Empty with spaces", &bytes.Buffer{}, false, "text/csv; charset=utf-8"}},
+			[]attachment{{"Empty with spaces", BytesSource(nil), false, "text/csv; charset=utf-8"}},
 			"text/csv; charset=utf-8;\n\tfilename=\"Empty with spaces\"",
 			"attachment;\n\tfilename=\"Empty with spaces\"",
 			"",
@@ -289,7 +293,7 @@ func TestMailYakWriteAttachments(t *testing.T) {
 			[]attachment{
 				{
 					"partyinvite.txt",
-					strings.NewReader(
+					BytesSource(
 						"If Baldrick served a meal at HQ he would be arrested for the biggest " +
 							"mass poisoning since Lucretia Borgia invited 500 friends for a Wine and Anthrax Party.",
 					),
@@ -309,7 +313,7 @@ func TestMailYakWriteAttachments(t *testing.T) {
 			[]attachment{
 				{
 					"qed.txt",
-					strings.NewReader(
+					BytesSource(
 						`Now it is such a bizarrely improbable coincidence that anything so mind-bogglingly ` +
 							`useful could have evolved purely by chance that some thinkers have chosen to see it ` +
 							`as the final and clinching proof of the non-existence of God. The argument goes something ` +
@@ -346,7 +350,7 @@ func TestMailYakWriteAttachments(t *testing.T) {
 		},
 		{
 			"HTML",
-			[]attachment{{"name.html", strings.NewReader("<html><head></head></html>"), false, ""}},
+			[]attachment{{"name.html", BytesSource("<html><head></head></html>"), false, ""}},
 			"text/html; charset=utf-8;\n\tfilename=\"name.html\"",
 			"attachment;\n\tfilename=\"name.html\"",
 			"PGh0bWw+PGhlYWQ+PC9oZWFkPjwvaHRtbD4=",
@@ -354,7 +358,7 @@ func TestMailYakWriteAttachments(t *testing.T) {
 		},
 		{
 			"HTML - wrong extension",
-			[]attachment{{"name.png", strings.NewReader("<html><head></head></html>"), false, ""}},
+			[]attachment{{"name.png", BytesSource("<html><head></head></html>"), false, ""}},
 			"text/html; charset=utf-8;\n\tfilename=\"name.png\"",
 			"attachment;\n\tfilename=\"name.png\"",
 			"PGh0bWw+PGhlYWQ+PC9oZWFkPjwvaHRtbD4=",
@@ -364,7 +368,7 @@ func TestMailYakWriteAttachments(t *testing.T) {
 		// inline attachments
 		{
 			"Empty inline",
-			[]attachment{{"Empty", &bytes.Buffer{}, true, ""}},
+			[]attachment{{"Empty", BytesSource(nil), true, ""}},
 			"text/plain; charset=utf-8;\n\tfilename=\"Empty\"",
 			"inline;\n\tfilename=\"Empty\"",
 			"",
@@ -372,7 +376,7 @@ func TestMailYakWriteAttachments(t *testing.T) {
 		},
 		{
 			"Short string inline",
-			[]attachment{{"advice", strings.NewReader("Don't Panic"), true, ""}},
+			[]attachment{{"advice", BytesSource("Don't Panic"), true, ""}},
 			"text/plain; charset=utf-8;\n\tfilename=\"advice\"",
 			"inline;\n\tfilename=\"advice\"",
 			"RG9uJ3QgUGFuaWM=",
@@ -383,7 +387,7 @@ func TestMailYakWriteAttachments(t *testing.T) {
 			[]attachment{
 				{
 					"partyinvite.txt",
-					strings.NewReader(
+					BytesSource(
 						"If Baldrick served a meal at HQ he would be arrested for the biggest " +
 							"mass poisoning since Lucretia Borgia invited 500 friends for a Wine and Anthrax Party.",
 					),
@@ -403,7 +407,7 @@ func TestMailYakWriteAttachments(t *testing.T) {
 			[]attachment{
 				{
 					"qed.txt",
-					strings.NewReader(
+					BytesSource(
 						`Now it is such a bizarrely improbable coincidence that anything so mind-bogglingly ` +
 							`useful could have evolved purely by chance that some thinkers have chosen to see it ` +
 							`as the final and clinching proof of the non-existence of God. The argument goes something ` +
@@ -440,7 +444,7 @@ func TestMailYakWriteAttachments(t *testing.T) {
 		},
 		{
 			"HTML inline",
-			[]attachment{{"name.html", strings.NewReader("<html><head></head></html>"), true, ""}},
+			[]attachment{{"name.html", BytesSource("<html><head></head></html>"), true, ""}},
 			"text/html; charset=utf-8;\n\tfilename=\"name.html\"",
 			"inline;\n\tfilename=\"name.html\"",
 			"PGh0bWw+PGhlYWQ+PC9oZWFkPjwvaHRtbD4=",
@@ -448,7 +452,7 @@ func TestMailYakWriteAttachments(t *testing.T) {
 		},
 		{
 			"HTML - wrong extension inline",
-			[]attachment{{"name.png", strings.NewReader("<html><head></head></html>"), true, ""}},
+			[]attachment{{"name.png", BytesSource("<html><head></head></html>"), true, ""}},
 			"text/html; charset=utf-8;\n\tfilename=\"name.png\"",
 			"inline;\n\tfilename=\"name.png\"",
 			"PGh0bWw+PGhlYWQ+PC9oZWFkPjwvaHRtbD4=",
@@ -459,7 +463,7 @@ func TestMailYakWriteAttachments(t *testing.T) {
 			[]attachment{
 				{
 					"qed.txt",
-					base64.NewDecoder(base64.StdEncoding, strings.NewReader(
+					newReaderSource(base64.NewDecoder(base64.StdEncoding, strings.NewReader(
 						"Tm93IGl0IGlzIHN1Y2ggYSBiaXphcnJlbHkgaW1wcm9iYWJsZSBjb2luY2lkZW5jZSB0a"+
 							"GF0IGFueXRoaW5nIHNvIG1pbmQtYm9nZ2xpbmdseSB1c2VmdWwgY291bGQgaGF2ZSBldm"+
 							"9sdmVkIHB1cmVseSBieSBjaGFuY2UgdGhhdCBzb21lIHRoaW5rZXJzIGhhdmUgY2hvc2V"+
@@ -475,7 +479,7 @@ func TestMailYakWriteAttachments(t *testing.T) {
 							"biBhIHB1ZmYgb2YgbG9naWMuICJPaCwgdGhhdCB3YXMgZWFzeSwiIHNheXMgTWFuLCBhb"+
 							"mQgZm9yIGFuIGVuY29yZSBnb2VzIG9uIHRvIHByb3ZlIHRoYXQgYmxhY2sgaXMgd2hpdG"+
 							"UgYW5kIGdldHMgaGltc2VsZiBraWxsZWQgb24gdGhlIG5leHQgemVicmEgY3Jvc3Npbmcu",
-					)),
+					))),
 					false,
 					"",
 				},
@@ -548,7 +552,7 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 	}{
 		{
 			"Single Attachment",
-			[]attachment{{"name.txt", strings.NewReader("test"), false, ""}},
+			[]attachment{{"name.txt", BytesSource("test"), false, ""}},
 			[]testAttachment{
 				{
 					contentType: "text/plain; charset=utf-8;\n\tfilename=\"name.txt\"",
@@ -560,7 +564,7 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 		},
 		{
 			"Single Attachment with specified MIME type",
-			[]attachment{{"name.txt", strings.NewReader("test"), false, "text/csv; charset=utf-8"}},
+			[]attachment{{"name.txt", BytesSource("test"), false, "text/csv; charset=utf-8"}},
 			[]testAttachment{
 				{
 					contentType: "text/csv; charset=utf-8;\n\tfilename=\"name.txt\"",
@@ -573,8 +577,8 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 		{
 			"Multiple Attachment - same types",
 			[]attachment{
-				{"name.txt", strings.NewReader("test"), false, ""},
-				{"different.txt", strings.NewReader("another"), false, ""},
+				{"name.txt", BytesSource("test"), false, ""},
+				{"different.txt", BytesSource("another"), false, ""},
 			},
 			[]testAttachment{
 				{
@@ -593,8 +597,8 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 		{
 			"Multiple Attachment - different types",
 			[]attachment{
-				{"name.txt", strings.NewReader("test"), false, ""},
-				{"html.txt", strings.NewReader("<html><head></head></html>"), false, ""},
+				{"name.txt", BytesSource("test"), false, ""},
+				{"html.txt", BytesSource("<html><head></head></html>"), false, ""},
 			},
 			[]testAttachment{
 				{
@@ -613,8 +617,8 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 		{
 			"Multiple Attachment - different specified MIME types",
 			[]attachment{
-				{"name.txt", strings.NewReader("test"), false, "text/csv; charset=utf-8"},
-				{"html.txt", strings.NewReader("<html><head></head></html>"), false, "application/xml"},
+				{"name.txt", BytesSource("test"), false, "text/csv; charset=utf-8"},
+				{"html.txt", BytesSource("<html><head></head></html>"), false, "application/xml"},
 			},
 			[]testAttachment{
 				{
@@ -635,7 +639,7 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 			[]attachment{
 				{
 					"550.txt",
-					strings.NewReader(
+					BytesSource(
 						"Lorem ipsum dolor sit amet, consectetur adipiscing elit. Mauris ut nisl felis. " +
 							"Aenean felis justo, gravida eget leo aliquet, molestie aliquam risus. Vestibulum " +
 							"et nibh rhoncus, malesuada tellus eget, pellentesque diam. Sed venenatis vitae " +
@@ -648,7 +652,7 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 					"",
 				},
 				{
-					"520.txt", strings.NewReader(
+					"520.txt", BytesSource(
 						"Lorem ipsum dolor sit amet, consectetur adipiscing elit. Donec eu vestibulum dolor. " +
 							"Nunc ac posuere felis, a mattis leo. Duis elementum tempor leo, sed efficitur nunc. " +
 							"Cras ornare feugiat vulputate. Maecenas sit amet felis lobortis ipsum dignissim euismod. " +
@@ -697,7 +701,7 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 			[]attachment{
 				{
 					"520.txt",
-					strings.NewReader(
+					BytesSource(
 						"Lorem ipsum dolor sit amet, consectetur adipiscing elit. Donec eu vestibulum dolor. Nunc ac " +
 							"posuere felis, a mattis leo. Duis elementum tempor leo, sed efficitur nunc. Cras ornare " +
 							"feugiat vulputate. Maecenas sit amet felis lobortis ipsum dignissim euismod. Vestibulum " +
@@ -710,7 +714,7 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 				},
 				{
 					"550.txt",
-					strings.NewReader(
+					BytesSource(
 						"Lorem ipsum dolor sit amet, consectetur adipiscing elit. Mauris ut nisl felis. Aenean felis " +
 							"justo, gravida eget leo aliquet, molestie aliquam risus. Vestibulum et nibh rhoncus, " +
 							"malesuada tellus eget, pellentesque diam. Sed venenatis vitae erat vel ullamcorper. " +
@@ -759,7 +763,7 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 		// inline attachments
 		{
 			"Single Inline Attachment",
-			[]attachment{{"name.txt", strings.NewReader("test"), true, ""}},
+			[]attachment{{"name.txt", BytesSource("test"), true, ""}},
 			[]testAttachment{
 				{
 					contentType: "text/plain; charset=utf-8;\n\tfilename=\"name.txt\"",
@@ -771,7 +775,7 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 		},
 		{
 			"Single Inline Attachment with specified MIME type",
-			[]attachment{{"name.txt", strings.NewReader("test"), true, "text/csv; charset=utf-8"}},
+			[]attachment{{"name.txt", BytesSource("test"), true, "text/csv; charset=utf-8"}},
 			[]testAttachment{
 				{
 					contentType: "text/csv; charset=utf-8;\n\tfilename=\"name.txt\"",
@@ -784,8 +788,8 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 		{
 			"Multiple Inline Attachments - same types",
 			[]attachment{
-				{"name.txt", strings.NewReader("test"), true, ""},
-				{"different.txt", strings.NewReader("another"), true, ""},
+				{"name.txt", BytesSource("test"), true, ""},
+				{"different.txt", BytesSource("another"), true, ""},
 			},
 			[]testAttachment{
 				{
@@ -804,8 +808,8 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 		{
 			"Multiple Attachments - One Inline, One not",
 			[]attachment{
-				{"name.txt", strings.NewReader("test"), false, ""},
-				{"different.txt", strings.NewReader("another"), true, ""},
+				{"name.txt", BytesSource("test"), false, ""},
+				{"different.txt", BytesSource("another"), true, ""},
 			},
 			[]testAttachment{
 				{
@@ -824,8 +828,8 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 		{
 			"Multiple Inline Attachments - different types",
 			[]attachment{
-				{"name.txt", strings.NewReader("test"), true, ""},
-				{"html.txt", strings.NewReader("<html><head></head></html>"), true, ""},
+				{"name.txt", BytesSource("test"), true, ""},
+				{"html.txt", BytesSource("<html><head></head></html>"), true, ""},
 			},
 			[]testAttachment{
 				{
@@ -844,8 +848,8 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 		{
 			"Multiple Inline Attachments - specified MIME types",
 			[]attachment{
-				{"name.txt", strings.NewReader("test"), true, "text/csv; charset=utf-8"},
-				{"different.txt", strings.NewReader("<html><head></head></html>"), true, "application/xml"},
+				{"name.txt", BytesSource("test"), true, "text/csv; charset=utf-8"},
+				{"different.txt", BytesSource("<html><head></head></html>"), true, "application/xml"},
 			},
 			[]testAttachment{
 				{
@@ -866,7 +870,7 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 			[]attachment{
 				{
 					"550.txt",
-					strings.NewReader(
+					BytesSource(
 						"Lorem ipsum dolor sit amet, consectetur adipiscing elit. Mauris ut nisl felis. " +
 							"Aenean felis justo, gravida eget leo aliquet, molestie aliquam risus. Vestibulum " +
 							"et nibh rhoncus, malesuada tellus eget, pellentesque diam. Sed venenatis vitae " +
@@ -879,7 +883,7 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 					"",
 				},
 				{
-					"520.txt", strings.NewReader(
+					"520.txt", BytesSource(
 						"Lorem ipsum dolor sit amet, consectetur adipiscing elit. Donec eu vestibulum dolor. " +
 							"Nunc ac posuere felis, a mattis leo. Duis elementum tempor leo, sed efficitur nunc. " +
 							"Cras ornare feugiat vulputate. Maecenas sit amet felis lobortis ipsum dignissim euismod. " +
@@ -928,7 +932,7 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 			[]attachment{
 				{
 					"520.txt",
-					strings.NewReader(
+					BytesSource(
 						"Lorem ipsum dolor sit amet, consectetur adipiscing elit. Donec eu vestibulum dolor. Nunc ac " +
 							"posuere felis, a mattis leo. Duis elementum tempor leo, sed efficitur nunc. Cras ornare " +
 							"feugiat vulputate. Maecenas sit amet felis lobortis ipsum dignissim euismod. Vestibulum " +
@@ -941,7 +945,7 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 				},
 				{
 					"550.txt",
-					strings.NewReader(
+					BytesSource(
 						"Lorem ipsum dolor sit amet, consectetur adipiscing elit. Mauris ut nisl felis. Aenean felis " +
 							"justo, gravida eget leo aliquet, molestie aliquam risus. Vestibulum et nibh rhoncus, " +
 							"malesuada tellus eget, pellentesque diam. Sed venenatis vitae erat vel ullamcorper. " +
@@ -1023,3 +1027,233 @@ func TestMailYakWriteAttachments_multipleAttachments(t *testing.T) {
 		})
 	}
 }
+
+// TestAttachmentSources ensures every source can be opened repeatedly and
+// yields the same content
+func TestAttachmentSources(t *testing.T) {
+	t.Parallel()
+
+	want, err := ioutil.ReadFile("./storage/invoice.ru.1.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		src  AttachmentSource
+	}{
+		{"Bytes", BytesSource(want)},
+		{"File", FileSource("./storage/invoice.ru.1.html")},
+		{"Opener", OpenerFunc(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(want)), nil
+		})},
+		{"Seekable reader", newReaderSource(bytes.NewReader(want))},
+		{"Reader", newReaderSource(ioutil.NopCloser(bytes.NewBuffer(want)))},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			for i := 0; i < 3; i++ {
+				r, err := tt.src.Open()
+				if err != nil {
+					t.Fatalf("%q. Open() #%d error = %v", tt.name, i, err)
+				}
+				got, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatalf("%q. Read #%d error = %v", tt.name, i, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%q. Read #%d = %d bytes, want %d", tt.name, i, len(got), len(want))
+				}
+			}
+		})
+	}
+}
+
+// TestMailYakWriteAttachments_resend ensures the attachments of a message
+// built repeatedly are identical
+func TestMailYakWriteAttachments_resend(t *testing.T) {
+	t.Parallel()
+
+	m := &MailYak{}
+	m.AttachSource("invoice.html", FileSource("./storage/invoice.ru.1.html"))
+	m.AttachSource("note.txt", BytesSource("Don't Panic"))
+	m.Attach("seek.txt", strings.NewReader("Mostly harmless"))
+
+	var first []testAttachment
+	for i := 0; i < 3; i++ {
+		pc := &testPartCreator{}
+		if err := m.writeAttachments(pc, nopBuilder{}); err != nil {
+			t.Fatalf("#%d writeAttachments() error = %v", i, err)
+		}
+		if len(pc.attachments) != 3 {
+			t.Fatalf("#%d writeAttachments() wrote %d attachments, want 3", i, len(pc.attachments))
+		}
+
+		var got []testAttachment
+		for _, a := range pc.attachments {
+			if a.data.Len() == 0 {
+				t.Errorf("#%d attachment %q is empty", i, a.disposition)
+			}
+			got = append(got, *a)
+		}
+		if first == nil {
+			first = got
+			continue
+		}
+		for j := range got {
+			if got[j].contentType != first[j].contentType || got[j].data.String() != first[j].data.String() {
+				t.Errorf("#%d attachment %q differs from the first build", i, got[j].disposition)
+			}
+		}
+	}
+}
+
+// TestMailYakWriteAttachments_contentID ensures only inline attachments get a
+// Content-ID, an ASCII one whatever the filename
+func TestMailYakWriteAttachments_contentID(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		from     string
+		filename string
+		inline   bool
+		// Expected results.
+		domain string
+	}{
+		{"Attachment", "billing@example.org", "Счёт №42.html", false, ""},
+		{"Inline", "billing@example.org", "logo.png", true, "@example.org>"},
+		{"Inline Cyrillic", "billing@example.org", "Счёт №42.png", true, "@example.org>"},
+		{"No sender", "", "logo.png", true, "@localhost>"},
+		{"Sender out of ASCII", "счета@пример.рф", "logo.png", true, "@localhost>"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			m := &MailYak{fromAddr: tt.from}
+			if tt.inline {
+				m.AttachInlineSource(tt.filename, BytesSource("data"))
+			} else {
+				m.AttachSource(tt.filename, BytesSource("data"))
+			}
+
+			pc := &testPartCreator{}
+			if err := m.writeAttachments(pc, nopBuilder{}); err != nil {
+				t.Fatalf("%q. MailYak.writeAttachments() error = %v", tt.name, err)
+			}
+			got := pc.attachments[0].contentID
+			if !tt.inline {
+				if got != "" {
+					t.Errorf("%q. MailYak.writeAttachments() Content-ID = %q, want none", tt.name, got)
+				}
+				return
+			}
+			if got != "<"+m.contentID(tt.filename)+">" || !strings.HasSuffix(got, tt.domain) {
+				t.Errorf("%q. MailYak.writeAttachments() Content-ID = %q, want <hash%s", tt.name, got, tt.domain)
+			}
+			for i := 0; i < len(got); i++ {
+				if got[i] >= utf8.RuneSelf {
+					t.Errorf("%q. MailYak.writeAttachments() Content-ID = %q, not ASCII", tt.name, got)
+					break
+				}
+			}
+		})
+	}
+}
+
+// TestMailYakWithContentIDs ensures the cid: URLs of the HTML body naming
+// inline attachments are pointed at their Content-ID
+func TestMailYakWithContentIDs(t *testing.T) {
+	t.Parallel()
+
+	m := &MailYak{fromAddr: "billing@example.org"}
+	m.AttachInlineSource("logo.png", BytesSource("logo"))
+	m.AttachInlineSource("Счёт №42.png", BytesSource("qr"))
+	m.AttachSource("invoice.pdf", BytesSource("pdf"))
+	logo, qr := m.contentID("logo.png"), m.contentID("Счёт №42.png")
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		html string
+		// Expected results.
+		want string
+	}{
+		{"Name", `<img src="cid:logo.png">`, `<img src="cid:` + logo + `">`},
+		{"Single quotes", `<img src='CID:logo.png'/>`, `<img src='cid:` + logo + `'/>`},
+		{"Name out of ASCII", `<img src="cid:Счёт №42.png">`, `<img src="cid:` + qr + `">`},
+		{"Escaped name", `<img src="cid:%D0%A1%D1%87%D1%91%D1%82%20%E2%84%9642.png">`, `<img src="cid:` + qr + `">`},
+		{"CSS", `<td style="background:url(cid:logo.png)">`, `<td style="background:url(cid:` + logo + `)">`},
+		{"Unquoted", `<img src=cid:logo.png alt=Logo>`, `<img src=cid:` + logo + ` alt=Logo>`},
+		{"Several", `<img src="cid:logo.png"><img src="cid:logo.png">`, `<img src="cid:` + logo + `"><img src="cid:` + logo + `">`},
+		{"Longer name", `<img src="cid:logo.png2">`, `<img src="cid:logo.png2">`},
+		{"Attachment", `<a href="cid:invoice.pdf">`, `<a href="cid:invoice.pdf">`},
+		{"No reference", `<p>logo.png</p>`, `<p>logo.png</p>`},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := string(m.withContentIDs([]byte(tt.html))); got != tt.want {
+				t.Errorf("%q. MailYak.withContentIDs() = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestFilenameParam ensures filenames out of ASCII are RFC 2231 encoded, and
+// read back by ParseMail
+func TestFilenameParam(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		filename string
+		// Expected results.
+		want string
+	}{
+		{"ASCII", "invoice.html", `filename="invoice.html"`},
+		{"ASCII with spaces", "invoice 42.html", `filename="invoice 42.html"`},
+		{"Cyrillic", "Счёт №42.html", `filename*=utf-8''%D0%A1%D1%87%D1%91%D1%82%20%E2%84%9642.html`},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := filenameParam(tt.filename); got != tt.want {
+				t.Errorf("%q. filenameParam() = %q, want %q", tt.name, got, tt.want)
+			}
+
+			m := NewMail(&SMTPInfo{})
+			m.From("from@example.org")
+			m.To("to@example.org")
+			m.Plain().Set("Счёт во вложении")
+			m.AttachSourceWithMimeType(tt.filename, BytesSource("<p>Счёт</p>"), "text/html; charset=utf-8")
+			var buf bytes.Buffer
+			if _, err := m.WriteTo(&buf); err != nil {
+				t.Fatalf("%q. MailYak.WriteTo() error = %v", tt.name, err)
+			}
+
+			parsed, err := ParseMail(&SMTPInfo{}, &buf)
+			if err != nil {
+				t.Fatalf("%q. ParseMail() error = %v", tt.name, err)
+			}
+			if len(parsed.attachments) != 1 || parsed.attachments[0].filename != tt.filename {
+				t.Errorf("%q. ParseMail() attachments = %+v, want %q", tt.name, parsed.attachments, tt.filename)
+			}
+		})
+	}
+}
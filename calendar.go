@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// iCalendar methods (RFC 5546) supported for invitations.
+//
+// An update of an invitation is a REQUEST with the UID of the original event
+// and a higher sequence number.
+const (
+	CalendarRequest = "REQUEST"
+	CalendarCancel  = "CANCEL"
+)
+
+// maxICSLineLen is the maximum octet length of a content line before it is
+// folded (RFC 5545, section 3.1).
+const maxICSLineLen = 75
+
+const icsTimeFormat = "20060102T150405"
+
+// Attendee is a participant of a calendar event.
+type Attendee struct {
+	Name  string
+	Email string
+}
+
+// Event describes a meeting invitation, sent as a text/calendar alternative so
+// that mail clients show Accept/Decline buttons.
+type Event struct {
+	Method      string // CalendarRequest (default) or CalendarCancel
+	UID         string
+	Sequence    int
+	Start       time.Time
+	End         time.Time
+	TimeZone    *time.Location // nil to write the times in UTC
+	Summary     string
+	Description string
+	Location    string
+	Organizer   Attendee
+	Attendees   []Attendee
+}
+
+// Calendar adds ev to the email as a text/calendar alternative body part and
+// as an invite.ics attachment.
+//
+// The calendar data is generated when Calendar is called, so later changes to
+// ev have no effect.
+func (m *MailYak) Calendar(ev *Event) error {
+	ics, err := ev.ics(time.Now())
+	if err != nil {
+		return err
+	}
+	m.ics = ics
+	m.icsMethod = ev.method()
+	return nil
+}
+
+func (ev *Event) method() string {
+	if ev.Method == "" {
+		return CalendarRequest
+	}
+	return ev.Method
+}
+
+// ics renders the event as an iCalendar object, using stamp as DTSTAMP.
+func (ev *Event) ics(stamp time.Time) ([]byte, error) {
+	method := ev.method()
+	if method != CalendarRequest && method != CalendarCancel {
+		return nil, fmt.Errorf("calendar: unsupported method %q", ev.Method)
+	}
+	if ev.UID == "" {
+		return nil, errors.New("calendar: UID is required")
+	}
+	if ev.Start.IsZero() || ev.End.IsZero() {
+		return nil, errors.New("calendar: start and end are required")
+	}
+	if ev.End.Before(ev.Start) {
+		return nil, errors.New("calendar: end is before start")
+	}
+	if ev.Organizer.Email == "" {
+		return nil, errors.New("calendar: organizer is required")
+	}
+
+	var buf bytes.Buffer
+	line := func(name, value string) {
+		writeICSLine(&buf, name+":"+value)
+	}
+
+	line("BEGIN", "VCALENDAR")
+	line("PRODID", "-//Lunkov//srv-sendmail//EN")
+	line("VERSION", "2.0")
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", method)
+
+	tz := ev.fixedZone()
+	if tz != nil {
+		name, offset := ev.Start.In(tz).Zone()
+		line("BEGIN", "VTIMEZONE")
+		line("TZID", tz.String())
+		line("BEGIN", "STANDARD")
+		line("DTSTART", "19700101T000000")
+		line("TZOFFSETFROM", icsOffset(offset))
+		line("TZOFFSETTO", icsOffset(offset))
+		line("TZNAME", name)
+		line("END", "STANDARD")
+		line("END", "VTIMEZONE")
+	}
+
+	line("BEGIN", "VEVENT")
+	line("UID", icsEscape(ev.UID))
+	line("SEQUENCE", fmt.Sprintf("%d", ev.Sequence))
+	line("DTSTAMP", stamp.UTC().Format(icsTimeFormat)+"Z")
+	if tz != nil {
+		line("DTSTART;TZID="+tz.String(), ev.Start.In(tz).Format(icsTimeFormat))
+		line("DTEND;TZID="+tz.String(), ev.End.In(tz).Format(icsTimeFormat))
+	} else {
+		line("DTSTART", ev.Start.UTC().Format(icsTimeFormat)+"Z")
+		line("DTEND", ev.End.UTC().Format(icsTimeFormat)+"Z")
+	}
+	line("SUMMARY", icsEscape(ev.Summary))
+	if ev.Description != "" {
+		line("DESCRIPTION", icsEscape(ev.Description))
+	}
+	if ev.Location != "" {
+		line("LOCATION", icsEscape(ev.Location))
+	}
+	line("ORGANIZER"+icsCommonName(ev.Organizer.Name), "mailto:"+ev.Organizer.Email)
+	for _, a := range ev.Attendees {
+		line("ATTENDEE"+icsCommonName(a.Name)+";ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE", "mailto:"+a.Email)
+	}
+	if method == CalendarCancel {
+		line("STATUS", "CANCELLED")
+	} else {
+		line("STATUS", "CONFIRMED")
+	}
+	line("TRANSP", "OPAQUE")
+	line("END", "VEVENT")
+	line("END", "VCALENDAR")
+
+	return buf.Bytes(), nil
+}
+
+// fixedZone returns the event time zone when it can be described by a single
+// UTC offset around the event, otherwise nil and the times are written in UTC.
+func (ev *Event) fixedZone() *time.Location {
+	if ev.TimeZone == nil || ev.TimeZone == time.UTC {
+		return nil
+	}
+
+	year := ev.Start.In(ev.TimeZone).Year()
+	_, start := ev.Start.In(ev.TimeZone).Zone()
+	for _, t := range []time.Time{
+		ev.End,
+		time.Date(year, time.January, 1, 0, 0, 0, 0, ev.TimeZone),
+		time.Date(year, time.July, 1, 0, 0, 0, 0, ev.TimeZone),
+	} {
+		if _, offset := t.In(ev.TimeZone).Zone(); offset != start {
+			return nil
+		}
+	}
+	return ev.TimeZone
+}
+
+// icsOffset formats a UTC offset in seconds as +hhmm.
+func icsOffset(offset int) string {
+	sign := '+'
+	if offset < 0 {
+		sign = '-'
+		offset = -offset
+	}
+	return fmt.Sprintf("%c%02d%02d", sign, offset/3600, offset%3600/60)
+}
+
+// icsCommonName returns the CN parameter for name, if any.
+func icsCommonName(name string) string {
+	if name == "" {
+		return ""
+	}
+	return `;CN="` + strings.NewReplacer(`"`, "'", "\r", "", "\n", " ").Replace(name) + `"`
+}
+
+// icsEscape escapes a TEXT value (RFC 5545, section 3.3.11).
+func icsEscape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+		"\r", `\n`,
+	).Replace(s)
+}
+
+// writeICSLine writes a content line, folding it at maxICSLineLen octets
+// without splitting UTF-8 sequences.
+func writeICSLine(buf *bytes.Buffer, l string) {
+	limit := maxICSLineLen
+	for len(l) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(l[cut]) {
+			cut--
+		}
+		buf.WriteString(l[:cut])
+		buf.WriteString("\r\n ")
+		l = l[cut:]
+		// The leading space of the continuation counts towards the limit
+		limit = maxICSLineLen - 1
+	}
+	buf.WriteString(l)
+	buf.WriteString("\r\n")
+}
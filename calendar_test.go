@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEventICS ensures invitations are rendered as valid iCalendar objects
+func TestEventICS(t *testing.T) {
+	t.Parallel()
+
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+
+	stamp := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	base := Event{
+		UID:       "inspection-42@example.org",
+		Start:     time.Date(2026, 10, 20, 10, 0, 0, 0, moscow),
+		End:       time.Date(2026, 10, 20, 11, 30, 0, 0, moscow),
+		TimeZone:  moscow,
+		Summary:   "Осмотр помещения",
+		Location:  "Москва, ул. Тверская, 1",
+		Organizer: Attendee{Name: "Notify", Email: "notify@example.org"},
+		Attendees: []Attendee{{Email: "client@example.org"}},
+	}
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		ev func() Event
+		// Expected results.
+		want    []string
+		wantErr bool
+	}{
+		{
+			"Request with time zone",
+			func() Event { return base },
+			[]string{
+				"METHOD:REQUEST\r\n",
+				"BEGIN:VTIMEZONE\r\nTZID:Europe/Moscow\r\nBEGIN:STANDARD\r\nDTSTART:19700101T000000\r\nTZOFFSETFROM:+0300\r\nTZOFFSETTO:+0300\r\nTZNAME:MSK\r\nEND:STANDARD\r\nEND:VTIMEZONE\r\n",
+				"UID:inspection-42@example.org\r\nSEQUENCE:0\r\nDTSTAMP:20261018T090000Z\r\n",
+				"DTSTART;TZID=Europe/Moscow:20261020T100000\r\nDTEND;TZID=Europe/Moscow:20261020T113000\r\n",
+				"LOCATION:Москва\\, ул. Тверская\\, 1\r\n",
+				"ORGANIZER;CN=\"Notify\":mailto:notify@example.org\r\n",
+				"ATTENDEE;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:client\r\n @example.org\r\n",
+				"STATUS:CONFIRMED\r\n",
+			},
+			false,
+		},
+		{
+			"Zone with daylight saving time falls back to UTC",
+			func() Event {
+				ev := base
+				ev.TimeZone = berlin
+				ev.Start = time.Date(2026, 10, 20, 10, 0, 0, 0, berlin)
+				ev.End = ev.Start.Add(time.Hour)
+				return ev
+			},
+			[]string{"DTSTART:20261020T080000Z\r\nDTEND:20261020T090000Z\r\n"},
+			false,
+		},
+		{
+			"Cancel",
+			func() Event {
+				ev := base
+				ev.Method = CalendarCancel
+				ev.Sequence = 3
+				return ev
+			},
+			[]string{"METHOD:CANCEL\r\n", "SEQUENCE:3\r\n", "STATUS:CANCELLED\r\n"},
+			false,
+		},
+		{
+			"Escaped description",
+			func() Event {
+				ev := base
+				ev.Description = "Line one;\nline two, \\ end"
+				return ev
+			},
+			[]string{`DESCRIPTION:Line one\;\nline two\, \\ end` + "\r\n"},
+			false,
+		},
+		{
+			"Missing UID",
+			func() Event {
+				ev := base
+				ev.UID = ""
+				return ev
+			},
+			nil,
+			true,
+		},
+		{
+			"End before start",
+			func() Event {
+				ev := base
+				ev.End = ev.Start.Add(-time.Hour)
+				return ev
+			},
+			nil,
+			true,
+		},
+		{
+			"Unknown method",
+			func() Event {
+				ev := base
+				ev.Method = "PUBLISH"
+				return ev
+			},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ev := tt.ev()
+			got, err := ev.ics(stamp)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. Event.ics() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(got), want) {
+					t.Errorf("%q. Event.ics() = %q, want to contain %q", tt.name, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestWriteICSLine ensures long lines are folded without splitting runes
+func TestWriteICSLine(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	writeICSLine(&buf, "SUMMARY:"+strings.Repeat("Счёт", 40))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+	if len(lines) < 2 {
+		t.Fatalf("writeICSLine() = %q, want folded lines", buf.String())
+	}
+
+	var unfolded string
+	for i, l := range lines {
+		if len(l) > maxICSLineLen {
+			t.Errorf("line %d is %d octets long", i, len(l))
+		}
+		if i > 0 {
+			if l[0] != ' ' {
+				t.Errorf("line %d = %q, want a leading space", i, l)
+			}
+			l = l[1:]
+		}
+		unfolded += l
+	}
+	if want := "SUMMARY:" + strings.Repeat("Счёт", 40); unfolded != want {
+		t.Errorf("unfolded = %q, want %q", unfolded, want)
+	}
+}
+
+// TestMailYakBuildMime_calendar ensures the invitation is added as an
+// alternative and an attachment
+func TestMailYakBuildMime_calendar(t *testing.T) {
+	t.Parallel()
+
+	m := &MailYak{
+		toAddrs:   []string{"client@example.org"},
+		fromAddr:  "notify@example.org",
+		trimRegex: regexp.MustCompile("\r?\n"),
+	}
+	m.HTML().Set("<p>Invitation</p>")
+
+	err := m.Calendar(&Event{
+		UID:       "call-1@example.org",
+		Start:     time.Date(2026, 10, 20, 10, 0, 0, 0, time.UTC),
+		End:       time.Date(2026, 10, 20, 11, 0, 0, 0, time.UTC),
+		Summary:   "Call",
+		Organizer: Attendee{Email: "notify@example.org"},
+		Attendees: []Attendee{{Email: "client@example.org"}},
+	})
+	if err != nil {
+		t.Fatalf("MailYak.Calendar() error = %v", err)
+	}
+
+	buf, err := m.buildMimeWithBoundaries("mixed", "alt")
+	if err != nil {
+		t.Fatalf("MailYak.buildMime() error = %v", err)
+	}
+
+	var types []string
+	mr := multipart.NewReader(buf, "mixed")
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		if ct := p.Header.Get("Content-Type"); strings.HasPrefix(ct, "multipart/alternative") {
+			ar := multipart.NewReader(p, "alt")
+			for {
+				ap, err := ar.NextPart()
+				if err != nil {
+					break
+				}
+				types = append(types, ap.Header.Get("Content-Type"))
+				if strings.HasPrefix(ap.Header.Get("Content-Type"), "text/calendar") {
+					body, _ := ioutil.ReadAll(ap)
+					if !strings.Contains(string(body), "UID:call-1@example.org\r\n") {
+						t.Errorf("calendar part = %q, want the event UID", body)
+					}
+				}
+			}
+		} else {
+			types = append(types, ct)
+		}
+	}
+
+	want := []string{
+		"text/html; charset=UTF-8",
+		"text/calendar; method=REQUEST; charset=UTF-8",
+		"application/ics; filename=\"invite.ics\"",
+	}
+	if strings.Join(types, "|") != strings.Join(want, "|") {
+		t.Errorf("MailYak.buildMime() parts = %q, want %q", types, want)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// outputCharset is a legacy single-byte charset messages can be written in,
+// for mailboxes mangling UTF-8.
+type outputCharset struct {
+	name    string // IANA name, used in Content-Type and encoded words
+	charmap *charmap.Charmap
+}
+
+var (
+	windows1251 = &outputCharset{"windows-1251", charmap.Windows1251}
+	koi8r       = &outputCharset{"KOI8-R", charmap.KOI8R}
+)
+
+// outputCharsets maps the lower case names and aliases of the supported
+// charsets.
+var outputCharsets = map[string]*outputCharset{
+	"windows-1251": windows1251,
+	"cp1251":       windows1251,
+	"koi8-r":       koi8r,
+	"koi8r":        koi8r,
+}
+
+// encodedWords matches runs of RFC 2047 encoded words.
+var encodedWords = regexp.MustCompile(`=\?[^?\s]+\?[bBqQ]\?[^?\s]*\?=(?:[ \t]+=\?[^?\s]+\?[bBqQ]\?[^?\s]*\?=)*`)
+
+// lookupCharset returns the output charset called name, or nil for UTF-8.
+func lookupCharset(name string) (*outputCharset, error) {
+	switch name = strings.ToLower(strings.TrimSpace(name)); name {
+	case "", "utf-8", "utf8":
+		return nil, nil
+	}
+	if c, ok := outputCharsets[name]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("unsupported charset %q", name)
+}
+
+// Charset sets the charset the bodies and the encoded header values are
+// written in: UTF-8 (the default), windows-1251 or KOI8-R. Defaults to the
+// charset setting of the SMTP profile.
+//
+// Sending fails when the message holds a character the charset cannot
+// represent.
+func (m *MailYak) Charset(name string) error {
+	c, err := lookupCharset(name)
+	if err != nil {
+		return err
+	}
+	m.charset = c
+	return nil
+}
+
+// charsetName returns the name of the charset the message is written in.
+func (m *MailYak) charsetName() string {
+	if m.charset == nil {
+		return "UTF-8"
+	}
+	return m.charset.name
+}
+
+// checkCharset reports the first character of the headers or bodies the
+// charset of the message cannot represent, before anything is sent.
+func (m *MailYak) checkCharset() error {
+	if m.charset == nil {
+		return nil
+	}
+	if err := m.writeHeaders(ioutil.Discard); err != nil {
+		return err
+	}
+	_, err := m.bodyParts()
+	return err
+}
+
+// encode transcodes the UTF-8 text s, describing it as what in errors.
+func (c *outputCharset) encode(s []byte, what string) ([]byte, error) {
+	out := make([]byte, 0, len(s))
+	for i, r := range string(s) {
+		b, ok := c.charmap.EncodeRune(r)
+		if !ok {
+			return nil, fmt.Errorf("%s: charset %s cannot represent %q (U+%04X) at offset %d", what, c.name, r, r, i)
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+// recodeWords re-encodes the UTF-8 encoded words of the header value in the
+// charset, describing the header as name in errors.
+func (c *outputCharset) recodeWords(value, name string) (string, error) {
+	var err error
+	recoded := encodedWords.ReplaceAllStringFunc(value, func(words string) string {
+		if err != nil {
+			return words
+		}
+		var text string
+		if text, err = headerDecoder.DecodeHeader(words); err != nil {
+			return words
+		}
+		var b []byte
+		if b, err = c.encode([]byte(text), name); err != nil {
+			return words
+		}
+		return wordEncoding(text).Encode(c.name, string(b))
+	})
+	if err != nil {
+		return "", err
+	}
+	return recoded, nil
+}
+
+// wordEncoding returns the encoding of the words holding text: Q, unless text
+// holds a character a Q encoded word can not carry in a display name
+// (RFC 2047, 5), such as the comma of "Бухгалтерия, ООО".
+func wordEncoding(text string) mime.WordEncoder {
+	if strings.ContainsAny(text, `()<>@,;:\".[]`) {
+		return mime.BEncoding
+	}
+	return mime.QEncoding
+}
+
+// charsetReader returns a reader converting the text of input in charset to
+// UTF-8.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii":
+		return input, nil
+	}
+	// Archived messages come in any charset, not only the output ones
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("parse: unsupported charset %q", charset)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// TestLookupCharset ensures charset names and aliases are resolved
+func TestLookupCharset(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		charset string
+		// Expected results.
+		want    *outputCharset
+		wantErr bool
+	}{
+		{"Default", "", nil, false},
+		{"UTF-8", "UTF-8", nil, false},
+		{"Windows-1251", "Windows-1251", windows1251, false},
+		{"CP1251", " cp1251 ", windows1251, false},
+		{"KOI8-R", "KOI8-R", koi8r, false},
+		{"Unsupported", "iso-8859-5", nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := lookupCharset(tt.charset)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. lookupCharset() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got, tt.name)
+		})
+	}
+}
+
+// TestOutputCharsetRecodeWords ensures UTF-8 encoded words are re-encoded in
+// the charset and unrepresentable characters are reported
+func TestOutputCharsetRecodeWords(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		charset *outputCharset
+		value   string
+		// Expected results.
+		want    string
+		wantErr bool
+	}{
+		{"ASCII", windows1251, "Invoice", "Invoice", false},
+		{"Windows-1251", windows1251, "=?UTF-8?q?=D0=A1=D1=87=D0=B5=D1=82?=", "=?windows-1251?q?=D1=F7=E5=F2?=", false},
+		{"KOI8-R", koi8r, "=?UTF-8?q?=D0=A1=D1=87=D0=B5=D1=82?=", "=?KOI8-R?q?=F3=DE=C5=D4?=", false},
+		{"Display name", windows1251, "=?UTF-8?q?=D0=A1=D1=87=D0=B5=D1=82?= <from@example.org>", "=?windows-1251?q?=D1=F7=E5=F2?= <from@example.org>", false},
+		{"Unrepresentable", windows1251, "=?UTF-8?q?=E2=82=AC=E2=9C=93?=", "", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := tt.charset.recodeWords(tt.value, "Subject")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. outputCharset.recodeWords() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if err != nil {
+				assert.Contains(t, err.Error(), "U+2713", tt.name)
+				return
+			}
+			assert.Equal(t, tt.want, got, tt.name)
+		})
+	}
+}
+
+// TestMailYakWriteTo_charset ensures bodies and headers are transcoded into
+// the charset of the message, and that the message survives parsing
+func TestMailYakWriteTo_charset(t *testing.T) {
+	t.Parallel()
+
+	m := &MailYak{
+		headers:   map[string]string{},
+		trimRegex: regexp.MustCompile("\r?\n"),
+		date:      time.Now().Format(time.RFC1123Z),
+	}
+	if err := m.Charset("cp1251"); err != nil {
+		t.Fatal(err)
+	}
+	m.From("from@example.org")
+	m.FromName("Бухгалтерия")
+	m.To("Иван Петров <ivan@example.org>")
+	m.Cc("to@example.org", `"Бухгалтерия, ООО" <buh@example.org>`)
+	m.ReplyTo("Отдел продаж <sales@example.org>")
+	m.Subject("Счёт № 42")
+	m.Plain().Set("Оплатите счёт до пятницы.")
+	m.HTML().Set("<p>Оплатите счёт до пятницы.</p>")
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatalf("MailYak.WriteTo() error = %v", err)
+	}
+	out := buf.String()
+	assert.Contains(t, out, "Subject: =?windows-1251?")
+	assert.Contains(t, out, "From: =?windows-1251?")
+	assert.Contains(t, out, "To: =?windows-1251?")
+	assert.Contains(t, out, "text/plain; charset=windows-1251")
+	assert.Contains(t, out, "text/html; charset=windows-1251")
+	assert.NotContains(t, out, "UTF-8")
+
+	want, err := charmap.Windows1251.NewEncoder().String("Оплатите счёт до пятницы.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts, err := m.bodyParts()
+	if err != nil {
+		t.Fatalf("MailYak.bodyParts() error = %v", err)
+	}
+	assert.Equal(t, want, string(parts[0].data))
+
+	parsed, err := ParseMail(&SMTPInfo{}, strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("ParseMail() error = %v", err)
+	}
+	assert.Equal(t, "Счёт № 42", decodeTestHeader(t, parsed.subject))
+	assert.Equal(t, "Бухгалтерия", decodeTestHeader(t, parsed.fromName))
+	// The display names are read back from the words of the charset
+	for _, field := range []struct {
+		name  string
+		got   []string
+		names []string
+	}{
+		{"To", parsed.toAddrs, []string{"Иван Петров"}},
+		{"Cc", parsed.ccAddrs, []string{"", "Бухгалтерия, ООО"}},
+		{"Reply-To", []string{parsed.replyTo}, []string{"Отдел продаж"}},
+	} {
+		var names []string
+		for _, v := range field.got {
+			addr, err := addressParser.Parse(v)
+			if err != nil {
+				t.Fatalf("%s: %v", field.name, err)
+			}
+			names = append(names, addr.Name)
+		}
+		assert.Equal(t, field.names, names, field.name)
+	}
+	assert.Equal(t, "Оплатите счёт до пятницы.", parsed.plain.String())
+	assert.Equal(t, "<p>Оплатите счёт до пятницы.</p>", parsed.html.String())
+}
+
+// TestMailYakCheckCharset ensures unrepresentable characters fail the message
+// before it is sent
+func TestMailYakCheckCharset(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		charset  string
+		subject  string
+		fromName string
+		to       string
+		plain    string
+		// Expected results.
+		wantErr string
+	}{
+		{"UTF-8", "", "Rechnung ✓", "", "Jürgen <j@example.org>", "Grüße", ""},
+		{"Representable", "koi8-r", "Счёт", "Бухгалтерия", "Иван <ivan@example.org>", "Оплатите счёт", ""},
+		{"Subject", "koi8-r", "Rechnung ✓", "", "", "", "Subject: charset KOI8-R cannot represent"},
+		{"From name", "windows-1251", "", "Müller", "", "", "From: charset windows-1251 cannot represent 'ü'"},
+		{"To name", "windows-1251", "", "", "Jürgen Müller <j@example.org>", "", "To: charset windows-1251 cannot represent 'ü'"},
+		{"Unparsed To", "windows-1251", "", "", "Иван <ivan@", "", "To: text out of ASCII is not encoded"},
+		{"Body", "windows-1251", "", "", "", "Итого: 100 ₽", "text/plain body: charset windows-1251 cannot represent '₽' (U+20BD)"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			m := &MailYak{headers: map[string]string{}, trimRegex: regexp.MustCompile("\r?\n")}
+			if err := m.Charset(tt.charset); err != nil {
+				t.Fatal(err)
+			}
+			m.From("from@example.org")
+			m.FromName(tt.fromName)
+			m.To(tt.to)
+			m.Subject(tt.subject)
+			m.Plain().Set(tt.plain)
+
+			err := m.checkCharset()
+			if tt.wantErr == "" {
+				assert.NoError(t, err, tt.name)
+				return
+			}
+			if assert.Error(t, err, tt.name) {
+				assert.Contains(t, err.Error(), tt.wantErr, tt.name)
+			}
+		})
+	}
+}
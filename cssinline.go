@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// inlineCSS applies the rules of the <style> blocks of an HTML document onto
+// the style attributes of the matching elements, as many webmail clients
+// strip <style> blocks.
+//
+// Declarations are applied in cascade order: by !important, selector
+// specificity and source order, with the element's own style attribute
+// winning over non-important rules. At-rules such as @media queries and rules
+// using dynamic pseudo-classes (:hover and friends) cannot be inlined and are
+// kept in a residual <style> block in the document head.
+func inlineCSS(src []byte) ([]byte, error) {
+	doc, err := html.Parse(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect and remove the stylesheets
+	var sheets []string
+	var head *html.Node
+	var styles []*html.Node
+	walkElements(doc, func(n *html.Node) {
+		switch n.DataAtom {
+		case atom.Head:
+			if head == nil {
+				head = n
+			}
+		case atom.Style:
+			styles = append(styles, n)
+		}
+	})
+	if len(styles) == 0 {
+		return src, nil
+	}
+	for _, n := range styles {
+		if n.FirstChild != nil {
+			sheets = append(sheets, n.FirstChild.Data)
+		}
+		n.Parent.RemoveChild(n)
+	}
+
+	var rules []cssRule
+	var residual []string
+	for _, sheet := range sheets {
+		r, rest := parseStylesheet(sheet)
+		rules = append(rules, r...)
+		residual = append(residual, rest...)
+	}
+
+	// Apply the rules
+	walkElements(doc, func(n *html.Node) {
+		var matched []cssDeclaration
+		for _, rule := range rules {
+			if rule.selector.matches(n) {
+				for _, d := range rule.declarations {
+					d.specificity = rule.selector.specificity
+					d.order = rule.order
+					matched = append(matched, d)
+				}
+			}
+		}
+		if len(matched) == 0 {
+			return
+		}
+
+		// The style attribute beats any selector
+		for _, d := range parseDeclarations(attr(n, "style")) {
+			d.specificity = inlineSpecificity
+			matched = append(matched, d)
+		}
+		setAttr(n, "style", cascade(matched))
+	})
+
+	if len(residual) > 0 && head != nil {
+		style := &html.Node{Type: html.ElementNode, Data: "style", DataAtom: atom.Style}
+		style.AppendChild(&html.Node{Type: html.TextNode, Data: "\n" + strings.Join(residual, "\n") + "\n"})
+		head.AppendChild(style)
+	}
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// inlineSpecificity ranks a style attribute above every selector.
+var inlineSpecificity = [3]int{1 << 16, 0, 0}
+
+// cssRule is a single selector of a style rule with its declarations.
+type cssRule struct {
+	selector     *cssSelector
+	declarations []cssDeclaration
+	order        int
+}
+
+type cssDeclaration struct {
+	property    string
+	value       string
+	important   bool
+	specificity [3]int
+	order       int
+}
+
+// cascade sorts the declarations by precedence and returns the resulting
+// style attribute, keeping the properties in first-seen order.
+func cascade(decls []cssDeclaration) string {
+	sort.SliceStable(decls, func(i, j int) bool {
+		a, b := decls[i], decls[j]
+		if a.important != b.important {
+			return !a.important
+		}
+		if a.specificity != b.specificity {
+			for k := range a.specificity {
+				if a.specificity[k] != b.specificity[k] {
+					return a.specificity[k] < b.specificity[k]
+				}
+			}
+		}
+		return a.order < b.order
+	})
+
+	values := map[string]string{}
+	var props []string
+	for _, d := range decls {
+		if _, ok := values[d.property]; !ok {
+			props = append(props, d.property)
+		}
+		values[d.property] = d.value
+	}
+
+	parts := make([]string, len(props))
+	for i, p := range props {
+		parts[i] = p + ": " + values[p]
+	}
+	return strings.Join(parts, "; ") + ";"
+}
+
+// parseStylesheet splits a stylesheet into inlinable rules and the residual
+// CSS that must stay in a <style> block.
+func parseStylesheet(css string) ([]cssRule, []string) {
+	css = stripCSSComments(css)
+
+	var rules []cssRule
+	var residual []string
+	order := 0
+
+	for {
+		css = strings.TrimSpace(css)
+		if css == "" {
+			break
+		}
+
+		if css[0] == '@' {
+			end := atRuleEnd(css)
+			if rule := strings.TrimSpace(css[:end]); !strings.HasPrefix(strings.ToLower(rule), "@charset") {
+				residual = append(residual, rule)
+			}
+			css = css[end:]
+			continue
+		}
+
+		open := strings.IndexByte(css, '{')
+		if open < 0 {
+			break
+		}
+		close := matchingBrace(css, open)
+		prelude := strings.TrimSpace(css[:open])
+		body := css[open+1 : close]
+		if close < len(css) {
+			close++
+		}
+		css = css[close:]
+
+		decls := parseDeclarations(body)
+		if len(decls) == 0 {
+			continue
+		}
+
+		var kept []string
+		for _, sel := range splitOutside(prelude, ',') {
+			sel = strings.TrimSpace(sel)
+			parsed, ok := parseSelector(sel)
+			if !ok {
+				kept = append(kept, sel)
+				continue
+			}
+			rules = append(rules, cssRule{selector: parsed, declarations: decls, order: order})
+			order++
+		}
+		if len(kept) > 0 {
+			residual = append(residual, strings.Join(kept, ", ")+" {"+body+"}")
+		}
+	}
+
+	return rules, residual
+}
+
+// stripCSSComments removes /* */ comments.
+func stripCSSComments(css string) string {
+	for {
+		start := strings.Index(css, "/*")
+		if start < 0 {
+			return css
+		}
+		end := strings.Index(css[start+2:], "*/")
+		if end < 0 {
+			return css[:start]
+		}
+		css = css[:start] + css[start+2+end+2:]
+	}
+}
+
+// atRuleEnd returns the offset just past the at-rule css starts with, either
+// its terminating semicolon or its block.
+func atRuleEnd(css string) int {
+	for i := 0; i < len(css); i++ {
+		switch css[i] {
+		case ';':
+			return i + 1
+		case '{':
+			end := matchingBrace(css, i)
+			if end < len(css) {
+				end++
+			}
+			return end
+		}
+	}
+	return len(css)
+}
+
+// matchingBrace returns the offset of the brace closing the one at open, or
+// len(css) when unbalanced.
+func matchingBrace(css string, open int) int {
+	depth := 0
+	var quote byte
+	for i := open; i < len(css); i++ {
+		c := css[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(css)
+}
+
+// splitOutside splits s at sep, ignoring separators in quotes, parentheses
+// and brackets.
+func splitOutside(s string, sep byte) []string {
+	var parts []string
+	depth := 0
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseDeclarations parses the "property: value" pairs of a declaration
+// block or style attribute.
+func parseDeclarations(block string) []cssDeclaration {
+	var decls []cssDeclaration
+	for _, d := range splitOutside(block, ';') {
+		colon := strings.IndexByte(d, ':')
+		if colon < 0 {
+			continue
+		}
+		prop := strings.ToLower(strings.TrimSpace(d[:colon]))
+		value := strings.TrimSpace(d[colon+1:])
+		if prop == "" || value == "" {
+			continue
+		}
+
+		decl := cssDeclaration{property: prop, value: value}
+		if i := strings.LastIndex(value, "!"); i >= 0 && strings.EqualFold(strings.TrimSpace(value[i+1:]), "important") {
+			decl.important = true
+			decl.value = strings.TrimSpace(value[:i])
+		}
+		decls = append(decls, decl)
+	}
+	return decls
+}
+
+// walkElements calls fn for every element node below n, in document order.
+func walkElements(n *html.Node, fn func(*html.Node)) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode {
+			fn(c)
+		}
+		walkElements(c, fn)
+	}
+}
+
+// setAttr sets the named attribute of n, adding it when missing.
+func setAttr(n *html.Node, name, value string) {
+	for i, a := range n.Attr {
+		if a.Key == name && a.Namespace == "" {
+			n.Attr[i].Val = value
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: name, Val: value})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// TestInlineCSS ensures stylesheet rules end up in style attributes in
+// cascade order
+func TestInlineCSS(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		html string
+		// Expected results.
+		want string
+	}{
+		{
+			"No stylesheet",
+			`<p class="a">Text</p>`,
+			`<p class="a">Text</p>`,
+		},
+		{
+			"Type and class",
+			`<style>p { color: red; } .note { font-size: 10pt }</style><p class="note">Text</p>`,
+			`<html><head></head><body><p class="note" style="color: red; font-size: 10pt;">Text</p></body></html>`,
+		},
+		{
+			"Specificity beats source order",
+			`<style>#total { color: blue; } td.sum { color: green; } td { color: red; }</style>` +
+				`<table><tr><td id="total" class="sum">1</td><td class="sum">2</td><td>3</td></tr></table>`,
+			`<html><head></head><body><table><tbody><tr><td id="total" class="sum" style="color: blue;">1</td>` +
+				`<td class="sum" style="color: green;">2</td><td style="color: red;">3</td></tr></tbody></table></body></html>`,
+		},
+		{
+			"Later rule wins on equal specificity",
+			`<style>.a { color: red; } .b { color: blue; }</style><p class="b a">Text</p>`,
+			`<html><head></head><body><p class="b a" style="color: blue;">Text</p></body></html>`,
+		},
+		{
+			"Style attribute wins",
+			`<style>p { color: red; margin: 0 }</style><p style="color: blue">Text</p>`,
+			`<html><head></head><body><p style="color: blue; margin: 0;">Text</p></body></html>`,
+		},
+		{
+			"Important beats style attribute",
+			`<style>p { color: red !important }</style><p style="color: blue">Text</p>`,
+			`<html><head></head><body><p style="color: red;">Text</p></body></html>`,
+		},
+		{
+			"Combinators",
+			`<style>div > p { color: red } div span { font-weight: bold } h1 + p { margin: 0 }</style>` +
+				`<div><h1>T</h1><p><span>a</span></p></div><p>b</p>`,
+			`<html><head></head><body><div><h1>T</h1><p style="color: red; margin: 0;"><span style="font-weight: bold;">a</span></p></div><p>b</p></body></html>`,
+		},
+		{
+			"Attributes and pseudo-classes",
+			`<style>td[align="right"] { color: red } tr td:first-child { color: blue }</style>` +
+				`<table><tr><td>1</td><td align="right">2</td></tr></table>`,
+			`<html><head></head><body><table><tbody><tr><td style="color: blue;">1</td><td align="right" style="color: red;">2</td></tr></tbody></table></body></html>`,
+		},
+		{
+			"Media queries stay in a residual style",
+			`<style>/* base */ p { color: red } @media (max-width: 600px) { p { color: blue } } a:hover { color: green }</style><p>Text</p>`,
+			"<html><head><style>\n@media (max-width: 600px) { p { color: blue } }\na:hover { color: green }\n</style></head>" +
+				`<body><p style="color: red;">Text</p></body></html>`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := inlineCSS([]byte(tt.html))
+			if err != nil {
+				t.Fatalf("%q. inlineCSS() error = %v", tt.name, err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("%q. inlineCSS() = %v, want %v", tt.name, string(got), tt.want)
+			}
+		})
+	}
+}
+
+// TestParseSelector ensures selectors are parsed with the right specificity
+// and unsupported ones are rejected
+func TestParseSelector(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		sel  string
+		ok   bool
+		spec [3]int
+	}{
+		{"td", true, [3]int{0, 0, 1}},
+		{"*", true, [3]int{0, 0, 0}},
+		{"table.invoice_items td", true, [3]int{0, 1, 2}},
+		{"table.invoice_bank_rekv > tbody > tr > td", true, [3]int{0, 1, 4}},
+		{"#id.a.b[title]", true, [3]int{1, 3, 0}},
+		{"li:first-child", true, [3]int{0, 1, 1}},
+		{"a:hover", false, [3]int{}},
+		{"p::before", false, [3]int{}},
+		{"> p", false, [3]int{}},
+		{"p >", false, [3]int{}},
+		{"", false, [3]int{}},
+	}
+	for _, tt := range tests {
+		got, ok := parseSelector(tt.sel)
+		if ok != tt.ok {
+			t.Errorf("parseSelector(%q) ok = %v, want %v", tt.sel, ok, tt.ok)
+			continue
+		}
+		if ok && got.specificity != tt.spec {
+			t.Errorf("parseSelector(%q) specificity = %v, want %v", tt.sel, got.specificity, tt.spec)
+		}
+	}
+}
+
+// TestInlineCSS_invoice ensures the invoice template keeps its look without
+// the <style> block
+func TestInlineCSS_invoice(t *testing.T) {
+	t.Parallel()
+
+	src, err := ioutil.ReadFile("./storage/invoice.ru.1.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := inlineCSS(src)
+	if err != nil {
+		t.Fatalf("inlineCSS() error = %v", err)
+	}
+
+	out := string(got)
+	if strings.Contains(out, "<style") {
+		t.Errorf("inlineCSS() left a <style> block")
+	}
+	for _, want := range []string{
+		`<body style="width: 210mm; margin-left: auto; margin-right: auto; border: 1px #efefef solid; font-size: 11pt;">`,
+		`<table class="invoice_items" width="100%" cellpadding="2" cellspacing="0" style="border: 1px solid black; border-collapse: collapse; padding: 0; cellspacing: 0;">`,
+		`<th style="border-collapse: collapse; border: 1px solid black; width: 13mm; text-align: center;">`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("inlineCSS() = %v, want to contain %v", out, want)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// cssSelector is a parsed complex selector, e.g. "table.items > tr td".
+type cssSelector struct {
+	compounds []cssCompound
+	// combinators[i] joins compounds[i] and compounds[i+1]: ' ', '>', '+' or '~'
+	combinators []byte
+	specificity [3]int
+}
+
+// cssCompound is a sequence of simple selectors matching a single element,
+// e.g. "td.total:last-child".
+type cssCompound struct {
+	tag     string
+	id      string
+	classes []string
+	attrs   []cssAttrMatch
+	pseudos []string
+}
+
+// cssAttrMatch is an attribute selector such as [colspan="2"].
+type cssAttrMatch struct {
+	name  string
+	op    string // "", "=", "~=", "|=", "^=", "$=" or "*="
+	value string
+}
+
+// supportedPseudos lists the pseudo-classes that can be resolved statically.
+// Dynamic ones like :hover only make sense in a residual stylesheet.
+var supportedPseudos = map[string]bool{
+	"first-child": true,
+	"last-child":  true,
+	"only-child":  true,
+}
+
+// parseSelector parses a complex selector, returning false for selectors
+// that cannot be inlined.
+func parseSelector(sel string) (*cssSelector, bool) {
+	s := &cssSelector{}
+	cur := cssCompound{}
+	empty := true
+	var pending byte
+
+	finish := func() bool {
+		if empty {
+			return false
+		}
+		if len(s.compounds) > 0 {
+			if pending == 0 {
+				pending = ' '
+			}
+			s.combinators = append(s.combinators, pending)
+		}
+		s.compounds = append(s.compounds, cur)
+		cur = cssCompound{}
+		empty = true
+		pending = 0
+		return true
+	}
+
+	for i := 0; i < len(sel); {
+		c := sel[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if !empty && !finish() {
+				return nil, false
+			}
+			i++
+
+		case c == '>' || c == '+' || c == '~':
+			if !empty && !finish() {
+				return nil, false
+			}
+			if len(s.compounds) == 0 || pending != 0 {
+				return nil, false
+			}
+			pending = c
+			i++
+
+		case c == '*':
+			if !empty {
+				return nil, false
+			}
+			cur.tag = "*"
+			empty = false
+			i++
+
+		case c == '#' || c == '.':
+			name, n := cssIdent(sel[i+1:])
+			if n == 0 {
+				return nil, false
+			}
+			if c == '#' {
+				cur.id = name
+				s.specificity[0]++
+			} else {
+				cur.classes = append(cur.classes, name)
+				s.specificity[1]++
+			}
+			empty = false
+			i += 1 + n
+
+		case c == '[':
+			end := strings.IndexByte(sel[i:], ']')
+			if end < 0 {
+				return nil, false
+			}
+			m, ok := parseAttrMatch(sel[i+1 : i+end])
+			if !ok {
+				return nil, false
+			}
+			cur.attrs = append(cur.attrs, m)
+			s.specificity[1]++
+			empty = false
+			i += end + 1
+
+		case c == ':':
+			name, n := cssIdent(sel[i+1:])
+			if n == 0 || !supportedPseudos[strings.ToLower(name)] {
+				return nil, false
+			}
+			cur.pseudos = append(cur.pseudos, strings.ToLower(name))
+			s.specificity[1]++
+			empty = false
+			i += 1 + n
+
+		default:
+			name, n := cssIdent(sel[i:])
+			if n == 0 || !empty {
+				return nil, false
+			}
+			cur.tag = strings.ToLower(name)
+			s.specificity[2]++
+			empty = false
+			i += n
+		}
+	}
+
+	if empty {
+		// Trailing combinator, or nothing at all
+		if pending != 0 || len(s.compounds) == 0 {
+			return nil, false
+		}
+		return s, true
+	}
+	if !finish() {
+		return nil, false
+	}
+	return s, true
+}
+
+// cssIdent returns the identifier s starts with and its length in bytes.
+func cssIdent(s string) (string, int) {
+	n := 0
+	for n < len(s) {
+		c := s[n]
+		if c == '-' || c == '_' || c >= 0x80 ||
+			(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			n++
+			continue
+		}
+		break
+	}
+	return s[:n], n
+}
+
+// parseAttrMatch parses the inside of an attribute selector.
+func parseAttrMatch(s string) (cssAttrMatch, bool) {
+	s = strings.TrimSpace(s)
+	op := strings.IndexAny(s, "=~|^$*")
+	if op < 0 {
+		name, n := cssIdent(s)
+		return cssAttrMatch{name: strings.ToLower(name)}, n > 0 && n == len(s)
+	}
+
+	name, n := cssIdent(strings.TrimSpace(s[:op]))
+	if n == 0 {
+		return cssAttrMatch{}, false
+	}
+	m := cssAttrMatch{name: strings.ToLower(name)}
+	rest := s[op:]
+	if rest[0] == '=' {
+		m.op = "="
+	} else if len(rest) > 1 && rest[1] == '=' {
+		m.op = rest[:2]
+	} else {
+		return cssAttrMatch{}, false
+	}
+	m.value = strings.Trim(strings.TrimSpace(rest[len(m.op):]), `"'`)
+	return m, true
+}
+
+// matches reports whether the element n is selected.
+func (s *cssSelector) matches(n *html.Node) bool {
+	return s.matchAt(n, len(s.compounds)-1)
+}
+
+func (s *cssSelector) matchAt(n *html.Node, i int) bool {
+	if !s.compounds[i].matches(n) {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+
+	switch s.combinators[i-1] {
+	case '>':
+		p := n.Parent
+		return p != nil && p.Type == html.ElementNode && s.matchAt(p, i-1)
+	case '+':
+		p := prevElement(n)
+		return p != nil && s.matchAt(p, i-1)
+	case '~':
+		for p := prevElement(n); p != nil; p = prevElement(p) {
+			if s.matchAt(p, i-1) {
+				return true
+			}
+		}
+	default:
+		for p := n.Parent; p != nil && p.Type == html.ElementNode; p = p.Parent {
+			if s.matchAt(p, i-1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *cssCompound) matches(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	if c.tag != "" && c.tag != "*" && c.tag != n.Data {
+		return false
+	}
+	if c.id != "" && attr(n, "id") != c.id {
+		return false
+	}
+	if len(c.classes) > 0 {
+		have := strings.Fields(attr(n, "class"))
+		for _, want := range c.classes {
+			if !containsString(have, want) {
+				return false
+			}
+		}
+	}
+	for _, m := range c.attrs {
+		if !m.matches(n) {
+			return false
+		}
+	}
+	for _, p := range c.pseudos {
+		switch p {
+		case "first-child":
+			if prevElement(n) != nil {
+				return false
+			}
+		case "last-child":
+			if nextElement(n) != nil {
+				return false
+			}
+		case "only-child":
+			if prevElement(n) != nil || nextElement(n) != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (m *cssAttrMatch) matches(n *html.Node) bool {
+	var val string
+	found := false
+	for _, a := range n.Attr {
+		if a.Key == m.name {
+			val, found = a.Val, true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	switch m.op {
+	case "":
+		return true
+	case "=":
+		return val == m.value
+	case "~=":
+		return containsString(strings.Fields(val), m.value)
+	case "|=":
+		return val == m.value || strings.HasPrefix(val, m.value+"-")
+	case "^=":
+		return m.value != "" && strings.HasPrefix(val, m.value)
+	case "$=":
+		return m.value != "" && strings.HasSuffix(val, m.value)
+	case "*=":
+		return m.value != "" && strings.Contains(val, m.value)
+	}
+	return false
+}
+
+func prevElement(n *html.Node) *html.Node {
+	for p := n.PrevSibling; p != nil; p = p.PrevSibling {
+		if p.Type == html.ElementNode {
+			return p
+		}
+	}
+	return nil
+}
+
+func nextElement(n *html.Node) *html.Node {
+	for p := n.NextSibling; p != nil; p = p.NextSibling {
+		if p.Type == html.ElementNode {
+			return p
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// defaultDKIMHeaders are signed when the profile does not list any.
+var defaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "CC", "Mime-Version", "Content-Type",
+	"List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// dkimSigner signs messages per RFC 6376, with RSA-SHA256 or Ed25519-SHA256
+// (RFC 8463) keys.
+type dkimSigner struct {
+	options dkim.SignOptions
+}
+
+// newDKIMSigner loads the private key and checks the settings of info.
+func newDKIMSigner(info *DKIMInfo) (*dkimSigner, error) {
+	if info.Domain == "" || info.Selector == "" {
+		return nil, errors.New("dkim: domain and selector are required")
+	}
+
+	s := &dkimSigner{options: dkim.SignOptions{
+		Domain:                 info.Domain,
+		Selector:               info.Selector,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             info.Headers,
+	}}
+	if len(s.options.HeaderKeys) == 0 {
+		s.options.HeaderKeys = defaultDKIMHeaders
+	}
+	if !containsFold(s.options.HeaderKeys, "From") {
+		return nil, errors.New("dkim: the From header must be signed")
+	}
+
+	if info.Canonicalization != "" {
+		parts := strings.SplitN(strings.ToLower(info.Canonicalization), "/", 2)
+		s.options.HeaderCanonicalization = dkim.Canonicalization(parts[0])
+		s.options.BodyCanonicalization = dkim.CanonicalizationSimple
+		if len(parts) == 2 {
+			s.options.BodyCanonicalization = dkim.Canonicalization(parts[1])
+		}
+	}
+	for _, c := range []dkim.Canonicalization{s.options.HeaderCanonicalization, s.options.BodyCanonicalization} {
+		if c != dkim.CanonicalizationSimple && c != dkim.CanonicalizationRelaxed {
+			return nil, fmt.Errorf("dkim: unknown canonicalization %q", info.Canonicalization)
+		}
+	}
+
+	key, err := loadDKIMKey(info.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	s.options.Signer = key
+	return s, nil
+}
+
+// loadDKIMKey reads a PEM encoded PKCS#1 RSA or PKCS#8 RSA/Ed25519 private
+// key.
+func loadDKIMKey(filename string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("dkim: no PEM data in %s", filename)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		}
+		return nil, fmt.Errorf("dkim: unsupported key type %T in %s", key, filename)
+	}
+	return nil, fmt.Errorf("dkim: unsupported PEM block %q in %s", block.Type, filename)
+}
+
+// signature streams the message written by write through the signer and
+// returns the DKIM-Signature header line, including the trailing CRLF. The
+// message is hashed as it goes by, never held in memory.
+func (s *dkimSigner) signature(write func(w io.Writer) error) (string, error) {
+	signer, err := dkim.NewSigner(&s.options)
+	if err != nil {
+		return "", err
+	}
+	if err := write(signer); err != nil {
+		signer.Close()
+		return "", err
+	}
+	if err := signer.Close(); err != nil {
+		return "", err
+	}
+	return signer.Signature(), nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
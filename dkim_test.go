@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// writeTestKey stores key as a PEM file in dir, returning the file name and
+// the DNS TXT record of the matching public key.
+func writeTestKey(t *testing.T, dir string, key crypto.Signer) (string, string) {
+	var block *pem.Block
+	var record string
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+		pub, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)
+	case ed25519.PrivateKey:
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+		record = "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(k.Public().(ed25519.PublicKey))
+	}
+
+	f, err := ioutil.TempFile(dir, "dkim-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, block); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name(), record
+}
+
+// TestDKIMSign signs messages and verifies them with an independent DKIM
+// implementation
+func TestDKIMSign(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "dkim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaFile, rsaRecord := writeTestKey(t, dir, rsaKey)
+	edFile, edRecord := writeTestKey(t, dir, edKey)
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		info   DKIMInfo
+		record string
+		// Expected results.
+		algorithm string
+	}{
+		{
+			"RSA relaxed/relaxed",
+			DKIMInfo{Domain: "example.org", Selector: "mail", KeyFile: rsaFile},
+			rsaRecord,
+			"rsa-sha256",
+		},
+		{
+			"RSA simple/simple",
+			DKIMInfo{Domain: "example.org", Selector: "mail", KeyFile: rsaFile, Canonicalization: "simple/simple"},
+			rsaRecord,
+			"rsa-sha256",
+		},
+		{
+			"RSA relaxed/simple",
+			DKIMInfo{Domain: "example.org", Selector: "mail", KeyFile: rsaFile, Canonicalization: "relaxed/simple"},
+			rsaRecord,
+			"rsa-sha256",
+		},
+		{
+			"Ed25519",
+			DKIMInfo{Domain: "example.org", Selector: "ed", KeyFile: edFile},
+			edRecord,
+			"ed25519-sha256",
+		},
+		{
+			"Custom header list",
+			DKIMInfo{Domain: "example.org", Selector: "mail", KeyFile: rsaFile, Headers: []string{"From", "To", "Subject", "List-Id"}},
+			rsaRecord,
+			"rsa-sha256",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		// Not parallel, the key files are removed when the test returns
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := newDKIMSigner(&tt.info)
+			if err != nil {
+				t.Fatalf("%q. newDKIMSigner() error = %v", tt.name, err)
+			}
+
+			m := &MailYak{
+				toAddrs:   []string{"first@example.net", "second@example.net"},
+				fromAddr:  "invoice@example.org",
+				fromName:  "Invoices",
+				subject:   "=?UTF-8?q?=D0=A1=D1=87=D1=91=D1=82_=E2=84=961?=",
+				trimRegex: regexp.MustCompile("\r?\n"),
+				date:      time.Now().Format(time.RFC1123Z),
+				headers:   map[string]string{"Precedence": "bulk"},
+				dkim:      signer,
+			}
+			m.HTML().Set("<p>Invoice  in attachment  </p>\n\n\n")
+			m.AttachSource("invoice.html", FileSource("./storage/invoice.ru.1.html"))
+			// Read once, though the message is built to sign it and to write it
+			note := "Оплатите счёт до пятницы"
+			m.Attach("note.txt", ioutil.NopCloser(bytes.NewBufferString(note)))
+
+			var buf bytes.Buffer
+			if _, err := m.WriteTo(&buf); err != nil {
+				t.Fatalf("%q. MailYak.WriteTo() error = %v", tt.name, err)
+			}
+			if !strings.Contains(buf.String(), base64.StdEncoding.EncodeToString([]byte(note))) {
+				t.Errorf("%q. MailYak.WriteTo() = %q, want the one-shot attachment", tt.name, buf.String())
+			}
+			if !strings.HasPrefix(buf.String(), "DKIM-Signature: ") || !strings.Contains(buf.String(), " a="+tt.algorithm+";") {
+				t.Errorf("%q. MailYak.WriteTo() = %q, want a leading DKIM-Signature", tt.name, buf.String())
+			}
+
+			// Line endings as sent by the SMTP DATA writer
+			wire := regexp.MustCompile("\r?\n").ReplaceAll(buf.Bytes(), []byte("\r\n"))
+
+			verifications, err := dkim.VerifyWithOptions(bytes.NewReader(wire), &dkim.VerifyOptions{
+				LookupTXT: func(domain string) ([]string, error) {
+					return []string{tt.record}, nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("%q. dkim.Verify() error = %v", tt.name, err)
+			}
+			if len(verifications) != 1 {
+				t.Fatalf("%q. dkim.Verify() found %d signatures, want 1", tt.name, len(verifications))
+			}
+			if v := verifications[0]; v.Err != nil || v.Domain != "example.org" {
+				t.Errorf("%q. dkim.Verify() = %+v, error = %v", tt.name, v, v.Err)
+			}
+
+			// Tampering must break the signature
+			tampered := bytes.Replace(wire, []byte("Invoices <"), []byte("Invoicez <"), 1)
+			verifications, err = dkim.VerifyWithOptions(bytes.NewReader(tampered), &dkim.VerifyOptions{
+				LookupTXT: func(domain string) ([]string, error) {
+					return []string{tt.record}, nil
+				},
+			})
+			if err != nil || len(verifications) != 1 || verifications[0].Err == nil {
+				t.Errorf("%q. dkim.Verify() of a tampered message passed", tt.name)
+			}
+		})
+	}
+}
+
+// TestNewDKIMSigner ensures bad settings are rejected
+func TestNewDKIMSigner(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "dkim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, _ := writeTestKey(t, dir, edKey)
+
+	tests := []struct {
+		name string
+		info DKIMInfo
+	}{
+		{"No domain", DKIMInfo{Selector: "mail", KeyFile: keyFile}},
+		{"No selector", DKIMInfo{Domain: "example.org", KeyFile: keyFile}},
+		{"Missing key", DKIMInfo{Domain: "example.org", Selector: "mail", KeyFile: filepath.Join(dir, "missing.pem")}},
+		{"Not a key", DKIMInfo{Domain: "example.org", Selector: "mail", KeyFile: "./storage/invoice.ru.1.html"}},
+		{"Unknown canonicalization", DKIMInfo{Domain: "example.org", Selector: "mail", KeyFile: keyFile, Canonicalization: "loose/relaxed"}},
+		{"From not signed", DKIMInfo{Domain: "example.org", Selector: "mail", KeyFile: keyFile, Headers: []string{"Subject"}}},
+	}
+	for _, tt := range tests {
+		if _, err := newDKIMSigner(&tt.info); err == nil {
+			t.Errorf("%q. newDKIMSigner() error = nil, want an error", tt.name)
+		}
+	}
+}
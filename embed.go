@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// EmbedImages enables attaching the images referenced by the <img> tags of
+// the HTML body as inline parts when the message is built: images given as
+// data: URIs, and relative or absolute paths resolved in the directory set
+// with ImagesPath. Defaults to the embed_images setting of the SMTP profile.
+//
+// Most clients block data: images, and local paths do not resolve at the
+// recipient. The src attributes are rewritten to cid: URLs, identical images
+// are attached once.
+func (m *MailYak) EmbedImages(enabled bool) {
+	m.embedImages = enabled
+}
+
+// ImagesPath sets the directory the local images of the HTML body are read
+// from, see EmbedImages. Paths never resolve outside of dir.
+func (m *MailYak) ImagesPath(dir string) {
+	m.imagesPath = dir
+}
+
+// embedHTMLImages attaches the local and data: images of the HTML body as
+// inline parts and points their <img> tags at them.
+//
+// The HTML body is left untouched when it references no such image, so the
+// pass can run every time the message is built.
+func (m *MailYak) embedHTMLImages() error {
+	if !m.embedImages || m.html.Len() == 0 {
+		return nil
+	}
+
+	doc, err := html.Parse(bytes.NewReader(m.html.Bytes()))
+	if err != nil {
+		return err
+	}
+
+	var imgs []*html.Node
+	walkElements(doc, func(n *html.Node) {
+		if n.DataAtom == atom.Img && embeddable(attr(n, "src")) {
+			imgs = append(imgs, n)
+		}
+	})
+	if len(imgs) == 0 {
+		return nil
+	}
+
+	// Names are derived from the contents, so an image is attached once
+	attached := map[string]bool{}
+	for _, a := range m.attachments {
+		if a.inline {
+			attached[a.filename] = true
+		}
+	}
+	for _, n := range imgs {
+		src := attr(n, "src")
+		data, mimeType, ext, err := m.loadImage(src)
+		if err != nil {
+			return fmt.Errorf("image %q: %v", src, err)
+		}
+
+		sum := sha256.Sum256(data)
+		cid := fmt.Sprintf("img-%x%s", sum[:8], ext)
+		if !attached[cid] {
+			attached[cid] = true
+			m.AttachInlineSourceWithMimeType(cid, BytesSource(data), mimeType)
+		}
+		setAttr(n, "src", "cid:"+cid)
+	}
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, doc); err != nil {
+		return err
+	}
+	m.html.Set(buf.String())
+	return nil
+}
+
+// embeddable reports whether src is a data: URI or a local path.
+func embeddable(src string) bool {
+	src = strings.TrimSpace(src)
+	if src == "" || strings.HasPrefix(src, "//") || strings.HasPrefix(src, "#") {
+		return false
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "" || strings.EqualFold(u.Scheme, "data")
+}
+
+// loadImage returns the contents, the MIME type and the file extension of the
+// image at src.
+func (m *MailYak) loadImage(src string) ([]byte, string, string, error) {
+	src = strings.TrimSpace(src)
+	if strings.HasPrefix(strings.ToLower(src), "data:") {
+		return decodeDataURI(src)
+	}
+
+	if m.imagesPath == "" {
+		return nil, "", "", errors.New("no images path set")
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	// Rooting the cleaned path keeps "../" from leaving the directory
+	name := filepath.Join(m.imagesPath, filepath.FromSlash(path.Clean("/"+u.Path)))
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	mimeType := mime.TypeByExtension(ext)
+	if !strings.HasPrefix(mimeType, "image/") {
+		return nil, "", "", fmt.Errorf("not an image (%s)", mimeType)
+	}
+	return data, mimeType, ext, nil
+}
+
+// decodeDataURI decodes an RFC 2397 data: URI holding an image.
+func decodeDataURI(uri string) ([]byte, string, string, error) {
+	comma := strings.IndexByte(uri, ',')
+	if comma < 0 {
+		return nil, "", "", errors.New("malformed data URI")
+	}
+	meta, payload := uri[len("data:"):comma], uri[comma+1:]
+
+	isBase64 := false
+	if strings.HasSuffix(strings.ToLower(meta), ";base64") {
+		isBase64 = true
+		meta = meta[:len(meta)-len(";base64")]
+	}
+	mimeType, _, err := mime.ParseMediaType(meta)
+	if err != nil || !strings.HasPrefix(mimeType, "image/") {
+		return nil, "", "", fmt.Errorf("not an image (%s)", meta)
+	}
+
+	var data []byte
+	if isBase64 {
+		// Line breaks and spaces are common in hand-written URIs
+		payload = strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, payload)
+		data, err = base64.StdEncoding.DecodeString(payload)
+	} else {
+		var s string
+		s, err = url.PathUnescape(payload)
+		data = []byte(s)
+	}
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	// image/svg+xml -> .svg
+	ext := "." + strings.TrimSuffix(strings.TrimPrefix(mimeType, "image/"), "+xml")
+	return data, mimeType, ext, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMailYakEmbedHTMLImages ensures local and data: images are attached once
+// and referenced by cid: URLs
+func TestMailYakEmbedHTMLImages(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "embed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logo := []byte("\x89PNG\r\n\x1a\nlogo")
+	if err := os.MkdirAll(filepath.Join(dir, "img"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"img/logo.png":  logo,
+		"img/stamp.gif": []byte("GIF89a stamp"),
+		"invoice.html":  []byte("<p>invoice</p>"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logoURI := "data:image/png;base64," + base64.StdEncoding.EncodeToString(logo)
+	logoCID := testImageCID(logo, ".png")
+	stampCID := testImageCID([]byte("GIF89a stamp"), ".gif")
+	svgCID := testImageCID([]byte("<svg/>"), ".svg")
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		html    string
+		enabled bool
+		// Expected results.
+		srcs        []string
+		attachments []string // name:mime type
+		wantErr     bool
+	}{
+		{
+			"Deduplicated",
+			`<img src="img/logo.png"><img src="/img/logo.png"><img src="../../img/logo.png"><img src="` + logoURI + `"><img src="img/stamp.gif">`,
+			true,
+			[]string{"cid:" + logoCID, "cid:" + logoCID, "cid:" + logoCID, "cid:" + logoCID, "cid:" + stampCID},
+			[]string{logoCID + ":image/png", stampCID + ":image/gif"},
+			false,
+		},
+		{
+			"Remote images untouched",
+			`<img src="https://example.org/logo.png"><img src="//example.org/logo.png"><img src="cid:logo"><img>`,
+			true,
+			[]string{"https://example.org/logo.png", "//example.org/logo.png", "cid:logo", ""},
+			nil,
+			false,
+		},
+		{
+			"Percent-encoded data URI",
+			`<img src="data:image/svg+xml,%3Csvg%2F%3E">`,
+			true,
+			[]string{"cid:" + svgCID},
+			[]string{svgCID + ":image/svg+xml"},
+			false,
+		},
+		{
+			"Disabled",
+			`<img src="img/logo.png">`,
+			false,
+			[]string{"img/logo.png"},
+			nil,
+			false,
+		},
+		{"Missing file", `<img src="img/missing.png">`, true, nil, nil, true},
+		{"Not an image", `<img src="invoice.html">`, true, nil, nil, true},
+		{"Not an image URI", `<img src="data:text/html,%3Cp%3E">`, true, nil, nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		// Not parallel, the images are removed when the test returns
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MailYak{headers: map[string]string{}, trimRegex: regexp.MustCompile("\r?\n")}
+			m.EmbedImages(tt.enabled)
+			m.ImagesPath(dir)
+			m.HTML().Set(tt.html)
+
+			err := m.embedHTMLImages()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. MailYak.embedHTMLImages() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var srcs []string
+			for _, match := range regexp.MustCompile(`<img(?: src="([^"]*)")?`).FindAllStringSubmatch(m.html.String(), -1) {
+				srcs = append(srcs, match[1])
+			}
+			assert.Equal(t, tt.srcs, srcs, tt.name)
+
+			var got []string
+			for _, a := range m.attachments {
+				assert.True(t, a.inline, tt.name)
+				got = append(got, a.filename+":"+a.mimeType)
+			}
+			assert.Equal(t, tt.attachments, got, tt.name)
+		})
+	}
+}
+
+// testImageCID returns the name embedHTMLImages gives to data.
+func testImageCID(data []byte, ext string) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("img-%x%s", sum[:8], ext)
+}
+
+// TestMailYakWriteTo_embedImages ensures embedded images are sent with a
+// Content-ID matching the rewritten src, and that building the message again
+// does not attach them twice
+func TestMailYakWriteTo_embedImages(t *testing.T) {
+	t.Parallel()
+
+	m := &MailYak{
+		headers:     map[string]string{},
+		trimRegex:   regexp.MustCompile("\r?\n"),
+		date:        time.Now().Format(time.RFC1123Z),
+		embedImages: true,
+	}
+	m.HTML().Set(`<p>Logo <img src="data:image/gif;base64,R0lGODlhAQABAAAAACw="></p>`)
+
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		if _, err := m.WriteTo(&buf); err != nil {
+			t.Fatalf("MailYak.WriteTo() error = %v", err)
+		}
+		if len(m.attachments) != 1 {
+			t.Fatalf("MailYak.WriteTo() attachments = %d, want 1", len(m.attachments))
+		}
+		name := m.attachments[0].filename
+		assert.Contains(t, m.html.String(), `src="cid:`+name+`"`)
+		assert.Contains(t, buf.String(), "Content-Id: <"+m.contentID(name)+">\r\n")
+		assert.Contains(t, buf.String(), "Content-Disposition: inline;")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"strings"
+	"unicode/utf8"
+)
+
+// Line length limits of RFC 5322, section 2.1.1, excluding the CRLF.
+const (
+	maxLineOctets    = 998
+	maxPreferredLine = 78
+	maxBase64LineLen = 76 // RFC 2045, section 6.8
+)
+
+// Content-Transfer-Encoding values of body parts.
+const (
+	encoding7bit            = "7bit"
+	encoding8bit            = "8bit"
+	encodingQuotedPrintable = "quoted-printable"
+	encodingBase64          = "base64"
+)
+
+// errLineTooLong is returned when an output line exceeds maxLineOctets.
+var errLineTooLong = errors.New("line longer than 998 octets")
+
+// bodyEncoding picks the transfer encoding of a text part: data is sent as is
+// when it is short-lined ASCII, or short-lined UTF-8 with allow8bit (the
+// server announced 8BITMIME). Otherwise mostly-ASCII data is sent as
+// quoted-printable and the rest, like Cyrillic text, as the more compact
+// base64.
+func bodyEncoding(data []byte, allow8bit bool) string {
+	var nonASCII, escaped, line, longest int
+	binary := false
+
+	for i, c := range data {
+		switch {
+		case c == '\n':
+			if line > longest {
+				longest = line
+			}
+			line = 0
+			continue
+		case c == '\r':
+			if i+1 == len(data) || data[i+1] != '\n' {
+				binary = true
+			}
+			continue
+		case c == 0:
+			binary = true
+		case c >= 0x80:
+			nonASCII++
+		}
+		if c >= 0x80 || c == '=' || (c < ' ' && c != '\t') {
+			escaped++
+		}
+		line++
+	}
+	if line > longest {
+		longest = line
+	}
+
+	switch {
+	case !binary && longest <= maxPreferredLine && nonASCII == 0:
+		return encoding7bit
+	case !binary && longest <= maxPreferredLine && allow8bit && utf8.Valid(data):
+		return encoding8bit
+	case escaped*6 < len(data):
+		// Quoted-printable triples escaped octets, base64 grows everything
+		// by a third
+		return encodingQuotedPrintable
+	}
+	return encodingBase64
+}
+
+// writeEncoded writes data to w in the given transfer encoding.
+func writeEncoded(w io.Writer, encoding string, data []byte) error {
+	switch encoding {
+	case encoding7bit, encoding8bit:
+		_, err := w.Write(canonicalCRLF(data))
+		return err
+
+	case encodingBase64:
+		enc := base64.NewEncoder(base64.StdEncoding, lineSplitterBuilder{maxLen: maxBase64LineLen}.new(w))
+		if _, err := enc.Write(data); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+
+	qpw := quotedprintable.NewWriter(w)
+	if _, err := qpw.Write(data); err != nil {
+		return err
+	}
+	return qpw.Close()
+}
+
+// foldHeader returns the "name: value" header field with its CRLF, folded
+// before whitespace so that lines stay within maxPreferredLine octets where
+// possible (RFC 5322, section 2.2.3). Values that cannot be folded under
+// maxLineOctets are rejected.
+func foldHeader(name, value string) (string, error) {
+	rest := name + ": " + value
+	var b strings.Builder
+
+	// The first fold point must follow the "name: " prefix
+	min := len(name) + 2
+	for len(rest) > maxPreferredLine {
+		cut := strings.LastIndexAny(rest[:maxPreferredLine+1], " \t")
+		if cut < min {
+			// No whitespace in time, fold at the next one
+			next := strings.IndexAny(rest[maxPreferredLine+1:], " \t")
+			if next < 0 {
+				break
+			}
+			cut = maxPreferredLine + 1 + next
+		}
+		if strings.TrimSpace(rest[:cut]) == "" {
+			break
+		}
+		b.WriteString(rest[:cut])
+		b.WriteString("\r\n")
+		rest = rest[cut:]
+		// Continuation lines start with the whitespace they were folded at
+		min = 1
+	}
+	b.WriteString(rest)
+	b.WriteString("\r\n")
+
+	field := b.String()
+	for _, line := range strings.Split(field, "\r\n") {
+		if len(line) > maxLineOctets {
+			return "", fmt.Errorf("header %s: %v", name, errLineTooLong)
+		}
+	}
+	return field, nil
+}
+
+// lineLimitWriter passes writes through to w, failing as soon as a line
+// exceeds maxLineOctets.
+type lineLimitWriter struct {
+	w    io.Writer
+	line int // octets of the current line, including a pending CR
+}
+
+func (l *lineLimitWriter) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if c == '\n' {
+			l.line = 0
+			continue
+		}
+		l.line++
+		// A trailing CR belongs to the line ending
+		if l.line > maxLineOctets+1 || (l.line == maxLineOctets+1 && c != '\r') {
+			return 0, errLineTooLong
+		}
+	}
+	return l.w.Write(p)
+}
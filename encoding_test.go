@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestBodyEncoding ensures the transfer encoding follows the content of the
+// part and the 8BITMIME support of the server
+func TestBodyEncoding(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		data      string
+		allow8bit bool
+		// Expected results.
+		want string
+	}{
+		{"Short ASCII", "Hello\r\nWorld\n", false, encoding7bit},
+		{"Short ASCII, 8bit allowed", "Hello", true, encoding7bit},
+		{"Empty", "", false, encoding7bit},
+		{"Long ASCII line", strings.Repeat("word ", 20), false, encodingQuotedPrintable},
+		{"Mostly ASCII", "Total price: 100 € incl. VAT", false, encodingQuotedPrintable},
+		{"UTF-8 with 8BITMIME", "Счёт на оплату", true, encoding8bit},
+		{"Cyrillic without 8BITMIME", "Счёт на оплату", false, encodingBase64},
+		{"Long Cyrillic line with 8BITMIME", strings.Repeat("Счёт ", 20), true, encodingBase64},
+		{"Invalid UTF-8", "\xff\xfe short", true, encodingBase64},
+		{"Bare CR", "Hello\rWorld", false, encodingQuotedPrintable},
+		{"NUL", "Hello World\x00", true, encodingQuotedPrintable},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := bodyEncoding([]byte(tt.data), tt.allow8bit); got != tt.want {
+				t.Errorf("%q. bodyEncoding() = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestFoldHeader ensures long header fields are folded and unfoldable ones
+// rejected
+func TestFoldHeader(t *testing.T) {
+	t.Parallel()
+
+	subject := mime.QEncoding.Encode("UTF-8", strings.Repeat("Счёт на оплату ", 10))
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		field string
+		value string
+		// Expected results.
+		want    string
+		wantErr bool
+	}{
+		{"Short", "Subject", "Invoice", "Subject: Invoice\r\n", false},
+		{"Empty", "To", "", "To: \r\n", false},
+		{
+			"Long",
+			"Subject",
+			strings.TrimSpace(strings.Repeat("Invoice number 1234 ", 5)),
+			"Subject: Invoice number 1234 Invoice number 1234 Invoice number 1234 Invoice\r\n number 1234 Invoice number 1234\r\n",
+			false,
+		},
+		{
+			"Long word",
+			"X-Token",
+			strings.Repeat("a", 100) + " b",
+			"X-Token: " + strings.Repeat("a", 100) + "\r\n b\r\n",
+			false,
+		},
+		{"Too long", "X-Token", strings.Repeat("a", 1000), "", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := foldHeader(tt.field, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. foldHeader() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("%q. foldHeader() = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+
+	// Encoded words are folded between words and decode back to the value
+	got, err := foldHeader("Subject", subject)
+	if err != nil {
+		t.Fatalf("foldHeader() error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(got, "\r\n"), "\r\n")
+	assert.True(t, len(lines) > 1, got)
+	for _, line := range lines[1:] {
+		assert.True(t, len(line) <= maxPreferredLine, line)
+	}
+	unfolded := strings.Replace(strings.TrimPrefix(strings.TrimSuffix(got, "\r\n"), "Subject: "), "\r\n", "", -1)
+	decoded, err := new(mime.WordDecoder).DecodeHeader(unfolded)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Repeat("Счёт на оплату ", 10), decoded)
+}
+
+// TestLineLimitWriter ensures lines over 998 octets are rejected
+func TestLineLimitWriter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		writes []string
+		// Expected results.
+		wantErr bool
+	}{
+		{"Short lines", []string{"a\r\nb\r\n"}, false},
+		{"998 octets", []string{strings.Repeat("a", 998) + "\r\n"}, false},
+		{"998 octets, split CRLF", []string{strings.Repeat("a", 998) + "\r", "\n"}, false},
+		{"999 octets", []string{strings.Repeat("a", 999) + "\r\n"}, true},
+		{"Across writes", []string{strings.Repeat("a", 500), strings.Repeat("a", 500)}, true},
+		{"Reset by LF", []string{strings.Repeat("a", 998) + "\n", strings.Repeat("a", 998)}, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var buf bytes.Buffer
+			w := &lineLimitWriter{w: &buf}
+			var err error
+			for _, s := range tt.writes {
+				if _, err = w.Write([]byte(s)); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%q. lineLimitWriter.Write() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestMailYakWriteTo_8bit ensures 8bit parts are labelled up to the top-level
+// entity only when the server supports 8BITMIME
+func TestMailYakWriteTo_8bit(t *testing.T) {
+	t.Parallel()
+
+	newMail := func(allow8bit bool) *MailYak {
+		m := &MailYak{
+			headers:   map[string]string{},
+			trimRegex: regexp.MustCompile("\r?\n"),
+			date:      time.Now().Format(time.RFC1123Z),
+			allow8bit: allow8bit,
+		}
+		m.Plain().Set("Счёт на оплату")
+		m.Subject(strings.Repeat("Счёт на оплату ", 10))
+		return m
+	}
+
+	var buf bytes.Buffer
+	if _, err := newMail(true).WriteTo(&buf); err != nil {
+		t.Fatalf("MailYak.WriteTo() error = %v", err)
+	}
+	assert.Equal(t, 3, strings.Count(buf.String(), "Content-Transfer-Encoding: 8bit\r\n"))
+	assert.Contains(t, buf.String(), "\r\n\r\nСчёт на оплату\r\n")
+	assert.Contains(t, buf.String(), "?=\r\n =?UTF-8?")
+
+	buf.Reset()
+	if _, err := newMail(false).WriteTo(&buf); err != nil {
+		t.Fatalf("MailYak.WriteTo() error = %v", err)
+	}
+	assert.NotContains(t, buf.String(), "8bit")
+	assert.Contains(t, buf.String(), "Content-Transfer-Encoding: base64\r\n")
+
+	m := newMail(true)
+	m.AddHeader("X-Token", strings.Repeat("a", 1000))
+	if _, err := m.WriteTo(&buf); err == nil {
+		t.Errorf("MailYak.WriteTo() error = nil, want %v", errLineTooLong)
+	}
+}
+
+// TestMailYakWriteTo_base64Lines ensures the base64 of the bodies and the
+// attachments alike is broken at maxBase64LineLen
+func TestMailYakWriteTo_base64Lines(t *testing.T) {
+	t.Parallel()
+
+	m := &MailYak{
+		headers:   map[string]string{},
+		trimRegex: regexp.MustCompile("\r?\n"),
+		date:      time.Now().Format(time.RFC1123Z),
+	}
+	m.Plain().Set(strings.Repeat("Счёт на оплату ", 20))
+	m.AttachSource("invoice.html", FileSource("./storage/invoice.ru.1.html"))
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatalf("MailYak.WriteTo() error = %v", err)
+	}
+	// Every line of a base64 part but its last is full
+	base64Line := regexp.MustCompile(`^[A-Za-z0-9+/=]+$`)
+	lines := strings.Split(buf.String(), "\r\n")
+	parts := 0
+	for i, l := range lines {
+		if !base64Line.MatchString(l) {
+			continue
+		}
+		last := i+1 == len(lines) || !base64Line.MatchString(lines[i+1])
+		if last {
+			parts++
+		}
+		if len(l) > maxBase64LineLen || !last && len(l) != maxBase64LineLen {
+			t.Errorf("MailYak.WriteTo() base64 line %q is %d long, want %d", l, len(l), maxBase64LineLen)
+		}
+	}
+	assert.Equal(t, 2, parts)
+}
@@ -5,8 +5,17 @@ go 1.13
 require (
 	github.com/Lunkov/grpc-bpmn v0.0.0-20210206092613-ba7c83c29538
 	github.com/Lunkov/lib-env v0.0.0-20210314124046-885d8975482c
+	github.com/ProtonMail/go-crypto v1.0.0
+	github.com/emersion/go-msgauth v0.6.6
 	github.com/golang/glog v0.0.0-20210429001901-424d2337a529
-	golang.org/x/net v0.0.0-20210505024714-0287a6fb4125
+	github.com/jung-kurt/gofpdf v1.16.2
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	github.com/stretchr/testify v1.5.1
+	github.com/yuin/goldmark v1.4.13
+	go.mozilla.org/pkcs7 v0.9.0
+	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d
+	golang.org/x/net v0.8.0
+	golang.org/x/text v0.8.0
 	google.golang.org/grpc v1.37.0
 	gopkg.in/yaml.v2 v2.4.0
 )
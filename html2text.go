@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// maxTableWidth is the widest a table is laid out in aligned columns, wider
+// tables have their cells joined with a separator instead.
+const maxTableWidth = 78
+
+// htmlToText renders an HTML document as readable plain text, suitable for the
+// text/plain alternative of an email.
+//
+// Paragraphs and line breaks are kept, links are rendered as "text (url)",
+// tables are laid out in columns and style and script blocks are dropped.
+func htmlToText(src []byte) (string, error) {
+	return htmlToWrappedText(src, 0)
+}
+
+// htmlToWrappedText is htmlToText wrapping the lines of text at width runes,
+// list items with a hanging indent; preformatted text and tables are kept as
+// they are. Words are never broken.
+func htmlToWrappedText(src []byte, width int) (string, error) {
+	doc, err := html.Parse(bytes.NewReader(src))
+	if err != nil {
+		return "", err
+	}
+
+	r := &textRenderer{width: width}
+	r.walk(doc)
+	return r.String(), nil
+}
+
+// textRenderer accumulates the text of the walked nodes, collapsing
+// whitespace the way a browser would.
+type textRenderer struct {
+	buf      strings.Builder
+	newlines int  // pending line breaks
+	space    bool // pending space between words
+	pre      int  // depth of <pre> elements
+	lists    []int
+	bol      bool // at the beginning of a line
+	width    int  // wraps the lines of text when set
+	col      int  // runes of the current line
+	indent   int  // of the wrapped lines
+}
+
+// String returns the rendered text with trailing whitespace removed from every
+// line and no more than one empty line in a row.
+func (r *textRenderer) String() string {
+	lines := strings.Split(r.buf.String(), "\n")
+	out := lines[:0]
+	for _, l := range lines {
+		l = strings.TrimRight(l, " ")
+		if l == "" && len(out) > 0 && out[len(out)-1] == "" {
+			continue
+		}
+		out = append(out, l)
+	}
+	return strings.Trim(strings.Join(out, "\n"), "\n")
+}
+
+// breakLines requests at least n line breaks before the next text.
+func (r *textRenderer) breakLines(n int) {
+	if n > r.newlines {
+		r.newlines = n
+	}
+	r.space = false
+}
+
+// write appends s as inline text, flushing pending breaks and spaces.
+func (r *textRenderer) write(s string) {
+	if s == "" {
+		return
+	}
+	if r.buf.Len() > 0 {
+		if r.newlines > 0 {
+			r.buf.WriteString(strings.Repeat("\n", r.newlines))
+			r.col = 0
+		} else if r.space && !r.bol {
+			r.buf.WriteByte(' ')
+			r.col++
+		}
+	}
+	r.newlines = 0
+	r.space = false
+	r.bol = false
+	r.buf.WriteString(s)
+	r.col += utf8.RuneCountInString(s)
+}
+
+// wrap starts a new line when w does not fit in the current one. A word
+// glued to the previous one, e.g. after a closing </b>, moves along with it.
+func (r *textRenderer) wrap(w string) {
+	if r.width == 0 || r.pre > 0 || r.newlines > 0 || r.bol || r.col == 0 {
+		return
+	}
+	n := utf8.RuneCountInString(w)
+	if r.space {
+		if r.col+1+n <= r.width {
+			return
+		}
+		r.buf.WriteString("\n" + strings.Repeat(" ", r.indent))
+		r.col = r.indent
+		r.space = false
+		r.bol = true
+		return
+	}
+
+	if r.col+n <= r.width {
+		return
+	}
+	// Break at the last space of the line, past the indent and list marker
+	s := r.buf.String()
+	line := strings.LastIndexByte(s, '\n') + 1
+	i := strings.LastIndexByte(s[line:], ' ')
+	if i < r.indent {
+		return
+	}
+	tail := s[line+i+1:]
+	r.buf.Reset()
+	r.buf.WriteString(s[:line+i] + "\n" + strings.Repeat(" ", r.indent) + tail)
+	r.col = r.indent + utf8.RuneCountInString(tail)
+}
+
+// text writes the contents of a text node.
+func (r *textRenderer) text(s string) {
+	s = strings.Replace(s, "\u00a0", " ", -1)
+
+	if r.pre > 0 {
+		lines := strings.Split(s, "\n")
+		for i, l := range lines {
+			if i > 0 {
+				r.newline()
+			}
+			r.write(l)
+		}
+		return
+	}
+
+	if strings.TrimLeft(s, " \t\r\n\f") != s {
+		r.space = true
+	}
+	words := strings.Fields(s)
+	for i, w := range words {
+		if i > 0 {
+			r.space = true
+		}
+		r.wrap(w)
+		r.write(w)
+	}
+	if len(words) > 0 && strings.TrimRight(s, " \t\r\n\f") != s {
+		r.space = true
+	}
+}
+
+// newline writes a line break even when no text follows, so consecutive
+// breaks produce empty lines.
+func (r *textRenderer) newline() {
+	if r.buf.Len() > 0 && r.newlines > 0 {
+		r.buf.WriteString(strings.Repeat("\n", r.newlines))
+	}
+	r.buf.WriteByte('\n')
+	r.newlines = 0
+	r.space = false
+	r.bol = true
+	r.col = 0
+}
+
+func (r *textRenderer) walkChildren(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.walk(c)
+	}
+}
+
+func (r *textRenderer) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		r.text(n.Data)
+		return
+	case html.DocumentNode:
+		r.walkChildren(n)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Title, atom.Noscript, atom.Template:
+		return
+
+	case atom.Br:
+		r.newline()
+
+	case atom.Hr:
+		r.breakLines(1)
+		r.write(strings.Repeat("-", 40))
+		r.breakLines(1)
+
+	case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Blockquote:
+		r.breakLines(2)
+		r.walkChildren(n)
+		r.breakLines(2)
+
+	case atom.Pre:
+		r.breakLines(2)
+		r.pre++
+		r.walkChildren(n)
+		r.pre--
+		r.breakLines(2)
+
+	case atom.Ul, atom.Ol:
+		r.breakLines(2)
+		r.lists = append(r.lists, 0)
+		if n.DataAtom == atom.Ol {
+			r.lists[len(r.lists)-1] = 1
+		}
+		r.walkChildren(n)
+		r.lists = r.lists[:len(r.lists)-1]
+		r.breakLines(2)
+
+	case atom.Li:
+		r.breakLines(1)
+		indent := ""
+		marker := "*"
+		if depth := len(r.lists); depth > 0 {
+			indent = strings.Repeat("  ", depth-1)
+			if r.lists[depth-1] > 0 {
+				marker = strconv.Itoa(r.lists[depth-1]) + "."
+				r.lists[depth-1]++
+			}
+		}
+		r.write(indent + marker)
+		r.space = true
+		saved := r.indent
+		r.indent = utf8.RuneCountInString(indent + marker + " ")
+		r.walkChildren(n)
+		r.indent = saved
+		r.breakLines(1)
+
+	case atom.A:
+		r.link(n)
+
+	case atom.Img:
+		if alt := attr(n, "alt"); alt != "" {
+			r.text(alt)
+		}
+
+	case atom.Table:
+		r.breakLines(2)
+		r.table(n)
+		r.breakLines(2)
+
+	case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Nav,
+		atom.Main, atom.Aside, atom.Address, atom.Form, atom.Fieldset, atom.Figure,
+		atom.Dl, atom.Dt, atom.Dd, atom.Center:
+		r.breakLines(1)
+		r.walkChildren(n)
+		r.breakLines(1)
+
+	default:
+		r.walkChildren(n)
+	}
+}
+
+// link renders an anchor as "text (url)", or just the url when the text
+// repeats it.
+func (r *textRenderer) link(n *html.Node) {
+	sub := &textRenderer{}
+	sub.walkChildren(n)
+	text := sub.String()
+
+	href := strings.TrimSpace(attr(n, "href"))
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+		r.text(text)
+		return
+	}
+
+	target := strings.TrimPrefix(href, "mailto:")
+	switch text {
+	case "", href, target:
+		r.text(target)
+	default:
+		r.text(text + " (" + target + ")")
+	}
+}
+
+// table lays out the rows of a table in aligned columns.
+func (r *textRenderer) table(n *html.Node) {
+	var rows [][]string
+	forEachRow(n, func(tr *html.Node) {
+		var row []string
+		for c := tr.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || (c.DataAtom != atom.Td && c.DataAtom != atom.Th) {
+				continue
+			}
+			sub := &textRenderer{}
+			sub.walkChildren(c)
+			row = append(row, sub.String())
+		}
+		rows = append(rows, row)
+	})
+
+	// Drop empty rows and columns, they only exist for the visual layout
+	var cols int
+	var filled [][]string
+	for _, row := range rows {
+		empty := true
+		for _, cell := range row {
+			if cell != "" {
+				empty = false
+			}
+		}
+		if empty {
+			continue
+		}
+		filled = append(filled, row)
+		if len(row) > cols {
+			cols = len(row)
+		}
+	}
+	used := make([]bool, cols)
+	for _, row := range filled {
+		for i, cell := range row {
+			if cell != "" {
+				used[i] = true
+			}
+		}
+	}
+	for i, row := range filled {
+		var kept []string
+		for j := 0; j < cols; j++ {
+			if !used[j] {
+				continue
+			}
+			cell := ""
+			if j < len(row) {
+				cell = row[j]
+			}
+			kept = append(kept, cell)
+		}
+		filled[i] = kept
+	}
+
+	// Column widths, measured in runes
+	var widths []int
+	for _, row := range filled {
+		for i, cell := range row {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			for _, l := range strings.Split(cell, "\n") {
+				if w := utf8.RuneCountInString(l); w > widths[i] {
+					widths[i] = w
+				}
+			}
+		}
+	}
+	total := 0
+	for _, w := range widths {
+		total += w + 3
+	}
+
+	for _, row := range filled {
+		r.breakLines(1)
+
+		// Layout tables with a single column are plain blocks of text
+		if len(widths) == 1 {
+			r.write(row[0])
+			continue
+		}
+
+		if total > maxTableWidth {
+			var cells []string
+			for _, cell := range row {
+				if cell != "" {
+					cells = append(cells, strings.Replace(cell, "\n", " ", -1))
+				}
+			}
+			r.write(strings.Join(cells, " | "))
+			continue
+		}
+
+		// No separators after the last filled cell
+		last := 0
+		for i, cell := range row {
+			if cell != "" {
+				last = i
+			}
+		}
+		row = row[:last+1]
+
+		lines := 1
+		split := make([][]string, len(row))
+		for i, cell := range row {
+			split[i] = strings.Split(cell, "\n")
+			if len(split[i]) > lines {
+				lines = len(split[i])
+			}
+		}
+		for l := 0; l < lines; l++ {
+			var line strings.Builder
+			for i := range row {
+				s := ""
+				if l < len(split[i]) {
+					s = split[i][l]
+				}
+				if i > 0 {
+					line.WriteString(" | ")
+				}
+				line.WriteString(s)
+				line.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(s)))
+			}
+			r.breakLines(1)
+			r.write(strings.TrimRight(line.String(), " "))
+		}
+	}
+}
+
+// forEachRow calls fn for every row of the table n, skipping nested tables.
+func forEachRow(n *html.Node, fn func(tr *html.Node)) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		switch c.DataAtom {
+		case atom.Tr:
+			fn(c)
+		case atom.Thead, atom.Tbody, atom.Tfoot:
+			forEachRow(c, fn)
+		}
+	}
+}
+
+// attr returns the value of the named attribute of n.
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// TestHTMLToText ensures HTML bodies are rendered as readable plain text
+func TestHTMLToText(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		html string
+		// Expected results.
+		want string
+	}{
+		{
+			"Paragraphs",
+			"<p>First   paragraph\n of text.</p><p>Second</p>",
+			"First paragraph of text.\n\nSecond",
+		},
+		{
+			"Line breaks",
+			"<div>line one<br>line two<br><br>after an empty line</div>",
+			"line one\nline two\n\nafter an empty line",
+		},
+		{
+			"Inline elements",
+			"<p>Hello <b>bold</b> <i>world</i>!</p>",
+			"Hello bold world!",
+		},
+		{
+			"Link",
+			`<p>See <a href="https://example.org/invoice">the invoice</a>.</p>`,
+			"See the invoice (https://example.org/invoice).",
+		},
+		{
+			"Link repeating its url",
+			`<a href="https://example.org">https://example.org</a>`,
+			"https://example.org",
+		},
+		{
+			"Mailto link",
+			`<a href="mailto:support@example.org">support@example.org</a>`,
+			"support@example.org",
+		},
+		{
+			"Anchor without href",
+			`<a name="top">Top</a>`,
+			"Top",
+		},
+		{
+			"Style and script dropped",
+			"<html><head><title>T</title><style>p { color: red; }</style></head><body><script>alert(1)</script><p>Text</p></body></html>",
+			"Text",
+		},
+		{
+			"Lists",
+			"<ul><li>one</li><li>two</li></ul><ol><li>first</li><li>second</li></ol>",
+			"* one\n* two\n\n1. first\n2. second",
+		},
+		{
+			"Table",
+			"<table><tr><th>Товар</th><th>Кол-во</th><th>Сумма</th></tr>" +
+				"<tr><td>Бумага</td><td>2</td><td>105,23</td></tr></table>",
+			"Товар  | Кол-во | Сумма\nБумага | 2      | 105,23",
+		},
+		{
+			"Layout table",
+			"<table width=\"100%\"><tr><td>Внимание!</td></tr><tr><td>&nbsp;</td></tr></table>",
+			"Внимание!",
+		},
+		{
+			"Image alt",
+			`<p><img src="cid:logo" alt="Logo"> Company</p>`,
+			"Logo Company",
+		},
+		{
+			"Preformatted",
+			"<pre>a  b\n  c</pre>",
+			"a  b\n  c",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := htmlToText([]byte(tt.html))
+			if err != nil {
+				t.Fatalf("%q. htmlToText() error = %v", tt.name, err)
+			}
+			if got != tt.want {
+				t.Errorf("%q. htmlToText() = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestHTMLToText_invoice ensures the invoice template keeps its content and
+// loses its stylesheet
+func TestHTMLToText_invoice(t *testing.T) {
+	t.Parallel()
+
+	src, err := ioutil.ReadFile("./storage/invoice.ru.1.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := htmlToText(src)
+	if err != nil {
+		t.Fatalf("htmlToText() error = %v", err)
+	}
+
+	for _, want := range []string{"Банк получателя", "В том числе НДС: | 105.23", "сто пять рублей 23 копейки"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("htmlToText() = %q, want to contain %q", got, want)
+		}
+	}
+	for _, unwanted := range []string{"border-collapse", "<", "Бланк"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("htmlToText() = %q, must not contain %q", got, unwanted)
+		}
+	}
+}
+
+// TestHTMLToWrappedText ensures the lines of text are wrapped between words,
+// and that preformatted text and tables are not
+func TestHTMLToWrappedText(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		html  string
+		width int
+		// Expected results.
+		want string
+	}{
+		{
+			"Paragraph",
+			"<p>Направляем вам счёт на оплату услуг по договору</p>",
+			20,
+			"Направляем вам счёт\nна оплату услуг по\nдоговору",
+		},
+		{
+			"Exact width",
+			"<p>aaaa bbbb cccc</p>",
+			9,
+			"aaaa bbbb\ncccc",
+		},
+		{
+			"Inline elements",
+			"<p>aaaa <b>bbbb</b>cc <i>dddd</i></p>",
+			10,
+			"aaaa\nbbbbcc\ndddd",
+		},
+		{
+			"Long word",
+			"<p>a https://example.org/invoice/42 b</p>",
+			10,
+			"a\nhttps://example.org/invoice/42\nb",
+		},
+		{
+			"Link",
+			`<p>Оплатить <a href="https://pay.example.org/42">счёт</a></p>`,
+			20,
+			"Оплатить счёт\n(https://pay.example.org/42)",
+		},
+		{
+			"Hanging indent",
+			"<ul><li>aaaa bbbb cccc</li><li>dddd</li></ul><ol><li>eeee ffff</li></ol>",
+			10,
+			"* aaaa\n  bbbb\n  cccc\n* dddd\n\n1. eeee\n   ffff",
+		},
+		{
+			"Line break",
+			"<p>aaaa bbbb<br>cccc dddd</p>",
+			9,
+			"aaaa bbbb\ncccc dddd",
+		},
+		{
+			"Preformatted",
+			"<pre>aaaa bbbb cccc</pre>",
+			5,
+			"aaaa bbbb cccc",
+		},
+		{
+			"Table",
+			"<table><tr><td>aaaa bbbb</td><td>cccc</td></tr></table>",
+			5,
+			"aaaa bbbb | cccc",
+		},
+		{
+			"No width",
+			"<p>aaaa bbbb cccc</p>",
+			0,
+			"aaaa bbbb cccc",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := htmlToWrappedText([]byte(tt.html), tt.width)
+			if err != nil {
+				t.Fatalf("%q. htmlToWrappedText() error = %v", tt.name, err)
+			}
+			if got != tt.want {
+				t.Errorf("%q. htmlToWrappedText() = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
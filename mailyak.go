@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"net"
+	netmail "net/mail"
 	"net/smtp"
 	"regexp"
 	"strings"
@@ -35,7 +38,23 @@ type MailYak struct {
 	trimRegex      *regexp.Regexp
 	host           string
 	writeBccHeader bool
-	date           string
+	date           string         // set with Date, stamped at sending when empty
+	sentAt         time.Time      // time the message was last built at
+	location       *time.Location // time zone of the stamped date
+	autoPlainText  bool
+	inlineStyles   bool
+	ics            []byte // text/calendar invitation
+	icsMethod      string
+	dkim           *dkimSigner
+	smime          *smimeSigner
+	pgp            *pgpSigner
+	skipped        []string // recipients without a PGP key, left out of the headers
+	allow8bit      bool // the server supports 8BITMIME
+	embedImages    bool
+	imagesPath     string
+	charset        *outputCharset // nil for UTF-8
+	tls            *tls.Config    // TLS from the very beginning, dialed at sending
+	serverName     string
 }
 
 // New returns an instance of MailYak using host as the SMTP server, and
@@ -51,97 +70,213 @@ type MailYak struct {
 //		))
 //
 func NewMail(info *SMTPInfo) *MailYak {
+  m := newMail(info)
+  if m.tls != nil {
+    if err := m.dialTLS(); err != nil {
+      return nil
+    }
+  }
+  return m
+}
+
+// newMail returns a MailYak for the profile info without connecting to the
+// server, as for parsing a message; the TLS connection is made at sending.
+func newMail(info *SMTPInfo) *MailYak {
   if glog.V(9) {
     glog.Infof("DBG: NEW MAIL: Init (%v)", info)
   }
   m := MailYak{
     client: nil,
-		headers:        map[string]string{},
+		headers:        map[string]string{"Auto-Submitted": AutoGenerated},
 		host:           info.ConnectStr,
 		auth:           info.Auth,
 		trimRegex:      regexp.MustCompile("\r?\n"),
 		writeBccHeader: false,
-		date:           time.Now().Format(time.RFC1123Z),
+		location:       info.location,
+		autoPlainText:  !info.DisableAutoPlainText,
+		inlineStyles:   info.InlineCSS,
+		embedImages:    info.EmbedImages,
+		charset:        info.charset,
+		dkim:           info.DKIM.signer,
+		smime:          info.SMIME.signer,
+		pgp:            info.PGP.signer,
 	}
   if info.EnableTLS {
-    // Here is the key, you need to call tls.Dial instead of smtp.Dial
-    // for smtp servers running on 465 that require an ssl connection
-    // from the very beginning (no starttls)
-    conn, err := tls.Dial("tcp", info.ConnectStr, &info.TLS)
-    if err != nil {
-      glog.Errorf("ERR: MAIL: New Mail Dial TLS(%s): %v", info.ConnectStr, err)
-      return nil
-    }
-
-    m.client, err = smtp.NewClient(conn, info.Address)
-    if err != nil {
-      glog.Errorf("ERR: MAIL: New Mail Dial Client(%s): %v", info.Address, err)
-      return nil
-    }
-    // Auth
-    if err = m.client.Auth(info.Auth); err != nil {
-      glog.Errorf("ERR: MAIL: New Mail Auth(%s): %v", info.ConnectStr, err)
-      return nil
-    }
-    if glog.V(9) {
-      glog.Infof("DBG: MAIL: Init TLS (%s)", info.ConnectStr)
-    }
+    m.tls, m.serverName = info.TLS, info.Address
   }
-  
 	return &m
 }
 
+// dialTLS connects and authenticates to the server of a TLS profile.
+func (m *MailYak) dialTLS() error {
+  // Here is the key, you need to call tls.Dial instead of smtp.Dial
+  // for smtp servers running on 465 that require an ssl connection
+  // from the very beginning (no starttls)
+  conn, err := tls.Dial("tcp", m.host, m.tls)
+  if err != nil {
+    glog.Errorf("ERR: MAIL: New Mail Dial TLS(%s): %v", m.host, err)
+    return err
+  }
+
+  m.client, err = smtp.NewClient(conn, m.serverName)
+  if err != nil {
+    glog.Errorf("ERR: MAIL: New Mail Dial Client(%s): %v", m.serverName, err)
+    return err
+  }
+  // Auth
+  if err = m.client.Auth(m.auth); err != nil {
+    glog.Errorf("ERR: MAIL: New Mail Auth(%s): %v", m.host, err)
+    return err
+  }
+  if glog.V(9) {
+    glog.Infof("DBG: MAIL: Init TLS (%s)", m.host)
+  }
+  return nil
+}
+
 // Send attempts to send the built email via the configured SMTP server.
 //
 // Attachments are read when Send() is called, and any connection/authentication
-// errors will be returned by Send().
+// errors will be returned by Send(). The message is streamed straight into the
+// SMTP DATA command and is never buffered in memory as a whole.
 func (m *MailYak) Send() error {
-	buf, err := m.buildMime()
-	if err != nil {
-		return err
-	}
+  if err := m.checkCharset(); err != nil {
+    glog.Errorf("ERR: MAIL: %v", err)
+    return err
+  }
+  if m.client == nil && m.tls != nil {
+    if err := m.dialTLS(); err != nil {
+      return err
+    }
+  }
   if m.client != nil {
     if glog.V(9) {
       glog.Infof("DBG: MAIL: Sending TLS (%s)", m.host)
     }
-    
-    if err = m.client.Mail(m.fromAddr); err != nil {
-      glog.Errorf("ERR: MAIL: m.fromAddr(%s): %v", m.fromAddr, err)
-      return err
-    }
+    return m.transmit(m.client)
+  }
+
+  c, err := smtp.Dial(m.host)
+  if err != nil {
+    glog.Errorf("ERR: MAIL: Dial(%s): %v", m.host, err)
+    return err
+  }
+  defer c.Close()
 
-    if err = m.client.Rcpt(m.toAddrs[0]); err != nil {
-      glog.Errorf("ERR: MAIL: m.toAddrs(%s): %v", m.toAddrs, err)
+  if ok, _ := c.Extension("STARTTLS"); ok {
+    host, _, _ := net.SplitHostPort(m.host)
+    if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+      glog.Errorf("ERR: MAIL: StartTLS(%s): %v", m.host, err)
       return err
     }
+  }
+  if m.auth != nil {
+    if ok, _ := c.Extension("AUTH"); ok {
+      if err = c.Auth(m.auth); err != nil {
+        glog.Errorf("ERR: MAIL: Auth(%s): %v", m.host, err)
+        return err
+      }
+    }
+  }
 
-    // Data
-    w, err := m.client.Data()
-    if err != nil {
-      glog.Errorf("ERR: MAIL: m.Data: %v", err)
-      return err
+  if err = m.transmit(c); err != nil {
+    return err
+  }
+  return c.Quit()
+}
+
+// transmit runs a single mail transaction on c, streaming the MIME message
+// into the DATA writer.
+func (m *MailYak) transmit(c *smtp.Client) error {
+  rcpts, err := m.envelopeRecipients()
+  if err != nil {
+    glog.Errorf("ERR: MAIL: %v", err)
+    return err
+  }
+  if len(rcpts) == 0 {
+    // Reported as a failure, the job must not pass for sent
+    err = errors.New("no recipients")
+    if len(m.recipientAddrs()) > 0 {
+      err = errors.New("all recipients skipped: no PGP keys")
     }
+    glog.Errorf("ERR: MAIL: %v", err)
+    return err
+  }
 
-    _, err = w.Write(buf.Bytes())
-    if err != nil {
-      glog.Errorf("ERR: MAIL: m.Data.Write: %v", err)
+  if err := c.Mail(m.fromAddr); err != nil {
+    glog.Errorf("ERR: MAIL: m.fromAddr(%s): %v", m.fromAddr, err)
+    return err
+  }
+
+  for _, rcpt := range rcpts {
+    if err := c.Rcpt(rcpt); err != nil {
+      glog.Errorf("ERR: MAIL: Rcpt(%s): %v", rcpt, err)
       return err
     }
+  }
 
-    err = w.Close()
-    if err != nil {
-      glog.Errorf("ERR: MAIL: Close: %v", err)
-      return err
+  // net/smtp adds BODY=8BITMIME to MAIL FROM when the server supports it
+  m.allow8bit, _ = c.Extension("8BITMIME")
+
+  // Data
+  w, err := c.Data()
+  if err != nil {
+    glog.Errorf("ERR: MAIL: m.Data: %v", err)
+    return err
+  }
+
+  if _, err = m.WriteTo(w); err != nil {
+    glog.Errorf("ERR: MAIL: m.Data.Write: %v", err)
+    w.Close()
+    return err
+  }
+
+  if err = w.Close(); err != nil {
+    glog.Errorf("ERR: MAIL: Close: %v", err)
+    return err
+  }
+  return nil
+}
+
+// envelopeRecipients returns the To, CC and BCC addresses the message is
+// delivered to, without those skipped for lack of a PGP key.
+//
+// Recipients are checked before the mail transaction starts, so a missing key
+// under the fail policy never leaves a half-written message.
+func (m *MailYak) envelopeRecipients() ([]string, error) {
+  all := append(append(append([]string{}, m.toAddrs...), m.ccAddrs...), m.bccAddrs...)
+  if m.pgp == nil {
+    return all, nil
+  }
+
+  skipped, err := m.pgp.skippedRecipients(m.recipientAddrs())
+  if err != nil {
+    return nil, err
+  }
+  if len(skipped) == 0 {
+    return all, nil
+  }
+
+  var rcpts []string
+  for _, rcpt := range all {
+    if !isSkipped(rcpt, skipped) {
+      rcpts = append(rcpts, rcpt)
     }
-    return nil
   }
-	return smtp.SendMail(
-		m.host,
-		m.auth,
-		m.fromAddr,
-		append(append(m.toAddrs, m.ccAddrs...), m.bccAddrs...),
-		buf.Bytes(),
-	)
+  return rcpts, nil
+}
+
+// isSkipped reports whether the To, CC or BCC entry rcpt is one of the
+// skipped addresses.
+func isSkipped(rcpt string, skipped []string) bool {
+  if len(skipped) == 0 {
+    return false
+  }
+  addr := rcpt
+  if parsed, err := netmail.ParseAddress(rcpt); err == nil {
+    addr = parsed.Address
+  }
+  return containsFold(skipped, addr)
 }
 
 // MimeBuf returns the buffer containing all the RAW MIME data.
@@ -171,8 +306,8 @@ func (m *MailYak) String() string {
 
 	if len(m.headers) > 0 {
 		var hdrs []string
-		for k, v := range m.headers {
-			hdrs = append(hdrs, fmt.Sprintf("%s: %q", k, v))
+		for _, k := range m.headerNames() {
+			hdrs = append(hdrs, fmt.Sprintf("%s: %q", k, m.headers[k]))
 		}
 		custom = strings.Join(hdrs, ", ") + ", "
 	}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"net/textproto"
 	"strings"
+	"sync"
 	"testing"
   "github.com/stretchr/testify/assert"
 )
@@ -29,7 +32,115 @@ func TestMailYakStringer(t *testing.T) {
 
 	mail.date = "a date"
 
-	want := "&MailYak{date: \"a date\", from: \"from@example.org\", fromName: \"From Example\", html: 31 bytes, plain: 42 bytes, toAddrs: [to@example.org], bccAddrs: [bcc1@example.org bcc2@example.org], subject: \"Test subject\", Precedence: \"bulk\", host: \"mail.host.com:25\", attachments (2): [{filename: test.html} {filename: test2.html}], auth set: true}"
+	want := "&MailYak{date: \"a date\", from: \"from@example.org\", fromName: \"From Example\", html: 31 bytes, plain: 42 bytes, toAddrs: [to@example.org], bccAddrs: [bcc1@example.org bcc2@example.org], subject: \"Test subject\", Auto-Submitted: \"auto-generated\", Precedence: \"bulk\", host: \"mail.host.com:25\", attachments (2): [{filename: test.html} {filename: test2.html}], auth set: true}"
 	got := fmt.Sprintf("%+v", mail)
   assert.Equal(t, want, got)
 }
+
+// testSMTPServer is a minimal SMTP server recording the received messages
+type testSMTPServer struct {
+	lis      net.Listener
+	mu       sync.Mutex
+	rcpts    [][]string
+	messages []string
+}
+
+func newTestSMTPServer(t *testing.T) *testSMTPServer {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSMTPServer{lis: lis}
+	go s.serve()
+	return s
+}
+
+func (s *testSMTPServer) Close() error {
+	return s.lis.Close()
+}
+
+func (s *testSMTPServer) info() SMTPInfo {
+	addr := s.lis.Addr().(*net.TCPAddr)
+	info := SMTPInfo{Address: addr.IP.String(), Port: int32(addr.Port)}
+	info.expand()
+	return info
+}
+
+func (s *testSMTPServer) serve() {
+	for {
+		conn, err := s.lis.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 localhost ESMTP")
+
+	var rcpts []string
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			tc.PrintfLine("250 localhost")
+		case "MAIL":
+			rcpts = nil
+			tc.PrintfLine("250 OK")
+		case "RCPT":
+			rcpts = append(rcpts, strings.Trim(strings.SplitN(line, ":", 2)[1], "<>"))
+			tc.PrintfLine("250 OK")
+		case "DATA":
+			tc.PrintfLine("354 Go ahead")
+			data, err := tc.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.rcpts = append(s.rcpts, rcpts)
+			s.messages = append(s.messages, string(data))
+			s.mu.Unlock()
+			tc.PrintfLine("250 OK")
+		case "QUIT":
+			tc.PrintfLine("221 Bye")
+			return
+		default:
+			tc.PrintfLine("250 OK")
+		}
+	}
+}
+
+// TestMailYakSend ensures the message is streamed to every recipient
+func TestMailYakSend(t *testing.T) {
+	t.Parallel()
+
+	srv := newTestSMTPServer(t)
+	defer srv.Close()
+	info := srv.info()
+
+	mail := NewMail(&info)
+	mail.From("from@example.org")
+	mail.To("to@example.org")
+	mail.Cc("cc@example.org")
+	mail.Bcc("bcc@example.org")
+	mail.Subject("Test subject")
+	mail.Plain().Set("Plain text part")
+
+	if err := mail.Send(); err != nil {
+		t.Fatalf("MailYak.Send() error = %v", err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	assert.Equal(t, [][]string{{"to@example.org", "cc@example.org", "bcc@example.org"}}, srv.rcpts)
+	assert.Equal(t, 1, len(srv.messages))
+	assert.Contains(t, srv.messages[0], "Subject: Test subject\n")
+	assert.Contains(t, srv.messages[0], "Plain text part")
+}
@@ -4,9 +4,11 @@ import (
   "fmt"
   "flag"
   "net"
+  "net/http"
   "net/smtp"
   "io/ioutil"
   "path/filepath"
+  "time"
   "gopkg.in/yaml.v2"
   "github.com/golang/glog"
   
@@ -31,8 +33,69 @@ type SMTPInfo struct {
   UserLogin       string  `yaml:"user_login"`
   Password        string  `yaml:"password"`
   Secret          string  `yaml:"secret"` // MD5
+  // Do not derive the text/plain part from the HTML body
+  DisableAutoPlainText bool `yaml:"disable_auto_plain_text"`
+  // Apply the <style> rules of HTML bodies onto style attributes
+  InlineCSS       bool    `yaml:"inline_css"`
+  // Attach the local and data: images of HTML bodies as inline parts
+  EmbedImages     bool    `yaml:"embed_images"`
+  // Default layout of the templates, in templates/_layouts
+  Layout          string  `yaml:"layout"`
+  // Output charset: utf-8 (default), windows-1251 or koi8-r
+  Charset         string  `yaml:"charset"`
+  charset         *outputCharset
+  // IANA time zone of the Date header, e.g. Europe/Moscow; the host zone by default
+  TimeZone        string  `yaml:"timezone"`
+  location        *time.Location
+  DKIM            DKIMInfo `yaml:"dkim"`
+  SMIME           SMIMEInfo `yaml:"smime"`
+  PGP             PGPInfo  `yaml:"pgp"`
   Auth            smtp.Auth
-  TLS             tls.Config
+  TLS             *tls.Config
+  // Why the profile can not send, e.g. its signing key failed to load
+  broken          error
+}
+
+type DKIMInfo struct {
+  Domain          string   `yaml:"domain"`
+  Selector        string   `yaml:"selector"`
+  KeyFile         string   `yaml:"key_file"` // PEM, RSA or Ed25519
+  Headers         []string `yaml:"headers"`
+  Canonicalization string  `yaml:"canonicalization"` // header/body, relaxed/relaxed by default
+  signer          *dkimSigner
+}
+
+type SMIMEInfo struct {
+  CertFile        string  `yaml:"cert_file"` // PEM, signing certificate and its chain
+  KeyFile         string  `yaml:"key_file"`  // PEM, RSA or ECDSA
+  // Certificates of the recipients, messages are encrypted when all are found
+  CertsPath       string  `yaml:"certs_path"`
+  signer          *smimeSigner
+}
+
+type PGPInfo struct {
+  KeyFile         string  `yaml:"key_file"` // private key, armored or binary
+  Passphrase      string  `yaml:"passphrase"`
+  // Public keys of the recipients, messages are encrypted when set
+  Keyring         string  `yaml:"keyring"`
+  MissingKey      string  `yaml:"missing_key"` // fail (default), plain or skip
+  signer          *pgpSigner
+}
+
+type UnsubscribeInfo struct {
+  Listen          string  `yaml:"listen"` // HTTP address of the unsubscribe handler, e.g. 0.0.0.0:3001
+  URL             string  `yaml:"url"`    // public URL of the handler, used in List-Unsubscribe
+  Secret          string  `yaml:"secret"` // HMAC key of the unsubscribe tokens
+  Storage         string  `yaml:"storage"` // unsubscribed.json in the config path by default
+  list            *unsubscribeList
+}
+
+type PDFInfo struct {
+  // TrueType fonts of the PDF attachments, <family>[-Bold|-Italic|-BoldItalic].ttf,
+  // fonts in the config path by default
+  FontsPath       string  `yaml:"fonts_path"`
+  Font            string  `yaml:"font"` // default family, the first one by default
+  fonts           *pdfFonts
 }
 
 type BPMNInfo struct {
@@ -41,7 +104,14 @@ type BPMNInfo struct {
 
 type ConfigInfo struct {
   ConfigPath      string
+  TemplatesPath   string  `yaml:"templates_path"` // ./templates by default
+  DefaultLocale   string  `yaml:"default_locale"` // templates locale when none matches SEND_MAIL_LOCALE
+  // Seconds between checks of the templates for changes, 10 by default, -1 disables
+  TemplatesReload int     `yaml:"templates_reload"`
+  templates       *templateStore
   SMTP            map[string]SMTPInfo  `yaml:"smtp_settings"`
+  Unsubscribe     UnsubscribeInfo `yaml:"unsubscribe"`
+  PDF             PDFInfo `yaml:"pdf"`
   BPMN            BPMNInfo
 }
 
@@ -54,7 +124,11 @@ func (s *BPMNJobService) CallFunction(ctx context.Context, in *srv_bpmn.RPCBPMNJ
 	return &srv_bpmn.RPCBPMNJobResponse{BpmnProcessId: in.BpmnProcessId, Ok: ok}, nil
 }
 
-func (c *SMTPInfo) expand() {
+// expand fills the derived settings of the profile and loads its keys. A
+// profile whose charset or time zone is unknown, or whose keys fail to load,
+// is marked broken, sendMail refuses it rather than sending mangled, misdated
+// or unsigned mail.
+func (c *SMTPInfo) expand() error {
   if c.ConnectStr == "" {
     c.ConnectStr = fmt.Sprintf("%s:%d", c.Address, c.Port)
   }
@@ -66,8 +140,39 @@ func (c *SMTPInfo) expand() {
     c.Auth = smtp.CRAMMD5Auth(c.UserLogin, c.Secret)
   }
   if c.EnableTLS {
-    c.TLS = tls.Config{ InsecureSkipVerify: false, ServerName: c.Address }
+    c.TLS = &tls.Config{ InsecureSkipVerify: false, ServerName: c.Address }
+  }
+  c.broken = nil
+  charset, err := lookupCharset(c.Charset)
+  if err != nil {
+    c.broken = fmt.Errorf("charset: %v", err)
   }
+  c.charset = charset
+  c.location = nil
+  if c.TimeZone != "" {
+    if c.location, err = time.LoadLocation(c.TimeZone); err != nil && c.broken == nil {
+      c.broken = fmt.Errorf("timezone: %v", err)
+    }
+  }
+  c.DKIM.signer = nil
+  if c.DKIM.Domain != "" {
+    if c.DKIM.signer, err = newDKIMSigner(&c.DKIM); err != nil && c.broken == nil {
+      c.broken = fmt.Errorf("DKIM: %v", err)
+    }
+  }
+  c.SMIME.signer = nil
+  if c.SMIME.CertFile != "" || c.SMIME.KeyFile != "" || c.SMIME.CertsPath != "" {
+    if c.SMIME.signer, err = newSMIMESigner(&c.SMIME); err != nil && c.broken == nil {
+      c.broken = fmt.Errorf("S/MIME: %v", err)
+    }
+  }
+  c.PGP.signer = nil
+  if c.PGP.KeyFile != "" || c.PGP.Keyring != "" || c.PGP.MissingKey != "" {
+    if c.PGP.signer, err = newPGPSigner(&c.PGP); err != nil && c.broken == nil {
+      c.broken = fmt.Errorf("PGP: %v", err)
+    }
+  }
+  return c.broken
 }
 
 func loadConfig(filename string) ConfigInfo {
@@ -90,10 +195,20 @@ func loadConfig(filename string) ConfigInfo {
   if cfg.ConfigPath == "" {
     cfg.ConfigPath = filepath.Dir(filename)
   }
+  if cfg.TemplatesPath == "" {
+    cfg.TemplatesPath = "./templates"
+  }
+  if cfg.templates, err = newTemplateStore(cfg.TemplatesPath, cfg.DefaultLocale); err != nil {
+    glog.Errorf("ERR: TEMPLATES(%s): %v", cfg.TemplatesPath, err)
+  }
   for i, sm := range cfg.SMTP {
-    sm.expand()
+    if err := sm.expand(); err != nil {
+      glog.Errorf("ERR: SMTP(%s): %v, the profile is disabled", i, err)
+    }
     cfg.SMTP[i] = sm
   }
+  cfg.Unsubscribe.expand(cfg.ConfigPath)
+  cfg.PDF.expand(cfg.ConfigPath)
   return cfg
 }
 
@@ -106,6 +221,29 @@ func main() {
     
   globConf = loadConfig(*configPath + "config.yaml")
 
+  // Broken templates are found at deploy time, not when an invoice is sent
+  if globConf.templates == nil {
+    glog.Fatalf("FAIL: Templates(%s) are not valid", globConf.TemplatesPath)
+  }
+  if globConf.TemplatesReload >= 0 {
+    interval := templatesReloadInterval
+    if globConf.TemplatesReload > 0 {
+      interval = time.Duration(globConf.TemplatesReload) * time.Second
+    }
+    go globConf.templates.watch(interval, nil)
+  }
+
+  if globConf.Unsubscribe.Listen != "" && globConf.Unsubscribe.enabled() {
+    mux := http.NewServeMux()
+    mux.Handle(globConf.Unsubscribe.unsubscribePath(), &globConf.Unsubscribe)
+    go func() {
+      glog.Infof("LOG: Start unsubscribe HTTP server (%s)", globConf.Unsubscribe.Listen)
+      if err := http.ListenAndServe(globConf.Unsubscribe.Listen, mux); err != nil {
+        glog.Errorf("ERR: Unsubscribe HTTP server: %v", err)
+      }
+    }()
+  }
+
   glog.Infof("LOG: Start gRPC SendMail server")
 
 	lis, err := net.Listen("tcp", "0.0.0.0:3000")
@@ -11,7 +11,6 @@ import (
   "google.golang.org/grpc"
   "google.golang.org/grpc/test/bufconn"
   
-  "github.com/Lunkov/lib-env"
   "github.com/Lunkov/grpc-bpmn"
 )
 
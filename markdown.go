@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// markdownParam is the job parameter holding a Markdown body, converted into
+// both the HTML and the plain text parts.
+const markdownParam = "SEND_MAIL_BODY_MARKDOWN"
+
+// markdownTextWidth is the width the plain text of the Markdown bodies is
+// wrapped at.
+const markdownTextWidth = 72
+
+// markdownStem is the template of the Markdown bodies in the template sets,
+// so they are wrapped into the layouts as the templates are. No file is
+// called so.
+const markdownStem = "\x00markdown"
+
+// markdownConverter converts CommonMark with the GitHub extensions: tables,
+// strikethrough, task lists and bare links. Raw HTML is dropped and links
+// with unsafe schemes, e.g. javascript:, are emptied, so the bodies of the
+// BPMN processes never inject markup.
+var markdownConverter = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// markdownToHTML converts the Markdown src into sanitized HTML.
+func markdownToHTML(src string) (string, error) {
+	var buf bytes.Buffer
+	if err := markdownConverter.Convert([]byte(src), &buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// markdownHTML is markdownToHTML for the HTML templates, {{markdown .TEXT}}.
+func markdownHTML(src string) (htmltemplate.HTML, error) {
+	out, err := markdownToHTML(src)
+	return htmltemplate.HTML(out), err
+}
+
+// markdownToText converts the Markdown src into plain text wrapped at
+// markdownTextWidth, the text templates' {{markdown .TEXT}}.
+func markdownToText(src string) (string, error) {
+	out, err := markdownToHTML(src)
+	if err != nil {
+		return "", err
+	}
+	return htmlToWrappedText([]byte(out), markdownTextWidth)
+}
+
+// renderMarkdown converts the Markdown src into the parts of a message.
+func renderMarkdown(src string) (*renderedMail, error) {
+	html, err := markdownToHTML(src)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := htmlToWrappedText([]byte(html), markdownTextWidth)
+	if err != nil {
+		return nil, err
+	}
+	return &renderedMail{plain: plain, html: html}, nil
+}
+
+// markdownTemplate returns the template rendering the markdownParam of the
+// data into both bodies.
+func (s *templateSet) markdownTemplate() (*mailTemplate, error) {
+	src := "{{markdown ." + markdownParam + "}}"
+	t := &mailTemplate{name: markdownStem, htmlSrc: src, plainSrc: src}
+	var err error
+	if t.html, err = s.parseHTML(markdownStem+templateHTMLExt, src); err != nil {
+		return nil, err
+	}
+	if t.plain, err = s.parseText(markdownStem+templatePlainExt, src); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// renderMarkdown renders the markdownParam of data into the bodies, wrapped
+// into the layout of ref when set.
+func (s *templateSet) renderMarkdown(ref templateRef, data interface{}) (*renderedMail, error) {
+	t, err := s.withRefLayout(markdownStem, ref)
+	if err != nil {
+		return nil, err
+	}
+	out, err := t.render(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", markdownParam, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRenderMarkdown ensures Markdown bodies are converted into sanitized
+// HTML and wrapped plain text
+func TestRenderMarkdown(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		src string
+		// Expected results.
+		html  string
+		plain string
+	}{
+		{
+			"Emphasis",
+			"Здравствуйте, **Иван Петрович**!",
+			"<p>Здравствуйте, <strong>Иван Петрович</strong>!</p>\n",
+			"Здравствуйте, Иван Петрович!",
+		},
+		{
+			"Heading and list",
+			"# Счёт № 42\n\n- Услуги\n- [Оплатить](https://pay.example.org/42)\n",
+			"<h1>Счёт № 42</h1>\n<ul>\n<li>Услуги</li>\n<li><a href=\"https://pay.example.org/42\">Оплатить</a></li>\n</ul>\n",
+			"Счёт № 42\n\n* Услуги\n* Оплатить (https://pay.example.org/42)",
+		},
+		{
+			"Raw HTML",
+			"<script>alert(1)</script>\n\nТекст <b onclick=\"alert(1)\">счёта</b>",
+			"<!-- raw HTML omitted -->\n<p>Текст <!-- raw HTML omitted -->счёта<!-- raw HTML omitted --></p>\n",
+			"Текст счёта",
+		},
+		{
+			"Unsafe link",
+			"[Оплатить](javascript:alert(1))",
+			"<p><a href=\"\">Оплатить</a></p>\n",
+			"Оплатить",
+		},
+		{
+			"Table",
+			"| Товар | Сумма |\n|---|---:|\n| Услуги | 105,23 |\n",
+			"<table>\n<thead>\n<tr>\n<th>Товар</th>\n<th style=\"text-align:right\">Сумма</th>\n</tr>\n</thead>\n" +
+				"<tbody>\n<tr>\n<td>Услуги</td>\n<td style=\"text-align:right\">105,23</td>\n</tr>\n</tbody>\n</table>\n",
+			"Товар  | Сумма\nУслуги | 105,23",
+		},
+		{
+			"Wrapped paragraph",
+			"Направляем вам счёт на оплату услуг по договору № 17 от 01.09.2026,\nсрок оплаты — пять банковских дней с даты выставления счёта.",
+			"<p>Направляем вам счёт на оплату услуг по договору № 17 от 01.09.2026,\nсрок оплаты — пять банковских дней с даты выставления счёта.</p>\n",
+			"Направляем вам счёт на оплату услуг по договору № 17 от 01.09.2026, срок\n" +
+				"оплаты — пять банковских дней с даты выставления счёта.",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := renderMarkdown(tt.src)
+			if err != nil {
+				t.Fatalf("%q. renderMarkdown() error = %v", tt.name, err)
+			}
+			assert.Equal(t, tt.html, got.html, tt.name)
+			assert.Equal(t, tt.plain, got.plain, tt.name)
+			for _, l := range strings.Split(got.plain, "\n") {
+				if utf8.RuneCountInString(l) > markdownTextWidth {
+					t.Errorf("%q. renderMarkdown() line %q is longer than %d", tt.name, l, markdownTextWidth)
+				}
+			}
+		})
+	}
+}
+
+// TestTemplateSetRenderMarkdown ensures Markdown bodies are wrapped into the
+// layouts, and that the templates can use Markdown too
+func TestTemplateSetRenderMarkdown(t *testing.T) {
+	t.Parallel()
+
+	s := loadTestTemplates(t, map[string]string{
+		"_layouts/letter.html":    `<div>{{template "content" .}}</div><footer>{{.ACCOUNT_FROM_NAME}}</footer>`,
+		"_layouts/letter.txt":     "{{template \"content\" .}}\n-- \n{{.ACCOUNT_FROM_NAME}}",
+		"_layouts/letter.en.html": `<div lang="en">{{template "content" .}}</div>`,
+		"_layouts/brief.txt":      "{{template \"content\" .}}\n",
+		"notice.html":             `<h1>Уведомление</h1>{{markdown .NOTE}}`,
+		"notice.txt":              "Уведомление\n\n{{markdown .NOTE}}",
+	})
+	data := map[string]interface{}{
+		"ACCOUNT_FROM_NAME":       `ООО "Поставщик"`,
+		"SEND_MAIL_BODY_MARKDOWN": "Счёт **№ 42** во вложении",
+		"NOTE":                    "Оплатите *до 25.10.2026*",
+	}
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		ref templateRef
+		// Expected results.
+		want    *renderedMail
+		wantErr bool
+	}{
+		{
+			"No layout",
+			templateRef{},
+			&renderedMail{
+				plain: "Счёт № 42 во вложении",
+				html:  "<p>Счёт <strong>№ 42</strong> во вложении</p>\n",
+			},
+			false,
+		},
+		{
+			"Layout",
+			templateRef{layout: "letter"},
+			&renderedMail{
+				plain: "Счёт № 42 во вложении\n-- \nООО \"Поставщик\"",
+				html:  "<div><p>Счёт <strong>№ 42</strong> во вложении</p>\n</div><footer>ООО &#34;Поставщик&#34;</footer>",
+			},
+			false,
+		},
+		{
+			"Localized layout",
+			templateRef{layout: "letter", locale: "en-US"},
+			&renderedMail{
+				plain: "Счёт № 42 во вложении",
+				html:  "<div lang=\"en\"><p>Счёт <strong>№ 42</strong> во вложении</p>\n</div>",
+			},
+			false,
+		},
+		{
+			"Layout without HTML",
+			templateRef{layout: "brief"},
+			&renderedMail{
+				plain: "Счёт № 42 во вложении\n",
+				html:  "<p>Счёт <strong>№ 42</strong> во вложении</p>\n",
+			},
+			false,
+		},
+		{"Unknown layout", templateRef{layout: "memo"}, nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := s.renderMarkdown(tt.ref, data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. templateSet.renderMarkdown() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got, tt.name)
+		})
+	}
+
+	got, err := s.render(templateRef{name: "notice"}, data)
+	if err != nil {
+		t.Fatalf("templateSet.render() error = %v", err)
+	}
+	assert.Equal(t, &renderedMail{
+		plain: "Уведомление\n\nОплатите до 25.10.2026",
+		html:  "<h1>Уведомление</h1><p>Оплатите <em>до 25.10.2026</em></p>\n",
+	}, got)
+
+	if _, err := s.renderMarkdown(templateRef{}, map[string]interface{}{}); err == nil {
+		t.Errorf("templateSet.renderMarkdown() without the body error = nil, want an error")
+	}
+}
+
+// TestSendMailMarkdown ensures SEND_MAIL_BODY_MARKDOWN fills both bodies,
+// wrapped into the layout of the profile.
+//
+// Not parallel, globConf is replaced for the duration of the test.
+func TestSendMailMarkdown(t *testing.T) {
+	saved := globConf.templates
+	defer func() { globConf.templates = saved }()
+	globConf.templates = &templateStore{}
+	globConf.templates.current.Store(loadTestTemplates(t, map[string]string{
+		"_layouts/letter.html": `<div>{{template "content" .}}</div>`,
+	}))
+
+	srv := newTestSMTPServer(t)
+	defer srv.Close()
+
+	info := srv.info()
+	info.Layout = "letter"
+	settings := map[string]SMTPInfo{"notify_mail": info}
+	prop := map[string]string{
+		"SEND_MAIL_FROM":          "notify_mail",
+		"SEND_MAIL_TO":            "first@example.org",
+		"SEND_MAIL_SUBJECT":       "Счёт 42",
+		"SEND_MAIL_BODY_MARKDOWN": "Счёт **№ 42** во вложении",
+	}
+	assert.True(t, sendMail(&settings, &prop))
+
+	prop["SEND_MAIL_LAYOUT"] = noLayout
+	prop["SEND_MAIL_BODY_PLAIN"] = "Счёт во вложении"
+	assert.True(t, sendMail(&settings, &prop))
+
+	delete(prop, "SEND_MAIL_LAYOUT")
+	globConf.templates = nil
+	assert.False(t, sendMail(&settings, &prop))
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if assert.Equal(t, 2, len(srv.messages)) {
+		for i, want := range []renderedMail{
+			{plain: "Счёт № 42 во вложении", html: "<div><p>Счёт <strong>№ 42</strong> во вложении</p>\n</div>"},
+			{plain: "Счёт во вложении", html: "<p>Счёт <strong>№ 42</strong> во вложении</p>\n"},
+		} {
+			msg, err := ParseMail(&SMTPInfo{}, strings.NewReader(srv.messages[i]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, want.plain, msg.plain.String(), "message #%d", i)
+			assert.Equal(t, want.html, msg.html.String(), "message #%d", i)
+		}
+	}
+}
@@ -6,8 +6,12 @@ import (
 	"fmt"
 	"io"
 	"mime/multipart"
-	"mime/quotedprintable"
+	netmail "net/mail"
 	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 func (m *MailYak) buildMime() (*bytes.Buffer, error) {
@@ -43,121 +47,447 @@ func randomBoundary() (string, error) {
 func (m *MailYak) buildMimeWithBoundaries(mb, ab string) (*bytes.Buffer, error) {
 	var buf bytes.Buffer
 
-	if err := m.writeHeaders(&buf); err != nil {
+	if err := m.writeMessage(&buf, mb, ab); err != nil {
 		return nil, err
 	}
 
-	// Start our multipart/mixed part
-	mixed := multipart.NewWriter(&buf)
-	if err := mixed.SetBoundary(mb); err != nil {
-		return nil, err
+	return &buf, nil
+}
+
+// WriteTo streams the MIME message to w, satisfying the io.WriterTo interface.
+//
+// Unlike MimeBuf, the message is never held in memory as a whole: headers,
+// bodies and base64 encoded attachments are written to w as they are
+// generated, so w is typically the SMTP DATA writer.
+func (m *MailYak) WriteTo(w io.Writer) (int64, error) {
+	mb, err := randomBoundary()
+	if err != nil {
+		return 0, err
 	}
-	defer mixed.Close()
 
-	fmt.Fprintf(&buf, "Content-Type: multipart/mixed;\r\n\tboundary=\"%s\"; charset=UTF-8\r\n\r\n", mixed.Boundary())
+	ab, err := randomBoundary()
+	if err != nil {
+		return 0, err
+	}
 
-	ctype := fmt.Sprintf("multipart/alternative;\r\n\tboundary=\"%s\"", ab)
+	cw := &countingWriter{w: w}
+	err = m.writeMessage(cw, mb, ab)
+	return cw.n, err
+}
 
-	altPart, err := mixed.CreatePart(textproto.MIMEHeader{"Content-Type": {ctype}})
-	if err != nil {
-		return nil, err
+// writeMessage writes the final message to w, wrapping its entity with
+// S/MIME or OpenPGP and signing it when a DKIM signer is configured.
+//
+// Signing needs the body hash before the headers are written, so the message
+// is generated twice: once into the DKIM signer and once into w. Attachments are
+// re-opened for the second pass (see AttachmentSource).
+func (m *MailYak) writeMessage(w io.Writer, mb, ab string) error {
+	// Both passes must carry the same Date
+	m.sentAt = time.Now()
+
+	// Nobody should see, or reply to, an address that never got the message
+	m.skipped = nil
+	if m.pgp != nil {
+		var err error
+		if m.skipped, err = m.pgp.skippedRecipients(m.recipientAddrs()); err != nil {
+			return err
+		}
 	}
 
-	if err := m.writeBody(altPart, ab); err != nil {
-		return nil, err
+	if err := m.embedHTMLImages(); err != nil {
+		return err
+	}
+
+	w = &lineLimitWriter{w: w}
+	entity := func(w io.Writer) error {
+		return m.writeEntity(w, mb, ab)
+	}
+
+	if m.smime != nil || m.pgp != nil {
+		// Signing and encryption need the whole entity, and their output
+		// differs on every run, so it is built once and reused by both passes
+		wrapped, err := m.wrappedEntity(mb, ab)
+		if err != nil {
+			return err
+		}
+		entity = func(w io.Writer) error {
+			_, err := w.Write(wrapped)
+			return err
+		}
+	}
+
+	if m.dkim != nil {
+		sig, err := m.dkim.signature(func(h io.Writer) error {
+			if err := m.writeHeaders(h); err != nil {
+				return err
+			}
+			return entity(&lineLimitWriter{w: h})
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, sig); err != nil {
+			return err
+		}
 	}
 
-	if err := m.writeAttachments(mixed, lineSplitterBuilder{}); err != nil {
+	if err := m.writeHeaders(w); err != nil {
+		return err
+	}
+	return entity(w)
+}
+
+// wrappedEntity returns the MIME entity in canonical form, signed and/or
+// encrypted with S/MIME and OpenPGP as configured.
+func (m *MailYak) wrappedEntity(mb, ab string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := m.writeEntity(&buf, mb, ab); err != nil {
 		return nil, err
 	}
 
-	return &buf, nil
+	entity := canonicalCRLF(buf.Bytes())
+	recipients := m.recipientAddrs()
+	var err error
+	if m.smime != nil {
+		if entity, err = m.smime.wrap(entity, recipients); err != nil {
+			return nil, err
+		}
+	}
+	if m.pgp != nil {
+		if entity, err = m.pgp.wrap(entity, recipients); err != nil {
+			return nil, err
+		}
+	}
+	return entity, nil
 }
 
-// writeHeaders writes the Mime-Version, Date, Reply-To, From, To and Subject headers,
-// plus any custom headers set via AddHeader().
-func (m *MailYak) writeHeaders(buf io.Writer) error {
+// recipientAddrs returns the bare addresses of all To, CC and BCC recipients.
+func (m *MailYak) recipientAddrs() []string {
+	var addrs []string
+	for _, list := range [][]string{m.toAddrs, m.ccAddrs, m.bccAddrs} {
+		for _, a := range list {
+			if parsed, err := netmail.ParseAddress(a); err == nil {
+				a = parsed.Address
+			}
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// canonicalCRLF converts bare LF line endings to CRLF, as signatures are
+// computed over the canonical form of an entity.
+func canonicalCRLF(b []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(b))
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			out.Write(b)
+			break
+		}
+		if i > 0 && b[i-1] == '\r' {
+			out.Write(b[:i+1])
+		} else {
+			out.Write(b[:i])
+			out.Write(crlf)
+		}
+		b = b[i+1:]
+	}
+	return out.Bytes()
+}
+
+// writeEntity writes the multipart/mixed entity of the message, from its
+// Content-Type header on.
+func (m *MailYak) writeEntity(w io.Writer, mb, ab string) error {
+	parts, err := m.bodyParts()
+	if err != nil {
+		return err
+	}
+
+	// Start our multipart/mixed part
+	mixed := multipart.NewWriter(w)
+	if err := mixed.SetBoundary(mb); err != nil {
+		return err
+	}
+
+	// Multiparts holding 8bit parts are labelled 8bit (RFC 2045, section 6.4)
+	var cte string
+	altHeader := textproto.MIMEHeader{"Content-Type": {fmt.Sprintf("multipart/alternative;\r\n\tboundary=\"%s\"", ab)}}
+	for _, p := range parts {
+		if p.encoding == encoding8bit {
+			cte = "Content-Transfer-Encoding: 8bit\r\n"
+			altHeader.Set("Content-Transfer-Encoding", encoding8bit)
+		}
+	}
+
+	fmt.Fprintf(w, "Content-Type: multipart/mixed;\r\n\tboundary=\"%s\"; charset=%s\r\n%s\r\n", mixed.Boundary(), m.charsetName(), cte)
 
-	if _, err := buf.Write([]byte(m.fromHeader())); err != nil {
+	altPart, err := mixed.CreatePart(altHeader)
+	if err != nil {
 		return err
 	}
 
-	if _, err := buf.Write([]byte("Mime-Version: 1.0\r\n")); err != nil {
+	if err := writeParts(altPart, ab, parts); err != nil {
 		return err
 	}
 
-	fmt.Fprintf(buf, "Date: %s\r\n", m.date)
+	if err := m.writeAttachments(mixed, lineSplitterBuilder{maxLen: maxBase64LineLen}); err != nil {
+		return err
+	}
+
+	// Some clients only look for the invitation in the attachments
+	if len(m.ics) > 0 {
+		invite := attachment{filename: "invite.ics", content: BytesSource(m.ics), mimeType: "application/ics"}
+		if err := writeAttachment(mixed, lineSplitterBuilder{maxLen: maxBase64LineLen}, invite, "", make([]byte, sniffLen)); err != nil {
+			return err
+		}
+	}
+
+	return mixed.Close()
+}
+
+// countingWriter passes writes through to w, counting the bytes written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeHeaders writes the Mime-Version, Date, Reply-To, From, To and Subject headers,
+// plus any custom headers set via AddHeader(). Recipients skipped for lack of a
+// PGP key are left out.
+//
+// Long header fields are folded, see foldHeader.
+func (m *MailYak) writeHeaders(buf io.Writer) error {
+	var err error
+	write := func(name, value string) {
+		if err != nil {
+			return
+		}
+		// Encoded words are written in UTF-8 by the setters
+		if m.charset != nil {
+			if value, err = m.charset.recodeWords(value, name); err != nil {
+				return
+			}
+			if !isASCII(value) {
+				err = fmt.Errorf("%s: text out of ASCII is not encoded in charset %s", name, m.charset.name)
+				return
+			}
+		}
+		var field string
+		if field, err = foldHeader(name, value); err == nil {
+			_, err = io.WriteString(buf, field)
+		}
+	}
+
+	write("From", m.fromValue())
+	write("Mime-Version", "1.0")
+	write("Date", m.dateValue())
 
 	if m.replyTo != "" {
-		fmt.Fprintf(buf, "Reply-To: %s\r\n", m.replyTo)
+		write("Reply-To", addressValue(m.replyTo))
 	}
 
-	fmt.Fprintf(buf, "Subject: %s\r\n", m.subject)
+	write("Subject", m.subject)
 
 	for _, to := range m.toAddrs {
-		fmt.Fprintf(buf, "To: %s\r\n", to)
+		if !isSkipped(to, m.skipped) {
+			write("To", addressValue(to))
+		}
 	}
 
 	for _, cc := range m.ccAddrs {
-		fmt.Fprintf(buf, "CC: %s\r\n", cc)
+		if !isSkipped(cc, m.skipped) {
+			write("CC", addressValue(cc))
+		}
 	}
 
 	if m.writeBccHeader {
 		for _, bcc := range m.bccAddrs {
-			fmt.Fprintf(buf, "BCC: %s\r\n", bcc)
+			if !isSkipped(bcc, m.skipped) {
+				write("BCC", addressValue(bcc))
+			}
 		}
 	}
 
-	for k, v := range m.headers {
-		fmt.Fprintf(buf, "%s: %s\r\n", k, v)
+	for _, k := range m.headerNames() {
+		write(k, m.headers[k])
 	}
 
-	return nil
+	return err
+}
+
+// headerNames returns the names of the custom headers in a stable order.
+func (m *MailYak) headerNames() []string {
+	names := make([]string, 0, len(m.headers))
+	for k := range m.headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
 }
 
 // fromHeader returns a correctly formatted From header, optionally with a name
 // component.
 func (m *MailYak) fromHeader() string {
+	return "From: " + m.fromValue() + "\r\n"
+}
+
+// fromValue returns the value of the From header.
+func (m *MailYak) fromValue() string {
 	if m.fromName == "" {
-		return fmt.Sprintf("From: %s\r\n", m.fromAddr)
+		return m.fromAddr
 	}
 
-	return fmt.Sprintf("From: %s <%s>\r\n", m.fromName, m.fromAddr)
+	return fmt.Sprintf("%s <%s>", m.fromName, m.fromAddr)
 }
 
-// writeBody writes the text/plain and text/html mime parts.
-func (m *MailYak) writeBody(w io.Writer, boundary string) error {
-	alt := multipart.NewWriter(w)
-	defer alt.Close()
+// addressValue returns the value of an address header with the display names
+// encoded as words, To() and friends take them raw. Values failing to parse
+// are returned unchanged.
+func addressValue(value string) string {
+	if isASCII(value) {
+		return value
+	}
+	list, err := addressParser.ParseList(value)
+	if err != nil {
+		return value
+	}
+	addrs := make([]string, len(list))
+	for i, a := range list {
+		addrs[i] = a.String()
+		if !isASCII(a.Name) {
+			addrs[i] = wordEncoding(a.Name).Encode("UTF-8", a.Name) + " " + (&netmail.Address{Address: a.Address}).String()
+		}
+	}
+	return strings.Join(addrs, ", ")
+}
 
-	if err := alt.SetBoundary(boundary); err != nil {
+// isASCII reports whether s holds only ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// dateValue returns the value of the Date header: the date set with Date, or
+// the time the message was built at in the time zone of the message.
+func (m *MailYak) dateValue() string {
+	if m.date != "" {
+		return m.date
+	}
+	t := m.sentAt
+	if t.IsZero() {
+		t = time.Now()
+	}
+	if m.location != nil {
+		t = t.In(m.location)
+	}
+	return t.Format(time.RFC1123Z)
+}
+
+// bodyPart is a text/plain, text/html or text/calendar alternative.
+type bodyPart struct {
+	ctype    string
+	charset  string
+	data     []byte
+	encoding string
+}
+
+// writeBody writes the text/plain, text/html and text/calendar mime parts.
+func (m *MailYak) writeBody(w io.Writer, boundary string) error {
+	parts, err := m.bodyParts()
+	if err != nil {
 		return err
 	}
+	return writeParts(w, boundary, parts)
+}
 
-	var err error
-	writePart := func(ctype string, data []byte) {
-		if len(data) == 0 || err != nil {
-			return
+// bodyParts returns the non-empty alternatives of the body with their
+// transfer encoding.
+//
+// The text/plain and text/html parts are transcoded into the charset of the
+// message, text/calendar is always UTF-8 (RFC 5545).
+//
+// When only the HTML body is set and autoPlainText is enabled, the text/plain
+// part is derived from the HTML. With inlineStyles enabled, the stylesheet of
+// the HTML body is inlined before encoding.
+//
+// The cid: URLs of the HTML body name the inline attachments, they are pointed
+// at their Content-ID.
+func (m *MailYak) bodyParts() ([]bodyPart, error) {
+	plain := m.plain.Bytes()
+	if len(plain) == 0 && m.autoPlainText && m.html.Len() > 0 {
+		text, err := htmlToText(m.html.Bytes())
+		if err != nil {
+			return nil, err
 		}
+		plain = []byte(text)
+	}
 
-		c := fmt.Sprintf("%s; charset=UTF-8", ctype)
+	html := m.html.Bytes()
+	if m.inlineStyles && len(html) > 0 {
+		var err error
+		if html, err = inlineCSS(html); err != nil {
+			return nil, err
+		}
+	}
+	if len(html) > 0 {
+		html = m.withContentIDs(html)
+	}
 
-		var part io.Writer
-		part, err = alt.CreatePart(textproto.MIMEHeader{"Content-Type": {c}, "Content-Transfer-Encoding": {"quoted-printable"}})
-		if err != nil {
-			return
+	// Signed content must survive relays without 8BITMIME (RFC 8551, RFC 3156)
+	allow8bit := m.allow8bit && m.smime == nil && m.pgp == nil
+
+	var parts []bodyPart
+	for _, p := range []bodyPart{
+		{ctype: "text/plain", charset: m.charsetName(), data: plain},
+		{ctype: "text/html", charset: m.charsetName(), data: html},
+		{ctype: "text/calendar; method=" + m.icsMethod, charset: "UTF-8", data: m.ics},
+	} {
+		if len(p.data) == 0 {
+			continue
+		}
+		if m.charset != nil && p.charset == m.charset.name {
+			var err error
+			if p.data, err = m.charset.encode(p.data, p.ctype+" body"); err != nil {
+				return nil, err
+			}
 		}
+		p.encoding = bodyEncoding(p.data, allow8bit)
+		parts = append(parts, p)
+	}
+	return parts, nil
+}
 
-		var buf bytes.Buffer
-		qpw := quotedprintable.NewWriter(&buf)
-		_, err = qpw.Write(data)
-		qpw.Close()
+// writeParts writes parts as a multipart/alternative body using boundary.
+func writeParts(w io.Writer, boundary string, parts []bodyPart) error {
+	alt := multipart.NewWriter(w)
 
-		_, err = part.Write(buf.Bytes())
+	if err := alt.SetBoundary(boundary); err != nil {
+		return err
 	}
 
-	writePart("text/plain", m.plain.Bytes())
-	writePart("text/html", m.html.Bytes())
+	for _, p := range parts {
+		c := fmt.Sprintf("%s; charset=%s", p.ctype, p.charset)
 
-	return err
+		part, err := alt.CreatePart(textproto.MIMEHeader{"Content-Type": {c}, "Content-Transfer-Encoding": {p.encoding}})
+		if err != nil {
+			return err
+		}
+		if err := writeEncoded(part, p.encoding, p.data); err != nil {
+			return err
+		}
+	}
+
+	return alt.Close()
 }
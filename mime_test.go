@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"mime/multipart"
+	netmail "net/mail"
 	"regexp"
 	"strings"
 	"testing"
@@ -229,7 +230,7 @@ func TestMailYakWriteBody(t *testing.T) {
 			"HTML",
 			"",
 			"t",
-			"--t\r\nContent-Transfer-Encoding: quoted-printable\r\nContent-Type: text/html; charset=UTF-8\r\n\r\nHTML\r\n--t--\r\n",
+			"--t\r\nContent-Transfer-Encoding: 7bit\r\nContent-Type: text/html; charset=UTF-8\r\n\r\nHTML\r\n--t--\r\n",
 			false,
 		},
 		{
@@ -237,7 +238,7 @@ func TestMailYakWriteBody(t *testing.T) {
 			"",
 			"Plain",
 			"t",
-			"--t\r\nContent-Transfer-Encoding: quoted-printable\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\nPlain\r\n--t--\r\n",
+			"--t\r\nContent-Transfer-Encoding: 7bit\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\nPlain\r\n--t--\r\n",
 			false,
 		},
 		{
@@ -245,7 +246,7 @@ func TestMailYakWriteBody(t *testing.T) {
 			"HTML",
 			"Plain",
 			"t",
-			"--t\r\nContent-Transfer-Encoding: quoted-printable\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\nPlain\r\n--t\r\nContent-Transfer-Encoding: quoted-printable\r\nContent-Type: text/html; charset=UTF-8\r\n\r\nHTML\r\n--t--\r\n",
+			"--t\r\nContent-Transfer-Encoding: 7bit\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\nPlain\r\n--t\r\nContent-Transfer-Encoding: 7bit\r\nContent-Type: text/html; charset=UTF-8\r\n\r\nHTML\r\n--t--\r\n",
 			false,
 		},
 		{
@@ -278,6 +279,64 @@ func TestMailYakWriteBody(t *testing.T) {
 	}
 }
 
+// TestMailYakWriteBody_autoPlainText ensures the plain-text part is derived
+// from HTML only when enabled and no plain body is set
+func TestMailYakWriteBody_autoPlainText(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Receiver fields.
+		rHTML      string
+		rPlain     string
+		rAutoPlain bool
+		// Expected results.
+		wantW string
+	}{
+		{
+			"Derived",
+			"<p>Hello <a href=\"https://example.org\">there</a></p>",
+			"",
+			true,
+			"--t\r\nContent-Transfer-Encoding: 7bit\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\nHello there (https://example.org)\r\n--t\r\nContent-Transfer-Encoding: 7bit\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n<p>Hello <a href=\"https://example.org\">there</a></p>\r\n--t--\r\n",
+		},
+		{
+			"Plain body wins",
+			"<p>HTML</p>",
+			"Plain",
+			true,
+			"--t\r\nContent-Transfer-Encoding: 7bit\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\nPlain\r\n--t\r\nContent-Transfer-Encoding: 7bit\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n<p>HTML</p>\r\n--t--\r\n",
+		},
+		{
+			"Disabled",
+			"<p>HTML</p>",
+			"",
+			false,
+			"--t\r\nContent-Transfer-Encoding: 7bit\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n<p>HTML</p>\r\n--t--\r\n",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			m := MailYak{autoPlainText: tt.rAutoPlain}
+			m.HTML().WriteString(tt.rHTML)
+			m.Plain().WriteString(tt.rPlain)
+
+			w := &bytes.Buffer{}
+			if err := m.writeBody(w, "t"); err != nil {
+				t.Fatalf("%q. MailYak.writeBody() error = %v", tt.name, err)
+			}
+
+			if gotW := w.String(); gotW != tt.wantW {
+				t.Errorf("%q. MailYak.writeBody() = %q, want %q", tt.name, gotW, tt.wantW)
+			}
+		})
+	}
+}
+
 // TestMailYakBuildMime tests all the other mime-related bits combine in a sane way
 func TestMailYakBuildMime(t *testing.T) {
 	t.Parallel()
@@ -319,7 +378,7 @@ func TestMailYakBuildMime(t *testing.T) {
 			"",
 			"",
 			"",
-			"From: \r\nMime-Version: 1.0\r\nDate: " + now + "\r\nSubject: \r\nTo: \r\nContent-Type: multipart/mixed;\r\n\tboundary=\"mixed\"; charset=UTF-8\r\n\r\n--mixed\r\nContent-Type: multipart/alternative;\r\n\tboundary=\"alt\"\r\n\r\n--alt\r\nContent-Transfer-Encoding: quoted-printable\r\nContent-Type: text/html; charset=UTF-8\r\n\r\nHTML\r\n--alt--\r\n\r\n--mixed--\r\n",
+			"From: \r\nMime-Version: 1.0\r\nDate: " + now + "\r\nSubject: \r\nTo: \r\nContent-Type: multipart/mixed;\r\n\tboundary=\"mixed\"; charset=UTF-8\r\n\r\n--mixed\r\nContent-Type: multipart/alternative;\r\n\tboundary=\"alt\"\r\n\r\n--alt\r\nContent-Transfer-Encoding: 7bit\r\nContent-Type: text/html; charset=UTF-8\r\n\r\nHTML\r\n--alt--\r\n\r\n--mixed--\r\n",
 			false,
 		},
 		{
@@ -331,7 +390,7 @@ func TestMailYakBuildMime(t *testing.T) {
 			"",
 			"",
 			"",
-			"From: \r\nMime-Version: 1.0\r\nDate: " + now + "\r\nSubject: \r\nTo: \r\nContent-Type: multipart/mixed;\r\n\tboundary=\"mixed\"; charset=UTF-8\r\n\r\n--mixed\r\nContent-Type: multipart/alternative;\r\n\tboundary=\"alt\"\r\n\r\n--alt\r\nContent-Transfer-Encoding: quoted-printable\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\nPlain\r\n--alt--\r\n\r\n--mixed--\r\n",
+			"From: \r\nMime-Version: 1.0\r\nDate: " + now + "\r\nSubject: \r\nTo: \r\nContent-Type: multipart/mixed;\r\n\tboundary=\"mixed\"; charset=UTF-8\r\n\r\n--mixed\r\nContent-Type: multipart/alternative;\r\n\tboundary=\"alt\"\r\n\r\n--alt\r\nContent-Transfer-Encoding: 7bit\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\nPlain\r\n--alt--\r\n\r\n--mixed--\r\n",
 			false,
 		},
 		{
@@ -482,7 +541,7 @@ func TestMailYakBuildMime_withAttachments(t *testing.T) {
 			"",
 			"",
 			[]attachment{
-				{"test.txt", strings.NewReader("content"), false, ""},
+				{"test.txt", BytesSource("content"), false, ""},
 			},
 			[]string{"Y29udGVudA=="},
 			false,
@@ -497,7 +556,7 @@ func TestMailYakBuildMime_withAttachments(t *testing.T) {
 			"",
 			"",
 			[]attachment{
-				{"test.txt", strings.NewReader("content"), true, ""},
+				{"test.txt", BytesSource("content"), true, ""},
 			},
 			[]string{"Y29udGVudA=="},
 			false,
@@ -512,8 +571,8 @@ func TestMailYakBuildMime_withAttachments(t *testing.T) {
 			"",
 			"",
 			[]attachment{
-				{"test.txt", strings.NewReader("content"), false, ""},
-				{"another.txt", strings.NewReader("another"), false, ""},
+				{"test.txt", BytesSource("content"), false, ""},
+				{"another.txt", BytesSource("another"), false, ""},
 			},
 			[]string{"Y29udGVudA==", "YW5vdGhlcg=="},
 			false,
@@ -528,8 +587,8 @@ func TestMailYakBuildMime_withAttachments(t *testing.T) {
 			"",
 			"",
 			[]attachment{
-				{"test.txt", strings.NewReader("content"), true, ""},
-				{"another.txt", strings.NewReader("another"), true, ""},
+				{"test.txt", BytesSource("content"), true, ""},
+				{"another.txt", BytesSource("another"), true, ""},
 			},
 			[]string{"Y29udGVudA==", "YW5vdGhlcg=="},
 			false,
@@ -615,3 +674,145 @@ func TestMailYakBuildMime_withAttachments(t *testing.T) {
 		})
 	}
 }
+
+// TestMailYakWriteTo ensures the streamed message matches the buffered one
+func TestMailYakWriteTo(t *testing.T) {
+	t.Parallel()
+
+	m := &MailYak{
+		toAddrs:   []string{"to@itsallbroken.com"},
+		subject:   "Streaming",
+		fromAddr:  "from@itsallbroken.com",
+		trimRegex: regexp.MustCompile("\r?\n"),
+		date:      time.Now().Format(time.RFC1123Z),
+	}
+	m.HTML().Set("<b>HTML</b>")
+	m.Plain().Set("Plain")
+	m.Attach("first.txt", strings.NewReader(strings.Repeat("first attachment ", 100)))
+
+	var got bytes.Buffer
+	n, err := m.WriteTo(&got)
+	if err != nil {
+		t.Fatalf("MailYak.WriteTo() error = %v", err)
+	}
+	if n != int64(got.Len()) {
+		t.Errorf("MailYak.WriteTo() n = %v, wrote %v bytes", n, got.Len())
+	}
+
+	// Rebuild using the boundaries chosen by WriteTo
+	re := regexp.MustCompile(`boundary="([0-9a-f]+)"`)
+	bounds := re.FindAllStringSubmatch(got.String(), -1)
+	if len(bounds) != 2 {
+		t.Fatalf("MailYak.WriteTo() boundaries = %v, want 2", bounds)
+	}
+
+	want, err := m.buildMimeWithBoundaries(bounds[0][1], bounds[1][1])
+	if err != nil {
+		t.Fatalf("MailYak.buildMimeWithBoundaries() error = %v", err)
+	}
+
+	if got.String() != want.String() {
+		t.Errorf("MailYak.WriteTo() = %v, want %v", got.String(), want.String())
+	}
+}
+
+// patternReader produces n bytes of repeating data without holding them in
+// memory.
+type patternReader struct {
+	n int64
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = byte('a' + i%26)
+	}
+	r.n -= int64(len(p))
+	return len(p), nil
+}
+
+const benchAttachmentSize = 16 << 20
+
+func benchmarkMail() *MailYak {
+	m := &MailYak{
+		toAddrs:   []string{"to@itsallbroken.com"},
+		subject:   "Benchmark",
+		fromAddr:  "from@itsallbroken.com",
+		trimRegex: regexp.MustCompile("\r?\n"),
+		date:      time.Now().Format(time.RFC1123Z),
+	}
+	m.HTML().Set("<b>Invoice in attachment</b>")
+	m.Attach("large.bin", &patternReader{n: benchAttachmentSize})
+	return m
+}
+
+// BenchmarkMailYakWriteTo streams a message with a large attachment; the
+// allocated bytes per op stay constant regardless of the attachment size.
+func BenchmarkMailYakWriteTo(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(benchAttachmentSize)
+
+	for i := 0; i < b.N; i++ {
+		m := benchmarkMail()
+		if _, err := m.WriteTo(ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkMailYakMimeBuf builds the same message in memory for comparison.
+func BenchmarkMailYakMimeBuf(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(benchAttachmentSize)
+
+	for i := 0; i < b.N; i++ {
+		m := benchmarkMail()
+		buf, err := m.MimeBuf()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := buf.WriteTo(ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestMailYakWriteTo_date ensures the Date header is stamped when the message
+// is written, not when it is created
+func TestMailYakWriteTo_date(t *testing.T) {
+	t.Parallel()
+
+	m := NewMail(&SMTPInfo{})
+	m.From("from@example.org")
+	m.To("to@example.org")
+	m.Plain().Set("Queued message")
+	m.TimeZone(time.UTC)
+
+	// A stamp left over from an earlier attempt
+	m.sentAt = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatalf("MailYak.WriteTo() error = %v", err)
+	}
+
+	msg, err := netmail.ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date, err := msg.Header.Date()
+	if err != nil {
+		t.Fatalf("Date header: %v", err)
+	}
+	if time.Since(date) > time.Minute {
+		t.Errorf("Date = %v, want the time of writing", date)
+	}
+	if _, offset := date.Zone(); offset != 0 {
+		t.Errorf("Date offset = %d, want 0", offset)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// skippedHeaders are not restored by ParseMail: they are either rebuilt when
+// the message is written, or describe a delivery that already happened.
+var skippedHeaders = map[string]bool{
+	"From":                      true,
+	"To":                        true,
+	"Cc":                        true,
+	"Bcc":                       true,
+	"Reply-To":                  true,
+	"Subject":                   true,
+	"Date":                      true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+	"Content-Disposition":       true,
+	"Content-Id":                true,
+	"Dkim-Signature":            true,
+	"Received":                  true,
+	"Return-Path":               true,
+}
+
+// headerDecoder decodes RFC 2047 encoded words.
+var headerDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// addressParser decodes the display names of addresses like headerDecoder.
+var addressParser = &netmail.AddressParser{WordDecoder: headerDecoder}
+
+// ParseMail reads an RFC 5322 message, such as an archived .eml file, into a
+// new MailYak using the SMTP profile info.
+//
+// The addresses, subject, date and custom headers, the plain, HTML and
+// calendar bodies, the attachments and the inline attachments are restored,
+// the latter named by filename as when attached, the HTML body following.
+// Signature parts of signed messages are dropped, encrypted messages are not
+// supported.
+func ParseMail(info *SMTPInfo, r io.Reader) (*MailYak, error) {
+	msg, err := netmail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+
+	// Parsing never touches the network, Send connects
+	m := newMail(info)
+	if err := m.parseHeaders(msg.Header); err != nil {
+		return nil, err
+	}
+
+	names := map[string]string{}
+	if err := m.parsePart(textproto.MIMEHeader(msg.Header), msg.Body, names); err != nil {
+		return nil, err
+	}
+	// Sending points the cid: URLs at the Content-IDs again
+	if m.html.Len() > 0 && len(names) > 0 {
+		m.html.Set(string(replaceContentIDs(m.html.Bytes(), names)))
+	}
+	return m, nil
+}
+
+// parseHeaders restores the addresses, subject, date and custom headers.
+func (m *MailYak) parseHeaders(h netmail.Header) error {
+	if from := h.Get("From"); from != "" {
+		addr, err := addressParser.Parse(from)
+		if err != nil {
+			return fmt.Errorf("parse: From: %v", err)
+		}
+		m.From(addr.Address)
+		m.FromName(addr.Name)
+	}
+
+	for _, field := range []struct {
+		name string
+		set  func(...string)
+	}{
+		{"To", m.To},
+		{"Cc", m.Cc},
+		{"Bcc", m.Bcc},
+	} {
+		addrs, err := parseAddressHeaders(h[field.name])
+		if err != nil {
+			return fmt.Errorf("parse: %s: %v", field.name, err)
+		}
+		field.set(addrs...)
+	}
+
+	if replyTo := h.Get("Reply-To"); replyTo != "" {
+		m.ReplyTo(replyTo)
+	}
+
+	subject, err := headerDecoder.DecodeHeader(h.Get("Subject"))
+	if err != nil {
+		return fmt.Errorf("parse: Subject: %v", err)
+	}
+	m.Subject(subject)
+
+	if date := h.Get("Date"); date != "" {
+		m.date = date
+	}
+
+	for name, values := range h {
+		if skippedHeaders[name] || len(values) == 0 {
+			continue
+		}
+		value, err := headerDecoder.DecodeHeader(values[0])
+		if err != nil {
+			return fmt.Errorf("parse: %s: %v", name, err)
+		}
+		m.AddHeader(name, value)
+	}
+	return nil
+}
+
+// parseAddressHeaders returns the addresses of the To, Cc or Bcc header
+// fields, one per entry, splitting address lists.
+func parseAddressHeaders(values []string) ([]string, error) {
+	var addrs []string
+	for _, v := range values {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		list, err := addressParser.ParseList(v)
+		if err != nil {
+			return nil, err
+		}
+		if len(list) == 1 {
+			// Kept as written, like the values given to To() and friends
+			addrs = append(addrs, strings.TrimSpace(v))
+			continue
+		}
+		for _, a := range list {
+			addrs = append(addrs, a.String())
+		}
+	}
+	return addrs, nil
+}
+
+// parsePart restores the body parts and attachments of the entity with
+// header h and body r, descending into multiparts. The names given to the
+// inline attachments are added to names by Content-ID.
+func (m *MailYak) parsePart(h textproto.MIMEHeader, r io.Reader, names map[string]string) error {
+	ctype := h.Get("Content-Type")
+	if ctype == "" {
+		ctype = "text/plain; charset=us-ascii"
+	}
+	mediaType, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return fmt.Errorf("parse: Content-Type %q: %v", ctype, err)
+	}
+
+	switch {
+	case mediaType == "multipart/encrypted" || mediaType == "application/pkcs7-mime":
+		return fmt.Errorf("parse: encrypted messages are not supported")
+
+	case mediaType == "application/pgp-signature" || mediaType == "application/pkcs7-signature":
+		// Signature of a multipart/signed entity, invalid once rebuilt
+		return nil
+
+	case strings.HasPrefix(mediaType, "multipart/"):
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("parse: %s: %v", mediaType, err)
+			}
+			if err := m.parsePart(p.Header, p, names); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := ioutil.ReadAll(decodeTransfer(h.Get("Content-Transfer-Encoding"), r))
+	if err != nil {
+		return fmt.Errorf("parse: %s: %v", mediaType, err)
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	filename := partFilename(dparams["filename"], params["name"])
+
+	if disposition != "attachment" && filename == "" {
+		switch mediaType {
+		case "text/plain", "text/html":
+			text, err := decodeCharset(params["charset"], data)
+			if err != nil {
+				return err
+			}
+			text = bytes.Replace(text, []byte("\r\n"), []byte("\n"), -1)
+			if mediaType == "text/plain" {
+				m.plain.Reset()
+				m.plain.Write(text)
+			} else {
+				m.html.Reset()
+				m.html.Write(text)
+			}
+			return nil
+
+		case "text/calendar":
+			m.ics = data
+			m.icsMethod = strings.ToUpper(params["method"])
+			if m.icsMethod == "" {
+				m.icsMethod = CalendarRequest
+			}
+			return nil
+		}
+	}
+
+	// The invitation is also attached when the message is written
+	if mediaType == "application/ics" && len(m.ics) > 0 {
+		return nil
+	}
+
+	cid := strings.Trim(h.Get("Content-ID"), "<>")
+	if disposition == "inline" || (disposition == "" && cid != "") {
+		// Named by their filename, as when attached, unless taken; the HTML
+		// body refers to them by Content-ID until renamed by ParseMail
+		name := filename
+		if name == "" || m.hasInline(name) {
+			name = cid
+		}
+		if cid != "" {
+			names[cid] = name
+		}
+		m.AttachInlineSourceWithMimeType(name, BytesSource(data), mediaType)
+		return nil
+	}
+
+	if filename == "" {
+		filename = "attachment"
+	}
+	m.AttachSourceWithMimeType(filename, BytesSource(data), mediaType)
+	return nil
+}
+
+// hasInline reports whether an inline attachment is called name.
+func (m *MailYak) hasInline(name string) bool {
+	for _, a := range m.attachments {
+		if a.inline && a.filename == name {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeTransfer returns a reader decoding r according to the
+// Content-Transfer-Encoding value cte.
+//
+// multipart.Reader already decodes quoted-printable parts and removes the
+// header.
+func decodeTransfer(cte string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case encodingBase64:
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case encodingQuotedPrintable:
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// partFilename returns the filename of a part from the Content-Disposition
+// filename or the Content-Type name parameter.
+//
+// RFC 2231 parameters are decoded by mime.ParseMediaType, RFC 2047 encoded
+// words (used by many clients despite RFC 2047, section 5) are decoded here.
+func partFilename(names ...string) string {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if decoded, err := headerDecoder.DecodeHeader(name); err == nil {
+			return decoded
+		}
+		return name
+	}
+	return ""
+}
+
+// decodeCharset returns the text in data, encoded in charset, as UTF-8.
+func decodeCharset(charset string, data []byte) ([]byte, error) {
+	r, err := charsetReader(charset, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseMailRoundTrip ensures parsing the output of buildMime restores the
+// message, so that it is rebuilt byte for byte
+func TestParseMailRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		build func(m *MailYak)
+	}{
+		{
+			"Plain",
+			func(m *MailYak) {
+				m.Plain().Set("Invoice in attachment\nRegards")
+			},
+		},
+		{
+			"Cyrillic HTML with derived text",
+			func(m *MailYak) {
+				m.FromName("Отдел продаж")
+				m.Subject("Счёт на оплату № 12 от 1 марта — " + strings.Repeat("длинная тема ", 5))
+				m.HTML().Set("<p>Счёт на оплату <b>№ 12</b></p>")
+			},
+		},
+		{
+			"Long lines",
+			func(m *MailYak) {
+				m.Plain().Set(strings.Repeat("Lorem ipsum dolor sit amet, consectetur = adipiscing elit ", 10))
+			},
+		},
+		{
+			"Attachments",
+			func(m *MailYak) {
+				m.Cc("accounting@example.net")
+				m.ReplyTo("sales@example.org")
+				m.AddHeader("X-Process", "Оплата счёта")
+				m.Plain().Set("Plain")
+				m.HTML().Set(`<p>HTML <img src="cid:logo.png"></p>`)
+				m.AttachSourceWithMimeType("счёт №12.pdf", BytesSource("%PDF-1.4 invoice"), "application/pdf")
+				m.AttachInlineSourceWithMimeType("logo.png", BytesSource(bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 100)), "image/png")
+			},
+		},
+		{
+			"Calendar",
+			func(m *MailYak) {
+				m.Plain().Set("Meeting")
+				m.ics = []byte("BEGIN:VCALENDAR\r\nMETHOD:CANCEL\r\nEND:VCALENDAR\r\n")
+				m.icsMethod = CalendarCancel
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			m := NewMail(&SMTPInfo{})
+			m.From("invoice@example.org")
+			m.To("buyer@example.net", "Buyer Two <two@example.net>")
+			tt.build(m)
+
+			want, err := m.buildMimeWithBoundaries("mixed", "alt")
+			if err != nil {
+				t.Fatalf("%q. MailYak.buildMime() error = %v", tt.name, err)
+			}
+
+			parsed, err := ParseMail(&SMTPInfo{}, bytes.NewReader(want.Bytes()))
+			if err != nil {
+				t.Fatalf("%q. ParseMail() error = %v", tt.name, err)
+			}
+			got, err := parsed.buildMimeWithBoundaries("mixed", "alt")
+			if err != nil {
+				t.Fatalf("%q. MailYak.buildMime() of the parsed mail error = %v", tt.name, err)
+			}
+			assert.Equal(t, want.String(), got.String(), tt.name)
+		})
+	}
+}
+
+// TestParseMail ensures messages written by other clients are decoded
+func TestParseMail(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		eml string
+		// Expected results.
+		subject     string
+		plain       string
+		html        string
+		attachments []string // name:mime type:content
+		wantErr     bool
+	}{
+		{
+			"Single part, quoted-printable",
+			"From: a@example.org\r\nTo: b@example.net\r\nSubject: =?UTF-8?B?0KHRh9GR0YI=?=\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nTotal: 100 =E2=82=AC, soft=\r\n break\r\n",
+			"Счёт",
+			"Total: 100 €, soft break\n",
+			"",
+			nil,
+			false,
+		},
+		{
+			"No Content-Type",
+			"From: a@example.org\r\nSubject: Hello\r\n\r\nHello\r\n",
+			"Hello",
+			"Hello\n",
+			"",
+			nil,
+			false,
+		},
+		{
+			"Base64 alternative and RFC 2231 filename",
+			"From: =?UTF-8?Q?=D0=9E=D1=82=D0=B4=D0=B5=D0=BB?= <a@example.org>\r\nSubject: Invoice\r\nContent-Type: multipart/mixed; boundary=\"m\"\r\n\r\n" +
+				"--m\r\nContent-Type: multipart/alternative; boundary=\"a\"\r\n\r\n" +
+				"--a\r\nContent-Type: text/plain; charset=\"UTF-8\"\r\nContent-Transfer-Encoding: base64\r\n\r\n0KHRh9GR0YI=\r\n" +
+				"--a\r\nContent-Type: text/html; charset=UTF-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n<p class=3D\"x\">Hi <img src=3D\"cid:logo@example.org\"></p>\r\n--a--\r\n" +
+				"--m\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment;\r\n filename*0*=UTF-8''%D1%81%D1%87%D1%91%D1%82;\r\n filename*1=\".pdf\"\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERg==\r\n" +
+				"--m\r\nContent-Type: image/png\r\nContent-Disposition: inline; filename=\"logo.png\"\r\nContent-ID: <logo@example.org>\r\nContent-Transfer-Encoding: base64\r\n\r\niVBORw==\r\n" +
+				"--m--\r\n",
+			"Invoice",
+			"Счёт",
+			`<p class="x">Hi <img src="cid:logo.png"></p>`,
+			[]string{"счёт.pdf:application/pdf:%PDF", "logo.png:image/png:\x89PNG"},
+			false,
+		},
+		{
+			"Latin-1 body",
+			"From: a@example.org\r\nSubject: =?iso-8859-1?q?Gr=FC=DFe?=\r\nContent-Type: text/plain; charset=iso-8859-1\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nSch=F6ne Gr=FC=DFe\r\n",
+			"Grüße",
+			"Schöne Grüße\n",
+			"",
+			nil,
+			false,
+		},
+		{
+			"KOI8-U subject, ISO-8859-5 body",
+			"From: a@example.org\r\nSubject: =?koi8-u?q?=B7=D6=C1=CB_=A6_=AD=C1=D7=C1?=\r\nContent-Type: text/plain; charset=\"ISO-8859-5\"\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n=C1=E7=F1=E2 =DE=DF=DB=D0=E7=D5=DD\r\n",
+			"Їжак і ґава",
+			"Счёт оплачен\n",
+			"",
+			nil,
+			false,
+		},
+		{
+			"RFC 2047 filename",
+			"From: a@example.org\r\nSubject: Invoice\r\nContent-Type: multipart/mixed; boundary=\"m\"\r\n\r\n" +
+				"--m\r\nContent-Type: text/plain\r\n\r\nSee attachment\r\n" +
+				"--m\r\nContent-Type: text/csv; name=\"=?UTF-8?B?0YHRh9GR0YIuY3N2?=\"\r\nContent-Disposition: attachment\r\n\r\na;b\r\n" +
+				"--m--\r\n",
+			"Invoice",
+			"See attachment",
+			"",
+			[]string{"счёт.csv:text/csv:a;b"},
+			false,
+		},
+		{
+			"Signed, signature dropped",
+			"From: a@example.org\r\nSubject: Signed\r\nContent-Type: multipart/signed; protocol=\"application/pgp-signature\"; micalg=pgp-sha256; boundary=\"s\"\r\n\r\n" +
+				"--s\r\nContent-Type: text/plain\r\n\r\nSigned text\r\n" +
+				"--s\r\nContent-Type: application/pgp-signature; name=\"signature.asc\"\r\n\r\n-----BEGIN PGP SIGNATURE-----\r\n" +
+				"--s--\r\n",
+			"Signed",
+			"Signed text",
+			"",
+			nil,
+			false,
+		},
+		{
+			"Encrypted",
+			"From: a@example.org\r\nContent-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"e\"\r\n\r\n--e--\r\n",
+			"",
+			"",
+			"",
+			nil,
+			true,
+		},
+		{
+			"Unknown charset",
+			"From: a@example.org\r\nContent-Type: text/plain; charset=x-unknown\r\n\r\nHello\r\n",
+			"",
+			"",
+			"",
+			nil,
+			true,
+		},
+		{
+			"Bad From",
+			"From: <broken\r\n\r\nHello\r\n",
+			"",
+			"",
+			"",
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			m, err := ParseMail(&SMTPInfo{}, strings.NewReader(tt.eml))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. ParseMail() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			assert.Equal(t, tt.subject, decodeTestHeader(t, m.subject), tt.name)
+			assert.Equal(t, tt.plain, m.plain.String(), tt.name)
+			assert.Equal(t, tt.html, m.html.String(), tt.name)
+
+			var got []string
+			for _, a := range m.attachments {
+				r, err := a.content.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, _ := ioutil.ReadAll(r)
+				r.Close()
+				got = append(got, a.filename+":"+a.mimeType+":"+string(data))
+			}
+			assert.Equal(t, tt.attachments, got, tt.name)
+		})
+	}
+}
+
+// TestParseMailOffline ensures parsing never connects to the server of the
+// profile, even one with TLS from the very beginning
+func TestParseMailOffline(t *testing.T) {
+	t.Parallel()
+
+	// A port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	info := SMTPInfo{ConnectStr: addr, Address: "127.0.0.1", EnableTLS: true}
+	info.expand()
+	m, err := ParseMail(&info, strings.NewReader("Subject: Invoice\r\n\r\nInvoice in attachment\r\n"))
+	if err != nil {
+		t.Fatalf("ParseMail() error = %v", err)
+	}
+	assert.Nil(t, m.client)
+	assert.Equal(t, "Invoice in attachment\n", m.plain.String())
+	assert.Error(t, m.Send(), "MailYak.Send() connects")
+}
+
+// decodeTestHeader decodes the RFC 2047 encoded words of a header value.
+func decodeTestHeader(t *testing.T, s string) string {
+	decoded, err := headerDecoder.DecodeHeader(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// ST00012 is the payment QR code of GOST R 56042-2014 the Russian bank apps
+// scan to fill a payment in: the format identifier ST0001, the encoding 2
+// (UTF-8) and the requisites as Key=Value separated by "|".
+const (
+	st00012Header    = "ST00012"
+	st00012Separator = "|"
+	paymentQRSize    = 256 // pixels
+)
+
+// paymentRequisite is a requisite of the payment QR code read from a job
+// parameter.
+type paymentRequisite struct {
+	key      string // in the ST00012 payload
+	param    string
+	required bool
+	max      int                  // characters
+	check    func(v string) error // nil for free text
+}
+
+// paymentRequisites are the requisites of SEND_MAIL_PAYMENT_*, in the order
+// of the payload; the first five are mandatory in the standard.
+var paymentRequisites = []paymentRequisite{
+	{"Name", "SEND_MAIL_PAYMENT_NAME", true, 160, nil},
+	{"PersonalAcc", "SEND_MAIL_PAYMENT_ACCOUNT", true, 20, paymentDigits(20)},
+	{"BankName", "SEND_MAIL_PAYMENT_BANK_NAME", true, 45, nil},
+	{"BIC", "SEND_MAIL_PAYMENT_BIC", true, 9, paymentDigits(9)},
+	{"CorrespAcc", "SEND_MAIL_PAYMENT_CORR_ACCOUNT", true, 20, paymentCorrAccount},
+	{"PayeeINN", "SEND_MAIL_PAYMENT_INN", false, 12, paymentDigits(10, 12)},
+	{"KPP", "SEND_MAIL_PAYMENT_KPP", false, 9, paymentKPP},
+	{"Sum", "SEND_MAIL_PAYMENT_SUM", false, 18, nil},
+	{"Purpose", "SEND_MAIL_PAYMENT_PURPOSE", false, 210, nil},
+}
+
+// paymentQRPayload builds the ST00012 payload from the job parameters:
+//
+//	SEND_MAIL_PAYMENT_NAME          payee name
+//	SEND_MAIL_PAYMENT_ACCOUNT       payee account, 20 digits
+//	SEND_MAIL_PAYMENT_BANK_NAME     payee bank
+//	SEND_MAIL_PAYMENT_BIC           bank BIC, 9 digits
+//	SEND_MAIL_PAYMENT_CORR_ACCOUNT  bank correspondent account, 20 digits or 0
+//	SEND_MAIL_PAYMENT_INN           payee INN, optional
+//	SEND_MAIL_PAYMENT_KPP           payee KPP, optional
+//	SEND_MAIL_PAYMENT_SUM           sum in rubles, e.g. 105.23, optional
+//	SEND_MAIL_PAYMENT_PURPOSE       purpose of the payment, optional
+//
+// White space is collapsed, values holding the separator are rejected.
+func paymentQRPayload(prop *map[string]string) (string, error) {
+	p := *prop
+	fields := []string{st00012Header}
+	for _, r := range paymentRequisites {
+		v := strings.Join(strings.Fields(p[r.param]), " ")
+		if v == "" {
+			if r.required {
+				return "", fmt.Errorf("%s is required", r.param)
+			}
+			continue
+		}
+		if r.key == "Sum" {
+			k, err := toKopecks(v)
+			if err != nil || k <= 0 {
+				return "", fmt.Errorf("bad %s(%s)", r.param, p[r.param])
+			}
+			v = fmt.Sprint(int64(k))
+		}
+		if strings.Contains(v, st00012Separator) {
+			return "", fmt.Errorf("bad %s: %q is not allowed", r.param, st00012Separator)
+		}
+		if utf8.RuneCountInString(v) > r.max {
+			return "", fmt.Errorf("bad %s: longer than %d characters", r.param, r.max)
+		}
+		if r.check != nil {
+			if err := r.check(v); err != nil {
+				return "", fmt.Errorf("bad %s(%s): %v", r.param, v, err)
+			}
+		}
+		fields = append(fields, r.key+"="+v)
+	}
+	return strings.Join(fields, st00012Separator), nil
+}
+
+// paymentQR renders the ST00012 payload of the job parameters into a PNG QR
+// code.
+func paymentQR(prop *map[string]string) ([]byte, error) {
+	payload, err := paymentQRPayload(prop)
+	if err != nil {
+		return nil, err
+	}
+	return qrcode.Encode(payload, qrcode.Medium, paymentQRSize)
+}
+
+// paymentDigits checks a number of one of the lengths given.
+func paymentDigits(lengths ...int) func(string) error {
+	return func(v string) error {
+		if !allDigits(v) {
+			return fmt.Errorf("not a number")
+		}
+		for _, n := range lengths {
+			if len(v) == n {
+				return nil
+			}
+		}
+		return fmt.Errorf("%d digits", len(v))
+	}
+}
+
+// paymentCorrAccount checks a correspondent account, 0 for the banks
+// without one.
+func paymentCorrAccount(v string) error {
+	if v == "0" {
+		return nil
+	}
+	return paymentDigits(20)(v)
+}
+
+// paymentKPP checks a KPP, 9 characters of which the 5th and 6th may be
+// letters.
+func paymentKPP(v string) error {
+	if len(v) != 9 || !allDigits(v[:4]) || !allDigits(v[6:]) {
+		return fmt.Errorf("not a KPP")
+	}
+	for _, c := range v[4:6] {
+		if (c < '0' || c > '9') && (c < 'A' || c > 'Z') {
+			return fmt.Errorf("not a KPP")
+		}
+	}
+	return nil
+}
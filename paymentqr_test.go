@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPaymentParams are the requisites of an invoice.
+func testPaymentParams() map[string]string {
+	return map[string]string{
+		"SEND_MAIL_PAYMENT_NAME":         `ООО "Поставщик"`,
+		"SEND_MAIL_PAYMENT_ACCOUNT":      "40702810138250123017",
+		"SEND_MAIL_PAYMENT_BANK_NAME":    `ПАО "Сбербанк"`,
+		"SEND_MAIL_PAYMENT_BIC":          "044525225",
+		"SEND_MAIL_PAYMENT_CORR_ACCOUNT": "30101810400000000225",
+		"SEND_MAIL_PAYMENT_INN":          "7701234567",
+		"SEND_MAIL_PAYMENT_KPP":          "770101001",
+		"SEND_MAIL_PAYMENT_SUM":          "105,23",
+		"SEND_MAIL_PAYMENT_PURPOSE":      "Оплата по счёту № 42\nот 18.10.2026, в т.ч. НДС 20%",
+	}
+}
+
+// TestPaymentQRPayload ensures the ST00012 payload holds the requisites in
+// the order of the standard, and that bad requisites are rejected
+func TestPaymentQRPayload(t *testing.T) {
+	t.Parallel()
+
+	full := "ST00012|Name=ООО \"Поставщик\"|PersonalAcc=40702810138250123017|BankName=ПАО \"Сбербанк\"" +
+		"|BIC=044525225|CorrespAcc=30101810400000000225|PayeeINN=7701234567|KPP=770101001" +
+		"|Sum=10523|Purpose=Оплата по счёту № 42 от 18.10.2026, в т.ч. НДС 20%"
+	required := "ST00012|Name=ООО \"Поставщик\"|PersonalAcc=40702810138250123017|BankName=ПАО \"Сбербанк\"" +
+		"|BIC=044525225|CorrespAcc=30101810400000000225"
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		param, value string
+		// Expected results.
+		want    string
+		wantErr bool
+	}{
+		{"Full", "", "", full, false},
+		{"No correspondent account", "SEND_MAIL_PAYMENT_CORR_ACCOUNT", "0", strings.Replace(full, "CorrespAcc=30101810400000000225", "CorrespAcc=0", 1), false},
+		{"Individual INN", "SEND_MAIL_PAYMENT_INN", "500100732259", strings.Replace(full, "7701234567", "500100732259", 1), false},
+		{"KPP with letters", "SEND_MAIL_PAYMENT_KPP", "7701AB001", strings.Replace(full, "770101001", "7701AB001", 1), false},
+		{"Round sum", "SEND_MAIL_PAYMENT_SUM", "1 500", strings.Replace(full, "Sum=10523", "Sum=150000", 1), false},
+		{"Missing name", "SEND_MAIL_PAYMENT_NAME", "", "", true},
+		{"Missing account", "SEND_MAIL_PAYMENT_ACCOUNT", " ", "", true},
+		{"Short account", "SEND_MAIL_PAYMENT_ACCOUNT", "4070281013825012301", "", true},
+		{"Bad BIC", "SEND_MAIL_PAYMENT_BIC", "04452522A", "", true},
+		{"Bad INN", "SEND_MAIL_PAYMENT_INN", "77012345", "", true},
+		{"Bad KPP", "SEND_MAIL_PAYMENT_KPP", "77010100", "", true},
+		{"Bad sum", "SEND_MAIL_PAYMENT_SUM", "сто", "", true},
+		{"Zero sum", "SEND_MAIL_PAYMENT_SUM", "0", "", true},
+		{"Separator", "SEND_MAIL_PAYMENT_PURPOSE", "Счёт 42|43", "", true},
+		{"Long bank name", "SEND_MAIL_PAYMENT_BANK_NAME", strings.Repeat("Банк", 12), "", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			prop := testPaymentParams()
+			if tt.param != "" {
+				prop[tt.param] = tt.value
+			}
+			got, err := paymentQRPayload(&prop)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. paymentQRPayload() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got, tt.name)
+		})
+	}
+
+	prop := testPaymentParams()
+	for _, r := range paymentRequisites {
+		if !r.required {
+			delete(prop, r.param)
+		}
+	}
+	got, err := paymentQRPayload(&prop)
+	if err != nil {
+		t.Fatalf("paymentQRPayload() error = %v", err)
+	}
+	assert.Equal(t, required, got, "No optional requisites")
+}
+
+// TestPaymentQR ensures the code is rendered into a PNG image
+func TestPaymentQR(t *testing.T) {
+	t.Parallel()
+
+	prop := testPaymentParams()
+	got, err := paymentQR(&prop)
+	if err != nil {
+		t.Fatalf("paymentQR() error = %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(got))
+	if err != nil {
+		t.Fatalf("png.Decode() error = %v", err)
+	}
+	assert.Equal(t, paymentQRSize, img.Bounds().Dx())
+	assert.Equal(t, paymentQRSize, img.Bounds().Dy())
+
+	delete(prop, "SEND_MAIL_PAYMENT_BIC")
+	if _, err := paymentQR(&prop); err == nil {
+		t.Errorf("paymentQR() error = nil, want an error")
+	}
+}
+
+// TestSendMailPaymentQR ensures the code is attached inline when the HTML
+// body shows it, and as a file otherwise
+func TestSendMailPaymentQR(t *testing.T) {
+	t.Parallel()
+
+	srv := newTestSMTPServer(t)
+	defer srv.Close()
+
+	settings := map[string]SMTPInfo{"notify_mail": srv.info()}
+	prop := testPaymentParams()
+	prop["SEND_MAIL_FROM"] = "notify_mail"
+	prop["SEND_MAIL_TO"] = "first@example.org"
+	prop["SEND_MAIL_SUBJECT"] = "Счёт 42"
+	prop["SEND_MAIL_BODY_HTML"] = `<p>Оплата по QR-коду:</p><img src="cid:qr.png">`
+	prop["SEND_MAIL_PAYMENT_QR"] = "qr.png"
+	assert.True(t, sendMail(&settings, &prop))
+
+	prop["SEND_MAIL_BODY_HTML"] = `<p>QR-код для оплаты во вложении</p>`
+	prop["SEND_MAIL_PAYMENT_QR"] = ""
+	assert.True(t, sendMail(&settings, &prop))
+
+	prop["SEND_MAIL_PAYMENT_ACCOUNT"] = "40702810138250123017|1"
+	assert.False(t, sendMail(&settings, &prop))
+
+	qr := testPaymentParams()
+	want, err := paymentQR(&qr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if assert.Equal(t, 2, len(srv.messages)) {
+		for i, filename := range []string{"qr.png", "payment-qr.png"} {
+			msg, err := ParseMail(&SMTPInfo{}, strings.NewReader(srv.messages[i]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assert.Len(t, msg.attachments, 1, "message #%d", i) {
+				a := msg.attachments[0]
+				assert.Equal(t, filename, a.filename, "message #%d", i)
+				assert.Equal(t, i == 0, a.inline, "message #%d", i)
+				assert.Equal(t, "image/png", a.mimeType, "message #%d", i)
+				assert.Equal(t, BytesSource(want), a.content, "message #%d", i)
+			}
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/jung-kurt/gofpdf"
+	"golang.org/x/net/html"
+)
+
+// Page of the PDF documents, A4 in millimetres.
+const (
+	pdfPageWidth  = 210.0
+	pdfPageHeight = 297.0
+	pdfMargin     = 15.0
+)
+
+// pdfFontStyles maps the suffixes of the font file names to gofpdf styles,
+// e.g. DejaVuSans-BoldOblique.ttf.
+var pdfFontStyles = map[string]string{
+	"regular":     "",
+	"bold":        "B",
+	"italic":      "I",
+	"oblique":     "I",
+	"bolditalic":  "BI",
+	"boldoblique": "BI",
+}
+
+// expand loads the fonts of the PDF attachments. PDF attachments are only
+// rendered when fonts are found, the core PDF fonts have no Cyrillic.
+func (p *PDFInfo) expand(configPath string) {
+	configured := p.FontsPath != ""
+	if !configured {
+		p.FontsPath = filepath.Join(configPath, "fonts")
+	}
+	p.fonts = nil
+
+	fonts, err := loadPDFFonts(p.FontsPath, p.Font)
+	if os.IsNotExist(err) && !configured {
+		if glog.V(2) {
+			glog.Infof("LOG: PDF(%s): no fonts, PDF attachments are disabled", p.FontsPath)
+		}
+		return
+	}
+	if err != nil {
+		glog.Errorf("ERR: PDF(%s): %v", p.FontsPath, err)
+		return
+	}
+	p.fonts = fonts
+}
+
+// pdfFonts are the TrueType fonts of a directory, by family and gofpdf
+// style. They are embedded into the documents using them.
+type pdfFonts struct {
+	families map[string]map[string][]byte
+	def      string // default family
+}
+
+// loadPDFFonts reads the .ttf files of dir, named <family>[-<style>].ttf.
+// The default family is font, or the first one in alphabetical order.
+func loadPDFFonts(dir, font string) (*pdfFonts, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &pdfFonts{families: map[string]map[string][]byte{}}
+	for _, fi := range files {
+		if fi.IsDir() || !strings.EqualFold(filepath.Ext(fi.Name()), ".ttf") {
+			continue
+		}
+		family, style := splitFontName(strings.TrimSuffix(fi.Name(), filepath.Ext(fi.Name())))
+		data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if f.families[family] == nil {
+			f.families[family] = map[string][]byte{}
+		}
+		f.families[family][style] = data
+	}
+	if len(f.families) == 0 {
+		return nil, fmt.Errorf("no .ttf fonts")
+	}
+
+	if font != "" {
+		f.def = fontKey(font)
+		if f.families[f.def] == nil {
+			return nil, fmt.Errorf("font %q not found", font)
+		}
+		return f, nil
+	}
+	var names []string
+	for name := range f.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	f.def = names[0]
+	return f, nil
+}
+
+// splitFontName returns the family key and the gofpdf style of the font
+// file name stem.
+func splitFontName(stem string) (string, string) {
+	if i := strings.LastIndexByte(stem, '-'); i > 0 {
+		if style, ok := pdfFontStyles[strings.ToLower(stem[i+1:])]; ok {
+			return fontKey(stem[:i]), style
+		}
+	}
+	return fontKey(stem), ""
+}
+
+// fontKey normalizes a family name, "DejaVu Sans" is DejaVuSans.ttf.
+func fontKey(family string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "", "_", "", `"`, "", "'", "").Replace(family))
+}
+
+// resolve returns the family and the style of the font to use for f: the
+// first family of the CSS list found, and the closest style.
+func (fonts *pdfFonts) resolve(f pdfFont) (string, string) {
+	family := fonts.def
+	for _, name := range strings.Split(f.family, ",") {
+		if key := fontKey(strings.TrimSpace(name)); fonts.families[key] != nil {
+			family = key
+			break
+		}
+	}
+
+	style := ""
+	if f.bold {
+		style += "B"
+	}
+	if f.italic {
+		style += "I"
+	}
+	styles := fonts.families[family]
+	for _, s := range []string{style, strings.TrimSuffix(style, "I"), strings.TrimPrefix(style, "B"), ""} {
+		if styles[s] != nil {
+			return family, s
+		}
+	}
+	// Only styled variants
+	for _, s := range []string{"", "B", "I", "BI"} {
+		if styles[s] != nil {
+			return family, s
+		}
+	}
+	return family, ""
+}
+
+// gofpdfCanvas draws laid out documents with gofpdf.
+type gofpdfCanvas struct {
+	pdf   *gofpdf.Fpdf
+	fonts *pdfFonts
+	added map[string]bool // fonts added to the document
+}
+
+// setFont selects f, embedding the font on its first use.
+func (g *gofpdfCanvas) setFont(f pdfFont) {
+	family, style := g.fonts.resolve(f)
+	if !g.added[family+style] {
+		g.pdf.AddUTF8FontFromBytes(family, style, g.fonts.families[family][style])
+		g.added[family+style] = true
+	}
+	if f.underline {
+		style += "U"
+	}
+	g.pdf.SetFont(family, style, f.size)
+}
+
+func (g *gofpdfCanvas) addPage() {
+	g.pdf.AddPage()
+}
+
+func (g *gofpdfCanvas) measure(s string, f pdfFont) float64 {
+	g.setFont(f)
+	return g.pdf.GetStringWidth(s)
+}
+
+func (g *gofpdfCanvas) text(x, y float64, s string, f pdfFont, c pdfColor) {
+	g.setFont(f)
+	g.pdf.SetTextColor(c.r, c.g, c.b)
+	g.pdf.Text(x, y, s)
+}
+
+func (g *gofpdfCanvas) fill(x, y, w, h float64, c pdfColor) {
+	g.pdf.SetFillColor(c.r, c.g, c.b)
+	g.pdf.Rect(x, y, w, h, "F")
+}
+
+func (g *gofpdfCanvas) line(x1, y1, x2, y2, width float64, c pdfColor) {
+	g.pdf.SetDrawColor(c.r, c.g, c.b)
+	g.pdf.SetLineWidth(width)
+	g.pdf.Line(x1, y1, x2, y2)
+}
+
+// htmlToPDF converts an HTML document to an A4 PDF, without a browser: the
+// subset of HTML and CSS of the invoices is laid out in pure Go.
+//
+// Blocks, paragraphs, lists and tables, with colspan, rowspan and collapsed
+// borders, are supported, as are the font, color, text-align, width, height,
+// margin, padding, border and background properties of the <style> blocks and
+// style attributes. Images, floats and positioning are not.
+func htmlToPDF(src []byte, fonts *pdfFonts) ([]byte, error) {
+	if fonts == nil {
+		return nil, fmt.Errorf("no fonts for PDF")
+	}
+	src, err := inlineCSS(src)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := html.Parse(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(pdfMargin, pdfMargin, pdfMargin)
+	pdf.SetAutoPageBreak(false, pdfMargin)
+	if title := htmlTitle(doc); title != "" {
+		pdf.SetTitle(title, true)
+	}
+
+	c := &gofpdfCanvas{pdf: pdf, fonts: fonts, added: map[string]bool{}}
+	slices := layoutHTML(c, doc, fonts.def, pdfMargin, pdfPageWidth-2*pdfMargin)
+	paginate(c, slices, pdfMargin, pdfPageHeight-pdfMargin)
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// htmlTitle returns the text of the <title> of doc.
+func htmlTitle(doc *html.Node) string {
+	var title string
+	walkElements(doc, func(n *html.Node) {
+		if n.Data == "title" && title == "" && n.FirstChild != nil {
+			title = strings.Join(strings.Fields(n.FirstChild.Data), " ")
+		}
+	})
+	return title
+}
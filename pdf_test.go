@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// testPDFFonts are the Go fonts, regular and bold, as family "go".
+func testPDFFonts() *pdfFonts {
+	return &pdfFonts{
+		families: map[string]map[string][]byte{"go": {"": goregular.TTF, "B": gobold.TTF}},
+		def:      "go",
+	}
+}
+
+// writeTestFonts writes the Go fonts to a directory, under the names given.
+func writeTestFonts(t *testing.T, names ...string) string {
+	dir, err := ioutil.TempDir("", "fonts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), goregular.TTF, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// TestLoadPDFFonts ensures the families and styles are read from the file
+// names
+func TestLoadPDFFonts(t *testing.T) {
+	t.Parallel()
+
+	dir := writeTestFonts(t, "DejaVuSans.ttf", "DejaVuSans-Bold.ttf", "DejaVuSans-BoldOblique.TTF",
+		"Go-Regular.ttf", "Go-Italic.ttf", "Go-Medium.ttf")
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "LICENSE.txt"), []byte("license"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	empty := writeTestFonts(t)
+	defer os.RemoveAll(empty)
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		dir  string
+		font string
+		// Expected results.
+		def      string
+		families map[string][]string
+		wantErr  bool
+	}{
+		{
+			"First family by default",
+			dir,
+			"",
+			"dejavusans",
+			map[string][]string{"dejavusans": {"", "B", "BI"}, "go": {"", "I"}, "gomedium": {""}},
+			false,
+		},
+		{
+			"Configured family",
+			dir,
+			"Go",
+			"go",
+			map[string][]string{"dejavusans": {"", "B", "BI"}, "go": {"", "I"}, "gomedium": {""}},
+			false,
+		},
+		{
+			"CSS family name",
+			dir,
+			"DejaVu Sans",
+			"dejavusans",
+			map[string][]string{"dejavusans": {"", "B", "BI"}, "go": {"", "I"}, "gomedium": {""}},
+			false,
+		},
+		{"Unknown family", dir, "Arial", "", nil, true},
+		{"No fonts", empty, "", "", nil, true},
+		{"Missing directory", filepath.Join(dir, "missing"), "", "", nil, true},
+	}
+	// Not parallel, the directories are removed when the test returns.
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadPDFFonts(tt.dir, tt.font)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. loadPDFFonts() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tt.def, got.def, tt.name)
+			families := map[string][]string{}
+			for family, styles := range got.families {
+				for _, style := range []string{"", "B", "I", "BI"} {
+					if styles[style] != nil {
+						families[family] = append(families[family], style)
+					}
+				}
+			}
+			assert.Equal(t, tt.families, families, tt.name)
+		})
+	}
+}
+
+// TestPDFFontsResolve ensures a font is found for every CSS font
+func TestPDFFontsResolve(t *testing.T) {
+	t.Parallel()
+
+	fonts := testPDFFonts()
+	fonts.families["dejavusans"] = map[string][]byte{"BI": goregular.TTF}
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		font pdfFont
+		// Expected results.
+		family, style string
+	}{
+		{"Default", pdfFont{}, "go", ""},
+		{"Unknown family", pdfFont{family: "Arial"}, "go", ""},
+		{"Family list", pdfFont{family: `"Times New Roman", Go, sans-serif`}, "go", ""},
+		{"Bold", pdfFont{family: "go", bold: true}, "go", "B"},
+		{"Bold italic", pdfFont{bold: true, italic: true}, "go", "B"},
+		{"Italic", pdfFont{italic: true}, "go", ""},
+		{"Only a styled variant", pdfFont{family: "DejaVu Sans"}, "dejavusans", "BI"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			family, style := fonts.resolve(tt.font)
+			assert.Equal(t, tt.family, family, tt.name)
+			assert.Equal(t, tt.style, style, tt.name)
+		})
+	}
+}
+
+// TestPDFInfoExpand ensures the fonts are loaded from the configuration, and
+// that PDF attachments are disabled without them
+func TestPDFInfoExpand(t *testing.T) {
+	t.Parallel()
+
+	configPath := writeTestFonts(t)
+	defer os.RemoveAll(configPath)
+	if err := os.Mkdir(filepath.Join(configPath, "fonts"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(configPath, "fonts", "Go.ttf"), goregular.TTF, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		info       PDFInfo
+		configPath string
+		// Expected results.
+		fontsPath string
+		loaded    bool
+	}{
+		{"Default directory", PDFInfo{}, configPath, filepath.Join(configPath, "fonts"), true},
+		{"Configured directory", PDFInfo{FontsPath: filepath.Join(configPath, "fonts"), Font: "Go"}, "/nonexistent", filepath.Join(configPath, "fonts"), true},
+		{"No default directory", PDFInfo{}, "/nonexistent", "/nonexistent/fonts", false},
+		{"Missing configured directory", PDFInfo{FontsPath: "/nonexistent"}, configPath, "/nonexistent", false},
+		{"Missing font", PDFInfo{Font: "Arial"}, configPath, filepath.Join(configPath, "fonts"), false},
+	}
+	// Not parallel, the directories are removed when the test returns.
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.info.expand(tt.configPath)
+			assert.Equal(t, tt.fontsPath, tt.info.FontsPath, tt.name)
+			assert.Equal(t, tt.loaded, tt.info.fonts != nil, tt.name)
+		})
+	}
+}
+
+// TestHTMLToPDF ensures the invoice template converts to a single page
+// document with the fonts embedded
+func TestHTMLToPDF(t *testing.T) {
+	t.Parallel()
+
+	src, err := ioutil.ReadFile("storage/invoice.ru.1.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := htmlToPDF(src, testPDFFonts())
+	if err != nil {
+		t.Fatalf("htmlToPDF() error = %v", err)
+	}
+	assert.True(t, bytes.HasPrefix(got, []byte("%PDF-")), "PDF header")
+	assert.Equal(t, 1, bytes.Count(got, []byte("/Type /Page\n")), "pages")
+	assert.Contains(t, string(got), "/FontFile2", "embedded font")
+
+	if _, err := htmlToPDF(src, nil); err == nil {
+		t.Errorf("htmlToPDF() without fonts error = nil, want an error")
+	}
+}
@@ -0,0 +1,1318 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Conversions of the CSS units into millimetres, the unit of the layout.
+const (
+	ptMM = 25.4 / 72
+	pxMM = 25.4 / 96
+)
+
+// Defaults of the layout.
+const (
+	pdfFontSize   = 12.0 // pt, the medium font size of the browsers
+	pdfLineHeight = 1.2  // times the font size
+	pdfCellPad    = pxMM // cellpadding of the tables without one
+)
+
+// pdfCanvas is what a laid out document is measured with and drawn on.
+type pdfCanvas interface {
+	addPage()
+	// measure returns the width of s in f.
+	measure(s string, f pdfFont) float64
+	// text draws s with its baseline at y.
+	text(x, y float64, s string, f pdfFont, c pdfColor)
+	fill(x, y, w, h float64, c pdfColor)
+	line(x1, y1, x2, y2, width float64, c pdfColor)
+}
+
+// pdfFont selects a font of the canvas.
+type pdfFont struct {
+	family    string // CSS font-family list, the canvas picks an available one
+	bold      bool
+	italic    bool
+	underline bool
+	size      float64 // pt
+}
+
+type pdfColor struct {
+	r, g, b int
+}
+
+// pdfTextStyle is the inherited part of the style of an element.
+type pdfTextStyle struct {
+	font  pdfFont
+	color pdfColor
+	align string // left, center or right
+}
+
+// pdfLength is a CSS length, in millimetres or percents of the containing
+// block.
+type pdfLength struct {
+	value   float64
+	percent bool
+	set     bool
+}
+
+// resolve returns the length in millimetres for the containing width ref.
+func (l pdfLength) resolve(ref float64) float64 {
+	if l.percent {
+		return l.value * ref / 100
+	}
+	return l.value
+}
+
+// pdfBorder is a side of a border, none when its width is zero.
+type pdfBorder struct {
+	width float64
+	color pdfColor
+	given bool // set by CSS, even to none
+}
+
+// pdfBoxStyle is the non-inherited part of the style of a block or a cell.
+// The sides are top, right, bottom and left.
+type pdfBoxStyle struct {
+	width      pdfLength
+	height     pdfLength
+	minHeight  pdfLength
+	margin     [4]float64
+	centered   bool // margin-left and margin-right auto
+	padding    [4]float64
+	paddingSet bool
+	border     [4]pdfBorder
+	background *pdfColor
+	valign     string // top, middle or bottom, for cells
+}
+
+// decorated reports whether the box draws anything but its contents.
+func (s *pdfBoxStyle) decorated() bool {
+	if s.background != nil || s.height.set {
+		return true
+	}
+	for _, b := range s.border {
+		if b.width > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// pdfBox is a part of the document laid out as a block.
+type pdfBox interface {
+	// widths returns the narrowest width the box fits in and the width of
+	// its contents without wrapping.
+	widths(c pdfCanvas) (float64, float64)
+	// layout lays the box out in width and returns its height.
+	layout(c pdfCanvas, width float64) float64
+	draw(c pdfCanvas, x, y float64)
+	// slices returns the parts the box may be split into across pages.
+	slices(x float64) []pdfSlice
+}
+
+// pdfSlice is a part of the document that is never split across pages.
+type pdfSlice struct {
+	height float64
+	draw   func(c pdfCanvas, y float64)
+}
+
+// paginate draws the slices from top to bottom of the pages, starting a new
+// page when the next slice does not fit.
+func paginate(c pdfCanvas, slices []pdfSlice, top, bottom float64) {
+	c.addPage()
+	y := top
+	for _, s := range slices {
+		if y+s.height > bottom && y > top {
+			c.addPage()
+			y = top
+		}
+		s.draw(c, y)
+		y += s.height
+	}
+}
+
+// layoutHTML lays the body of doc out in width from the left edge x, with
+// font the default font family, and returns the slices of the pages.
+func layoutHTML(c pdfCanvas, doc *html.Node, font string, x, width float64) []pdfSlice {
+	body := doc
+	walkElements(doc, func(n *html.Node) {
+		if n.DataAtom == atom.Body && body == doc {
+			body = n
+		}
+	})
+
+	ts := pdfTextStyle{
+		font:  pdfFont{family: font, size: pdfFontSize},
+		align: "left",
+	}
+	root := newPDFBlock(body, ts)
+	root.layout(c, width)
+	return root.slices(x)
+}
+
+// Elements laid out as blocks, the others are inline.
+var pdfBlockElements = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Blockquote: true, atom.Body: true,
+	atom.Center: true, atom.Dd: true, atom.Div: true, atom.Dl: true, atom.Dt: true,
+	atom.Footer: true, atom.Form: true, atom.H1: true, atom.H2: true, atom.H3: true,
+	atom.H4: true, atom.H5: true, atom.H6: true, atom.Header: true, atom.Hr: true,
+	atom.Li: true, atom.Main: true, atom.Nav: true, atom.Ol: true, atom.P: true,
+	atom.Pre: true, atom.Section: true, atom.Table: true, atom.Ul: true,
+}
+
+// Elements without any contents to lay out.
+var pdfSkippedElements = map[atom.Atom]bool{
+	atom.Head: true, atom.Script: true, atom.Style: true, atom.Title: true,
+	atom.Img: true, atom.Iframe: true, atom.Object: true, atom.Svg: true,
+}
+
+// Font sizes of the headings, in em.
+var pdfHeadingSizes = map[atom.Atom]float64{
+	atom.H1: 2, atom.H2: 1.5, atom.H3: 1.17, atom.H4: 1, atom.H5: 0.83, atom.H6: 0.67,
+}
+
+// pdfBlock is a block with block and inline children, the latter grouped
+// into paragraphs.
+type pdfBlock struct {
+	style    pdfBoxStyle
+	children []pdfBox
+
+	// Laid out
+	width   float64 // of the border box
+	height  float64 // with the margins
+	offset  float64 // left margin, when centered
+	content float64 // height of the children
+}
+
+// newPDFBlock builds the block of the element n, ts being the inherited style.
+func newPDFBlock(n *html.Node, ts pdfTextStyle) *pdfBlock {
+	ts = pdfElementTextStyle(n, ts)
+	b := &pdfBlock{style: pdfElementBoxStyle(n, ts)}
+
+	var runs []pdfRun
+	flush := func() {
+		if p := newPDFParagraph(runs, ts.align); p != nil {
+			b.children = append(b.children, p)
+		}
+		runs = nil
+	}
+	if n.DataAtom == atom.Li {
+		marker := "• "
+		if n.Parent != nil && n.Parent.DataAtom == atom.Ol {
+			marker = strconv.Itoa(pdfListIndex(n)) + ". "
+		}
+		runs = append(runs, pdfRun{text: marker, style: ts})
+	}
+
+	var add func(n *html.Node, ts pdfTextStyle)
+	add = func(n *html.Node, ts pdfTextStyle) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch {
+			case c.Type == html.TextNode:
+				runs = append(runs, pdfRun{text: c.Data, style: ts})
+			case c.Type != html.ElementNode || pdfSkippedElements[c.DataAtom]:
+			case c.DataAtom == atom.Br:
+				runs = append(runs, pdfRun{br: true, style: ts})
+			case c.DataAtom == atom.Table:
+				flush()
+				b.children = append(b.children, newPDFTable(c, ts))
+			case c.DataAtom == atom.Hr:
+				flush()
+				b.children = append(b.children, newPDFRule(c, ts))
+			case pdfBlockElements[c.DataAtom]:
+				flush()
+				b.children = append(b.children, newPDFBlock(c, ts))
+			default:
+				add(c, pdfElementTextStyle(c, ts))
+			}
+		}
+	}
+	add(n, ts)
+	flush()
+	return b
+}
+
+// pdfListIndex returns the number of the list item n in its list.
+func pdfListIndex(n *html.Node) int {
+	i := 1
+	for c := n.PrevSibling; c != nil; c = c.PrevSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Li {
+			i++
+		}
+	}
+	return i
+}
+
+// edges returns the widths of the padding and border of the box, left and
+// right, top and bottom.
+func (b *pdfBlock) edges() (float64, float64) {
+	s := &b.style
+	return s.padding[3] + s.padding[1] + s.border[3].width + s.border[1].width,
+		s.padding[0] + s.padding[2] + s.border[0].width + s.border[2].width
+}
+
+func (b *pdfBlock) widths(c pdfCanvas) (float64, float64) {
+	var min, max float64
+	for _, child := range b.children {
+		cmin, cmax := child.widths(c)
+		min, max = maxFloat(min, cmin), maxFloat(max, cmax)
+	}
+	h, _ := b.edges()
+	if b.style.width.set && !b.style.width.percent {
+		return maxFloat(min+h, b.style.width.value), b.style.width.value
+	}
+	return min + h, max + h
+}
+
+func (b *pdfBlock) layout(c pdfCanvas, width float64) float64 {
+	s := &b.style
+	b.width, b.offset = width, 0
+	if s.width.set {
+		b.width = s.width.resolve(width)
+	}
+	if b.width > width {
+		b.width = width
+	}
+	if s.centered {
+		b.offset = (width - b.width) / 2
+	}
+
+	h, v := b.edges()
+	b.content = 0
+	for _, child := range b.children {
+		b.content += child.layout(c, b.width-h)
+	}
+
+	inner := b.content
+	if s.height.set {
+		inner = s.height.value
+	}
+	if s.minHeight.set && inner < s.minHeight.value {
+		inner = s.minHeight.value
+	}
+	b.height = s.margin[0] + v + inner + s.margin[2]
+	return b.height
+}
+
+// boxHeight returns the height of the border box.
+func (b *pdfBlock) boxHeight() float64 {
+	return b.height - b.style.margin[0] - b.style.margin[2]
+}
+
+func (b *pdfBlock) draw(c pdfCanvas, x, y float64) {
+	x, y = x+b.offset, y+b.style.margin[0]
+	b.drawDecoration(c, x, y, b.width, b.boxHeight())
+	b.drawContent(c, x, y)
+}
+
+// drawDecoration draws the background and the borders of the box.
+func (b *pdfBlock) drawDecoration(c pdfCanvas, x, y, w, h float64) {
+	if b.style.background != nil {
+		c.fill(x, y, w, h, *b.style.background)
+	}
+	drawPDFBorders(c, b.style.border, x, y, w, h, [4]bool{true, true, true, true})
+}
+
+// drawContent draws the children inside the padding of the box at x, y.
+func (b *pdfBlock) drawContent(c pdfCanvas, x, y float64) {
+	s := &b.style
+	x += s.border[3].width + s.padding[3]
+	y += s.border[0].width + s.padding[0]
+	for _, child := range b.children {
+		for _, sl := range child.slices(x) {
+			sl.draw(c, y)
+			y += sl.height
+		}
+	}
+}
+
+func (b *pdfBlock) slices(x float64) []pdfSlice {
+	s := &b.style
+	if s.decorated() {
+		return []pdfSlice{{b.height, func(c pdfCanvas, y float64) { b.draw(c, x, y) }}}
+	}
+
+	// The children may be split across pages
+	x += b.offset + s.border[3].width + s.padding[3]
+	out := []pdfSlice{pdfSpace(s.margin[0] + s.border[0].width + s.padding[0])}
+	for _, child := range b.children {
+		out = append(out, child.slices(x)...)
+	}
+	rest := b.height - s.margin[0] - s.border[0].width - s.padding[0] - b.content
+	return append(out, pdfSpace(rest))
+}
+
+// pdfSpace is a blank slice.
+func pdfSpace(height float64) pdfSlice {
+	return pdfSlice{height, func(pdfCanvas, float64) {}}
+}
+
+// drawPDFBorders draws the sides of the box x, y, w, h, as far as set.
+func drawPDFBorders(c pdfCanvas, border [4]pdfBorder, x, y, w, h float64, sides [4]bool) {
+	if b := border[0]; b.width > 0 && sides[0] {
+		c.line(x, y, x+w, y, b.width, b.color)
+	}
+	if b := border[1]; b.width > 0 && sides[1] {
+		c.line(x+w, y, x+w, y+h, b.width, b.color)
+	}
+	if b := border[2]; b.width > 0 && sides[2] {
+		c.line(x, y+h, x+w, y+h, b.width, b.color)
+	}
+	if b := border[3]; b.width > 0 && sides[3] {
+		c.line(x, y, x, y+h, b.width, b.color)
+	}
+}
+
+// pdfRule is a horizontal rule, <hr>.
+type pdfRule struct {
+	style pdfTextStyle
+	color pdfColor
+	width float64
+	em    float64
+}
+
+func newPDFRule(n *html.Node, ts pdfTextStyle) *pdfRule {
+	r := &pdfRule{style: ts, color: pdfColor{128, 128, 128}, em: ts.font.size * ptMM}
+	if bs := pdfElementBoxStyle(n, ts); bs.background != nil {
+		r.color = *bs.background
+	}
+	return r
+}
+
+func (r *pdfRule) widths(pdfCanvas) (float64, float64) { return 0, 0 }
+
+func (r *pdfRule) layout(c pdfCanvas, width float64) float64 {
+	r.width = width
+	return r.em
+}
+
+func (r *pdfRule) draw(c pdfCanvas, x, y float64) {
+	c.line(x, y+r.em/2, x+r.width, y+r.em/2, pxMM, r.color)
+}
+
+func (r *pdfRule) slices(x float64) []pdfSlice {
+	return []pdfSlice{{r.em, func(c pdfCanvas, y float64) { r.draw(c, x, y) }}}
+}
+
+// pdfRun is inline text in a style, or a line break.
+type pdfRun struct {
+	text  string
+	style pdfTextStyle
+	br    bool
+}
+
+// pdfWord is a word of a paragraph, words are separated by collapsible white
+// space, &nbsp; does not separate them.
+type pdfWord struct {
+	text     string
+	style    pdfTextStyle
+	space    bool // white space before the word
+	br       bool
+	trailing bool // a line break followed by an empty line
+}
+
+// pdfFragment is text of a line in a single style.
+type pdfFragment struct {
+	text  string
+	style pdfTextStyle
+	x     float64
+}
+
+type pdfLine struct {
+	fragments []pdfFragment
+	width     float64
+	height    float64
+	size      float64 // largest font size, pt
+}
+
+// pdfParagraph is inline content wrapped into lines.
+type pdfParagraph struct {
+	words []pdfWord
+	style pdfTextStyle // of the empty lines
+	align string
+	lines []pdfLine
+}
+
+// newPDFParagraph splits runs into words, nil when there are neither words
+// nor line breaks.
+func newPDFParagraph(runs []pdfRun, align string) *pdfParagraph {
+	if len(runs) == 0 {
+		return nil
+	}
+	p := &pdfParagraph{style: runs[0].style, align: align}
+	space, breaks := false, false
+	for _, r := range runs {
+		if r.br {
+			p.words = append(p.words, pdfWord{style: r.style, br: true})
+			space, breaks = false, true
+			continue
+		}
+		start := -1
+		for i, ch := range r.text {
+			if isCollapsibleSpace(ch) {
+				if start >= 0 {
+					p.words = append(p.words, pdfWord{text: r.text[start:i], style: r.style, space: space})
+					start = -1
+				}
+				space = true
+				continue
+			}
+			if start < 0 {
+				start = i
+			}
+		}
+		if start >= 0 {
+			p.words = append(p.words, pdfWord{text: r.text[start:], style: r.style, space: space})
+			space = false
+		}
+	}
+	if len(p.words) == 0 && !breaks {
+		return nil
+	}
+	// As in the browsers, a line break ending the paragraph adds no line
+	if n := len(p.words); n > 0 && p.words[n-1].br {
+		p.words = p.words[:n-1]
+		if n > 1 && p.words[n-2].br {
+			p.words[n-2].trailing = true
+		}
+	}
+	return p
+}
+
+// isCollapsibleSpace reports whether ch is HTML white space, which excludes
+// the non-breaking space.
+func isCollapsibleSpace(ch rune) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\f'
+}
+
+func (p *pdfParagraph) widths(c pdfCanvas) (float64, float64) {
+	var min, max, line float64
+	for _, w := range p.words {
+		if w.br {
+			max, line = maxFloat(max, line), 0
+			continue
+		}
+		ww := c.measure(w.text, w.style.font)
+		min = maxFloat(min, ww)
+		if w.space && line > 0 {
+			line += c.measure(" ", w.style.font)
+		}
+		line += ww
+	}
+	return min, maxFloat(max, line)
+}
+
+func (p *pdfParagraph) layout(c pdfCanvas, width float64) float64 {
+	p.lines = nil
+	var cur pdfLine
+	end := func(style pdfTextStyle) {
+		if cur.size == 0 {
+			cur.size = style.font.size
+		}
+		cur.height = cur.size * ptMM * pdfLineHeight
+		p.lines = append(p.lines, cur)
+		cur = pdfLine{}
+	}
+
+	for _, w := range p.words {
+		if w.br {
+			end(w.style)
+			continue
+		}
+		ww := c.measure(w.text, w.style.font)
+		var sw float64
+		if w.space && len(cur.fragments) > 0 {
+			sw = c.measure(" ", w.style.font)
+		}
+		if len(cur.fragments) > 0 && cur.width+sw+ww > width {
+			end(w.style)
+			sw = 0
+		}
+
+		text := w.text
+		if sw > 0 {
+			text = " " + text
+		}
+		if n := len(cur.fragments); n > 0 && cur.fragments[n-1].style == w.style {
+			cur.fragments[n-1].text += text
+		} else {
+			cur.fragments = append(cur.fragments, pdfFragment{text: text, style: w.style, x: cur.width})
+		}
+		cur.width += sw + ww
+		cur.size = maxFloat(cur.size, w.style.font.size)
+	}
+	if n := len(p.words); n == 0 || len(cur.fragments) > 0 || p.words[n-1].trailing {
+		end(p.style)
+	}
+
+	var height float64
+	for i := range p.lines {
+		height += p.lines[i].height
+	}
+	p.lines = p.aligned(width)
+	return height
+}
+
+// aligned returns the lines shifted according to the alignment in width.
+func (p *pdfParagraph) aligned(width float64) []pdfLine {
+	for i := range p.lines {
+		var shift float64
+		switch p.align {
+		case "center":
+			shift = (width - p.lines[i].width) / 2
+		case "right":
+			shift = width - p.lines[i].width
+		}
+		if shift <= 0 {
+			continue
+		}
+		for j := range p.lines[i].fragments {
+			p.lines[i].fragments[j].x += shift
+		}
+	}
+	return p.lines
+}
+
+// drawLine draws the line l with its top at y.
+func (p *pdfParagraph) drawLine(c pdfCanvas, l *pdfLine, x, y float64) {
+	size := l.size * ptMM
+	baseline := y + (l.height-size)/2 + 0.8*size
+	for _, f := range l.fragments {
+		// The space starting a fragment is drawn with it
+		c.text(x+f.x, baseline, f.text, f.style.font, f.style.color)
+	}
+}
+
+func (p *pdfParagraph) draw(c pdfCanvas, x, y float64) {
+	for i := range p.lines {
+		p.drawLine(c, &p.lines[i], x, y)
+		y += p.lines[i].height
+	}
+}
+
+func (p *pdfParagraph) slices(x float64) []pdfSlice {
+	out := make([]pdfSlice, len(p.lines))
+	for i := range p.lines {
+		l := &p.lines[i]
+		out[i] = pdfSlice{l.height, func(c pdfCanvas, y float64) { p.drawLine(c, l, x, y) }}
+	}
+	return out
+}
+
+// pdfCell is a cell of a table, laid out as a block.
+type pdfCell struct {
+	block            *pdfBlock
+	row, col         int
+	rowspan, colspan int
+	width            pdfLength // of the column, from a cell spanning one
+}
+
+// pdfTable is a table, the borders of the cells are collapsed.
+type pdfTable struct {
+	style  pdfBoxStyle
+	cells  []*pdfCell
+	rows   int
+	cols   int
+	rowMin []pdfLength // heights of the rows
+
+	// Laid out
+	width      float64
+	offset     float64
+	colWidths  []float64
+	rowHeights []float64
+}
+
+// newPDFTable builds the table n: the grid of its cells, their padding and
+// borders from the attributes of the table unless set by CSS.
+func newPDFTable(n *html.Node, ts pdfTextStyle) *pdfTable {
+	ts = pdfElementTextStyle(n, ts)
+	t := &pdfTable{style: pdfElementBoxStyle(n, ts)}
+	if !t.style.width.set {
+		t.style.width = pdfAttrLength(attr(n, "width"))
+	}
+
+	pad := pdfCellPad
+	if v := attr(n, "cellpadding"); v != "" {
+		pad = pdfAttrLength(v).value
+	}
+	var cellBorder float64
+	if v := attr(n, "border"); v != "" {
+		if w := pdfAttrLength(v).value; w > 0 {
+			cellBorder = pxMM
+			for i := range t.style.border {
+				if !t.style.border[i].given {
+					t.style.border[i] = pdfBorder{width: w}
+				}
+			}
+		}
+	}
+
+	// Cells taken by the rowspans of the previous rows
+	taken := map[[2]int]bool{}
+	forEachRow(n, func(tr *html.Node) {
+		row := t.rows
+		t.rows++
+		rowTS := pdfElementTextStyle(tr, ts)
+		rs := pdfElementBoxStyle(tr, rowTS)
+		min := rs.height
+		if rs.minHeight.set && (!min.set || rs.minHeight.value > min.value) {
+			min = rs.minHeight
+		}
+		t.rowMin = append(t.rowMin, min)
+
+		col := 0
+		for td := tr.FirstChild; td != nil; td = td.NextSibling {
+			if td.Type != html.ElementNode || (td.DataAtom != atom.Td && td.DataAtom != atom.Th) {
+				continue
+			}
+			for taken[[2]int{row, col}] {
+				col++
+			}
+			cts := rowTS
+			if td.DataAtom == atom.Th {
+				cts.align = "center"
+			}
+			cell := &pdfCell{
+				block:   newPDFBlock(td, cts),
+				row:     row,
+				col:     col,
+				rowspan: pdfSpan(attr(td, "rowspan")),
+				colspan: pdfSpan(attr(td, "colspan")),
+			}
+			bs := &cell.block.style
+			if !bs.paddingSet {
+				bs.padding = [4]float64{pad, pad, pad, pad}
+			}
+			for i := range bs.border {
+				if !bs.border[i].given && cellBorder > 0 {
+					bs.border[i] = pdfBorder{width: cellBorder}
+				}
+			}
+			if !bs.width.set {
+				bs.width = pdfAttrLength(attr(td, "width"))
+			}
+			if !bs.height.set {
+				bs.height = pdfAttrLength(attr(td, "height"))
+			}
+			if bs.valign == "" {
+				bs.valign = strings.ToLower(attr(td, "valign"))
+			}
+			if bs.valign == "" {
+				bs.valign = strings.ToLower(attr(tr, "valign"))
+			}
+			// The widths and heights are those of the column and the row
+			cell.width, bs.width = bs.width, pdfLength{}
+			if bs.height.set {
+				bs.minHeight, bs.height = bs.height, pdfLength{}
+			}
+			bs.margin = [4]float64{}
+
+			for r := row; r < row+cell.rowspan; r++ {
+				for c := col; c < col+cell.colspan; c++ {
+					taken[[2]int{r, c}] = true
+				}
+			}
+			t.cells = append(t.cells, cell)
+			col += cell.colspan
+			if col > t.cols {
+				t.cols = col
+			}
+		}
+	})
+
+	// Rowspans past the last row
+	for _, cell := range t.cells {
+		if cell.row+cell.rowspan > t.rows {
+			cell.rowspan = t.rows - cell.row
+		}
+	}
+	return t
+}
+
+// pdfSpan parses a colspan or rowspan, 1 when missing.
+func pdfSpan(v string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n < 1 {
+		return 1
+	}
+	if n > 1000 {
+		return 1000
+	}
+	return n
+}
+
+// columns returns the minimum and preferred widths of the columns.
+func (t *pdfTable) columns(c pdfCanvas) ([]float64, []float64) {
+	min := make([]float64, t.cols)
+	max := make([]float64, t.cols)
+	for _, cell := range t.cells {
+		if cell.colspan != 1 {
+			continue
+		}
+		cmin, cmax := cell.block.widths(c)
+		min[cell.col] = maxFloat(min[cell.col], cmin)
+		max[cell.col] = maxFloat(max[cell.col], cmax)
+	}
+	// Cells spanning several columns widen them evenly
+	for _, cell := range t.cells {
+		if cell.colspan == 1 {
+			continue
+		}
+		cmin, cmax := cell.block.widths(c)
+		var smin, smax float64
+		for i := cell.col; i < cell.col+cell.colspan; i++ {
+			smin += min[i]
+			smax += max[i]
+		}
+		for i := cell.col; i < cell.col+cell.colspan; i++ {
+			if cmin > smin {
+				min[i] += (cmin - smin) / float64(cell.colspan)
+			}
+			if cmax > smax {
+				max[i] += (cmax - smax) / float64(cell.colspan)
+			}
+		}
+	}
+	for i := range max {
+		max[i] = maxFloat(max[i], min[i])
+	}
+	return min, max
+}
+
+func (t *pdfTable) widths(c pdfCanvas) (float64, float64) {
+	min, max := t.columns(c)
+	var smin, smax float64
+	for i := range min {
+		smin += min[i]
+		smax += max[i]
+	}
+	if t.style.width.set && !t.style.width.percent {
+		return maxFloat(smin, t.style.width.value), t.style.width.value
+	}
+	return smin, smax
+}
+
+// layoutColumns sets the widths of the columns: the widths of the cells
+// first, the rest of the table shared by the other columns as their contents
+// need.
+func (t *pdfTable) layoutColumns(c pdfCanvas, width float64) {
+	min, max := t.columns(c)
+	fixed := make([]float64, t.cols)
+	isFixed := make([]bool, t.cols)
+	for _, cell := range t.cells {
+		if cell.colspan == 1 && cell.width.set {
+			fixed[cell.col] = maxFloat(fixed[cell.col], cell.width.resolve(width))
+			isFixed[cell.col] = true
+		}
+	}
+
+	var sumFixed, sumMax, sumMin float64
+	autos := 0
+	for i := 0; i < t.cols; i++ {
+		if isFixed[i] {
+			sumFixed += fixed[i]
+		} else {
+			sumMax += max[i]
+			sumMin += min[i]
+			autos++
+		}
+	}
+
+	if !t.style.width.set {
+		// As wide as the contents, up to the available width
+		width = minFloat(width, sumFixed+sumMax)
+	}
+	t.width = width
+	t.colWidths = make([]float64, t.cols)
+	rest := width - sumFixed
+	switch {
+	case autos == 0 && sumFixed > 0:
+		// The fixed columns are stretched or shrunk to the width
+		for i := range fixed {
+			t.colWidths[i] = fixed[i] * width / sumFixed
+		}
+		return
+	case rest < sumMin:
+		// Too narrow: the auto columns get their minimum, the fixed ones share the rest
+		if sumFixed > 0 {
+			scale := maxFloat(width-sumMin, 0) / sumFixed
+			for i := range fixed {
+				fixed[i] *= scale
+			}
+		}
+		rest = sumMin
+	}
+	for i := 0; i < t.cols; i++ {
+		switch {
+		case isFixed[i]:
+			t.colWidths[i] = fixed[i]
+		case sumMax > 0:
+			t.colWidths[i] = rest * max[i] / sumMax
+		default:
+			t.colWidths[i] = rest / float64(autos)
+		}
+	}
+}
+
+// span returns the offset of the first column or row of a cell and the width
+// or height of the cell.
+func span(sizes []float64, from, n int) (float64, float64) {
+	var offset, size float64
+	for i := 0; i < from; i++ {
+		offset += sizes[i]
+	}
+	for i := from; i < from+n; i++ {
+		size += sizes[i]
+	}
+	return offset, size
+}
+
+func (t *pdfTable) layout(c pdfCanvas, width float64) float64 {
+	avail := width
+	if t.style.width.set {
+		width = minFloat(t.style.width.resolve(avail), avail)
+	}
+	t.layoutColumns(c, width)
+	t.offset = 0
+	if t.style.centered {
+		t.offset = (avail - t.width) / 2
+	}
+
+	t.rowHeights = make([]float64, t.rows)
+	for i, min := range t.rowMin {
+		if min.set {
+			t.rowHeights[i] = min.value
+		}
+	}
+	// Single rows first, then the rowspans grow their last row
+	for pass := 0; pass < 2; pass++ {
+		for _, cell := range t.cells {
+			if (cell.rowspan == 1) != (pass == 0) {
+				continue
+			}
+			_, w := span(t.colWidths, cell.col, cell.colspan)
+			h := cell.block.layout(c, w)
+			_, have := span(t.rowHeights, cell.row, cell.rowspan)
+			if h > have {
+				t.rowHeights[cell.row+cell.rowspan-1] += h - have
+			}
+		}
+	}
+
+	// Rows grown to the height of the table, in proportion
+	_, h := span(t.rowHeights, 0, t.rows)
+	if t.style.height.set && h < t.style.height.value && t.rows > 0 {
+		extra := t.style.height.value - h
+		for i := range t.rowHeights {
+			if h > 0 {
+				t.rowHeights[i] += extra * t.rowHeights[i] / h
+			} else {
+				t.rowHeights[i] += extra / float64(t.rows)
+			}
+		}
+		h = t.style.height.value
+	}
+	return t.style.margin[0] + h + t.style.margin[2]
+}
+
+// drawRows draws the rows from first to last, excluded, at x, y.
+func (t *pdfTable) drawRows(c pdfCanvas, x, y float64, first, last int) {
+	_, top := span(t.rowHeights, 0, first)
+	for _, cell := range t.cells {
+		if cell.row < first || cell.row >= last {
+			continue
+		}
+		cx, w := span(t.colWidths, cell.col, cell.colspan)
+		cy, h := span(t.rowHeights, cell.row, cell.rowspan)
+		cx, cy = x+cx, y+cy-top
+
+		b := cell.block
+		b.drawDecoration(c, cx, cy, w, h)
+		var shift float64
+		switch free := h - b.boxHeight(); b.style.valign {
+		case "top":
+		case "bottom":
+			shift = free
+		default:
+			shift = free / 2
+		}
+		b.drawContent(c, cx, cy+maxFloat(shift, 0))
+	}
+
+	_, h := span(t.rowHeights, first, last-first)
+	drawPDFBorders(c, t.style.border, x, y, t.width, h, [4]bool{first == 0, true, last == t.rows, true})
+}
+
+func (t *pdfTable) draw(c pdfCanvas, x, y float64) {
+	t.drawRows(c, x+t.offset, y+t.style.margin[0], 0, t.rows)
+}
+
+func (t *pdfTable) slices(x float64) []pdfSlice {
+	x += t.offset
+	out := []pdfSlice{pdfSpace(t.style.margin[0])}
+
+	// Rows joined by rowspans stay on the same page
+	first, last := 0, 0
+	for first < t.rows {
+		last = first + 1
+		for grown := true; grown; {
+			grown = false
+			for _, cell := range t.cells {
+				if cell.row >= first && cell.row < last && cell.row+cell.rowspan > last {
+					last, grown = cell.row+cell.rowspan, true
+				}
+			}
+		}
+		from, to := first, last
+		_, h := span(t.rowHeights, from, to-from)
+		out = append(out, pdfSlice{h, func(c pdfCanvas, y float64) { t.drawRows(c, x, y, from, to) }})
+		first = last
+	}
+	return append(out, pdfSpace(t.style.margin[2]))
+}
+
+// pdfElementTextStyle returns the inherited style of n, from its tag and its
+// style attribute.
+func pdfElementTextStyle(n *html.Node, ts pdfTextStyle) pdfTextStyle {
+	switch n.DataAtom {
+	case atom.B, atom.Strong:
+		ts.font.bold = true
+	case atom.I, atom.Em, atom.Cite, atom.Var:
+		ts.font.italic = true
+	case atom.U, atom.Ins:
+		ts.font.underline = true
+	case atom.Small:
+		ts.font.size *= 0.83
+	case atom.Big:
+		ts.font.size *= 1.2
+	case atom.Center:
+		ts.align = "center"
+	case atom.Th:
+		ts.font.bold = true
+	case atom.Font:
+		if c, ok := parsePDFColor(attr(n, "color")); ok {
+			ts.color = c
+		}
+		if f := attr(n, "face"); f != "" {
+			ts.font.family = f
+		}
+	}
+	if size, ok := pdfHeadingSizes[n.DataAtom]; ok {
+		ts.font.size *= size
+		ts.font.bold = true
+	}
+	if a := attr(n, "align"); a != "" && n.DataAtom != atom.Table && n.DataAtom != atom.Img {
+		ts.align = strings.ToLower(a)
+	}
+
+	for _, d := range parseDeclarations(attr(n, "style")) {
+		v := strings.ToLower(d.value)
+		switch d.property {
+		case "font-weight":
+			w, err := strconv.Atoi(v)
+			ts.font.bold = v == "bold" || v == "bolder" || (err == nil && w >= 600)
+		case "font-style":
+			ts.font.italic = v == "italic" || v == "oblique"
+		case "font-size":
+			if size, ok := parsePDFFontSize(v, ts.font.size); ok {
+				ts.font.size = size
+			}
+		case "font-family":
+			ts.font.family = d.value
+		case "color":
+			if c, ok := parsePDFColor(v); ok {
+				ts.color = c
+			}
+		case "text-align":
+			ts.align = v
+		case "text-decoration", "text-decoration-line":
+			ts.font.underline = strings.Contains(v, "underline")
+		}
+	}
+	if ts.align == "justify" || ts.align == "start" {
+		ts.align = "left"
+	}
+	if ts.align == "end" {
+		ts.align = "right"
+	}
+	return ts
+}
+
+// pdfElementBoxStyle returns the box style of n, from its tag and its style
+// attribute, lengths in em relative to the font of ts.
+func pdfElementBoxStyle(n *html.Node, ts pdfTextStyle) pdfBoxStyle {
+	var s pdfBoxStyle
+	em := ts.font.size * ptMM
+	switch n.DataAtom {
+	case atom.P, atom.Ul, atom.Ol, atom.Dl, atom.Blockquote:
+		s.margin[0], s.margin[2] = em, em
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		s.margin[0], s.margin[2] = 0.67*em, 0.67*em
+	}
+	switch n.DataAtom {
+	case atom.Ul, atom.Ol:
+		s.padding[3] = 40 * pxMM
+	case atom.Blockquote:
+		s.padding[3], s.padding[1] = 40*pxMM, 40*pxMM
+	}
+	if c, ok := parsePDFColor(attr(n, "bgcolor")); ok {
+		s.background = &c
+	}
+
+	for _, d := range parseDeclarations(attr(n, "style")) {
+		v := strings.ToLower(d.value)
+		switch d.property {
+		case "width":
+			s.width, _ = parsePDFLength(v, em)
+		case "height":
+			s.height, _ = parsePDFLength(v, em)
+		case "min-height":
+			s.minHeight, _ = parsePDFLength(v, em)
+		case "margin":
+			sides := pdfSides(v)
+			for i, side := range sides {
+				l, _ := parsePDFLength(side, em)
+				s.margin[i] = l.value
+			}
+			s.centered = sides[1] == "auto" && sides[3] == "auto"
+		case "margin-top", "margin-right", "margin-bottom", "margin-left":
+			l, _ := parsePDFLength(v, em)
+			s.margin[pdfSide(d.property)] = l.value
+		case "padding":
+			for i, side := range pdfSides(v) {
+				l, _ := parsePDFLength(side, em)
+				s.padding[i] = l.value
+			}
+			s.paddingSet = true
+		case "padding-top", "padding-right", "padding-bottom", "padding-left":
+			l, _ := parsePDFLength(v, em)
+			s.padding[pdfSide(d.property)] = l.value
+			s.paddingSet = true
+		case "border":
+			b := parsePDFBorder(v, em)
+			s.border = [4]pdfBorder{b, b, b, b}
+		case "border-top", "border-right", "border-bottom", "border-left":
+			s.border[pdfSide(d.property)] = parsePDFBorder(v, em)
+		case "background", "background-color":
+			if c, ok := parsePDFColor(strings.Fields(v + " x")[0]); ok {
+				s.background = &c
+			}
+		case "vertical-align":
+			s.valign = v
+		}
+	}
+	// Margins set one by one, after the shorthand
+	for _, d := range parseDeclarations(attr(n, "style")) {
+		switch d.property {
+		case "margin-left", "margin-right":
+			s.centered = false
+		}
+	}
+	if s.valign == "text-top" {
+		s.valign = "top"
+	}
+	if s.valign == "text-bottom" || s.valign == "baseline" {
+		s.valign = "bottom"
+	}
+	if s.height.percent {
+		s.height = pdfLength{}
+	}
+	if s.minHeight.percent {
+		s.minHeight = pdfLength{}
+	}
+	return s
+}
+
+// pdfSide returns the index of the side named by the suffix of a property.
+func pdfSide(property string) int {
+	switch {
+	case strings.HasSuffix(property, "-top"):
+		return 0
+	case strings.HasSuffix(property, "-right"):
+		return 1
+	case strings.HasSuffix(property, "-bottom"):
+		return 2
+	}
+	return 3
+}
+
+// pdfSides expands the one to four values of a shorthand to top, right,
+// bottom and left.
+func pdfSides(v string) [4]string {
+	f := strings.Fields(v)
+	switch len(f) {
+	case 0:
+		return [4]string{}
+	case 1:
+		return [4]string{f[0], f[0], f[0], f[0]}
+	case 2:
+		return [4]string{f[0], f[1], f[0], f[1]}
+	case 3:
+		return [4]string{f[0], f[1], f[2], f[1]}
+	}
+	return [4]string{f[0], f[1], f[2], f[3]}
+}
+
+// parsePDFBorder parses a border shorthand, "1px solid black". Borders
+// without a width are 1px wide.
+func parsePDFBorder(v string, em float64) pdfBorder {
+	b := pdfBorder{width: pxMM, given: true}
+	for _, f := range strings.Fields(v) {
+		switch f {
+		case "none", "hidden", "0":
+			return pdfBorder{given: true}
+		case "thin":
+			b.width = pxMM
+		case "medium":
+			b.width = 3 * pxMM
+		case "thick":
+			b.width = 5 * pxMM
+		case "solid", "dashed", "dotted", "double", "groove", "ridge", "inset", "outset":
+		default:
+			if l, ok := parsePDFLength(f, em); ok && !l.percent {
+				b.width = l.value
+			} else if c, ok := parsePDFColor(f); ok {
+				b.color = c
+			}
+		}
+	}
+	if b.width <= 0 {
+		return pdfBorder{given: true}
+	}
+	return b
+}
+
+// pdfUnits are the lengths of the absolute CSS units, in millimetres.
+var pdfUnits = map[string]float64{
+	"mm": 1, "cm": 10, "in": 25.4, "pt": ptMM, "pc": 12 * ptMM, "px": pxMM,
+}
+
+// parsePDFLength parses a CSS length, em being the font size in millimetres.
+// Numbers without a unit are pixels.
+func parsePDFLength(v string, em float64) (pdfLength, bool) {
+	v = strings.TrimSpace(v)
+	num, unit := v, ""
+	for i := len(v) - 1; i >= 0; i-- {
+		if (v[i] >= '0' && v[i] <= '9') || v[i] == '.' {
+			num, unit = v[:i+1], v[i+1:]
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return pdfLength{}, false
+	}
+	switch unit {
+	case "%":
+		return pdfLength{value: f, percent: true, set: true}, true
+	case "em", "rem":
+		return pdfLength{value: f * em, set: true}, true
+	case "":
+		return pdfLength{value: f * pxMM, set: true}, true
+	}
+	if mm, ok := pdfUnits[unit]; ok {
+		return pdfLength{value: f * mm, set: true}, true
+	}
+	return pdfLength{}, false
+}
+
+// pdfAttrLength parses the length of a width or height attribute, pixels or
+// percents.
+func pdfAttrLength(v string) pdfLength {
+	if v == "" {
+		return pdfLength{}
+	}
+	l, _ := parsePDFLength(v, 0)
+	return l
+}
+
+// Font sizes of the CSS keywords, pt.
+var pdfFontSizes = map[string]float64{
+	"xx-small": 7, "x-small": 7.5, "small": 10, "medium": 12, "large": 13.5,
+	"x-large": 18, "xx-large": 24,
+}
+
+// parsePDFFontSize parses a CSS font size relative to parent, in pt.
+func parsePDFFontSize(v string, parent float64) (float64, bool) {
+	if size, ok := pdfFontSizes[v]; ok {
+		return size, true
+	}
+	switch v {
+	case "smaller":
+		return parent * 0.83, true
+	case "larger":
+		return parent * 1.2, true
+	}
+	l, ok := parsePDFLength(v, parent*ptMM)
+	if !ok || l.value == 0 {
+		return 0, false
+	}
+	if l.percent {
+		return parent * l.value / 100, true
+	}
+	return l.value / ptMM, true
+}
+
+// Named CSS colors, the common ones.
+var pdfColorNames = map[string]pdfColor{
+	"black": {0, 0, 0}, "white": {255, 255, 255}, "red": {255, 0, 0},
+	"green": {0, 128, 0}, "blue": {0, 0, 255}, "gray": {128, 128, 128},
+	"grey": {128, 128, 128}, "silver": {192, 192, 192}, "maroon": {128, 0, 0},
+	"navy": {0, 0, 128}, "yellow": {255, 255, 0}, "orange": {255, 165, 0},
+	"lightgray": {211, 211, 211}, "lightgrey": {211, 211, 211},
+	"darkgray": {169, 169, 169}, "darkgrey": {169, 169, 169},
+}
+
+// parsePDFColor parses a CSS color, #rgb, #rrggbb, rgb(r, g, b) or a name.
+func parsePDFColor(v string) (pdfColor, bool) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if c, ok := pdfColorNames[v]; ok {
+		return c, true
+	}
+	if strings.HasPrefix(v, "#") {
+		hex := v[1:]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		n, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || len(hex) != 6 {
+			return pdfColor{}, false
+		}
+		return pdfColor{int(n >> 16), int(n >> 8 & 0xff), int(n & 0xff)}, true
+	}
+	if strings.HasPrefix(v, "rgb(") && strings.HasSuffix(v, ")") {
+		parts := strings.Split(v[4:len(v)-1], ",")
+		if len(parts) != 3 {
+			return pdfColor{}, false
+		}
+		var rgb [3]int
+		for i, p := range parts {
+			n, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil || n < 0 || n > 255 {
+				return pdfColor{}, false
+			}
+			rgb[i] = n
+		}
+		return pdfColor{rgb[0], rgb[1], rgb[2]}, true
+	}
+	return pdfColor{}, false
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
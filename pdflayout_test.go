@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jung-kurt/gofpdf"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// recordingCanvas measures with gofpdf and the Go fonts, and records the
+// text drawn on each page.
+type recordingCanvas struct {
+	pdfCanvas
+	pages [][]recordedText
+}
+
+type recordedText struct {
+	x, y float64
+	s    string
+}
+
+func newRecordingCanvas() *recordingCanvas {
+	return &recordingCanvas{pdfCanvas: &gofpdfCanvas{
+		pdf:   gofpdf.New("P", "mm", "A4", ""),
+		fonts: testPDFFonts(),
+		added: map[string]bool{},
+	}}
+}
+
+func (r *recordingCanvas) addPage() {
+	r.pages = append(r.pages, nil)
+}
+
+func (r *recordingCanvas) text(x, y float64, s string, f pdfFont, c pdfColor) {
+	r.pages[len(r.pages)-1] = append(r.pages[len(r.pages)-1], recordedText{x, y, s})
+}
+
+func (r *recordingCanvas) fill(x, y, w, h float64, c pdfColor) {}
+
+func (r *recordingCanvas) line(x1, y1, x2, y2, width float64, c pdfColor) {}
+
+// layoutTestBody lays the body of src out in width.
+func layoutTestBody(t *testing.T, c pdfCanvas, src string, width float64) *pdfBlock {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body *html.Node
+	walkElements(doc, func(n *html.Node) {
+		if n.DataAtom == atom.Body {
+			body = n
+		}
+	})
+	b := newPDFBlock(body, pdfTextStyle{font: pdfFont{family: "go", size: pdfFontSize}, align: "left"})
+	b.layout(c, width)
+	return b
+}
+
+// lineTexts returns the text of the lines of p.
+func lineTexts(p *pdfParagraph) []string {
+	var out []string
+	for _, l := range p.lines {
+		var b strings.Builder
+		for _, f := range l.fragments {
+			b.WriteString(f.text)
+		}
+		out = append(out, b.String())
+	}
+	return out
+}
+
+// TestPDFParagraph ensures white space and line breaks are laid out as the
+// browsers do
+func TestPDFParagraph(t *testing.T) {
+	t.Parallel()
+
+	c := newRecordingCanvas()
+	narrow := c.measure("Счёт на оплату", pdfFont{family: "go", size: pdfFontSize}) + 0.1
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		src   string
+		width float64
+		// Expected results.
+		want []string
+	}{
+		{"Collapsed spaces", "  Счёт \n\t на  оплату ", 100, []string{"Счёт на оплату"}},
+		{"Styles", "Счёт <b>на</b> оплату", 100, []string{"Счёт на оплату"}},
+		{"Break", "Счёт<br>на оплату", 100, []string{"Счёт", "на оплату"}},
+		{"Space around a break", "Счёт <br> на оплату", 100, []string{"Счёт", "на оплату"}},
+		{"Trailing break", "Счёт<br>", 100, []string{"Счёт"}},
+		{"Two trailing breaks", "Счёт<br><br>", 100, []string{"Счёт", ""}},
+		{"Empty line", "Счёт<br><br>на оплату", 100, []string{"Счёт", "", "на оплату"}},
+		{"Only a break", "<br>", 100, []string{""}},
+		{"Wrapped", "Счёт на оплату № 42", narrow, []string{"Счёт на оплату", "№ 42"}},
+		{"Non-breaking space", "Счёт на оплату&nbsp;№ 42", narrow, []string{"Счёт на", "оплату" + nbsp + "№ 42"}},
+		{"Long word", "Счёт_на_оплату_№_42 от", narrow, []string{"Счёт_на_оплату_№_42", "от"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			b := layoutTestBody(t, newRecordingCanvas(), "<p>"+tt.src+"</p>", tt.width)
+			p := b.children[0].(*pdfBlock).children[0].(*pdfParagraph)
+			assert.Equal(t, tt.want, lineTexts(p), tt.name)
+		})
+	}
+}
+
+// TestPDFTable ensures the widths of the columns and the heights of the
+// rows, rowspans included
+func TestPDFTable(t *testing.T) {
+	t.Parallel()
+
+	line := pdfFontSize * ptMM * pdfLineHeight
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		src string
+		// Expected results.
+		colWidths  []float64
+		rowHeights []float64
+	}{
+		{
+			"Fixed column",
+			`<table style="width: 100mm" cellpadding="0">
+			<tr><td style="width: 20mm">А</td><td>Б</td></tr>
+			</table>`,
+			[]float64{20, 80},
+			[]float64{line},
+		},
+		{
+			"Percent column",
+			`<table width="100%" cellpadding="0">
+			<tr><td width="25%">А</td><td>Б</td></tr>
+			</table>`,
+			[]float64{45, 135},
+			[]float64{line},
+		},
+		{
+			"Row height",
+			`<table style="width: 100mm" cellpadding="0">
+			<tr style="height: 30mm"><td width="50%">А</td><td>Б</td></tr>
+			<tr><td height="20mm">А</td><td>Б</td></tr>
+			</table>`,
+			[]float64{50, 50},
+			[]float64{30, 20},
+		},
+		{
+			"Rowspan growing its last row",
+			`<table style="width: 100mm" cellpadding="0">
+			<tr><td style="width: 20mm">А</td><td rowspan="2">1<br>2<br>3<br>4<br>5</td></tr>
+			<tr><td>Б</td></tr>
+			<tr><td colspan="2">В</td></tr>
+			</table>`,
+			[]float64{20, 80},
+			[]float64{line, 4 * line, line},
+		},
+		{
+			"Table height",
+			`<table style="width: 100mm; height: 40mm" cellpadding="0">
+			<tr style="height: 10mm"><td>А</td></tr>
+			<tr style="height: 30mm"><td>Б</td></tr>
+			<tr style="height: 10mm"><td>В</td></tr>
+			</table>`,
+			[]float64{100},
+			[]float64{10, 30, 10},
+		},
+		{
+			"Grown to the table height",
+			`<table style="width: 100mm; height: 60mm" cellpadding="0">
+			<tr style="height: 10mm"><td>А</td></tr>
+			<tr style="height: 20mm"><td>Б</td></tr>
+			</table>`,
+			[]float64{100},
+			[]float64{20, 40},
+		},
+		{
+			"Padding and borders",
+			`<table border="1" cellpadding="2mm" style="width: 100mm">
+			<tr><td style="width: 30mm">А</td><td style="width: 30mm">Б</td></tr>
+			</table>`,
+			[]float64{50, 50},
+			[]float64{line + 4 + 2*pxMM},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			b := layoutTestBody(t, newRecordingCanvas(), tt.src, 180)
+			table := b.children[0].(*pdfTable)
+			assert.InDeltaSlice(t, tt.colWidths, table.colWidths, 0.001, tt.name)
+			assert.InDeltaSlice(t, tt.rowHeights, table.rowHeights, 0.001, tt.name)
+		})
+	}
+}
+
+// TestPaginate ensures long tables continue on the next pages, without
+// splitting the rows joined by rowspans
+func TestPaginate(t *testing.T) {
+	t.Parallel()
+
+	var src bytes.Buffer
+	src.WriteString(`<h1>Счёт</h1><table border="1" width="100%">`)
+	for i := 0; i < 100; i += 2 {
+		fmt.Fprintf(&src, `<tr><td>%d</td><td rowspan="2">Позиция %d</td></tr><tr><td>%d</td></tr>`, i, i/2, i+1)
+	}
+	src.WriteString(`</table><p>Итого</p>`)
+
+	doc, err := html.Parse(&src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newRecordingCanvas()
+	paginate(c, layoutHTML(c, doc, "go", pdfMargin, 180), pdfMargin, pdfPageHeight-pdfMargin)
+
+	if len(c.pages) < 3 {
+		t.Fatalf("paginate() pages = %d, want 3 or more", len(c.pages))
+	}
+	assert.Equal(t, "Счёт", c.pages[0][0].s, "title")
+	last := c.pages[len(c.pages)-1]
+	assert.Equal(t, "Итого", last[len(last)-1].s, "total")
+
+	rows := map[string]int{}
+	for page, texts := range c.pages {
+		for _, text := range texts {
+			if text.y < pdfMargin || text.y > pdfPageHeight-pdfMargin {
+				t.Errorf("page %d: %q at %.1f, out of the page", page, text.s, text.y)
+			}
+			rows[text.s] = page
+		}
+	}
+	for i := 0; i < 100; i += 2 {
+		first, second := rows[fmt.Sprint(i)], rows[fmt.Sprint(i+1)]
+		assert.Equal(t, first, second, "rows %d and %d", i, i+1)
+		assert.Equal(t, first, rows[fmt.Sprintf("Позиция %d", i/2)], "rowspan of row %d", i)
+	}
+}
+
+// TestParsePDFLength ensures the CSS lengths are converted to millimetres
+func TestParsePDFLength(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		v string
+		// Expected results.
+		want pdfLength
+		ok   bool
+	}{
+		{"Millimetres", "15mm", pdfLength{value: 15, set: true}, true},
+		{"Centimetres", "1.5cm", pdfLength{value: 15, set: true}, true},
+		{"Inches", "1in", pdfLength{value: 25.4, set: true}, true},
+		{"Points", "72pt", pdfLength{value: 25.4, set: true}, true},
+		{"Pixels", "96px", pdfLength{value: 25.4, set: true}, true},
+		{"Unitless pixels", " 96 ", pdfLength{value: 25.4, set: true}, true},
+		{"Em", "2em", pdfLength{value: 8, set: true}, true},
+		{"Percent", "50%", pdfLength{value: 50, percent: true, set: true}, true},
+		{"Zero", "0", pdfLength{value: 0, set: true}, true},
+		{"Negative", "-1mm", pdfLength{}, false},
+		{"Keyword", "auto", pdfLength{}, false},
+		{"Unknown unit", "10vh", pdfLength{}, false},
+		{"Empty", "", pdfLength{}, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, ok := parsePDFLength(tt.v, 4)
+			assert.Equal(t, tt.ok, ok, tt.name)
+			assert.InDelta(t, tt.want.value, got.value, 0.0001, tt.name)
+			assert.Equal(t, tt.want.percent, got.percent, tt.name)
+			assert.Equal(t, tt.want.set, got.set, tt.name)
+		})
+	}
+}
+
+// TestParsePDFColor ensures the CSS colors of the invoices are read
+func TestParsePDFColor(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		v string
+		// Expected results.
+		want pdfColor
+		ok   bool
+	}{
+		{"Name", "Black", pdfColor{0, 0, 0}, true},
+		{"Short hex", "#fA0", pdfColor{255, 170, 0}, true},
+		{"Hex", "#1a2b3c", pdfColor{26, 43, 60}, true},
+		{"RGB", "rgb(1, 2, 3)", pdfColor{1, 2, 3}, true},
+		{"Bad hex", "#12", pdfColor{}, false},
+		{"Not hex", "#ggg", pdfColor{}, false},
+		{"RGB out of range", "rgb(256, 0, 0)", pdfColor{}, false},
+		{"RGBA", "rgba(0, 0, 0, 0.5)", pdfColor{}, false},
+		{"Unknown name", "transparent", pdfColor{}, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, ok := parsePDFColor(tt.v)
+			assert.Equal(t, tt.ok, ok, tt.name)
+			assert.Equal(t, tt.want, got, tt.name)
+		})
+	}
+}
+
+// TestParsePDFBorder ensures the border shorthands are read in any order
+func TestParsePDFBorder(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		v string
+		// Expected results.
+		want pdfBorder
+	}{
+		{"Full", "1px solid black", pdfBorder{pxMM, pdfColor{0, 0, 0}, true}},
+		{"Any order", "#f00 dashed 2mm", pdfBorder{2, pdfColor{255, 0, 0}, true}},
+		{"Style only", "solid", pdfBorder{pxMM, pdfColor{}, true}},
+		{"Keyword width", "thick solid", pdfBorder{5 * pxMM, pdfColor{}, true}},
+		{"None", "none", pdfBorder{given: true}},
+		{"Zero", "0", pdfBorder{given: true}},
+		{"Zero width", "0mm solid", pdfBorder{given: true}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := parsePDFBorder(tt.v, 4)
+			assert.InDelta(t, tt.want.width, got.width, 0.0001, tt.name)
+			assert.Equal(t, tt.want.color, got.color, tt.name)
+			assert.Equal(t, tt.want.given, got.given, tt.name)
+		})
+	}
+}
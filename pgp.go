@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/golang/glog"
+)
+
+// Policies applied when a recipient has no key in the PGP keyring.
+const (
+	PGPMissingKeyFail  = "fail"  // the message is not sent
+	PGPMissingKeyPlain = "plain" // the message is sent unencrypted, signed when possible
+	PGPMissingKeySkip  = "skip"  // the recipient does not get the message
+)
+
+// pgpSigner signs and encrypts the MIME entity of a message as OpenPGP/MIME
+// (RFC 3156).
+type pgpSigner struct {
+	key        *openpgp.Entity
+	keyring    string
+	missingKey string
+	config     *packet.Config
+}
+
+// newPGPSigner loads the private key of info, if any, and checks the
+// keyring and the missing key policy.
+func newPGPSigner(info *PGPInfo) (*pgpSigner, error) {
+	s := &pgpSigner{
+		keyring:    info.Keyring,
+		missingKey: strings.ToLower(info.MissingKey),
+		config:     &packet.Config{DefaultHash: crypto.SHA256, DefaultCipher: packet.CipherAES256},
+	}
+	switch s.missingKey {
+	case "":
+		s.missingKey = PGPMissingKeyFail
+	case PGPMissingKeyFail, PGPMissingKeyPlain, PGPMissingKeySkip:
+	default:
+		return nil, fmt.Errorf("pgp: unknown missing_key policy %q", info.MissingKey)
+	}
+
+	if info.KeyFile != "" {
+		keys, err := readKeyRing(info.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 || keys[0].PrivateKey == nil {
+			return nil, fmt.Errorf("pgp: no private key in %s", info.KeyFile)
+		}
+		s.key = keys[0]
+		if err := decryptEntity(s.key, info.Passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.keyring != "" {
+		if _, err := readKeyRing(s.keyring); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.key == nil && s.keyring == "" {
+		return nil, errors.New("pgp: neither a private key nor a keyring is set")
+	}
+	return s, nil
+}
+
+// readKeyRing reads an armored or binary keyring.
+func readKeyRing(filename string) (openpgp.EntityList, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	head, _ := r.Peek(5)
+	var keys openpgp.EntityList
+	if string(head) == "-----" {
+		keys, err = openpgp.ReadArmoredKeyRing(r)
+	} else {
+		keys, err = openpgp.ReadKeyRing(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pgp: %s: %v", filename, err)
+	}
+	return keys, nil
+}
+
+// decryptEntity unlocks the private key and subkeys of e.
+func decryptEntity(e *openpgp.Entity, passphrase string) error {
+	keys := []*packet.PrivateKey{e.PrivateKey}
+	for _, sub := range e.Subkeys {
+		if sub.PrivateKey != nil {
+			keys = append(keys, sub.PrivateKey)
+		}
+	}
+	for _, k := range keys {
+		if !k.Encrypted {
+			continue
+		}
+		if passphrase == "" {
+			return errors.New("pgp: the private key is protected, passphrase required")
+		}
+		if err := k.Decrypt([]byte(passphrase)); err != nil {
+			return fmt.Errorf("pgp: %v", err)
+		}
+	}
+	return nil
+}
+
+// recipientKeys looks up the keys of addrs in the keyring, applying the
+// missing key policy: it returns the keys to encrypt for (nil to send
+// unencrypted) and the addresses that must not get the message.
+func (s *pgpSigner) recipientKeys(addrs []string) (openpgp.EntityList, []string, error) {
+	if s.keyring == "" || len(addrs) == 0 {
+		return nil, nil, nil
+	}
+
+	// The keyring is read on every message, so keys can be added without a
+	// restart
+	keyring, err := readKeyRing(s.keyring)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var keys openpgp.EntityList
+	var skipped []string
+	for _, addr := range addrs {
+		key := findPGPKey(keyring, addr, time.Now())
+		if key != nil {
+			keys = append(keys, key)
+			continue
+		}
+
+		switch s.missingKey {
+		case PGPMissingKeyPlain:
+			if glog.V(2) {
+				glog.Infof("LOG: PGP: no key for %s, sending unencrypted", addr)
+			}
+			return nil, nil, nil
+		case PGPMissingKeySkip:
+			if glog.V(2) {
+				glog.Infof("LOG: PGP: no key for %s, skipping the recipient", addr)
+			}
+			skipped = append(skipped, addr)
+		default:
+			return nil, nil, fmt.Errorf("pgp: no key for %s", addr)
+		}
+	}
+
+	// Let the sender read its own copy
+	if s.key != nil && len(keys) > 0 {
+		keys = append(keys, s.key)
+	}
+	return keys, skipped, nil
+}
+
+// findPGPKey returns the newest key of keyring with a valid identity for
+// addr, or nil.
+func findPGPKey(keyring openpgp.EntityList, addr string, now time.Time) *openpgp.Entity {
+	var found *openpgp.Entity
+	for _, e := range keyring {
+		if e.Revoked(now) {
+			continue
+		}
+		for _, id := range e.Identities {
+			if id.UserId == nil || !strings.EqualFold(id.UserId.Email, addr) {
+				continue
+			}
+			if id.Revoked(now) || (id.SelfSignature != nil && e.PrimaryKey.KeyExpired(id.SelfSignature, now)) {
+				continue
+			}
+			if found == nil || e.PrimaryKey.CreationTime.After(found.PrimaryKey.CreationTime) {
+				found = e
+			}
+		}
+	}
+	return found
+}
+
+// skippedRecipients returns the addresses that must not get the message,
+// failing when the policy does not allow a missing key.
+func (s *pgpSigner) skippedRecipients(addrs []string) ([]string, error) {
+	_, skipped, err := s.recipientKeys(addrs)
+	return skipped, err
+}
+
+// wrap signs the canonical MIME entity when a private key is set, and
+// encrypts the result for the recipients found in the keyring, returning the
+// new entity.
+func (s *pgpSigner) wrap(entity []byte, recipients []string) ([]byte, error) {
+	keys, skipped, err := s.recipientKeys(recipients)
+	if err != nil {
+		return nil, err
+	}
+	if len(skipped) > 0 && len(keys) == 0 {
+		// Never fall back to plain text when skipping recipients
+		return nil, errors.New("pgp: no recipient has a key")
+	}
+
+	if s.key != nil {
+		boundary, err := randomBoundary()
+		if err != nil {
+			return nil, err
+		}
+		if entity, err = s.sign(entity, boundary); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(keys) > 0 {
+		boundary, err := randomBoundary()
+		if err != nil {
+			return nil, err
+		}
+		return s.encrypt(entity, keys, boundary)
+	}
+	return entity, nil
+}
+
+// sign returns a multipart/signed entity holding entity and its detached
+// signature.
+func (s *pgpSigner) sign(entity []byte, boundary string) ([]byte, error) {
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, s.key, bytes.NewReader(entity), s.config); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Content-Type: multipart/signed; protocol=\"application/pgp-signature\";\r\n\tmicalg=pgp-sha256; boundary=\"%s\"\r\n\r\n", boundary)
+	fmt.Fprintf(&buf, "This is an OpenPGP/MIME signed message (RFC 3156)\r\n\r\n--%s\r\n", boundary)
+	buf.Write(entity)
+	fmt.Fprintf(&buf, "\r\n--%s\r\n", boundary)
+	buf.WriteString("Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n")
+	buf.WriteString("Content-Description: OpenPGP digital signature\r\n")
+	buf.WriteString("Content-Disposition: attachment; filename=\"signature.asc\"\r\n\r\n")
+	buf.Write(canonicalCRLF(sig.Bytes()))
+	fmt.Fprintf(&buf, "\r\n--%s--\r\n", boundary)
+	return buf.Bytes(), nil
+}
+
+// encrypt returns a multipart/encrypted entity holding entity encrypted for
+// keys.
+func (s *pgpSigner) encrypt(entity []byte, keys openpgp.EntityList, boundary string) ([]byte, error) {
+	var msg bytes.Buffer
+	aw, err := armor.Encode(&msg, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := openpgp.Encrypt(aw, keys, nil, nil, s.config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pw.Write(entity); err != nil {
+		return nil, err
+	}
+	if err := pw.Close(); err != nil {
+		return nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\";\r\n\tboundary=\"%s\"\r\n\r\n", boundary)
+	fmt.Fprintf(&buf, "This is an OpenPGP/MIME encrypted message (RFC 3156)\r\n\r\n--%s\r\n", boundary)
+	buf.WriteString("Content-Type: application/pgp-encrypted\r\n")
+	buf.WriteString("Content-Description: PGP/MIME version identification\r\n\r\n")
+	buf.WriteString("Version: 1\r\n")
+	fmt.Fprintf(&buf, "\r\n--%s\r\n", boundary)
+	buf.WriteString("Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n")
+	buf.WriteString("Content-Description: OpenPGP encrypted message\r\n")
+	buf.WriteString("Content-Disposition: inline; filename=\"encrypted.asc\"\r\n\r\n")
+	buf.Write(canonicalCRLF(msg.Bytes()))
+	fmt.Fprintf(&buf, "\r\n--%s--\r\n", boundary)
+	return buf.Bytes(), nil
+}
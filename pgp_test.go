@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestPGPKeys creates the key of the sender and of a recipient, storing
+// the private key of the sender and a public keyring holding the recipient
+// in dir.
+func writeTestPGPKeys(t *testing.T, dir string) (string, string, *openpgp.Entity, *openpgp.Entity) {
+	sender, err := openpgp.NewEntity("Invoices", "", "invoice@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buyer, err := openpgp.NewEntity("Buyer", "", "buyer@example.net", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(dir, "private.asc")
+	keyringFile := filepath.Join(dir, "pubring.gpg")
+
+	var priv bytes.Buffer
+	w, err := armor.Encode(&priv, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err := ioutil.WriteFile(keyFile, priv.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var pub bytes.Buffer
+	if err := buyer.Serialize(&pub); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyringFile, pub.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return keyFile, keyringFile, sender, buyer
+}
+
+// splitPGPParts returns the two parts of a multipart/signed or
+// multipart/encrypted body, byte for byte.
+func splitPGPParts(t *testing.T, body []byte, boundary string) ([]byte, []byte) {
+	delim := "--" + boundary
+	start := strings.Index(string(body), delim+"\r\n") + len(delim) + 2
+	end := strings.LastIndex(string(body), "\r\n"+delim+"\r\n")
+	if start < len(delim)+2 || end < start {
+		t.Fatalf("body = %q, want two parts", body)
+	}
+	second := string(body[end+len(delim)+4:])
+	second = second[:strings.Index(second, "\r\n"+delim+"--")]
+	return body[start:end], []byte(second)
+}
+
+// partBody strips the headers of a part.
+func partBody(part []byte) []byte {
+	return part[bytes.Index(part, []byte("\r\n\r\n"))+4:]
+}
+
+// TestPGP signs and encrypts messages and checks them with the openpgp
+// package
+func TestPGP(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pgp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile, keyringFile, sender, buyer := writeTestPGPKeys(t, dir)
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		info PGPInfo
+		to   []string
+		// Expected results.
+		encrypted bool
+		signed    bool
+		rcpts     []string
+		wantErr   bool
+	}{
+		{
+			"Sign",
+			PGPInfo{KeyFile: keyFile},
+			[]string{"buyer@example.net"},
+			false,
+			true,
+			[]string{"buyer@example.net"},
+			false,
+		},
+		{
+			"Sign and encrypt",
+			PGPInfo{KeyFile: keyFile, Keyring: keyringFile},
+			[]string{"Buyer <Buyer@example.net>"},
+			true,
+			true,
+			[]string{"Buyer <Buyer@example.net>"},
+			false,
+		},
+		{
+			"Encrypt only",
+			PGPInfo{Keyring: keyringFile},
+			[]string{"buyer@example.net"},
+			true,
+			false,
+			[]string{"buyer@example.net"},
+			false,
+		},
+		{
+			"Missing key, fail",
+			PGPInfo{KeyFile: keyFile, Keyring: keyringFile},
+			[]string{"buyer@example.net", "other@example.net"},
+			false,
+			false,
+			nil,
+			true,
+		},
+		{
+			"Missing key, plain",
+			PGPInfo{KeyFile: keyFile, Keyring: keyringFile, MissingKey: "plain"},
+			[]string{"buyer@example.net", "other@example.net"},
+			false,
+			true,
+			[]string{"buyer@example.net", "other@example.net"},
+			false,
+		},
+		{
+			"Missing key, skip",
+			PGPInfo{KeyFile: keyFile, Keyring: keyringFile, MissingKey: "skip"},
+			[]string{"buyer@example.net", "other@example.net"},
+			true,
+			true,
+			[]string{"buyer@example.net"},
+			false,
+		},
+		{
+			"All keys missing, skip",
+			PGPInfo{KeyFile: keyFile, Keyring: keyringFile, MissingKey: "skip"},
+			[]string{"other@example.net"},
+			false,
+			false,
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		// Not parallel, the keys are removed when the test returns
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := newPGPSigner(&tt.info)
+			if err != nil {
+				t.Fatalf("%q. newPGPSigner() error = %v", tt.name, err)
+			}
+
+			m := &MailYak{
+				toAddrs:   tt.to,
+				fromAddr:  "invoice@example.org",
+				subject:   "Invoice",
+				trimRegex: regexp.MustCompile("\r?\n"),
+				date:      time.Now().Format(time.RFC1123Z),
+				headers:   map[string]string{},
+				pgp:       signer,
+			}
+			m.Plain().Set("Invoice in attachment\n")
+			m.Attach("invoice.txt", strings.NewReader("Total: 105.23"))
+
+			rcpts, err := m.envelopeRecipients()
+			if tt.rcpts != nil || err != nil {
+				assert.Equal(t, tt.rcpts, rcpts, tt.name)
+			}
+
+			var buf bytes.Buffer
+			_, err = m.WriteTo(&buf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. MailYak.WriteTo() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			msg, err := netmail.ReadMessage(&buf)
+			if err != nil {
+				t.Fatalf("%q. ReadMessage() error = %v", tt.name, err)
+			}
+			body, err := ioutil.ReadAll(msg.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatalf("%q. Content-Type error = %v", tt.name, err)
+			}
+
+			if tt.encrypted {
+				if mediaType != "multipart/encrypted" || params["protocol"] != "application/pgp-encrypted" {
+					t.Fatalf("%q. Content-Type = %q, want multipart/encrypted", tt.name, msg.Header.Get("Content-Type"))
+				}
+				version, encrypted := splitPGPParts(t, body, params["boundary"])
+				assert.Equal(t, "Version: 1\r\n", string(partBody(version)), tt.name)
+
+				block, err := armor.Decode(bytes.NewReader(partBody(encrypted)))
+				if err != nil {
+					t.Fatalf("%q. armor.Decode() error = %v", tt.name, err)
+				}
+				md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{buyer}, nil, nil)
+				if err != nil {
+					t.Fatalf("%q. openpgp.ReadMessage() error = %v", tt.name, err)
+				}
+				entity, err := ioutil.ReadAll(md.UnverifiedBody)
+				if err != nil {
+					t.Fatal(err)
+				}
+				inner, err := netmail.ReadMessage(bytes.NewReader(entity))
+				if err != nil {
+					t.Fatalf("%q. ReadMessage(decrypted) error = %v", tt.name, err)
+				}
+				if body, err = ioutil.ReadAll(inner.Body); err != nil {
+					t.Fatal(err)
+				}
+				if mediaType, params, err = mime.ParseMediaType(inner.Header.Get("Content-Type")); err != nil {
+					t.Fatalf("%q. Content-Type error = %v", tt.name, err)
+				}
+			}
+
+			if !tt.signed {
+				assert.Equal(t, "multipart/mixed", mediaType, tt.name)
+				return
+			}
+
+			if mediaType != "multipart/signed" || params["protocol"] != "application/pgp-signature" || params["micalg"] != "pgp-sha256" {
+				t.Fatalf("%q. Content-Type = %q, want multipart/signed", tt.name, mediaType)
+			}
+			content, sig := splitPGPParts(t, body, params["boundary"])
+			if !bytes.HasPrefix(content, []byte("Content-Type: multipart/mixed;")) {
+				t.Errorf("%q. signed content = %q, want the multipart/mixed entity", tt.name, content)
+			}
+
+			keyring := openpgp.EntityList{sender}
+			if _, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(content), bytes.NewReader(partBody(sig)), nil); err != nil {
+				t.Errorf("%q. CheckArmoredDetachedSignature() error = %v", tt.name, err)
+			}
+			tampered := append(append([]byte{}, content...), ' ')
+			if _, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(tampered), bytes.NewReader(partBody(sig)), nil); err == nil {
+				t.Errorf("%q. CheckArmoredDetachedSignature() of tampered content passed", tt.name)
+			}
+		})
+	}
+}
+
+// TestPGPSendSkip ensures recipients without a key are left out of the SMTP
+// transaction and the headers under the skip policy
+func TestPGPSendSkip(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pgp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, keyringFile, _, _ := writeTestPGPKeys(t, dir)
+
+	srv := newTestSMTPServer(t)
+	defer srv.Close()
+	info := srv.info()
+	info.PGP = PGPInfo{Keyring: keyringFile, MissingKey: "skip"}
+	info.expand()
+
+	mail := NewMail(&info)
+	mail.From("invoice@example.org")
+	mail.To("buyer@example.net")
+	mail.Cc("other@example.net")
+	mail.Subject("Invoice")
+	mail.Plain().Set("Invoice in attachment")
+
+	if err := mail.Send(); err != nil {
+		t.Fatalf("MailYak.Send() error = %v", err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	assert.Equal(t, [][]string{{"buyer@example.net"}}, srv.rcpts)
+	assert.Equal(t, 1, len(srv.messages))
+	assert.Contains(t, srv.messages[0], "multipart/encrypted")
+	assert.NotContains(t, srv.messages[0], "Invoice in attachment")
+	// Nor shown to the others
+	assert.Contains(t, srv.messages[0], "To: buyer@example.net")
+	assert.NotContains(t, srv.messages[0], "other@example.net")
+	srv.mu.Unlock()
+
+	// Nobody left to send to is a failure, not a sent message
+	mail.To("other@example.net")
+	mail.Cc()
+	err = mail.Send()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "all recipients skipped")
+	}
+	srv.mu.Lock()
+	assert.Equal(t, 1, len(srv.messages))
+}
+
+// TestNewPGPSigner ensures bad settings are rejected
+func TestNewPGPSigner(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pgp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile, keyringFile, _, _ := writeTestPGPKeys(t, dir)
+
+	tests := []struct {
+		name string
+		info PGPInfo
+	}{
+		{"Nothing set", PGPInfo{}},
+		{"Unknown policy", PGPInfo{Keyring: keyringFile, MissingKey: "ignore"}},
+		{"Public key as private key", PGPInfo{KeyFile: keyringFile}},
+		{"Missing keyring", PGPInfo{KeyFile: keyFile, Keyring: filepath.Join(dir, "missing.gpg")}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newPGPSigner(&tt.info); err == nil {
+				t.Errorf("%q. newPGPSigner() error = nil, want an error", tt.name)
+			}
+		})
+	}
+}
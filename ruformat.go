@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// nbsp separates the thousands and the currency sign in formatted amounts,
+// so they are never broken across lines.
+const nbsp = "\u00a0"
+
+// kopecks is an amount of money in kopecks, the template functions pass
+// amounts as kopecks to keep the arithmetic exact.
+type kopecks int64
+
+// String returns the amount in rubles, e.g. 105.23, as the functions accept
+// it back.
+func (k kopecks) String() string {
+	sign := ""
+	if k < 0 {
+		sign, k = "-", -k
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, k/100, k%100)
+}
+
+// toKopecks converts an amount in rubles to kopecks. Strings may use a comma
+// as decimal separator and spaces between the thousands, e.g. "1 234,5";
+// more than two decimals are rounded half away from zero.
+func toKopecks(v interface{}) (kopecks, error) {
+	switch v := v.(type) {
+	case kopecks:
+		return v, nil
+	case int:
+		return kopecks(v) * 100, nil
+	case int64:
+		return kopecks(v) * 100, nil
+	case float64:
+		return kopecks(math.Round(v * 100)), nil
+	case json.Number:
+		return parseKopecks(v.String())
+	case string:
+		return parseKopecks(v)
+	}
+	return 0, fmt.Errorf("not an amount: %v (%T)", v, v)
+}
+
+// parseKopecks parses an amount in rubles, see toKopecks.
+func parseKopecks(s string) (kopecks, error) {
+	clean := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		if r == ',' {
+			return '.'
+		}
+		return r
+	}, s)
+
+	neg := strings.HasPrefix(clean, "-")
+	clean = strings.TrimPrefix(strings.TrimPrefix(clean, "-"), "+")
+	whole, frac := clean, ""
+	if i := strings.IndexByte(clean, '.'); i >= 0 {
+		whole, frac = clean[:i], clean[i+1:]
+	}
+	if whole == "" && frac == "" || !allDigits(whole) || !allDigits(frac) {
+		return 0, fmt.Errorf("not an amount: %q", s)
+	}
+
+	rubles := int64(0)
+	if whole != "" {
+		var err error
+		if rubles, err = strconv.ParseInt(whole, 10, 64); err != nil || rubles > math.MaxInt64/100-1 {
+			return 0, fmt.Errorf("amount out of range: %q", s)
+		}
+	}
+	cents := 0
+	for i := 0; i < 2; i++ {
+		cents *= 10
+		if i < len(frac) {
+			cents += int(frac[i] - '0')
+		}
+	}
+	if len(frac) > 2 && frac[2] >= '5' {
+		cents++
+	}
+
+	k := kopecks(rubles*100 + int64(cents))
+	if neg {
+		k = -k
+	}
+	return k, nil
+}
+
+// allDigits reports whether s holds ASCII digits only.
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// toRate converts a VAT rate in percent, e.g. 20 or "20%".
+func toRate(v interface{}) (int64, error) {
+	var rate int64
+	switch v := v.(type) {
+	case int:
+		rate = int64(v)
+	case int64:
+		rate = v
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("not a VAT rate: %v", v)
+		}
+		rate = int64(v)
+	case json.Number:
+		return toRate(v.String())
+	case string:
+		var err error
+		if rate, err = strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(v), "%"), 10, 64); err != nil {
+			return 0, fmt.Errorf("not a VAT rate: %q", v)
+		}
+	default:
+		return 0, fmt.Errorf("not a VAT rate: %v (%T)", v, v)
+	}
+	if rate < 0 || rate > 100 {
+		return 0, fmt.Errorf("VAT rate out of range: %d", rate)
+	}
+	return rate, nil
+}
+
+// roundDiv returns n/d rounded half away from zero, d > 0.
+func roundDiv(n, d int64) int64 {
+	if n < 0 {
+		return -((-n*2 + d) / (2 * d))
+	}
+	return (n*2 + d) / (2 * d)
+}
+
+// formatMoney formats an amount as "1 234 567,89 ₽".
+func formatMoney(v interface{}) (string, error) {
+	k, err := toKopecks(v)
+	if err != nil {
+		return "", err
+	}
+	return formatAmount(k) + nbsp + "₽", nil
+}
+
+// formatAmount formats an amount as "1 234 567,89".
+func formatAmount(k kopecks) string {
+	sign := ""
+	if k < 0 {
+		sign, k = "-", -k
+	}
+	digits := strconv.FormatInt(int64(k/100), 10)
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(nbsp)
+		}
+		b.WriteRune(d)
+	}
+	return fmt.Sprintf("%s%s,%02d", sign, b.String(), k%100)
+}
+
+// vatIncluded returns the VAT included in sum at rate percent.
+func vatIncluded(sum, rate interface{}) (kopecks, error) {
+	k, r, err := vatArgs(sum, rate)
+	if err != nil {
+		return 0, err
+	}
+	return kopecks(roundDiv(int64(k)*r, 100+r)), nil
+}
+
+// vatOnTop returns the VAT charged on top of sum at rate percent.
+func vatOnTop(sum, rate interface{}) (kopecks, error) {
+	k, r, err := vatArgs(sum, rate)
+	if err != nil {
+		return 0, err
+	}
+	return kopecks(roundDiv(int64(k)*r, 100)), nil
+}
+
+// withoutVAT returns sum less the VAT it includes at rate percent.
+func withoutVAT(sum, rate interface{}) (kopecks, error) {
+	vat, err := vatIncluded(sum, rate)
+	if err != nil {
+		return 0, err
+	}
+	k, _ := toKopecks(sum)
+	return k - vat, nil
+}
+
+// withVAT returns sum plus the VAT charged on top of it at rate percent.
+func withVAT(sum, rate interface{}) (kopecks, error) {
+	vat, err := vatOnTop(sum, rate)
+	if err != nil {
+		return 0, err
+	}
+	k, _ := toKopecks(sum)
+	return k + vat, nil
+}
+
+// vatArgs converts the arguments of the VAT functions.
+func vatArgs(sum, rate interface{}) (kopecks, int64, error) {
+	k, err := toKopecks(sum)
+	if err != nil {
+		return 0, 0, err
+	}
+	r, err := toRate(rate)
+	if err != nil {
+		return 0, 0, err
+	}
+	return k, r, nil
+}
+
+// Russian numerals, by gender where they differ.
+var (
+	ruUnitsMasculine = []string{"", "один", "два", "три", "четыре", "пять", "шесть", "семь", "восемь", "девять"}
+	ruUnitsFeminine  = []string{"", "одна", "две", "три", "четыре", "пять", "шесть", "семь", "восемь", "девять"}
+	ruTeens          = []string{"десять", "одиннадцать", "двенадцать", "тринадцать", "четырнадцать", "пятнадцать", "шестнадцать", "семнадцать", "восемнадцать", "девятнадцать"}
+	ruTens           = []string{"", "", "двадцать", "тридцать", "сорок", "пятьдесят", "шестьдесят", "семьдесят", "восемьдесят", "девяносто"}
+	ruHundreds       = []string{"", "сто", "двести", "триста", "четыреста", "пятьсот", "шестьсот", "семьсот", "восемьсот", "девятьсот"}
+)
+
+// ruNoun holds the forms of a noun after a numeral: один рубль, два рубля,
+// пять рублей.
+type ruNoun struct {
+	one, few, many string
+	feminine       bool
+}
+
+var (
+	ruRuble  = ruNoun{"рубль", "рубля", "рублей", false}
+	ruKopeck = ruNoun{"копейка", "копейки", "копеек", true}
+	ruScales = []ruNoun{
+		{"тысяча", "тысячи", "тысяч", true},
+		{"миллион", "миллиона", "миллионов", false},
+		{"миллиард", "миллиарда", "миллиардов", false},
+		{"триллион", "триллиона", "триллионов", false},
+		{"квадриллион", "квадриллиона", "квадриллионов", false},
+	}
+	ruMonthsGenitive = []string{"января", "февраля", "марта", "апреля", "мая", "июня", "июля", "августа", "сентября", "октября", "ноября", "декабря"}
+)
+
+// form returns the form of the noun agreeing with n.
+func (w ruNoun) form(n int64) string {
+	if n < 0 {
+		n = -n
+	}
+	switch n %= 100; {
+	case n >= 11 && n <= 19:
+		return w.many
+	case n%10 == 1:
+		return w.one
+	case n%10 >= 2 && n%10 <= 4:
+		return w.few
+	}
+	return w.many
+}
+
+// ruTriad writes n, below 1000, in words.
+func ruTriad(n int64, feminine bool) []string {
+	var words []string
+	if h := n / 100; h > 0 {
+		words = append(words, ruHundreds[h])
+	}
+	switch t := n % 100; {
+	case t >= 10 && t <= 19:
+		words = append(words, ruTeens[t-10])
+	default:
+		if t/10 > 0 {
+			words = append(words, ruTens[t/10])
+		}
+		if u := t % 10; u > 0 {
+			if feminine {
+				words = append(words, ruUnitsFeminine[u])
+			} else {
+				words = append(words, ruUnitsMasculine[u])
+			}
+		}
+	}
+	return words
+}
+
+// ruNumber writes n in words, agreeing in gender with the counted noun.
+func ruNumber(n int64, feminine bool) string {
+	if n == 0 {
+		return "ноль"
+	}
+	var words []string
+	if n < 0 {
+		words = append(words, "минус")
+		n = -n
+	}
+
+	var triads []int64
+	for ; n > 0; n /= 1000 {
+		triads = append(triads, n%1000)
+	}
+	for i := len(triads) - 1; i >= 0; i-- {
+		t := triads[i]
+		if t == 0 {
+			continue
+		}
+		if i == 0 {
+			words = append(words, ruTriad(t, feminine)...)
+			continue
+		}
+		scale := ruScales[i-1]
+		words = append(words, ruTriad(t, scale.feminine)...)
+		words = append(words, scale.form(t))
+	}
+	return strings.Join(words, " ")
+}
+
+// moneyInWords writes an amount as Russian accounting documents require,
+// e.g. "сто пять рублей 23 копейки".
+func moneyInWords(v interface{}) (string, error) {
+	k, err := toKopecks(v)
+	if err != nil {
+		return "", err
+	}
+	rubles, cents := int64(k/100), int64(k%100)
+	if cents < 0 {
+		cents = -cents
+	}
+	words := ruNumber(rubles, ruRuble.feminine)
+	if k < 0 && rubles == 0 {
+		words = "минус " + words
+	}
+	return fmt.Sprintf("%s %s %02d %s", words, ruRuble.form(rubles), cents, ruKopeck.form(cents)), nil
+}
+
+// dateLayouts are the accepted formats of the dates given as strings.
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"02.01.2006",
+}
+
+// toDate converts a time.Time or a string in one of the dateLayouts.
+func toDate(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		s := strings.TrimSpace(v)
+		for _, layout := range dateLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("not a date: %q", v)
+	}
+	return time.Time{}, fmt.Errorf("not a date: %v (%T)", v, v)
+}
+
+// longDate formats a date as "18 октября 2026 г.".
+func longDate(v interface{}) (string, error) {
+	t, err := toDate(v)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d %s %d г.", t.Day(), ruMonthsGenitive[t.Month()-1], t.Year()), nil
+}
+
+// shortDate formats a date as "18.10.2026".
+func shortDate(v interface{}) (string, error) {
+	t, err := toDate(v)
+	if err != nil {
+		return "", err
+	}
+	return t.Format("02.01.2006"), nil
+}
+
+// capitalize upper-cases the first letter of s, for amounts in words
+// opening a sentence.
+func capitalize(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	if r == utf8.RuneError {
+		return s
+	}
+	return string(unicode.ToUpper(r)) + s[size:]
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ru replaces the spaces of want with the non-breaking ones of the amounts
+func ru(want string) string {
+	return strings.Replace(want, " ", nbsp, -1)
+}
+
+// TestToKopecks ensures amounts are read from the job parameters and JSON
+// exactly
+func TestToKopecks(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		v interface{}
+		// Expected results.
+		want    kopecks
+		wantErr bool
+	}{
+		{"Dot", "105.23", 10523, false},
+		{"Comma", "105,23", 10523, false},
+		{"Thousands", "1 234 567,89", 123456789, false},
+		{"Non-breaking thousands", ru("1 234 567,89"), 123456789, false},
+		{"One decimal", "1234,5", 123450, false},
+		{"No decimals", "4200", 420000, false},
+		{"Only decimals", ".5", 50, false},
+		{"Rounded up", "17,538", 1754, false},
+		{"Rounded down", "17,534", 1753, false},
+		{"Negative", "-87,69", -8769, false},
+		{"Float", 105.23, 10523, false},
+		{"Float rounding", 0.1 + 0.2, 30, false},
+		{"Int", 1500, 150000, false},
+		{"JSON number", json.Number("2450.80"), 245080, false},
+		{"Kopecks", kopecks(1754), 1754, false},
+		{"Empty", "", 0, true},
+		{"Letters", "105,23 руб.", 0, true},
+		{"Two separators", "1.234,56", 0, true},
+		{"Out of range", "999999999999999999999", 0, true},
+		{"Boolean", true, 0, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := toKopecks(tt.v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. toKopecks() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got, tt.name)
+		})
+	}
+}
+
+// TestFormatMoney ensures amounts are written as 1 234,50 ₽
+func TestFormatMoney(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		v interface{}
+		// Expected results.
+		want    string
+		wantErr bool
+	}{
+		{"Small", "105.23", ru("105,23 ₽"), false},
+		{"Thousands", "4500", ru("4 500,00 ₽"), false},
+		{"Millions", "1234567.89", ru("1 234 567,89 ₽"), false},
+		{"Hundred thousands", 118000, ru("118 000,00 ₽"), false},
+		{"Kopecks only", "0.07", ru("0,07 ₽"), false},
+		{"Refund", "-2450.8", ru("-2 450,80 ₽"), false},
+		{"Not an amount", "сто", "", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := formatMoney(tt.v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. formatMoney() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got, tt.name)
+		})
+	}
+}
+
+// TestVAT ensures the VAT of invoices is computed to the kopeck
+func TestVAT(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		sum  interface{}
+		rate interface{}
+		// Expected results.
+		vat, without, onTop, with kopecks
+		wantErr                   bool
+	}{
+		{"20%", "105.23", 20, 1754, 8769, 2105, 12628, false},
+		{"20% round sum", "118000", "20%", 1966667, 9833333, 2360000, 14160000, false},
+		{"10%", "2450.80", "10", 22280, 222800, 24508, 269588, false},
+		{"0%", "1500", 0, 0, 150000, 0, 150000, false},
+		{"Half kopeck", "0.03", 20, 1, 2, 1, 4, false},
+		{"Refund", "-105.23", 20, -1754, -8769, -2105, -12628, false},
+		{"JSON", json.Number("1200"), json.Number("20"), 20000, 100000, 24000, 144000, false},
+		{"Fractional rate", "100", 20.5, 0, 0, 0, 0, true},
+		{"Rate out of range", "100", 120, 0, 0, 0, 0, true},
+		{"Bad rate", "100", "НДС", 0, 0, 0, 0, true},
+		{"Bad sum", "сто", 20, 0, 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			for _, f := range []struct {
+				name string
+				fn   func(sum, rate interface{}) (kopecks, error)
+				want kopecks
+			}{
+				{"vatIncluded", vatIncluded, tt.vat},
+				{"withoutVAT", withoutVAT, tt.without},
+				{"vatOnTop", vatOnTop, tt.onTop},
+				{"withVAT", withVAT, tt.with},
+			} {
+				got, err := f.fn(tt.sum, tt.rate)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("%q. %s() error = %v, wantErr %v", tt.name, f.name, err, tt.wantErr)
+				}
+				assert.Equal(t, f.want, got, "%s %s", tt.name, f.name)
+			}
+		})
+	}
+}
+
+// TestMoneyInWords ensures the numerals agree with рубль and копейка
+func TestMoneyInWords(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		v interface{}
+		// Expected results.
+		want    string
+		wantErr bool
+	}{
+		{"Request example", "105.23", "сто пять рублей 23 копейки", false},
+		{"One", "1.01", "один рубль 01 копейка", false},
+		{"Few", "2.02", "два рубля 02 копейки", false},
+		{"Teens", "11.11", "одиннадцать рублей 11 копеек", false},
+		{"Twenty one", "21.21", "двадцать один рубль 21 копейка", false},
+		{"Zero", "0", "ноль рублей 00 копеек", false},
+		{"Kopecks only", "0.50", "ноль рублей 50 копеек", false},
+		{"Feminine thousand", "1001", "одна тысяча один рубль 00 копеек", false},
+		{"Two thousand", "2450.80", "две тысячи четыреста пятьдесят рублей 80 копеек", false},
+		{"Twenty two thousand", "22000", "двадцать две тысячи рублей 00 копеек", false},
+		{"Teen thousands", "12345.67", "двенадцать тысяч триста сорок пять рублей 67 копеек", false},
+		{"Invoice with VAT", "118000", "сто восемнадцать тысяч рублей 00 копеек", false},
+		{"Million", "1000000", "один миллион рублей 00 копеек", false},
+		{"Millions", "1234567.89", "один миллион двести тридцать четыре тысячи пятьсот шестьдесят семь рублей 89 копеек", false},
+		{"Billions", "3000000004.04", "три миллиарда четыре рубля 04 копейки", false},
+		{"Negative", "-5.05", "минус пять рублей 05 копеек", false},
+		{"Negative kopecks", "-0.21", "минус ноль рублей 21 копейка", false},
+		{"Not an amount", "", "", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := moneyInWords(tt.v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. moneyInWords() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got, tt.name)
+		})
+	}
+}
+
+// TestLongDate ensures dates are written with the genitive month names
+func TestLongDate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		v interface{}
+		// Expected results.
+		want, short string
+		wantErr     bool
+	}{
+		{"ISO", "2026-10-18", "18 октября 2026 г.", "18.10.2026", false},
+		{"Russian", "01.03.2026", "1 марта 2026 г.", "01.03.2026", false},
+		{"RFC 3339", "2026-05-09T10:00:00+03:00", "9 мая 2026 г.", "09.05.2026", false},
+		{"Timestamp", "2026-12-31 23:59:59", "31 декабря 2026 г.", "31.12.2026", false},
+		{"Time", time.Date(2027, time.January, 15, 0, 0, 0, 0, time.UTC), "15 января 2027 г.", "15.01.2027", false},
+		{"Not a date", "18 октября", "", "", true},
+		{"Not a string", 20261018, "", "", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := longDate(tt.v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. longDate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got, tt.name)
+
+			got, err = shortDate(tt.v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. shortDate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			assert.Equal(t, tt.short, got, tt.name)
+		})
+	}
+}
+
+// TestTemplateFuncs ensures the helpers are available to the templates,
+// partials and layouts, and that bad values fail the rendering
+func TestTemplateFuncs(t *testing.T) {
+	t.Parallel()
+
+	dir := writeTestTemplates(t, map[string]string{
+		"invoice.txt": "Счёт от {{longDate .PAYMENT_DATE}}\n" +
+			"Итого: {{money .PAYMENT_SUM_WITH_VAT}}, в т.ч. НДС 20%: {{money (vat .PAYMENT_SUM_WITH_VAT 20)}}\n" +
+			"{{template \"in_words\" .}}",
+		"invoice.html":            `<p>{{money (withoutVat .PAYMENT_SUM_WITH_VAT 20)}}</p>`,
+		"invoice.subject":         `Счёт от {{shortDate .PAYMENT_DATE}}`,
+		"_partials/in_words.txt":  `{{capitalize (moneyInWords .PAYMENT_SUM_WITH_VAT)}}`,
+		"_layouts/default.txt":    "{{template \"content\" .}}\n{{money (withVat .PAYMENT_SUM 20)}}",
+		"broken_date.txt":         `{{longDate .PAYMENT_SUM}}`,
+		"broken_sum.txt":          `{{money .PAYMENT_DATE}}`,
+		"_partials/unused.txt":    `{{addVat "1" 20}}`,
+		"_partials/unused_2.html": `{{money "1"}}`,
+	})
+	defer os.RemoveAll(dir)
+
+	s, err := loadTemplateSet(dir, "")
+	if err != nil {
+		t.Fatalf("loadTemplateSet() error = %v", err)
+	}
+	prop := map[string]string{
+		"PAYMENT_DATE":         "2026-10-18",
+		"PAYMENT_SUM":          "87.69",
+		"PAYMENT_SUM_WITH_VAT": "105.23",
+	}
+	data, err := templateData(&prop)
+	if err != nil {
+		t.Fatalf("templateData() error = %v", err)
+	}
+
+	got, err := s.render(templateRef{name: "invoice", layout: "default"}, data)
+	if err != nil {
+		t.Fatalf("templateSet.render() error = %v", err)
+	}
+	assert.Equal(t, &renderedMail{
+		subject: "Счёт от 18.10.2026",
+		plain: "Счёт от 18 октября 2026 г.\n" +
+			"Итого: " + ru("105,23 ₽") + ", в т.ч. НДС 20%: " + ru("17,54 ₽") + "\n" +
+			"Сто пять рублей 23 копейки\n" +
+			ru("105,23 ₽"),
+		html: ru("<p>87,69 ₽</p>"),
+	}, got)
+
+	for _, name := range []string{"broken_date", "broken_sum"} {
+		if _, err := s.render(templateRef{name: name}, data); err == nil {
+			t.Errorf("%q. templateSet.render() error = nil, want an error", name)
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+  "fmt"
+  "os"
   "path/filepath"
-  "io/ioutil"
-  "bytes"
+  "strconv"
   "strings"
+  "time"
   "github.com/golang/glog"
 )
 
@@ -32,12 +34,37 @@ func sendMail(smtp_settings *map[string]SMTPInfo, prop *map[string]string) bool
     glog.Errorf("ERR: SEND MAIL: 'SEND_FROM(%s)' not found", mailFromName)
     return false
   }
+  if mailFrom.broken != nil {
+    glog.Errorf("ERR: SEND MAIL: 'SEND_FROM(%s)' is disabled: %v", mailFromName, mailFrom.broken)
+    return false
+  }
   mailTo, ok = (*prop)["SEND_MAIL_TO"]
   if !ok {
     glog.Errorf("ERR: SEND MAIL: 'SEND_MAIL_TO' don`t set\n")
     return false
   }
+  // Bodies and subject rendered from the job parameters
+  var rendered *renderedMail
+  if _, ok := (*prop)["SEND_MAIL_TEMPLATE"]; ok {
+    if globConf.templates == nil {
+      glog.Errorf("ERR: SEND MAIL: templates are not loaded")
+      return false
+    }
+    data, err := templateData(prop)
+    if err != nil {
+      glog.Errorf("ERR: SEND MAIL: %v", err)
+      return false
+    }
+    ref := templateRefFromParams(prop, mailFrom.Layout)
+    if rendered, err = globConf.templates.set().render(ref, data); err != nil {
+      glog.Errorf("ERR: SEND MAIL: %v", err)
+      return false
+    }
+  }
   mailSubject, ok = (*prop)["SEND_MAIL_SUBJECT"]
+  if rendered != nil && rendered.subject != "" {
+    mailSubject, ok = rendered.subject, true
+  }
   if !ok {
     glog.Errorf("ERR: SEND MAIL: 'SEND_MAIL_SUBJECT' don`t set\n")
     return false
@@ -51,9 +78,38 @@ func sendMail(smtp_settings *map[string]SMTPInfo, prop *map[string]string) bool
 
   mail.From(mailFrom.UserLogin)
   mail.FromName(mailFrom.UserName)
+  mail.ImagesPath(globConf.TemplatesPath)
   
   mail.Subject(mailSubject)
 
+  if err := headersFromParams(mail, prop, &mailFrom); err != nil {
+    glog.Errorf("ERR: SEND MAIL: %v", err)
+    return false
+  }
+
+  // Markdown body converted into both parts, the explicit bodies win
+  if src, ok := (*prop)[markdownParam]; ok {
+    var md *renderedMail
+    var err error
+    ref := templateRefFromParams(prop, mailFrom.Layout)
+    if ref.layout == "" {
+      md, err = renderMarkdown(src)
+    } else if globConf.templates == nil {
+      err = fmt.Errorf("templates are not loaded, layout %q", ref.layout)
+    } else {
+      var data map[string]interface{}
+      if data, err = templateData(prop); err == nil {
+        md, err = globConf.templates.set().renderMarkdown(ref, data)
+      }
+    }
+    if err != nil {
+      glog.Errorf("ERR: SEND MAIL: MARKDOWN: %v", err)
+      return false
+    }
+    mail.Plain().Set(md.plain)
+    mail.HTML().Set(md.html)
+  }
+
   mailBody, ok = (*prop)["SEND_MAIL_BODY_PLAIN"]
   if ok {
     mail.Plain().Set(mailBody)
@@ -62,6 +118,14 @@ func sendMail(smtp_settings *map[string]SMTPInfo, prop *map[string]string) bool
   if ok {
     mail.HTML().Set(mailBody)
   }
+  if rendered != nil {
+    if rendered.plain != "" {
+      mail.Plain().Set(rendered.plain)
+    }
+    if rendered.html != "" {
+      mail.HTML().Set(rendered.html)
+    }
+  }
   
   attachments, ok = (*prop)["SEND_MAIL_ATTACMENTS"]
   if ok {
@@ -74,21 +138,95 @@ func sendMail(smtp_settings *map[string]SMTPInfo, prop *map[string]string) bool
         if glog.V(9) {
           glog.Infof("DBG: SEND MAIL: READ FILE: %v", filename)
         }
-        rawBytes, err := ioutil.ReadFile(filename)
-        if err != nil {
+        if _, err := os.Stat(filename); err != nil {
           glog.Errorf("ERR: SEND MAIL: CANN`T READ FILE(%s): %v", filename, err)
           return false
         }
 
-        mail.Attach(filepath.Base(filename), bytes.NewBuffer(rawBytes))
+        // The file is re-read for every recipient
+        mail.AttachSource(filepath.Base(filename), FileSource(filename))
       }
     }
   }
   
+  // Templates rendered into attachments, kept in memory
+  if list, ok := (*prop)["SEND_MAIL_ATTACH_TEMPLATES"]; ok {
+    if globConf.templates == nil {
+      glog.Errorf("ERR: SEND MAIL: templates are not loaded")
+      return false
+    }
+    data, err := templateData(prop)
+    if err != nil {
+      glog.Errorf("ERR: SEND MAIL: %v", err)
+      return false
+    }
+    rendered, err := globConf.templates.set().renderAttachments(list, (*prop)["SEND_MAIL_LOCALE"], data, globConf.PDF.fonts)
+    if err != nil {
+      glog.Errorf("ERR: SEND MAIL: %v", err)
+      return false
+    }
+    for _, a := range rendered {
+      if glog.V(9) {
+        glog.Infof("DBG: SEND MAIL: RENDERED FILE: %v (%d bytes)", a.filename, len(a.content))
+      }
+      mail.AttachSourceWithMimeType(a.filename, BytesSource(a.content), a.mimeType)
+    }
+  }
+
+  // ST00012 payment QR code, inline when the HTML body shows it as cid:<name>
+  if name, ok := (*prop)["SEND_MAIL_PAYMENT_QR"]; ok {
+    qr, err := paymentQR(prop)
+    if err != nil {
+      glog.Errorf("ERR: SEND MAIL: PAYMENT QR: %v", err)
+      return false
+    }
+    if name = filepath.Base(strings.TrimSpace(name)); name == "." || name == string(filepath.Separator) {
+      name = "payment-qr.png"
+    }
+    if strings.Contains(mail.HTML().String(), "cid:" + name) {
+      mail.AttachInlineSourceWithMimeType(name, BytesSource(qr), "image/png")
+    } else {
+      mail.AttachSourceWithMimeType(name, BytesSource(qr), "image/png")
+    }
+  }
+
   arMailTo := strings.Split(mailTo + ";", ";")
+
+  if _, ok = (*prop)["SEND_MAIL_ICAL_START"]; ok {
+    ev, err := eventFromParams(prop, &mailFrom, mailSubject, arMailTo)
+    if err == nil {
+      err = mail.Calendar(ev)
+    }
+    if err != nil {
+      glog.Errorf("ERR: SEND MAIL: ICAL: %v", err)
+      return false
+    }
+    if glog.V(2) {
+      glog.Infof("LOG: SEND MAIL: ICAL %s (UID=%s, SEQUENCE=%d)", ev.method(), ev.UID, ev.Sequence)
+    }
+  }
+
+  // Non-transactional mails carry a category recipients can unsubscribe from
+  category := (*prop)["SEND_MAIL_CATEGORY"]
+  unsubscribe := &globConf.Unsubscribe
+  if category != "" && !unsubscribe.enabled() {
+    glog.Errorf("ERR: SEND MAIL: unsubscribe is not configured, SEND_MAIL_CATEGORY(%s) can not be sent", category)
+    return false
+  }
+
   result := true  
   for _, mail2 := range arMailTo {
     if mail2 != "" {
+      if category != "" {
+        addr := unsubscribeAddr(mail2)
+        if unsubscribe.list.contains(addr, category) {
+          if glog.V(2) {
+            glog.Infof("LOG: SEND MAIL(%s: %s): unsubscribed from %s, skipped", mail2, mailSubject, category)
+          }
+          continue
+        }
+        unsubscribe.addHeaders(mail, addr, category)
+      }
       if glog.V(2) {
         glog.Infof("LOG: SENDING MAIL(%s: %s) ...", mail2, mailSubject)
       }
@@ -110,3 +248,164 @@ func sendMail(smtp_settings *map[string]SMTPInfo, prop *map[string]string) bool
   return result
 }
 
+// headersFromParams sets the optional headers of the SEND_MAIL_* parameters:
+//
+//   SEND_MAIL_PRIORITY        high, normal (default) or low, or 1 to 5
+//   SEND_MAIL_READ_RECEIPT    address receiving read receipts, "true" for the sender
+//   SEND_MAIL_AUTO_SUBMITTED  auto-generated (default), auto-replied or no
+//   SEND_MAIL_DATE            Date of backdated or imported mail, RFC 1123 or an
+//                             icalTimeLayouts time in the profile time zone;
+//                             the time of sending when unset
+func headersFromParams(mail *MailYak, prop *map[string]string, from *SMTPInfo) error {
+  p := *prop
+
+  if err := mail.Priority(p["SEND_MAIL_PRIORITY"]); err != nil {
+    return fmt.Errorf("bad SEND_MAIL_PRIORITY: %v", err)
+  }
+
+  receipt := p["SEND_MAIL_READ_RECEIPT"]
+  switch strings.ToLower(receipt) {
+  case "true", "yes", "1":
+    receipt = from.UserLogin
+  case "false", "no", "0":
+    receipt = ""
+  }
+  mail.ReadReceipt(receipt)
+
+  if value, ok := p["SEND_MAIL_AUTO_SUBMITTED"]; ok {
+    if err := mail.AutoSubmitted(value); err != nil {
+      return fmt.Errorf("bad SEND_MAIL_AUTO_SUBMITTED: %v", err)
+    }
+  }
+
+  if date, ok := p["SEND_MAIL_DATE"]; ok {
+    t, err := time.Parse(time.RFC1123Z, strings.TrimSpace(date))
+    if err != nil {
+      loc := time.Local
+      if from.location != nil {
+        loc = from.location
+      }
+      if t, err = parseICalTime(date, loc); err != nil {
+        return fmt.Errorf("bad SEND_MAIL_DATE: %v", err)
+      }
+    }
+    mail.Date(t)
+  }
+  return nil
+}
+
+// icalTimeLayouts are the accepted formats of SEND_MAIL_ICAL_START and
+// SEND_MAIL_ICAL_END; all but RFC 3339 are read in SEND_MAIL_ICAL_TIMEZONE.
+var icalTimeLayouts = []string{
+  "2006-01-02 15:04",
+  "2006-01-02T15:04",
+  "2006-01-02 15:04:05",
+  "2006-01-02T15:04:05",
+  "02.01.2006 15:04",
+}
+
+// eventFromParams builds a calendar invitation from the SEND_MAIL_ICAL_*
+// parameters:
+//
+//   SEND_MAIL_ICAL_METHOD       REQUEST (default), UPDATE or CANCEL
+//   SEND_MAIL_ICAL_UID          event UID, required: the process keeps it for UPDATE and CANCEL
+//   SEND_MAIL_ICAL_SEQUENCE     revision, derived from the clock for UPDATE and CANCEL when unset
+//   SEND_MAIL_ICAL_START        start time
+//   SEND_MAIL_ICAL_END          end time, one hour after the start when unset
+//   SEND_MAIL_ICAL_TIMEZONE     IANA time zone, e.g. Europe/Moscow
+//   SEND_MAIL_ICAL_SUMMARY      title, the mail subject when unset
+//   SEND_MAIL_ICAL_DESCRIPTION  description
+//   SEND_MAIL_ICAL_LOCATION     location
+//   SEND_MAIL_ICAL_ORGANIZER    organizer address, the sender when unset
+//   SEND_MAIL_ICAL_ATTENDEES    ';' separated attendee addresses, the recipients when unset
+func eventFromParams(prop *map[string]string, from *SMTPInfo, subject string, mailTo []string) (*Event, error) {
+  p := *prop
+  ev := &Event{
+    UID:         p["SEND_MAIL_ICAL_UID"],
+    Summary:     p["SEND_MAIL_ICAL_SUMMARY"],
+    Description: p["SEND_MAIL_ICAL_DESCRIPTION"],
+    Location:    p["SEND_MAIL_ICAL_LOCATION"],
+    Organizer:   Attendee{Name: from.UserName, Email: from.UserLogin},
+  }
+  if ev.Summary == "" {
+    ev.Summary = subject
+  }
+  if organizer, ok := p["SEND_MAIL_ICAL_ORGANIZER"]; ok {
+    ev.Organizer = Attendee{Email: organizer}
+  }
+
+  method := strings.ToUpper(p["SEND_MAIL_ICAL_METHOD"])
+  switch method {
+  case "", CalendarRequest:
+    ev.Method = CalendarRequest
+  case "UPDATE":
+    ev.Method = CalendarRequest
+  case CalendarCancel:
+    ev.Method = CalendarCancel
+  default:
+    return nil, fmt.Errorf("unknown SEND_MAIL_ICAL_METHOD(%s)", method)
+  }
+  // A generated UID would never reach the process, so no later UPDATE or
+  // CANCEL could refer to the event
+  if ev.UID = strings.TrimSpace(ev.UID); ev.UID == "" {
+    return nil, fmt.Errorf("SEND_MAIL_ICAL_UID is required")
+  }
+
+  if seq, ok := p["SEND_MAIL_ICAL_SEQUENCE"]; ok {
+    n, err := strconv.Atoi(seq)
+    if err != nil || n < 0 {
+      return nil, fmt.Errorf("bad SEND_MAIL_ICAL_SEQUENCE(%s)", seq)
+    }
+    ev.Sequence = n
+  } else if method == "UPDATE" || method == CalendarCancel {
+    // Minutes since the epoch always exceed the sequence of earlier revisions
+    ev.Sequence = int(time.Now().Unix() / 60)
+  }
+
+  loc := time.UTC
+  if tz, ok := p["SEND_MAIL_ICAL_TIMEZONE"]; ok {
+    var err error
+    if loc, err = time.LoadLocation(tz); err != nil {
+      return nil, fmt.Errorf("bad SEND_MAIL_ICAL_TIMEZONE(%s): %v", tz, err)
+    }
+    ev.TimeZone = loc
+  }
+
+  var err error
+  if ev.Start, err = parseICalTime(p["SEND_MAIL_ICAL_START"], loc); err != nil {
+    return nil, fmt.Errorf("bad SEND_MAIL_ICAL_START: %v", err)
+  }
+  if end, ok := p["SEND_MAIL_ICAL_END"]; ok {
+    if ev.End, err = parseICalTime(end, loc); err != nil {
+      return nil, fmt.Errorf("bad SEND_MAIL_ICAL_END: %v", err)
+    }
+  } else {
+    ev.End = ev.Start.Add(time.Hour)
+  }
+
+  attendees := mailTo
+  if list, ok := p["SEND_MAIL_ICAL_ATTENDEES"]; ok {
+    attendees = strings.Split(list, ";")
+  }
+  for _, a := range attendees {
+    if a = strings.TrimSpace(a); a != "" {
+      ev.Attendees = append(ev.Attendees, Attendee{Email: a})
+    }
+  }
+
+  return ev, nil
+}
+
+// parseICalTime parses s in one of the icalTimeLayouts.
+func parseICalTime(s string, loc *time.Location) (time.Time, error) {
+  s = strings.TrimSpace(s)
+  if t, err := time.Parse(time.RFC3339, s); err == nil {
+    return t, nil
+  }
+  for _, layout := range icalTimeLayouts {
+    if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+      return t, nil
+    }
+  }
+  return time.Time{}, fmt.Errorf("unknown time format %q", s)
+}
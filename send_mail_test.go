@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSendMailAttachmentsToEveryRecipient ensures every recipient receives
+// the full attachment, not just the first one
+func TestSendMailAttachmentsToEveryRecipient(t *testing.T) {
+	t.Parallel()
+
+	srv := newTestSMTPServer(t)
+	defer srv.Close()
+
+	settings := map[string]SMTPInfo{"notify_mail": srv.info()}
+	prop := map[string]string{
+		"SEND_MAIL_FROM":       "notify_mail",
+		"SEND_MAIL_TO":         "first@example.org;second@example.org",
+		"SEND_MAIL_SUBJECT":    "Invoice",
+		"SEND_MAIL_BODY_HTML":  "Invoice in attachment",
+		"SEND_MAIL_ATTACMENTS": "./storage/invoice.ru.1.html",
+	}
+	assert.True(t, sendMail(&settings, &prop))
+
+	invoice, err := ioutil.ReadFile("./storage/invoice.ru.1.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(invoice)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	assert.Equal(t, [][]string{{"first@example.org"}, {"second@example.org"}}, srv.rcpts)
+	for i, msg := range srv.messages {
+		// Strip the line breaks of the base64 body
+		flat := strings.NewReplacer("\r\n", "", "\n", "").Replace(msg)
+		assert.Contains(t, flat, encoded, "message #%d", i)
+	}
+}
+
+// TestEventFromParams ensures BPMN parameters are turned into invitations
+func TestEventFromParams(t *testing.T) {
+	t.Parallel()
+
+	from := SMTPInfo{UserLogin: "notify@example.org", UserName: "Notify"}
+	to := []string{"first@example.org", "second@example.org", ""}
+
+	prop := map[string]string{
+		"SEND_MAIL_ICAL_UID":      "inspection-42@example.org",
+		"SEND_MAIL_ICAL_START":    "2026-10-20 10:00",
+		"SEND_MAIL_ICAL_TIMEZONE": "Europe/Moscow",
+		"SEND_MAIL_ICAL_LOCATION": "Office",
+	}
+	ev, err := eventFromParams(&prop, &from, "Inspection", to)
+	if err != nil {
+		t.Fatalf("eventFromParams() error = %v", err)
+	}
+	assert.Equal(t, CalendarRequest, ev.Method)
+	assert.Equal(t, "Inspection", ev.Summary)
+	assert.Equal(t, "2026-10-20T07:00:00Z", ev.Start.UTC().Format(time.RFC3339))
+	assert.Equal(t, time.Hour, ev.End.Sub(ev.Start))
+	assert.Equal(t, Attendee{Name: "Notify", Email: "notify@example.org"}, ev.Organizer)
+	assert.Equal(t, []Attendee{{Email: "first@example.org"}, {Email: "second@example.org"}}, ev.Attendees)
+	assert.Equal(t, "inspection-42@example.org", ev.UID)
+
+	prop = map[string]string{
+		"SEND_MAIL_ICAL_METHOD": "UPDATE",
+		"SEND_MAIL_ICAL_UID":    "inspection-42@example.org",
+		"SEND_MAIL_ICAL_START":  "2026-10-20T10:00:00+03:00",
+		"SEND_MAIL_ICAL_END":    "2026-10-20T12:00:00+03:00",
+	}
+	ev, err = eventFromParams(&prop, &from, "Inspection", to)
+	if err != nil {
+		t.Fatalf("eventFromParams() error = %v", err)
+	}
+	assert.Equal(t, CalendarRequest, ev.Method)
+	assert.True(t, ev.Sequence > 0)
+	assert.Equal(t, 2*time.Hour, ev.End.Sub(ev.Start))
+
+	for _, bad := range []map[string]string{
+		{"SEND_MAIL_ICAL_UID": "inspection-42@example.org", "SEND_MAIL_ICAL_START": "tomorrow"},
+		{"SEND_MAIL_ICAL_START": "2026-10-20 10:00"},
+		{"SEND_MAIL_ICAL_START": "2026-10-20 10:00", "SEND_MAIL_ICAL_METHOD": "CANCEL"},
+		{"SEND_MAIL_ICAL_UID": "inspection-42@example.org", "SEND_MAIL_ICAL_START": "2026-10-20 10:00", "SEND_MAIL_ICAL_METHOD": "PUBLISH"},
+		{"SEND_MAIL_ICAL_UID": "inspection-42@example.org", "SEND_MAIL_ICAL_START": "2026-10-20 10:00", "SEND_MAIL_ICAL_TIMEZONE": "Mars/Olympus"},
+		{"SEND_MAIL_ICAL_UID": "inspection-42@example.org", "SEND_MAIL_ICAL_START": "2026-10-20 10:00", "SEND_MAIL_ICAL_SEQUENCE": "-1"},
+	} {
+		bad := bad
+		if _, err := eventFromParams(&bad, &from, "Inspection", to); err == nil {
+			t.Errorf("eventFromParams(%v) error = nil, want an error", bad)
+		}
+	}
+}
+
+// TestSendMailHeaders ensures the priority, read receipt and Auto-Submitted
+// parameters reach the message
+func TestSendMailHeaders(t *testing.T) {
+	t.Parallel()
+
+	srv := newTestSMTPServer(t)
+	defer srv.Close()
+
+	info := srv.info()
+	info.UserLogin = "notify@example.org"
+	info.TimeZone = "Europe/Moscow"
+	info.expand()
+	settings := map[string]SMTPInfo{"notify_mail": info}
+	prop := map[string]string{
+		"SEND_MAIL_FROM":         "notify_mail",
+		"SEND_MAIL_TO":           "first@example.org",
+		"SEND_MAIL_SUBJECT":      "Contract deadline",
+		"SEND_MAIL_BODY_PLAIN":   "The contract expires tomorrow",
+		"SEND_MAIL_PRIORITY":     "high",
+		"SEND_MAIL_READ_RECEIPT": "true",
+	}
+	assert.True(t, sendMail(&settings, &prop))
+
+	prop["SEND_MAIL_PRIORITY"] = "normal"
+	prop["SEND_MAIL_READ_RECEIPT"] = "legal@example.org"
+	prop["SEND_MAIL_AUTO_SUBMITTED"] = "no"
+	assert.True(t, sendMail(&settings, &prop))
+
+	prop["SEND_MAIL_DATE"] = "2020-12-31 23:00"
+	assert.True(t, sendMail(&settings, &prop))
+
+	prop["SEND_MAIL_DATE"] = "yesterday"
+	assert.False(t, sendMail(&settings, &prop))
+
+	delete(prop, "SEND_MAIL_DATE")
+	prop["SEND_MAIL_PRIORITY"] = "urgent"
+	assert.False(t, sendMail(&settings, &prop))
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if assert.Equal(t, 3, len(srv.messages)) {
+		assert.Contains(t, srv.messages[0], "X-Priority: 1 (Highest)\n")
+		assert.Contains(t, srv.messages[0], "Importance: high\n")
+		assert.Contains(t, srv.messages[0], "Disposition-Notification-To: notify@example.org\n")
+		assert.Contains(t, srv.messages[0], "Auto-Submitted: auto-generated\n")
+
+		assert.NotContains(t, srv.messages[1], "X-Priority")
+		assert.Contains(t, srv.messages[1], "Disposition-Notification-To: legal@example.org\n")
+		assert.NotContains(t, srv.messages[1], "Auto-Submitted")
+
+		assert.Regexp(t, `\nDate: .* \+0300\n`, srv.messages[0])
+		assert.Contains(t, srv.messages[2], "Date: Thu, 31 Dec 2020 23:00:00 +0300\n")
+	}
+}
+
+// TestSendMailBrokenProfile ensures a profile whose settings or keys fail to
+// load never sends, rather than sending mangled or unsigned mail
+func TestSendMailBrokenProfile(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		setup func(info *SMTPInfo)
+	}{
+		{"Unknown charset", func(info *SMTPInfo) {
+			info.Charset = "iso-8859-5"
+		}},
+		{"Unknown time zone", func(info *SMTPInfo) {
+			info.TimeZone = "Europe/Atlantis"
+		}},
+		{"DKIM key missing", func(info *SMTPInfo) {
+			info.DKIM = DKIMInfo{Domain: "example.org", Selector: "mail", KeyFile: "./storage/missing.pem"}
+		}},
+		{"Not a DKIM key", func(info *SMTPInfo) {
+			info.DKIM = DKIMInfo{Domain: "example.org", Selector: "mail", KeyFile: "./storage/invoice.ru.1.html"}
+		}},
+		{"S/MIME key missing", func(info *SMTPInfo) {
+			info.SMIME = SMIMEInfo{CertFile: "./storage/missing.pem", KeyFile: "./storage/missing.key"}
+		}},
+		{"S/MIME certificates missing", func(info *SMTPInfo) {
+			info.SMIME = SMIMEInfo{CertsPath: "./storage/missing"}
+		}},
+		{"PGP key missing", func(info *SMTPInfo) {
+			info.PGP = PGPInfo{KeyFile: "./storage/missing.asc"}
+		}},
+		{"PGP keyring missing", func(info *SMTPInfo) {
+			info.PGP = PGPInfo{Keyring: "./storage/missing.gpg", MissingKey: PGPMissingKeyFail}
+		}},
+		{"PGP policy without keys", func(info *SMTPInfo) {
+			info.PGP = PGPInfo{MissingKey: PGPMissingKeyPlain}
+		}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Never connected, the profile is refused first
+			info := SMTPInfo{ConnectStr: "127.0.0.1:25", UserLogin: "notify@example.org"}
+			tt.setup(&info)
+			if err := info.expand(); err == nil {
+				t.Errorf("%q. SMTPInfo.expand() error = nil, want an error", tt.name)
+			}
+			settings := map[string]SMTPInfo{"notify_mail": info}
+			prop := map[string]string{
+				"SEND_MAIL_FROM":       "notify_mail",
+				"SEND_MAIL_TO":         "first@example.org",
+				"SEND_MAIL_SUBJECT":    "Счёт 42",
+				"SEND_MAIL_BODY_PLAIN": "Счёт во вложении",
+			}
+			assert.False(t, sendMail(&settings, &prop), tt.name)
+		})
+	}
+}
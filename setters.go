@@ -1,6 +1,35 @@
 package main
 
-import "mime"
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+)
+
+// Message priorities, see Priority.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// xPriorities are the labels of the X-Priority numbers, and the Importance
+// each of them is shown as.
+var xPriorities = map[string]struct{ label, importance string }{
+	"1": {"Highest", PriorityHigh},
+	"2": {"High", PriorityHigh},
+	"3": {"Normal", PriorityNormal},
+	"4": {"Low", PriorityLow},
+	"5": {"Lowest", PriorityLow},
+}
+
+// Auto-Submitted values (RFC 3834), see AutoSubmitted.
+const (
+	AutoGenerated   = "auto-generated"
+	AutoReplied     = "auto-replied"
+	AutoSubmittedNo = "no"
+)
 
 // To sets a list of recipient addresses.
 //
@@ -77,6 +106,25 @@ func (m *MailYak) WriteBccHeader(shouldWrite bool) {
 	m.writeBccHeader = shouldWrite
 }
 
+// AutoPlainText enables deriving the text/plain part from the HTML body when
+// no plain-text body is set. Defaults to true unless the SMTP profile sets
+// disable_auto_plain_text.
+//
+// A plain-text alternative improves spam scores and accessibility.
+func (m *MailYak) AutoPlainText(enabled bool) {
+	m.autoPlainText = enabled
+}
+
+// InlineCSS enables applying the <style> rules of the HTML body onto the style
+// attributes of the matching elements before the message is encoded. Defaults
+// to the inline_css setting of the SMTP profile.
+//
+// Gmail and many webmail clients strip <style> blocks, media queries are kept
+// in a residual <style> block.
+func (m *MailYak) InlineCSS(enabled bool) {
+	m.inlineStyles = enabled
+}
+
 // Cc sets a list of carbon copy (CC) addresses.
 //
 // You can pass one or more addresses to this method, which are viewable to the other recipients.
@@ -145,3 +193,77 @@ func (m *MailYak) Subject(sub string) {
 func (m *MailYak) AddHeader(name, value string) {
 	m.headers[m.trimRegex.ReplaceAllString(name, "")] = mime.QEncoding.Encode("UTF-8", m.trimRegex.ReplaceAllString(value, ""))
 }
+
+// Priority sets the X-Priority and Importance headers, shown as a flag by most
+// mail clients.
+//
+// priority is PriorityHigh, PriorityNormal or PriorityLow, or an X-Priority
+// number from 1 (highest) to 5 (lowest), kept as given with the Importance
+// derived from it. PriorityNormal removes the headers.
+func (m *MailYak) Priority(priority string) error {
+	number := strings.ToLower(strings.TrimSpace(priority))
+	switch number {
+	case PriorityHigh:
+		number = "1"
+	case PriorityLow:
+		number = "5"
+	case PriorityNormal, "":
+		delete(m.headers, "X-Priority")
+		delete(m.headers, "Importance")
+		return nil
+	}
+
+	p, ok := xPriorities[number]
+	if !ok {
+		return fmt.Errorf("unknown priority %q", priority)
+	}
+	m.headers["X-Priority"] = number + " (" + p.label + ")"
+	m.headers["Importance"] = p.importance
+	return nil
+}
+
+// ReadReceipt requests a read receipt (RFC 8098) to be sent to addr, an empty
+// addr removes the request.
+//
+// Mail clients usually ask the recipient before sending a receipt.
+func (m *MailYak) ReadReceipt(addr string) {
+	addr = m.trimRegex.ReplaceAllString(addr, "")
+	if addr == "" {
+		delete(m.headers, "Disposition-Notification-To")
+		return
+	}
+	m.headers["Disposition-Notification-To"] = addr
+}
+
+// AutoSubmitted sets the Auto-Submitted header (RFC 3834), telling
+// autoresponders not to reply. Defaults to AutoGenerated, AutoSubmittedNo
+// removes the header.
+func (m *MailYak) AutoSubmitted(value string) error {
+	switch value = strings.ToLower(strings.TrimSpace(value)); value {
+	case AutoSubmittedNo, "":
+		delete(m.headers, "Auto-Submitted")
+	case AutoGenerated, AutoReplied:
+		m.headers["Auto-Submitted"] = value
+	default:
+		return fmt.Errorf("unknown Auto-Submitted value %q", value)
+	}
+	return nil
+}
+
+// Date sets the Date header, for backdated or imported messages. By default
+// the date is stamped when the message is sent, see TimeZone. A zero t
+// restores the default.
+func (m *MailYak) Date(t time.Time) {
+	if t.IsZero() {
+		m.date = ""
+		return
+	}
+	m.date = t.Format(time.RFC1123Z)
+}
+
+// TimeZone sets the time zone of the date stamped when the message is sent.
+// Defaults to the timezone setting of the SMTP profile, or to the local time
+// zone of the host.
+func (m *MailYak) TimeZone(loc *time.Location) {
+	m.location = loc
+}
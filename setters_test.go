@@ -4,6 +4,7 @@ import (
 	"reflect"
 	"regexp"
 	"testing"
+	"time"
 )
 
 func TestMailYakTo(t *testing.T) {
@@ -235,3 +236,105 @@ func TestMailYakAddHeader(t *testing.T) {
 		})
 	}
 }
+
+func TestMailYakPriority(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		priority string
+		// Want
+		want    map[string]string
+		wantErr bool
+	}{
+		{"High", "High", map[string]string{"X-Priority": "1 (Highest)", "Importance": "high"}, false},
+		{"High number", "2", map[string]string{"X-Priority": "2 (High)", "Importance": "high"}, false},
+		{"Normal number", " 3 ", map[string]string{"X-Priority": "3 (Normal)", "Importance": "normal"}, false},
+		{"Low number", "4", map[string]string{"X-Priority": "4 (Low)", "Importance": "low"}, false},
+		{"Low", "low", map[string]string{"X-Priority": "5 (Lowest)", "Importance": "low"}, false},
+		{"Normal", "normal", map[string]string{}, false},
+		{"Empty", "", map[string]string{}, false},
+		{"Unknown", "urgent", map[string]string{}, true},
+		{"Out of range", "6", map[string]string{}, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			m := &MailYak{
+				headers:   map[string]string{"Importance": "low"},
+				trimRegex: regexp.MustCompile("\r?\n"),
+			}
+			err := m.Priority(tt.priority)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. MailYak.Priority() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(m.headers, tt.want) {
+				t.Errorf("%q. MailYak.Priority() = %v, want %v", tt.name, m.headers, tt.want)
+			}
+		})
+	}
+}
+
+func TestMailYakReadReceiptAndAutoSubmitted(t *testing.T) {
+	t.Parallel()
+
+	m := NewMail(&SMTPInfo{})
+	if got := m.headers["Auto-Submitted"]; got != AutoGenerated {
+		t.Errorf("NewMail() Auto-Submitted = %q, want %q", got, AutoGenerated)
+	}
+
+	m.ReadReceipt("sender@example.org\r\n")
+	if got := m.headers["Disposition-Notification-To"]; got != "sender@example.org" {
+		t.Errorf("MailYak.ReadReceipt() = %q, want %q", got, "sender@example.org")
+	}
+	m.ReadReceipt("")
+	if _, ok := m.headers["Disposition-Notification-To"]; ok {
+		t.Errorf("MailYak.ReadReceipt(\"\") kept the header")
+	}
+
+	if err := m.AutoSubmitted("Auto-Replied"); err != nil || m.headers["Auto-Submitted"] != AutoReplied {
+		t.Errorf("MailYak.AutoSubmitted() = %q, error = %v", m.headers["Auto-Submitted"], err)
+	}
+	if err := m.AutoSubmitted(AutoSubmittedNo); err != nil {
+		t.Errorf("MailYak.AutoSubmitted() error = %v", err)
+	}
+	if _, ok := m.headers["Auto-Submitted"]; ok {
+		t.Errorf("MailYak.AutoSubmitted(%q) kept the header", AutoSubmittedNo)
+	}
+	if err := m.AutoSubmitted("sometimes"); err == nil {
+		t.Errorf("MailYak.AutoSubmitted() error = nil, want an error")
+	}
+}
+
+func TestMailYakDateAndTimeZone(t *testing.T) {
+	t.Parallel()
+
+	moscow := time.FixedZone("MSK", 3*60*60)
+	m := NewMail(&SMTPInfo{})
+	if m.date != "" {
+		t.Errorf("NewMail() date = %q, want it stamped at sending", m.date)
+	}
+
+	m.TimeZone(moscow)
+	m.sentAt = time.Date(2021, time.March, 1, 9, 30, 0, 0, time.UTC)
+	if got, want := m.dateValue(), "Mon, 01 Mar 2021 12:30:00 +0300"; got != want {
+		t.Errorf("MailYak.dateValue() = %q, want %q", got, want)
+	}
+
+	m.Date(time.Date(2020, time.December, 31, 23, 0, 0, 0, time.UTC))
+	if got, want := m.dateValue(), "Thu, 31 Dec 2020 23:00:00 +0000"; got != want {
+		t.Errorf("MailYak.Date() = %q, want %q", got, want)
+	}
+
+	m.Date(time.Time{})
+	if m.date != "" {
+		t.Errorf("MailYak.Date(time.Time{}) = %q, want the default", m.date)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"go.mozilla.org/pkcs7"
+)
+
+func init() {
+	// The package default is DES-CBC, which current clients refuse to open
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256CBC
+}
+
+// smimeCertExts are the file extensions looked at in the recipient
+// certificate directory.
+var smimeCertExts = []string{".pem", ".crt", ".cer"}
+
+// smimeSigner signs and encrypts the MIME entity of a message (RFC 8551).
+type smimeSigner struct {
+	cert      *x509.Certificate
+	chain     []*x509.Certificate // intermediates sent along with cert
+	key       crypto.PrivateKey
+	certsPath string
+}
+
+// newSMIMESigner loads the signing certificate and key of info, if any, and
+// checks the recipient certificate directory.
+func newSMIMESigner(info *SMIMEInfo) (*smimeSigner, error) {
+	s := &smimeSigner{certsPath: info.CertsPath}
+
+	if info.CertFile != "" || info.KeyFile != "" {
+		if info.CertFile == "" || info.KeyFile == "" {
+			return nil, errors.New("smime: cert_file and key_file go together")
+		}
+		certs, err := loadCertificates(info.CertFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(certs) == 0 {
+			return nil, fmt.Errorf("smime: no certificate in %s", info.CertFile)
+		}
+		s.cert, s.chain = certs[0], certs[1:]
+
+		if s.key, err = loadSMIMEKey(info.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.certsPath != "" {
+		fi, err := os.Stat(s.certsPath)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("smime: %s is not a directory", s.certsPath)
+		}
+	}
+
+	if s.key == nil && s.certsPath == "" {
+		return nil, errors.New("smime: neither a signing certificate nor a certificate directory is set")
+	}
+	return s, nil
+}
+
+// loadCertificates reads the PEM or DER encoded certificates of filename.
+func loadCertificates(filename string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		return x509.ParseCertificates(data)
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("smime: %s: %v", filename, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// loadSMIMEKey reads a PEM encoded PKCS#1 RSA, SEC 1 EC or PKCS#8 private
+// key.
+func loadSMIMEKey(filename string) (crypto.PrivateKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("smime: no PEM data in %s", filename)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case *ecdsa.PrivateKey:
+			return k, nil
+		}
+		return nil, fmt.Errorf("smime: unsupported key type %T in %s", key, filename)
+	}
+	return nil, fmt.Errorf("smime: unsupported PEM block %q in %s", block.Type, filename)
+}
+
+// recipientCerts returns a certificate for every address, or false when one
+// of them has no usable certificate in the certificate directory.
+func (s *smimeSigner) recipientCerts(addrs []string) ([]*x509.Certificate, bool) {
+	if s.certsPath == "" || len(addrs) == 0 {
+		return nil, false
+	}
+
+	files, err := ioutil.ReadDir(s.certsPath)
+	if err != nil {
+		glog.Errorf("ERR: S/MIME: %v", err)
+		return nil, false
+	}
+
+	// The directory is read on every message, so certificates can be added
+	// without a restart
+	now := time.Now()
+	found := map[string]*x509.Certificate{}
+	for _, fi := range files {
+		if fi.IsDir() || !containsFold(smimeCertExts, filepath.Ext(fi.Name())) {
+			continue
+		}
+		certs, err := loadCertificates(filepath.Join(s.certsPath, fi.Name()))
+		if err != nil {
+			glog.Errorf("ERR: S/MIME: %s: %v", fi.Name(), err)
+			continue
+		}
+		for _, cert := range certs {
+			if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+				continue
+			}
+			if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+				continue
+			}
+			for _, email := range cert.EmailAddresses {
+				email = strings.ToLower(email)
+				if prev, ok := found[email]; !ok || cert.NotAfter.After(prev.NotAfter) {
+					found[email] = cert
+				}
+			}
+		}
+	}
+
+	var certs []*x509.Certificate
+	for _, addr := range addrs {
+		cert, ok := found[strings.ToLower(addr)]
+		if !ok {
+			if glog.V(9) {
+				glog.Infof("DBG: S/MIME: no certificate for %s", addr)
+			}
+			return nil, false
+		}
+		certs = append(certs, cert)
+	}
+
+	// Let the sender read its own copy
+	if s.cert != nil {
+		if _, ok := s.cert.PublicKey.(*rsa.PublicKey); ok {
+			certs = append(certs, s.cert)
+		}
+	}
+	return certs, true
+}
+
+// wrap signs the canonical MIME entity when a signing key is set, and
+// encrypts the result when every recipient has a certificate, returning the
+// new entity.
+func (s *smimeSigner) wrap(entity []byte, recipients []string) ([]byte, error) {
+	if s.key != nil {
+		boundary, err := randomBoundary()
+		if err != nil {
+			return nil, err
+		}
+		if entity, err = s.sign(entity, boundary); err != nil {
+			return nil, err
+		}
+	}
+
+	if certs, ok := s.recipientCerts(recipients); ok {
+		return smimeEncrypt(entity, certs)
+	}
+	return entity, nil
+}
+
+// sign returns a multipart/signed entity holding entity and its detached
+// signature.
+func (s *smimeSigner) sign(entity []byte, boundary string) ([]byte, error) {
+	sd, err := pkcs7.NewSignedData(entity)
+	if err != nil {
+		return nil, err
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if len(s.chain) > 0 {
+		err = sd.AddSignerChain(s.cert, s.key, s.chain, pkcs7.SignerInfoConfig{})
+	} else {
+		err = sd.AddSigner(s.cert, s.key, pkcs7.SignerInfoConfig{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	sd.Detach()
+	sig, err := sd.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\";\r\n\tmicalg=sha-256; boundary=\"%s\"\r\n\r\n", boundary)
+	fmt.Fprintf(&buf, "This is an S/MIME signed message\r\n\r\n--%s\r\n", boundary)
+	buf.Write(entity)
+	fmt.Fprintf(&buf, "\r\n--%s\r\n", boundary)
+	buf.WriteString("Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+	buf.WriteString("Content-Disposition: attachment; filename=\"smime.p7s\"\r\n\r\n")
+	if err := writeBase64(&buf, sig); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(&buf, "\r\n--%s--\r\n", boundary)
+	return buf.Bytes(), nil
+}
+
+// smimeEncrypt returns an application/pkcs7-mime entity holding entity
+// encrypted for certs.
+func smimeEncrypt(entity []byte, certs []*x509.Certificate) ([]byte, error) {
+	env, err := pkcs7.Encrypt(entity, certs)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("Content-Type: application/pkcs7-mime; smime-type=enveloped-data;\r\n\tname=\"smime.p7m\"\r\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+	buf.WriteString("Content-Disposition: attachment; filename=\"smime.p7m\"\r\n\r\n")
+	if err := writeBase64(&buf, env); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeBase64 writes data base64 encoded, split into lines.
+func writeBase64(w io.Writer, data []byte) error {
+	splitter := lineSplitterBuilder{maxLen: maxBase64LineLen}.new(w)
+	enc := base64.NewEncoder(base64.StdEncoding, splitter)
+	if _, err := enc.Write(data); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	_, err := w.Write(crlf)
+	return err
+}
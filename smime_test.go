@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"go.mozilla.org/pkcs7"
+)
+
+// writeTestCert creates a self-signed S/MIME certificate for email, storing
+// the certificate and its key as PEM files in dir.
+func writeTestCert(t *testing.T, dir, email string) (string, string, *x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: email},
+		EmailAddresses: []string{email},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(24 * time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, email+".pem")
+	keyFile := filepath.Join(dir, email+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert, key
+}
+
+// TestSMIME signs and encrypts messages and checks them with the pkcs7
+// package
+func TestSMIME(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "smime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	senderDir := filepath.Join(dir, "sender")
+	certsDir := filepath.Join(dir, "certs")
+	for _, d := range []string{senderDir, certsDir} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certFile, keyFile, _, _ := writeTestCert(t, senderDir, "invoice@example.org")
+	_, _, rcptCert, rcptKey := writeTestCert(t, certsDir, "buyer@example.net")
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		info SMIMEInfo
+		to   []string
+		// Expected results.
+		encrypted bool
+		signed    bool
+	}{
+		{
+			"Sign",
+			SMIMEInfo{CertFile: certFile, KeyFile: keyFile},
+			[]string{"buyer@example.net"},
+			false,
+			true,
+		},
+		{
+			"Sign and encrypt",
+			SMIMEInfo{CertFile: certFile, KeyFile: keyFile, CertsPath: certsDir},
+			[]string{"Buyer <Buyer@example.net>"},
+			true,
+			true,
+		},
+		{
+			"Encrypt only",
+			SMIMEInfo{CertsPath: certsDir},
+			[]string{"buyer@example.net"},
+			true,
+			false,
+		},
+		{
+			"Sign, recipient without certificate",
+			SMIMEInfo{CertFile: certFile, KeyFile: keyFile, CertsPath: certsDir},
+			[]string{"buyer@example.net", "other@example.net"},
+			false,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		// Not parallel, the certificates are removed when the test returns
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := newSMIMESigner(&tt.info)
+			if err != nil {
+				t.Fatalf("%q. newSMIMESigner() error = %v", tt.name, err)
+			}
+
+			m := &MailYak{
+				toAddrs:   tt.to,
+				fromAddr:  "invoice@example.org",
+				subject:   "Invoice",
+				trimRegex: regexp.MustCompile("\r?\n"),
+				date:      time.Now().Format(time.RFC1123Z),
+				headers:   map[string]string{},
+				smime:     signer,
+			}
+			m.Plain().Set("Invoice in attachment\n")
+			m.Attach("invoice.txt", strings.NewReader("Total: 105.23"))
+
+			var buf bytes.Buffer
+			if _, err := m.WriteTo(&buf); err != nil {
+				t.Fatalf("%q. MailYak.WriteTo() error = %v", tt.name, err)
+			}
+
+			msg, err := netmail.ReadMessage(&buf)
+			if err != nil {
+				t.Fatalf("%q. ReadMessage() error = %v", tt.name, err)
+			}
+			if msg.Header.Get("Mime-Version") != "1.0" || msg.Header.Get("Subject") != "Invoice" {
+				t.Errorf("%q. headers = %v, want the message headers outside the S/MIME entity", tt.name, msg.Header)
+			}
+			body, err := ioutil.ReadAll(msg.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatalf("%q. Content-Type error = %v", tt.name, err)
+			}
+
+			if tt.encrypted {
+				if mediaType != "application/pkcs7-mime" || params["smime-type"] != "enveloped-data" {
+					t.Fatalf("%q. Content-Type = %q, want enveloped data", tt.name, msg.Header.Get("Content-Type"))
+				}
+				der, err := base64.StdEncoding.DecodeString(strings.Replace(string(body), "\r\n", "", -1))
+				if err != nil {
+					t.Fatalf("%q. base64 error = %v", tt.name, err)
+				}
+				p7, err := pkcs7.Parse(der)
+				if err != nil {
+					t.Fatalf("%q. pkcs7.Parse() error = %v", tt.name, err)
+				}
+				entity, err := p7.Decrypt(rcptCert, rcptKey)
+				if err != nil {
+					t.Fatalf("%q. Decrypt() error = %v", tt.name, err)
+				}
+				inner, err := netmail.ReadMessage(bytes.NewReader(entity))
+				if err != nil {
+					t.Fatalf("%q. ReadMessage(decrypted) error = %v", tt.name, err)
+				}
+				if body, err = ioutil.ReadAll(inner.Body); err != nil {
+					t.Fatal(err)
+				}
+				if mediaType, params, err = mime.ParseMediaType(inner.Header.Get("Content-Type")); err != nil {
+					t.Fatalf("%q. Content-Type error = %v", tt.name, err)
+				}
+			}
+
+			if !tt.signed {
+				if mediaType != "multipart/mixed" {
+					t.Errorf("%q. Content-Type = %q, want multipart/mixed", tt.name, mediaType)
+				}
+				return
+			}
+
+			if mediaType != "multipart/signed" || params["protocol"] != "application/pkcs7-signature" || params["micalg"] != "sha-256" {
+				t.Fatalf("%q. Content-Type = %q, want multipart/signed", tt.name, mediaType)
+			}
+
+			// The signed content is the first part, byte for byte
+			boundary := "--" + params["boundary"]
+			start := strings.Index(string(body), boundary+"\r\n") + len(boundary) + 2
+			end := strings.LastIndex(string(body), "\r\n"+boundary+"\r\n")
+			if start < len(boundary)+2 || end < start {
+				t.Fatalf("%q. body = %q, want two parts", tt.name, body)
+			}
+			content := body[start:end]
+			if !bytes.HasPrefix(content, []byte("Content-Type: multipart/mixed;")) {
+				t.Errorf("%q. signed content = %q, want the multipart/mixed entity", tt.name, content)
+			}
+
+			sigPart := string(body[end+len(boundary)+4:])
+			sigBody := sigPart[strings.Index(sigPart, "\r\n\r\n")+4 : strings.Index(sigPart, "\r\n"+boundary+"--")]
+			der, err := base64.StdEncoding.DecodeString(strings.Replace(sigBody, "\r\n", "", -1))
+			if err != nil {
+				t.Fatalf("%q. signature base64 error = %v", tt.name, err)
+			}
+			p7, err := pkcs7.Parse(der)
+			if err != nil {
+				t.Fatalf("%q. pkcs7.Parse() error = %v", tt.name, err)
+			}
+			p7.Content = content
+			if err := p7.Verify(); err != nil {
+				t.Errorf("%q. Verify() error = %v", tt.name, err)
+			}
+
+			p7.Content = append(append([]byte{}, content...), ' ')
+			if err := p7.Verify(); err == nil {
+				t.Errorf("%q. Verify() of tampered content passed", tt.name)
+			}
+		})
+	}
+}
+
+// TestSMIMEWithDKIM ensures the DKIM signature covers the S/MIME entity that
+// is actually sent
+func TestSMIMEWithDKIM(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "smime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, _, _ := writeTestCert(t, dir, "invoice@example.org")
+	smimeSigner, err := newSMIMESigner(&SMIMEInfo{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dkimFile, record := writeTestKey(t, dir, rsaKey)
+	dkimSigner, err := newDKIMSigner(&DKIMInfo{Domain: "example.org", Selector: "mail", KeyFile: dkimFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &MailYak{
+		toAddrs:   []string{"buyer@example.net"},
+		fromAddr:  "invoice@example.org",
+		subject:   "Invoice",
+		trimRegex: regexp.MustCompile("\r?\n"),
+		date:      time.Now().Format(time.RFC1123Z),
+		headers:   map[string]string{},
+		dkim:      dkimSigner,
+		smime:     smimeSigner,
+	}
+	m.Plain().Set("Invoice in attachment\n")
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatalf("MailYak.WriteTo() error = %v", err)
+	}
+
+	wire := regexp.MustCompile("\r?\n").ReplaceAll(buf.Bytes(), []byte("\r\n"))
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(wire), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return []string{record}, nil
+		},
+	})
+	if err != nil || len(verifications) != 1 || verifications[0].Err != nil {
+		t.Errorf("dkim.Verify() = %v, error = %v", verifications, err)
+	}
+}
+
+// TestNewSMIMESigner ensures bad settings are rejected
+func TestNewSMIMESigner(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "smime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, _, _ := writeTestCert(t, dir, "invoice@example.org")
+
+	tests := []struct {
+		name string
+		info SMIMEInfo
+	}{
+		{"Nothing set", SMIMEInfo{}},
+		{"Certificate without key", SMIMEInfo{CertFile: certFile}},
+		{"Key without certificate", SMIMEInfo{KeyFile: keyFile}},
+		{"Key as certificate", SMIMEInfo{CertFile: keyFile, KeyFile: keyFile}},
+		{"Certificate as key", SMIMEInfo{CertFile: certFile, KeyFile: certFile}},
+		{"Missing directory", SMIMEInfo{CertsPath: filepath.Join(dir, "missing")}},
+		{"Directory is a file", SMIMEInfo{CertsPath: certFile}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newSMIMESigner(&tt.info); err == nil {
+				t.Errorf("%q. newSMIMESigner() error = nil, want an error", tt.name)
+			}
+		})
+	}
+}
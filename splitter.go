@@ -6,6 +6,8 @@ import (
 
 const maxLineLen = 60
 
+var crlf = []byte("\r\n")
+
 // lineSplitter breaks the given input into lines of maxLineLen characters
 // before writing a "\r\n" newline
 type lineSplitter struct {
@@ -14,10 +16,17 @@ type lineSplitter struct {
 	maxLen int
 }
 
-type lineSplitterBuilder struct{}
+// lineSplitterBuilder creates lineSplitters breaking lines at maxLen
+// characters, or maxLineLen when zero.
+type lineSplitterBuilder struct {
+	maxLen int
+}
 
 func (b lineSplitterBuilder) new(w io.Writer) io.Writer {
-	return &lineSplitter{w: w, maxLen: maxLineLen}
+	if b.maxLen == 0 {
+		return &lineSplitter{w: w, maxLen: maxLineLen}
+	}
+	return &lineSplitter{w: w, maxLen: b.maxLen}
 }
 
 func (w *lineSplitter) Write(p []byte) (int, error) {
@@ -53,7 +62,7 @@ func (w *lineSplitter) Write(p []byte) (int, error) {
 
 		// If this finishes a line, add linebreaks
 		if end == i+lineSize {
-			if _, err := w.w.Write([]byte("\r\n")); err != nil {
+			if _, err := w.w.Write(crlf); err != nil {
 				// If this errors, return the bytes wrote so far from the
 				// caller's perspective (it is unaware newlines are being added)
 				return i + len(chunk), err
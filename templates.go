@@ -0,0 +1,800 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"text/template/parse"
+)
+
+// Extensions of the files of a template: the HTML body, the plain text body
+// and the subject line.
+const (
+	templateHTMLExt    = ".html"
+	templatePlainExt   = ".txt"
+	templateSubjectExt = ".subject"
+)
+
+// Directories of the layouts and partials in the templates directory.
+const (
+	layoutsDir  = "_layouts"
+	partialsDir = "_partials"
+)
+
+// contentTemplate is the name layouts render the body of the template with,
+// {{template "content" .}}.
+const contentTemplate = "content"
+
+// noLayout disables the default layout of the profile in SEND_MAIL_LAYOUT.
+const noLayout = "none"
+
+// templateFuncs are the functions of the templates, formatting amounts and
+// dates the Russian way, see ruformat.go:
+//
+//	{{money .SUM}}                 1 234,50 ₽
+//	{{moneyInWords .SUM}}          одна тысяча двести тридцать четыре рубля 50 копеек
+//	{{longDate .DATE}}             18 октября 2026 г.
+//	{{shortDate .DATE}}            18.10.2026
+//	{{money (vat .SUM 20)}}        the VAT included in the sum
+//	{{money (withoutVat .SUM 20)}} the sum less the VAT it includes
+//	{{money (addVat .SUM 20)}}     the VAT charged on top of the sum
+//	{{money (withVat .SUM 20)}}    the sum plus the VAT charged on top
+//	{{markdown .TEXT}}             Markdown as HTML, or as plain text in the .txt files
+var templateFuncs = map[string]interface{}{
+	"money":        formatMoney,
+	"moneyInWords": moneyInWords,
+	"longDate":     longDate,
+	"shortDate":    shortDate,
+	"vat":          vatIncluded,
+	"withoutVat":   withoutVAT,
+	"addVat":       vatOnTop,
+	"withVat":      withVAT,
+	"capitalize":   capitalize,
+	"markdown":     markdownHTML,
+}
+
+// textTemplateFuncs override templateFuncs in the plain text templates.
+var textTemplateFuncs = map[string]interface{}{
+	"markdown": markdownToText,
+}
+
+// templateLocale matches the locales of template file names, e.g. ru or ru-RU.
+var templateLocale = regexp.MustCompile(`^[A-Za-z]{2,3}([-_][A-Za-z0-9]{2,8})*$`)
+
+// templateRef names a template of the templates directory.
+type templateRef struct {
+	name    string
+	locale  string // e.g. ru-RU, falls back to ru and the default locale
+	version string // the latest version when empty
+	layout  string // wraps the bodies when set
+}
+
+// templateVariant is a locale and version of a template, the files of which
+// are called stem.
+type templateVariant struct {
+	stem    string
+	version int
+}
+
+// templateSet is the parsed contents of the templates directory:
+//
+//	<name>[.<locale>][.<version>].html, .txt, .subject  templates, see resolveTemplate
+//	_layouts/<name>[.<locale>][.<version>].html, .txt   layouts of the bodies
+//	_partials/<name>.html, .txt                         partials, {{template "<name>" .}}
+//
+// A layout renders the body of the template with {{template "content" .}}
+// and declares blocks, {{block "title" .}}...{{end}}, the template can
+// override with {{define "title"}}...{{end}}. Partials are available to the
+// templates and the layouts, the .txt ones to the subjects too.
+//
+// The set is parsed once, when loaded, the templates combined with every
+// layout included.
+type templateSet struct {
+	dir           string
+	defaultLocale string
+	partialsHTML  *htmltemplate.Template
+	partialsText  *texttemplate.Template
+	names         []string // stems of the templates
+	layoutNames   []string // stems of the layouts
+	templates     map[string]*mailTemplate
+	layouts       map[string]*mailTemplate
+	combined      map[string]*mailTemplate // by template and layout stems
+}
+
+// mailTemplate renders the parts of a message from the files sharing its
+// name, any of them may be missing.
+//
+// Variables missing from the data fail the rendering instead of leaving a
+// hole in the message.
+type mailTemplate struct {
+	name     string
+	html     *htmltemplate.Template
+	plain    *texttemplate.Template
+	subject  *texttemplate.Template
+	htmlSrc  string // sources of the bodies, combined with layouts
+	plainSrc string
+}
+
+// renderedMail holds the parts rendered by a mailTemplate, the parts without
+// a template are empty.
+type renderedMail struct {
+	subject string
+	plain   string
+	html    string
+}
+
+// loadTemplateSet parses the templates, layouts and partials of dir. A
+// missing directory holds no templates.
+func loadTemplateSet(dir, defaultLocale string) (*templateSet, error) {
+	s := &templateSet{
+		dir:           dir,
+		defaultLocale: defaultLocale,
+		partialsHTML:  htmltemplate.New(partialsDir).Funcs(templateFuncs).Option("missingkey=error"),
+		partialsText:  texttemplate.New(partialsDir).Funcs(templateFuncs).Funcs(textTemplateFuncs).Option("missingkey=error"),
+		templates:     map[string]*mailTemplate{},
+		layouts:       map[string]*mailTemplate{},
+		combined:      map[string]*mailTemplate{},
+	}
+
+	if err := s.loadPartials(filepath.Join(dir, partialsDir)); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if s.templates[markdownStem], err = s.markdownTemplate(); err != nil {
+		return nil, err
+	}
+	if s.names, err = templateStems(dir); err != nil {
+		return nil, err
+	}
+	for _, stem := range s.names {
+		if s.templates[stem], err = s.parse(dir, stem); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.layoutNames, err = templateStems(filepath.Join(dir, layoutsDir)); err != nil {
+		return nil, err
+	}
+	for _, stem := range s.layoutNames {
+		if s.layouts[stem], err = s.parse(filepath.Join(dir, layoutsDir), stem); err != nil {
+			return nil, fmt.Errorf("layout: %v", err)
+		}
+	}
+
+	// The variants of both are picked per message, so any template may be
+	// wrapped into any layout
+	stems := append(append([]string{}, s.names...), markdownStem)
+	for _, stem := range stems {
+		for _, layout := range s.layoutNames {
+			t, err := s.combine(stem, layout)
+			if err != nil {
+				return nil, fmt.Errorf("template %q, layout %q: %v", stem, layout, err)
+			}
+			s.combined[combinedKey(stem, layout)] = t
+		}
+	}
+
+	// Parsing misses what is only found when executed: the escaping of the
+	// HTML bodies and the calls of undefined templates
+	for _, stem := range stems {
+		if err := s.templates[stem].check(); err != nil {
+			return nil, fmt.Errorf("template %q: %v", stem, err)
+		}
+		for _, layout := range s.layoutNames {
+			if err := s.combined[combinedKey(stem, layout)].check(); err != nil {
+				return nil, fmt.Errorf("template %q, layout %q: %v", stem, layout, err)
+			}
+		}
+	}
+	return s, nil
+}
+
+// loadPartials defines the .html and .txt files under dir as templates named
+// by their path in dir, without the extension.
+func (s *templateSet) loadPartials(dir string) error {
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := filepath.Ext(path)
+		if fi.IsDir() || (ext != templateHTMLExt && ext != templatePlainExt) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(strings.TrimSuffix(rel, ext))
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if ext == templateHTMLExt {
+			_, err = s.partialsHTML.New(name).Parse(string(src))
+		} else {
+			_, err = s.partialsText.New(name).Parse(string(src))
+		}
+		if err != nil {
+			return fmt.Errorf("partial %q: %v", name, err)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// templateStems returns the sorted stems of the template files of dir.
+func templateStems(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var stems []string
+	for _, fi := range files {
+		ext := filepath.Ext(fi.Name())
+		if fi.IsDir() || (ext != templateHTMLExt && ext != templatePlainExt && ext != templateSubjectExt) {
+			continue
+		}
+		stem := strings.TrimSuffix(fi.Name(), ext)
+		if validTemplateName(stem) && !seen[stem] {
+			seen[stem] = true
+			stems = append(stems, stem)
+		}
+	}
+	sort.Strings(stems)
+	return stems, nil
+}
+
+// parse reads and parses the files called stem in dir.
+func (s *templateSet) parse(dir, stem string) (*mailTemplate, error) {
+	t := &mailTemplate{name: stem}
+	base := filepath.Join(dir, stem)
+
+	src, ok, err := readTemplateFile(base + templateHTMLExt)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		t.htmlSrc = src
+		if t.html, err = s.parseHTML(stem+templateHTMLExt, src); err != nil {
+			return nil, err
+		}
+	}
+
+	if src, ok, err = readTemplateFile(base + templatePlainExt); err != nil {
+		return nil, err
+	}
+	if ok {
+		t.plainSrc = src
+		if t.plain, err = s.parseText(stem+templatePlainExt, src); err != nil {
+			return nil, err
+		}
+	}
+
+	if src, ok, err = readTemplateFile(base + templateSubjectExt); err != nil {
+		return nil, err
+	}
+	if ok {
+		if t.subject, err = s.parseText(stem+templateSubjectExt, src); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// parseHTML parses the name and source pairs, in order, along with the
+// partials; the template of the first pair is returned.
+func (s *templateSet) parseHTML(pairs ...string) (*htmltemplate.Template, error) {
+	set, err := s.partialsHTML.Clone()
+	if err != nil {
+		return nil, err
+	}
+	var root *htmltemplate.Template
+	for i := 0; i+1 < len(pairs); i += 2 {
+		t, err := set.New(pairs[i]).Parse(pairs[i+1])
+		if err != nil {
+			return nil, err
+		}
+		if root == nil {
+			root = t
+		}
+	}
+	return root, nil
+}
+
+// parseText is parseHTML for the plain text templates.
+func (s *templateSet) parseText(pairs ...string) (*texttemplate.Template, error) {
+	set, err := s.partialsText.Clone()
+	if err != nil {
+		return nil, err
+	}
+	var root *texttemplate.Template
+	for i := 0; i+1 < len(pairs); i += 2 {
+		t, err := set.New(pairs[i]).Parse(pairs[i+1])
+		if err != nil {
+			return nil, err
+		}
+		if root == nil {
+			root = t
+		}
+	}
+	return root, nil
+}
+
+// render renders the variant of ref with data, wrapping the bodies into the
+// layout of ref.
+func (s *templateSet) render(ref templateRef, data interface{}) (*renderedMail, error) {
+	stem, err := resolveTemplate(s.names, ref, s.defaultLocale)
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.withRefLayout(stem, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := t.render(data)
+	if err != nil {
+		return nil, fmt.Errorf("template %q: %v", stem, err)
+	}
+	return out, nil
+}
+
+// attachmentPDFExt renders the HTML part of a template into a PDF attachment.
+const attachmentPDFExt = ".pdf"
+
+// attachmentTypes are the MIME types of the parts rendered into attachments.
+var attachmentTypes = map[string]string{
+	templateHTMLExt:  "text/html; charset=utf-8",
+	templatePlainExt: "text/plain; charset=utf-8",
+	attachmentPDFExt: "application/pdf",
+}
+
+// renderedAttachment is a template rendered into an attachment.
+type renderedAttachment struct {
+	filename string
+	mimeType string
+	content  []byte
+}
+
+// renderAttachments renders the templates of list, separated by ";", into
+// attachments:
+//
+//	<name>[.html|.txt|.pdf][=<filename>]
+//
+// The HTML part is rendered when the extension is omitted, in the locale
+// given, and converted to PDF with fonts for .pdf; the filename is a text
+// template rendered with data too, and defaults to the name and the
+// extension.
+func (s *templateSet) renderAttachments(list, locale string, data interface{}, fonts *pdfFonts) ([]renderedAttachment, error) {
+	var out []renderedAttachment
+	for _, spec := range strings.Split(list, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		a, err := s.renderAttachment(spec, locale, data, fonts)
+		if err != nil {
+			return nil, fmt.Errorf("attachment %q: %v", strings.TrimSpace(spec), err)
+		}
+		out = append(out, *a)
+	}
+	return out, nil
+}
+
+// renderAttachment renders a single entry of renderAttachments.
+func (s *templateSet) renderAttachment(spec, locale string, data interface{}, fonts *pdfFonts) (*renderedAttachment, error) {
+	name, filename := spec, ""
+	if i := strings.IndexByte(spec, '='); i >= 0 {
+		name, filename = spec[:i], spec[i+1:]
+	}
+	name = strings.TrimSpace(name)
+	ext := filepath.Ext(name)
+	if _, ok := attachmentTypes[ext]; ok {
+		name = strings.TrimSuffix(name, ext)
+	} else {
+		ext = templateHTMLExt
+	}
+	if strings.TrimSpace(filename) == "" {
+		filename = name + ext
+	}
+
+	out, err := s.render(templateRef{name: name, locale: locale}, data)
+	if err != nil {
+		return nil, err
+	}
+	part, content := templateHTMLExt, out.html
+	if ext == templatePlainExt {
+		part, content = templatePlainExt, out.plain
+	}
+	if content == "" {
+		return nil, fmt.Errorf("template %q has no %s part", name, part)
+	}
+	a := &renderedAttachment{mimeType: attachmentTypes[ext], content: []byte(content)}
+	if ext == attachmentPDFExt {
+		if a.content, err = htmlToPDF(a.content, fonts); err != nil {
+			return nil, fmt.Errorf("PDF: %v", err)
+		}
+	}
+
+	if a.filename, err = renderFilename(filename, data); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// renderFilename renders the filename template src, keeping the last element
+// of the path it may produce.
+func renderFilename(src string, data interface{}) (string, error) {
+	t, err := texttemplate.New("filename").Funcs(templateFuncs).Option("missingkey=error").Parse(src)
+	if err != nil {
+		return "", fmt.Errorf("filename: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("filename: %v", err)
+	}
+
+	name := strings.Join(strings.Fields(buf.String()), " ")
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("filename %q is empty", src)
+	}
+	return name, nil
+}
+
+// withRefLayout returns the template called stem wrapped into the variant of
+// the layout of ref, or as it is without one.
+func (s *templateSet) withRefLayout(stem string, ref templateRef) (*mailTemplate, error) {
+	if ref.layout == "" {
+		return s.templates[stem], nil
+	}
+	layout, err := resolveTemplate(s.layoutNames, templateRef{name: ref.layout, locale: ref.locale}, s.defaultLocale)
+	if err != nil {
+		return nil, fmt.Errorf("layout: %v", err)
+	}
+	t, ok := s.combined[combinedKey(stem, layout)]
+	if !ok {
+		return nil, fmt.Errorf("template %q, layout %q: not loaded", stem, layout)
+	}
+	return t, nil
+}
+
+// combinedKey is the key of a template wrapped into a layout in the combined
+// templates of a set.
+func combinedKey(stem, layout string) string {
+	return stem + "\x00" + layout
+}
+
+// combine returns the template called stem with its bodies wrapped into the
+// layout called layout; the bodies missing from either are not wrapped.
+func (s *templateSet) combine(stem, layout string) (*mailTemplate, error) {
+	page, l := s.templates[stem], s.layouts[layout]
+	t := *page
+	var err error
+	// The layout comes first, so the blocks of the template override its own
+	if page.html != nil && l.html != nil {
+		if t.html, err = s.parseHTML(layoutsDir+"/"+layout+templateHTMLExt, l.htmlSrc, contentTemplate, page.htmlSrc); err != nil {
+			return nil, err
+		}
+	}
+	if page.plain != nil && l.plain != nil {
+		if t.plain, err = s.parseText(layoutsDir+"/"+layout+templatePlainExt, l.plainSrc, contentTemplate, page.plainSrc); err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+// validTemplateName reports whether name can be used as a template name,
+// never leaving the templates directory.
+func validTemplateName(name string) bool {
+	return name != "" && name == filepath.Base(name) && !strings.HasPrefix(name, ".")
+}
+
+// resolveTemplate returns the stem of the variant of ref among stems, named
+// <name>.<locale>.<version>, <name>.<locale>, <name>.<version> or <name>.
+//
+// Locales are tried from the most specific one, ru-RU then ru, to
+// defaultLocale and the files without a locale. The files without a version
+// come before the first version.
+func resolveTemplate(stems []string, ref templateRef, defaultLocale string) (string, error) {
+	if !validTemplateName(ref.name) {
+		return "", fmt.Errorf("template %q: bad name", ref.name)
+	}
+	want := -1
+	if ref.version != "" {
+		v, err := strconv.Atoi(ref.version)
+		if err != nil || v < 0 {
+			return "", fmt.Errorf("template %q: bad version %q", ref.name, ref.version)
+		}
+		want = v
+	}
+
+	latest := map[string]templateVariant{}
+	for _, stem := range stems {
+		locale, version, ok := splitTemplateStem(ref.name, stem)
+		if !ok || (want >= 0 && version != want) {
+			continue
+		}
+		if cur, found := latest[locale]; !found || version > cur.version {
+			latest[locale] = templateVariant{stem: stem, version: version}
+		}
+	}
+
+	locales := templateLocales(ref.locale, defaultLocale)
+	for _, locale := range locales {
+		if v, ok := latest[locale]; ok {
+			return v.stem, nil
+		}
+	}
+	if ref.version != "" {
+		return "", fmt.Errorf("template %q: no version %s for locales %q", ref.name, ref.version, locales)
+	}
+	return "", fmt.Errorf("template %q: no files for locales %q", ref.name, locales)
+}
+
+// splitTemplateStem returns the locale and the version of the template name
+// held by the files called stem.
+func splitTemplateStem(name, stem string) (string, int, bool) {
+	if stem == name {
+		return "", 0, true
+	}
+	if !strings.HasPrefix(stem, name+".") {
+		return "", 0, false
+	}
+
+	fields := strings.Split(stem[len(name)+1:], ".")
+	switch len(fields) {
+	case 1:
+		if v, err := strconv.Atoi(fields[0]); err == nil && v >= 0 {
+			return "", v, true
+		}
+		if templateLocale.MatchString(fields[0]) {
+			return normalizeLocale(fields[0]), 0, true
+		}
+	case 2:
+		v, err := strconv.Atoi(fields[1])
+		if err == nil && v >= 0 && templateLocale.MatchString(fields[0]) {
+			return normalizeLocale(fields[0]), v, true
+		}
+	}
+	return "", 0, false
+}
+
+// templateLocales returns the locales tried for locale, most specific first,
+// "" standing for the files without a locale.
+func templateLocales(locale, defaultLocale string) []string {
+	var locales []string
+	add := func(l string) {
+		l = normalizeLocale(l)
+		for _, seen := range locales {
+			if seen == l {
+				return
+			}
+		}
+		locales = append(locales, l)
+	}
+
+	for _, l := range []string{locale, defaultLocale} {
+		l = normalizeLocale(l)
+		for l != "" {
+			add(l)
+			i := strings.LastIndex(l, "-")
+			if i < 0 {
+				break
+			}
+			l = l[:i]
+		}
+	}
+	add("")
+	return locales
+}
+
+// normalizeLocale returns locale in lower case, with dashes between its
+// subtags: ru_RU and ru-RU are the same.
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
+
+// readTemplateFile returns the contents of the file at path, and whether it
+// exists.
+func readTemplateFile(path string) (string, bool, error) {
+	src, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(src), true, nil
+}
+
+// render executes the templates with data.
+func (t *mailTemplate) render(data interface{}) (*renderedMail, error) {
+	var out renderedMail
+	var buf bytes.Buffer
+
+	if t.subject != nil {
+		if err := t.subject.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		// Subjects are a single line, whatever the layout of the file
+		out.subject = strings.Join(strings.Fields(buf.String()), " ")
+		buf.Reset()
+	}
+	if t.plain != nil {
+		if err := t.plain.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		out.plain = buf.String()
+		buf.Reset()
+	}
+	if t.html != nil {
+		if err := t.html.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		out.html = buf.String()
+	}
+	return &out, nil
+}
+
+// check escapes the HTML body and looks for calls of undefined templates in
+// the others, the errors they would fail the rendering with.
+func (t *mailTemplate) check() error {
+	if t.html != nil {
+		// Escaping happens on the first execution, the errors of the missing
+		// data are not the concern here
+		if err := t.html.Execute(ioutil.Discard, nil); err != nil {
+			if _, ok := err.(*htmltemplate.Error); ok {
+				return err
+			}
+		}
+	}
+	for _, tt := range []*texttemplate.Template{t.plain, t.subject} {
+		if tt == nil {
+			continue
+		}
+		if err := checkTemplateCalls(tt, tt.Tree.Root, map[string]bool{tt.Name(): true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTemplateCalls reports the first {{template}} call under node of a
+// template not defined in the set of t, following the defined ones once.
+func checkTemplateCalls(t *texttemplate.Template, node parse.Node, seen map[string]bool) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Nodes {
+			if err := checkTemplateCalls(t, c, seen); err != nil {
+				return err
+			}
+		}
+	case *parse.IfNode:
+		return checkBranchCalls(t, &n.BranchNode, seen)
+	case *parse.RangeNode:
+		return checkBranchCalls(t, &n.BranchNode, seen)
+	case *parse.WithNode:
+		return checkBranchCalls(t, &n.BranchNode, seen)
+	case *parse.TemplateNode:
+		if seen[n.Name] {
+			return nil
+		}
+		seen[n.Name] = true
+		called := t.Lookup(n.Name)
+		if called == nil || called.Tree == nil {
+			return fmt.Errorf("%s: no such template %q", t.Name(), n.Name)
+		}
+		return checkTemplateCalls(t, called.Tree.Root, seen)
+	}
+	return nil
+}
+
+// checkBranchCalls is checkTemplateCalls for both lists of a branch.
+func checkBranchCalls(t *texttemplate.Template, n *parse.BranchNode, seen map[string]bool) error {
+	if err := checkTemplateCalls(t, n.List, seen); err != nil {
+		return err
+	}
+	return checkTemplateCalls(t, n.ElseList, seen)
+}
+
+// jsonParamSuffix marks the job parameters holding JSON, decoded into maps
+// and arrays for the templates, e.g. ITEMS_JSON is {{range .ITEMS}}.
+const jsonParamSuffix = "_JSON"
+
+// templateData returns the data templates are rendered with: the job
+// parameters by name, e.g. {{.ACCOUNT_TO_NAME}}, and the decoded values of
+// the JSON parameters by name without the suffix.
+//
+// Numbers are decoded as json.Number, so amounts are formatted exactly.
+func templateData(prop *map[string]string) (map[string]interface{}, error) {
+	data := make(map[string]interface{}, len(*prop))
+	for k, v := range *prop {
+		data[k] = v
+	}
+
+	names := make([]string, 0, len(*prop))
+	for k := range *prop {
+		if strings.HasSuffix(k, jsonParamSuffix) && k != jsonParamSuffix {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		name := strings.TrimSuffix(k, jsonParamSuffix)
+		if _, ok := (*prop)[name]; ok {
+			return nil, fmt.Errorf("parameter %s is also set as %s", name, k)
+		}
+		v, err := decodeJSONParam((*prop)[k])
+		if err != nil {
+			return nil, fmt.Errorf("bad %s: %v", k, err)
+		}
+		data[name] = v
+	}
+	return data, nil
+}
+
+// decodeJSONParam decodes the single JSON value of a job parameter.
+func decodeJSONParam(src string) (interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(src))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		if serr, ok := err.(*json.SyntaxError); ok {
+			return nil, fmt.Errorf("%v at offset %d", err, serr.Offset)
+		}
+		if err == io.EOF {
+			return nil, fmt.Errorf("empty value")
+		}
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the value at offset %d", dec.InputOffset())
+	}
+	return v, nil
+}
+
+// templateRefFromParams returns the template named by the SEND_MAIL_TEMPLATE,
+// SEND_MAIL_LOCALE, SEND_MAIL_TEMPLATE_VERSION and SEND_MAIL_LAYOUT
+// parameters. The layout defaults to layout, "none" disables it.
+func templateRefFromParams(prop *map[string]string, layout string) templateRef {
+	if l, ok := (*prop)["SEND_MAIL_LAYOUT"]; ok {
+		layout = l
+	}
+	if layout == noLayout {
+		layout = ""
+	}
+	return templateRef{
+		name:    (*prop)["SEND_MAIL_TEMPLATE"],
+		locale:  (*prop)["SEND_MAIL_LOCALE"],
+		version: (*prop)["SEND_MAIL_TEMPLATE_VERSION"],
+		layout:  layout,
+	}
+}
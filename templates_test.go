@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestTemplates writes files, by name, into a new directory.
+func writeTestTemplates(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// loadTestTemplates parses files as the templates directory.
+func loadTestTemplates(t *testing.T, files map[string]string) *templateSet {
+	dir := writeTestTemplates(t, files)
+	defer os.RemoveAll(dir)
+
+	s, err := loadTemplateSet(dir, "")
+	if err != nil {
+		t.Fatalf("loadTemplateSet() error = %v", err)
+	}
+	return s
+}
+
+// TestTemplateSetRender ensures the parts are rendered from the job
+// parameters, wrapped into layouts, and that missing variables fail the
+// rendering
+func TestTemplateSetRender(t *testing.T) {
+	t.Parallel()
+
+	s := loadTestTemplates(t, map[string]string{
+		"invoice.html":    `<p>{{.ACCOUNT_TO_NAME}}, {{.ACCOUNT_TO_CITY}}: {{.PAYMENT_SUM_WITH_VAT}}</p>`,
+		"invoice.txt":     "{{.ACCOUNT_TO_NAME}}\nК оплате: {{.PAYMENT_SUM_WITH_VAT}}\n",
+		"invoice.subject": "Счёт для\n  {{.ACCOUNT_TO_NAME}}\n",
+		"notice.txt":      "Notice for {{.ACCOUNT_TO_NAME}}",
+		"missing.html":    `<p>{{.ACCOUNT_TO_INN}}</p>`,
+		"act.html":        `{{define "title"}}Акт{{end}}<p>{{template "requisites" .}}</p>`,
+		"act.txt":         `Акт, {{template "requisites" .}}`,
+		"act.subject":     `{{template "company" .}}: акт`,
+
+		"_layouts/default.html":    `<h1>{{block "title" .}}Счёт{{end}}</h1>{{template "content" .}}<footer>{{template "legal/footer" .}}</footer>`,
+		"_layouts/default.txt":     "{{template \"content\" .}}\n--\n{{template \"company\" .}}",
+		"_layouts/default.en.html": `<h1>{{block "title" .}}Invoice{{end}}</h1>{{template "content" .}}`,
+		"_layouts/brief.txt":       "{{template \"content\" .}}\n",
+
+		"_partials/requisites.html":   `ИНН {{.ACCOUNT_FROM_INN}}`,
+		"_partials/requisites.txt":    `ИНН {{.ACCOUNT_FROM_INN}}`,
+		"_partials/company.txt":       `ООО "Поставщик"`,
+		"_partials/legal/footer.html": `{{template "requisites" .}}, {{.ACCOUNT_FROM_CITY}}`,
+	})
+
+	prop := map[string]string{
+		"ACCOUNT_TO_NAME":      `ООО "Получатель"`,
+		"ACCOUNT_TO_CITY":      "Москва",
+		"ACCOUNT_FROM_CITY":    "Москва",
+		"ACCOUNT_FROM_INN":     "7701234567",
+		"PAYMENT_SUM_WITH_VAT": "105.23",
+	}
+	data, err := templateData(&prop)
+	if err != nil {
+		t.Fatalf("templateData() error = %v", err)
+	}
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		ref templateRef
+		// Expected results.
+		want    *renderedMail
+		wantErr bool
+	}{
+		{
+			"All parts",
+			templateRef{name: "invoice"},
+			&renderedMail{
+				subject: `Счёт для ООО "Получатель"`,
+				plain:   "ООО \"Получатель\"\nК оплате: 105.23\n",
+				html:    `<p>ООО &#34;Получатель&#34;, Москва: 105.23</p>`,
+			},
+			false,
+		},
+		{"Plain only", templateRef{name: "notice"}, &renderedMail{plain: `Notice for ООО "Получатель"`}, false},
+		{
+			"Partials",
+			templateRef{name: "act"},
+			&renderedMail{
+				subject: `ООО "Поставщик": акт`,
+				plain:   "Акт, ИНН 7701234567",
+				html:    "<p>ИНН 7701234567</p>",
+			},
+			false,
+		},
+		{
+			"Layout",
+			templateRef{name: "invoice", layout: "default"},
+			&renderedMail{
+				subject: `Счёт для ООО "Получатель"`,
+				plain:   "ООО \"Получатель\"\nК оплате: 105.23\n\n--\nООО \"Поставщик\"",
+				html:    `<h1>Счёт</h1><p>ООО &#34;Получатель&#34;, Москва: 105.23</p><footer>ИНН 7701234567, Москва</footer>`,
+			},
+			false,
+		},
+		{
+			"Overridden block",
+			templateRef{name: "act", layout: "default"},
+			&renderedMail{
+				subject: `ООО "Поставщик": акт`,
+				plain:   "Акт, ИНН 7701234567\n--\nООО \"Поставщик\"",
+				html:    `<h1>Акт</h1><p>ИНН 7701234567</p><footer>ИНН 7701234567, Москва</footer>`,
+			},
+			false,
+		},
+		{
+			"Localized layout",
+			templateRef{name: "invoice", locale: "en-US", layout: "default"},
+			&renderedMail{
+				subject: `Счёт для ООО "Получатель"`,
+				plain:   "ООО \"Получатель\"\nК оплате: 105.23\n",
+				html:    `<h1>Invoice</h1><p>ООО &#34;Получатель&#34;, Москва: 105.23</p>`,
+			},
+			false,
+		},
+		{
+			"Layout without HTML",
+			templateRef{name: "invoice", layout: "brief"},
+			&renderedMail{
+				subject: `Счёт для ООО "Получатель"`,
+				plain:   "ООО \"Получатель\"\nК оплате: 105.23\n\n",
+				html:    `<p>ООО &#34;Получатель&#34;, Москва: 105.23</p>`,
+			},
+			false,
+		},
+		{"Unknown layout", templateRef{name: "invoice", layout: "letter"}, nil, true},
+		{"Missing variable", templateRef{name: "missing"}, nil, true},
+		{"Missing variable in layout", templateRef{name: "missing", layout: "default"}, nil, true},
+		{"Unknown template", templateRef{name: "receipt"}, nil, true},
+		{"Outside of the directory", templateRef{name: "../invoice"}, nil, true},
+		{"Empty name", templateRef{}, nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Twice, the second time from the cache
+			for i := 0; i < 2; i++ {
+				got, err := s.render(tt.ref, data)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("%q. templateSet.render() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+				}
+				assert.Equal(t, tt.want, got, tt.name)
+			}
+		})
+	}
+}
+
+// TestLoadTemplateSet ensures syntax, escaping and undefined template errors
+// are found when the set is loaded, and that every template is combined with
+// every layout
+func TestLoadTemplateSet(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		files map[string]string
+		// Expected results.
+		names   []string
+		wantErr bool
+	}{
+		{
+			"Valid",
+			map[string]string{
+				"invoice.ru.1.html":    "{{.A}}",
+				"invoice.ru.1.subject": "{{.B}}",
+				"notice.txt":           "{{.C}}",
+				"readme.md":            "{{",
+				"_layouts/default.txt": "{{template \"content\" .}}",
+			},
+			[]string{"invoice.ru.1", "notice"},
+			false,
+		},
+		{"Empty", map[string]string{}, nil, false},
+		{"Template", map[string]string{"invoice.html": "{{.A"}, nil, true},
+		{"Subject", map[string]string{"invoice.subject": "{{end}}"}, nil, true},
+		{"Layout", map[string]string{"_layouts/default.html": "{{template \"content\" .}"}, nil, true},
+		{"Partial", map[string]string{"_partials/footer.txt": "{{if}}"}, nil, true},
+		{"Escaping", map[string]string{"invoice.html": `<a href="{{.URL}}`}, nil, true},
+		{"Undefined", map[string]string{"invoice.txt": `{{template "missing" .}}`}, nil, true},
+		{"Undefined in branch", map[string]string{"invoice.subject": `{{if .A}}{{.A}}{{else}}{{template "company" .}}{{end}}`}, nil, true},
+		{
+			"Undefined in layout",
+			map[string]string{
+				"invoice.html":          "{{.A}}",
+				"_layouts/default.html": `{{template "content" .}}{{template "footer" .}}`,
+			},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := writeTestTemplates(t, tt.files)
+			defer os.RemoveAll(dir)
+
+			s, err := loadTemplateSet(dir, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. loadTemplateSet() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if err == nil {
+				assert.Equal(t, tt.names, s.names, tt.name)
+				for _, stem := range append([]string{markdownStem}, s.names...) {
+					for _, layout := range s.layoutNames {
+						assert.Contains(t, s.combined, combinedKey(stem, layout), tt.name)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestResolveTemplate ensures locales fall back from the most specific one
+// and the latest version is picked unless one is given
+func TestResolveTemplate(t *testing.T) {
+	t.Parallel()
+
+	stems := []string{
+		"invoice.ru.1",
+		"invoice.ru.2",
+		"invoice.ru-RU.1",
+		"invoice.en",
+		"invoice.3",
+		"invoice",
+		"invoice.ru.1.2",
+		"invoice_old.ru",
+		"receipt.kk_KZ.1",
+		"notice",
+	}
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		ref           templateRef
+		defaultLocale string
+		// Expected results.
+		want    string
+		wantErr bool
+	}{
+		{"Exact locale", templateRef{name: "invoice", locale: "ru-RU"}, "", "invoice.ru-RU.1", false},
+		{"Region underscore", templateRef{name: "invoice", locale: "ru_ru"}, "", "invoice.ru-RU.1", false},
+		{"Language fallback", templateRef{name: "invoice", locale: "ru-UA"}, "", "invoice.ru.2", false},
+		{"Given version", templateRef{name: "invoice", locale: "ru-UA", version: "1"}, "", "invoice.ru.1", false},
+		{"Default locale", templateRef{name: "invoice", locale: "de-DE"}, "en", "invoice.en", false},
+		{"Without locale", templateRef{name: "invoice", locale: "de"}, "", "invoice.3", false},
+		{"Unversioned first", templateRef{name: "invoice", version: "0"}, "", "invoice", false},
+		{"Unknown version", templateRef{name: "invoice", locale: "ru", version: "7"}, "", "", true},
+		{"Bad version", templateRef{name: "invoice", version: "latest"}, "", "", true},
+		{"Default locale only", templateRef{name: "receipt"}, "kk-KZ", "receipt.kk_KZ.1", false},
+		{"No locale matches", templateRef{name: "receipt", locale: "ru"}, "", "", true},
+		{"Unlocalized", templateRef{name: "notice", locale: "ru-RU"}, "en", "notice", false},
+		{"Unknown template", templateRef{name: "order"}, "", "", true},
+		{"Bad name", templateRef{name: "../invoice"}, "", "", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := resolveTemplate(stems, tt.ref, tt.defaultLocale)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. resolveTemplate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got, tt.name)
+		})
+	}
+}
+
+// TestTemplateLocales ensures the locales are tried from the most specific
+// one, without duplicates
+func TestTemplateLocales(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []string{"ru-ru", "ru", ""}, templateLocales("ru_RU", ""))
+	assert.Equal(t, []string{"ru-ru", "ru", "en-us", "en", ""}, templateLocales("ru-RU", "en-US"))
+	assert.Equal(t, []string{"ru", ""}, templateLocales("", "ru"))
+	assert.Equal(t, []string{""}, templateLocales("", ""))
+}
+
+// TestTemplateData ensures the JSON parameters are decoded for the templates,
+// and that invalid JSON fails the job
+func TestTemplateData(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		prop map[string]string
+		// Expected results.
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			"Plain parameters",
+			map[string]string{"ACCOUNT_TO_NAME": "Получатель"},
+			map[string]interface{}{"ACCOUNT_TO_NAME": "Получатель"},
+			false,
+		},
+		{
+			"Items",
+			map[string]string{"ITEMS_JSON": `[{"name": "Доставка", "qty": 2, "price": "450.00"}]`},
+			map[string]interface{}{
+				"ITEMS_JSON": `[{"name": "Доставка", "qty": 2, "price": "450.00"}]`,
+				"ITEMS": []interface{}{
+					map[string]interface{}{"name": "Доставка", "qty": json.Number("2"), "price": "450.00"},
+				},
+			},
+			false,
+		},
+		{
+			"Object",
+			map[string]string{"BUYER_JSON": ` {"inn": "7701234567", "vat": true} `},
+			map[string]interface{}{
+				"BUYER_JSON": ` {"inn": "7701234567", "vat": true} `,
+				"BUYER":      map[string]interface{}{"inn": "7701234567", "vat": true},
+			},
+			false,
+		},
+		{"Syntax error", map[string]string{"ITEMS_JSON": `[{"name": "Доставка",}]`}, nil, true},
+		{"Truncated", map[string]string{"ITEMS_JSON": `[{"name": "Доставка"`}, nil, true},
+		{"Empty", map[string]string{"ITEMS_JSON": ""}, nil, true},
+		{"Two values", map[string]string{"ITEMS_JSON": `[] []`}, nil, true},
+		{"Name taken", map[string]string{"ITEMS_JSON": `[]`, "ITEMS": "3"}, nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := templateData(&tt.prop)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. templateData() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got, tt.name)
+		})
+	}
+}
+
+// TestTemplateSetRender_items ensures templates loop over the decoded items
+func TestTemplateSetRender_items(t *testing.T) {
+	t.Parallel()
+
+	s := loadTestTemplates(t, map[string]string{
+		"invoice.ru.1.html": `<table>{{range $i, $item := .ITEMS}}` +
+			`<tr><td>{{$item.name}}</td><td>{{$item.qty}}</td><td>{{money $item.price}}</td></tr>` +
+			`{{end}}</table>`,
+		"invoice.ru.1.txt": `{{.BUYER.name}}, ИНН {{.BUYER.inn}}: {{len .ITEMS}}`,
+	})
+	prop := map[string]string{
+		"ITEMS_JSON": `[{"name": "Бумага А4", "qty": 10, "price": 350.5}, {"name": "Доставка", "qty": 1, "price": "1200"}]`,
+		"BUYER_JSON": `{"name": "ООО \"Получатель\"", "inn": "7701234567"}`,
+	}
+	data, err := templateData(&prop)
+	if err != nil {
+		t.Fatalf("templateData() error = %v", err)
+	}
+
+	got, err := s.render(templateRef{name: "invoice", locale: "ru"}, data)
+	if err != nil {
+		t.Fatalf("templateSet.render() error = %v", err)
+	}
+	assert.Equal(t, `ООО "Получатель", ИНН 7701234567: 2`, got.plain)
+	assert.Equal(t, "<table>"+
+		"<tr><td>Бумага А4</td><td>10</td><td>350,50"+nbsp+"₽</td></tr>"+
+		"<tr><td>Доставка</td><td>1</td><td>1"+nbsp+"200,00"+nbsp+"₽</td></tr>"+
+		"</table>", got.html)
+}
+
+// TestTemplateSetRenderAttachments ensures templates are rendered into
+// attachments under their rendered filenames
+func TestTemplateSetRenderAttachments(t *testing.T) {
+	t.Parallel()
+
+	s := loadTestTemplates(t, map[string]string{
+		"invoice.ru.1.html": `<h1>Счёт № {{.INVOICE_NUMBER}}</h1><p>{{money .PAYMENT_SUM_WITH_VAT}}</p>`,
+		"invoice.ru.1.txt":  `Счёт № {{.INVOICE_NUMBER}}: {{money .PAYMENT_SUM_WITH_VAT}}`,
+		"invoice.en.1.html": `<h1>Invoice {{.INVOICE_NUMBER}}</h1>`,
+		"act.html":          `<h1>Акт № {{.INVOICE_NUMBER}}</h1>`,
+		"notice.txt":        `Notice`,
+	})
+	prop := map[string]string{
+		"INVOICE_NUMBER":       "42",
+		"PAYMENT_DATE":         "2026-10-18",
+		"PAYMENT_SUM_WITH_VAT": "105.23",
+	}
+	data, err := templateData(&prop)
+	if err != nil {
+		t.Fatalf("templateData() error = %v", err)
+	}
+	html, plain := attachmentTypes[templateHTMLExt], attachmentTypes[templatePlainExt]
+
+	tests := []struct {
+		// Test description.
+		name string
+		// Parameters.
+		list   string
+		locale string
+		// Expected results.
+		want    []renderedAttachment
+		wantErr bool
+	}{
+		{
+			"Default filename",
+			"invoice",
+			"ru",
+			[]renderedAttachment{{"invoice.html", html, []byte("<h1>Счёт № 42</h1><p>105,23" + nbsp + "₽</p>")}},
+			false,
+		},
+		{
+			"Templated filename",
+			"invoice.html=Счёт № {{.INVOICE_NUMBER}} от {{shortDate .PAYMENT_DATE}}.html",
+			"ru",
+			[]renderedAttachment{{"Счёт № 42 от 18.10.2026.html", html, []byte("<h1>Счёт № 42</h1><p>105,23" + nbsp + "₽</p>")}},
+			false,
+		},
+		{
+			"Several",
+			"invoice.txt=invoice-{{.INVOICE_NUMBER}}.txt; act.html=act-{{.INVOICE_NUMBER}}.html;",
+			"ru",
+			[]renderedAttachment{
+				{"invoice-42.txt", plain, []byte("Счёт № 42: 105,23" + nbsp + "₽")},
+				{"act-42.html", html, []byte("<h1>Акт № 42</h1>")},
+			},
+			false,
+		},
+		{
+			"Locale",
+			"invoice=Invoice {{.INVOICE_NUMBER}}.html",
+			"en-US",
+			[]renderedAttachment{{"Invoice 42.html", html, []byte("<h1>Invoice 42</h1>")}},
+			false,
+		},
+		{
+			"Path in the filename",
+			"act=../../etc/{{.INVOICE_NUMBER}}.html",
+			"",
+			[]renderedAttachment{{"42.html", html, []byte("<h1>Акт № 42</h1>")}},
+			false,
+		},
+		{"Empty list", " ; ", "", nil, false},
+		{"Missing part", "notice.html", "", nil, true},
+		{"Unknown template", "receipt", "", nil, true},
+		{"Missing variable in the filename", "act={{.ACT_NUMBER}}.html", "", nil, true},
+		{"Bad filename", "act={{.INVOICE_NUMBER", "", nil, true},
+		{"Empty filename", "act={{/* none */}}", "", nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := s.renderAttachments(tt.list, tt.locale, data, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%q. templateSet.renderAttachments() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got, tt.name)
+		})
+	}
+}
+
+// TestTemplateSetRenderPDFAttachments ensures the HTML part is converted for
+// .pdf attachments, and fails without fonts
+func TestTemplateSetRenderPDFAttachments(t *testing.T) {
+	t.Parallel()
+
+	s := loadTestTemplates(t, map[string]string{
+		"invoice.html": `<h1>Счёт № {{.INVOICE_NUMBER}}</h1><table border="1"><tr><td>{{money .PAYMENT_SUM}}</td></tr></table>`,
+		"notice.txt":   `Notice`,
+	})
+	data := map[string]interface{}{"INVOICE_NUMBER": "42", "PAYMENT_SUM": "105.23"}
+
+	got, err := s.renderAttachments("invoice.pdf=Счёт {{.INVOICE_NUMBER}}.pdf", "", data, testPDFFonts())
+	if err != nil {
+		t.Fatalf("templateSet.renderAttachments() error = %v", err)
+	}
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, "Счёт 42.pdf", got[0].filename)
+		assert.Equal(t, "application/pdf", got[0].mimeType)
+		assert.True(t, bytes.HasPrefix(got[0].content, []byte("%PDF-")), "PDF header")
+	}
+
+	if _, err := s.renderAttachments("invoice.pdf", "", data, nil); err == nil {
+		t.Errorf("templateSet.renderAttachments() without fonts error = nil, want an error")
+	}
+	if _, err := s.renderAttachments("notice.pdf", "", data, testPDFFonts()); err == nil {
+		t.Errorf("templateSet.renderAttachments() without HTML error = nil, want an error")
+	}
+}
+
+// TestSendMailTemplate ensures SEND_MAIL_TEMPLATE fills the message and that
+// rendering errors stop the mail from being sent.
+//
+// Not parallel, globConf is replaced for the duration of the test.
+func TestSendMailTemplate(t *testing.T) {
+	saved := globConf.templates
+	defer func() { globConf.templates = saved }()
+	globConf.templates = &templateStore{}
+	globConf.templates.current.Store(loadTestTemplates(t, map[string]string{
+		"invoice.ru.1.html":    `<p>Счёт для {{.ACCOUNT_TO_NAME}}</p>`,
+		"invoice.ru.1.subject": `Счёт {{.INVOICE_NUMBER}}`,
+		"invoice.en.1.html":    `<p>Invoice for {{.ACCOUNT_TO_NAME}}</p>`,
+		"invoice.en.1.subject": `Invoice {{.INVOICE_NUMBER}}`,
+		"_layouts/letter.html": `<div>{{template "content" .}}</div>`,
+	}))
+
+	srv := newTestSMTPServer(t)
+	defer srv.Close()
+
+	info := srv.info()
+	info.Layout = "letter"
+	settings := map[string]SMTPInfo{"notify_mail": info}
+	prop := map[string]string{
+		"SEND_MAIL_FROM":     "notify_mail",
+		"SEND_MAIL_TO":       "first@example.org",
+		"SEND_MAIL_TEMPLATE": "invoice",
+		"SEND_MAIL_LOCALE":   "ru-RU",
+		"ACCOUNT_TO_NAME":    "Получатель",
+		"INVOICE_NUMBER":     "42",
+
+		"SEND_MAIL_ATTACH_TEMPLATES": "invoice=Счёт {{.INVOICE_NUMBER}}.html",
+	}
+	assert.True(t, sendMail(&settings, &prop))
+	delete(prop, "SEND_MAIL_ATTACH_TEMPLATES")
+
+	prop["SEND_MAIL_LOCALE"] = "en-GB"
+	prop["SEND_MAIL_LAYOUT"] = noLayout
+	assert.True(t, sendMail(&settings, &prop))
+
+	delete(prop, "INVOICE_NUMBER")
+	assert.False(t, sendMail(&settings, &prop))
+
+	prop["INVOICE_NUMBER"] = "42"
+	prop["SEND_MAIL_ATTACH_TEMPLATES"] = "invoice={{.ACT_NUMBER}}.html"
+	assert.False(t, sendMail(&settings, &prop))
+
+	prop["ITEMS_JSON"] = `[{"name": "Услуги"`
+	assert.False(t, sendMail(&settings, &prop))
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if assert.Equal(t, 2, len(srv.messages)) {
+		msg, err := ParseMail(&SMTPInfo{}, strings.NewReader(srv.messages[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Счёт 42", decodeTestHeader(t, msg.subject))
+		assert.Equal(t, "<div><p>Счёт для Получатель</p></div>", msg.html.String())
+		if assert.Len(t, msg.attachments, 1) {
+			a := msg.attachments[0]
+			assert.Equal(t, "Счёт 42.html", a.filename)
+			assert.Equal(t, "text/html", a.mimeType)
+			assert.Equal(t, BytesSource("<p>Счёт для Получатель</p>"), a.content)
+		}
+
+		msg, err = ParseMail(&SMTPInfo{}, strings.NewReader(srv.messages[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Invoice 42", msg.subject)
+		assert.Equal(t, "<p>Invoice for Получатель</p>", msg.html.String())
+	}
+}
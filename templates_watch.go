@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// templatesReloadInterval is the default time between two checks of the
+// templates directory for changes.
+const templatesReloadInterval = 10 * time.Second
+
+// templateStore holds the template set of a directory, swapped atomically
+// for a new one when the files of the directory change.
+//
+// A set failing to load never replaces the current one, so a broken deploy
+// keeps the mails going out with the previous templates.
+type templateStore struct {
+	dir           string
+	defaultLocale string
+	current       atomic.Value // *templateSet
+	stamp         string       // fingerprint of the files of the current set
+}
+
+// newTemplateStore loads the templates of dir, failing on any error
+// found in them.
+func newTemplateStore(dir, defaultLocale string) (*templateStore, error) {
+	st := &templateStore{dir: dir, defaultLocale: defaultLocale}
+	if _, err := st.reload(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// set returns the current template set.
+func (st *templateStore) set() *templateSet {
+	s, _ := st.current.Load().(*templateSet)
+	return s
+}
+
+// reload loads the templates again when the files of the directory changed,
+// and reports whether the set was replaced.
+//
+// A broken set is reported once, the next attempt waits for the next change.
+func (st *templateStore) reload() (bool, error) {
+	// Taken first, so changes made while loading are found on the next check
+	stamp, err := templatesStamp(st.dir)
+	if err != nil {
+		return false, err
+	}
+	if stamp == st.stamp && st.set() != nil {
+		return false, nil
+	}
+	st.stamp = stamp
+
+	s, err := loadTemplateSet(st.dir, st.defaultLocale)
+	if err != nil {
+		return false, err
+	}
+	st.current.Store(s)
+	return true, nil
+}
+
+// watch checks the templates directory for changes every interval, until
+// stop is closed.
+func (st *templateStore) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := st.reload()
+		if err != nil {
+			glog.Errorf("ERR: TEMPLATES(%s): %v, keeping the previous templates", st.dir, err)
+			continue
+		}
+		if reloaded {
+			if glog.V(2) {
+				glog.Infof("LOG: TEMPLATES(%s): reloaded", st.dir)
+			}
+		}
+	}
+}
+
+// templatesStamp returns a fingerprint of the names, sizes and modification
+// times of the files under dir, "" when dir does not exist.
+func templatesStamp(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00", path, fi.Size(), fi.ModTime().UnixNano())
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestTemplateStoreReload ensures changed templates are swapped in, and that
+// a set failing to load keeps the previous one
+func TestTemplateStoreReload(t *testing.T) {
+	t.Parallel()
+
+	dir := writeTestTemplates(t, map[string]string{"notice.txt": "v1 {{.NAME}}"})
+	defer os.RemoveAll(dir)
+
+	st, err := newTemplateStore(dir, "")
+	if err != nil {
+		t.Fatalf("newTemplateStore() error = %v", err)
+	}
+	render := func() string {
+		out, err := st.set().render(templateRef{name: "notice"}, map[string]interface{}{"NAME": "Иван"})
+		if err != nil {
+			t.Fatalf("templateSet.render() error = %v", err)
+		}
+		return out.plain
+	}
+	write := func(name, src string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, "v1 Иван", render())
+
+	reloaded, err := st.reload()
+	assert.False(t, reloaded, "unchanged")
+	assert.NoError(t, err)
+
+	write("notice.txt", "version 2 {{.NAME}}")
+	reloaded, err = st.reload()
+	assert.True(t, reloaded, "changed")
+	assert.NoError(t, err)
+	assert.Equal(t, "version 2 Иван", render())
+
+	write("broken.html", "{{.NAME")
+	reloaded, err = st.reload()
+	assert.False(t, reloaded, "broken")
+	assert.Error(t, err)
+	assert.Equal(t, "version 2 Иван", render())
+
+	// Reported once, until the next change
+	reloaded, err = st.reload()
+	assert.False(t, reloaded, "still broken")
+	assert.NoError(t, err)
+
+	if err := os.Remove(filepath.Join(dir, "broken.html")); err != nil {
+		t.Fatal(err)
+	}
+	write("notice.txt", "fixed {{.NAME}}")
+	reloaded, err = st.reload()
+	assert.True(t, reloaded, "fixed")
+	assert.NoError(t, err)
+	assert.Equal(t, "fixed Иван", render())
+
+	// Parsed, but calling an undefined template
+	write("notice.txt", `{{template "signature" .}}`)
+	reloaded, err = st.reload()
+	assert.False(t, reloaded, "undefined template")
+	assert.Error(t, err)
+	assert.Equal(t, "fixed Иван", render())
+}
+
+// TestNewTemplateStore ensures syntax errors fail the startup
+func TestNewTemplateStore(t *testing.T) {
+	t.Parallel()
+
+	dir := writeTestTemplates(t, map[string]string{"invoice.ru.1.html": "{{if .PAID}}"})
+	defer os.RemoveAll(dir)
+
+	if _, err := newTemplateStore(dir, ""); err == nil {
+		t.Errorf("newTemplateStore() error = nil, want a syntax error")
+	}
+
+	st, err := newTemplateStore(filepath.Join(dir, "missing"), "")
+	if err != nil {
+		t.Fatalf("newTemplateStore() error = %v", err)
+	}
+	assert.Empty(t, st.set().names)
+}
+
+// TestTemplateStoreWatch ensures the directory is polled until stopped
+func TestTemplateStoreWatch(t *testing.T) {
+	t.Parallel()
+
+	dir := writeTestTemplates(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	st, err := newTemplateStore(dir, "")
+	if err != nil {
+		t.Fatalf("newTemplateStore() error = %v", err)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		st.watch(10*time.Millisecond, stop)
+		close(done)
+	}()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "notice.txt"), []byte("notice"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(st.set().names) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-done
+	assert.Equal(t, []string{"notice"}, st.set().names)
+}
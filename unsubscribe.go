@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// unsubscribePage is shown on GET: following the link must not unsubscribe
+// by itself, as mail scanners prefetch links (RFC 8058, section 3.2).
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Отписка от рассылки</title></head>
+<body>
+{{if .Done}}<p>Адрес {{.Addr}} отписан от рассылки «{{.Category}}».</p>
+{{else}}<form method="post">
+<p>Отписать {{.Addr}} от рассылки «{{.Category}}»?</p>
+<input type="hidden" name="token" value="{{.Token}}">
+<input type="hidden" name="List-Unsubscribe" value="One-Click">
+<button type="submit">Отписаться</button>
+</form>
+{{end}}</body></html>
+`))
+
+// expand checks the settings and loads the list of unsubscribed addresses.
+// Unsubscribe links are only added when both the URL and the secret are set.
+func (u *UnsubscribeInfo) expand(configPath string) {
+	u.list = nil
+	if u.URL == "" && u.Secret == "" {
+		return
+	}
+	if u.URL == "" || u.Secret == "" {
+		glog.Errorf("ERR: UNSUBSCRIBE: url and secret go together")
+		return
+	}
+	if u.Storage == "" {
+		u.Storage = filepath.Join(configPath, "unsubscribed.json")
+	}
+
+	list, err := loadUnsubscribeList(u.Storage)
+	if err != nil {
+		glog.Errorf("ERR: UNSUBSCRIBE: %v", err)
+		return
+	}
+	u.list = list
+}
+
+func (u *UnsubscribeInfo) enabled() bool {
+	return u.list != nil
+}
+
+// token returns the signed token identifying addr and category.
+func (u *UnsubscribeInfo) token(addr, category string) string {
+	payload := strings.ToLower(addr) + "\n" + category
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(u.sign(payload))
+}
+
+func (u *UnsubscribeInfo) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(u.Secret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// parseToken checks the signature of token and returns its address and
+// category.
+func (u *UnsubscribeInfo) parseToken(token string) (string, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", "", errors.New("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", errors.New("malformed token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, u.sign(string(payload))) {
+		return "", "", errors.New("bad token signature")
+	}
+
+	fields := strings.SplitN(string(payload), "\n", 2)
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return "", "", errors.New("malformed token")
+	}
+	return fields[0], fields[1], nil
+}
+
+// link returns the unsubscribe URL of addr for category.
+func (u *UnsubscribeInfo) link(addr, category string) string {
+	sep := "?"
+	if strings.Contains(u.URL, "?") {
+		sep = "&"
+	}
+	return u.URL + sep + "token=" + u.token(addr, category)
+}
+
+// unsubscribeAddr returns the bare lower-case address of a recipient entry,
+// so "Ivan <ivan@example.org>" and ivan@example.org are one subscriber.
+func unsubscribeAddr(entry string) string {
+	if a, err := netmail.ParseAddress(entry); err == nil {
+		entry = a.Address
+	}
+	return strings.ToLower(strings.TrimSpace(entry))
+}
+
+// addHeaders adds the RFC 2369 and RFC 8058 one-click unsubscribe headers for
+// addr to m.
+func (u *UnsubscribeInfo) addHeaders(m *MailYak, addr, category string) {
+	m.AddHeader("List-Unsubscribe", "<"+u.link(addr, category)+">")
+	m.AddHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+}
+
+// ServeHTTP records unsubscribes: a POST with a valid token unsubscribes at
+// once (one-click, RFC 8058), a GET asks for a confirmation.
+func (u *UnsubscribeInfo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	token := r.Form.Get("token")
+	addr, category, err := u.parseToken(token)
+	if err != nil {
+		glog.Errorf("ERR: UNSUBSCRIBE(%s): %v", r.RemoteAddr, err)
+		http.Error(w, "bad unsubscribe link", http.StatusBadRequest)
+		return
+	}
+
+	data := struct {
+		Addr, Category, Token string
+		Done                  bool
+	}{addr, category, token, false}
+
+	if r.Method == http.MethodPost {
+		if err := u.list.add(addr, category); err != nil {
+			glog.Errorf("ERR: UNSUBSCRIBE(%s, %s): %v", addr, category, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		glog.Infof("LOG: UNSUBSCRIBE(%s, %s)", addr, category)
+		data.Done = true
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := unsubscribePage.Execute(w, data); err != nil {
+		glog.Errorf("ERR: UNSUBSCRIBE: %v", err)
+	}
+}
+
+// unsubscribeList is the persistent set of unsubscribed addresses per
+// category.
+type unsubscribeList struct {
+	mu       sync.Mutex
+	filename string
+	entries  map[string]map[string]time.Time // category -> address -> time
+}
+
+// loadUnsubscribeList reads the list stored in filename, which does not have
+// to exist yet.
+func loadUnsubscribeList(filename string) (*unsubscribeList, error) {
+	l := &unsubscribeList{filename: filename, entries: map[string]map[string]time.Time{}}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &l.entries); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// contains reports whether addr unsubscribed from category.
+func (l *unsubscribeList) contains(addr, category string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.entries[category][strings.ToLower(addr)]
+	return ok
+}
+
+// add records the unsubscribe and saves the list.
+func (l *unsubscribeList) add(addr, category string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	addr = strings.ToLower(addr)
+	if _, ok := l.entries[category][addr]; ok {
+		return nil
+	}
+	if l.entries[category] == nil {
+		l.entries[category] = map[string]time.Time{}
+	}
+	l.entries[category][addr] = time.Now().UTC()
+
+	data, err := json.MarshalIndent(l.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Replace the file atomically, so a crash never leaves a truncated list
+	tmp := l.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.filename)
+}
+
+// unsubscribePath returns the path the handler is served on.
+func (u *UnsubscribeInfo) unsubscribePath() string {
+	p, err := url.Parse(u.URL)
+	if err != nil || p.Path == "" {
+		return "/"
+	}
+	return p.Path
+}
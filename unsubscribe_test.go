@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestUnsubscribe returns enabled unsubscribe settings storing the list in
+// dir.
+func newTestUnsubscribe(t *testing.T, dir string) *UnsubscribeInfo {
+	u := &UnsubscribeInfo{URL: "https://mail.example.org/unsubscribe", Secret: "secret"}
+	u.expand(dir)
+	if !u.enabled() {
+		t.Fatal("unsubscribe not enabled")
+	}
+	return u
+}
+
+// TestUnsubscribeToken ensures tokens carry the address and category and
+// cannot be forged
+func TestUnsubscribeToken(t *testing.T) {
+	t.Parallel()
+
+	u := &UnsubscribeInfo{Secret: "secret"}
+	other := &UnsubscribeInfo{Secret: "other"}
+	token := u.token("Buyer@Example.net", "news")
+
+	addr, category, err := u.parseToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "buyer@example.net", addr)
+	assert.Equal(t, "news", category)
+
+	forged := u.token("buyer@example.net", "invoices")
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"Empty", ""},
+		{"No signature", strings.Split(token, ".")[0]},
+		{"Other secret", other.token("buyer@example.net", "news")},
+		{"Swapped payload", strings.Split(forged, ".")[0] + "." + strings.Split(token, ".")[1]},
+		{"Bad base64", "!!!." + strings.Split(token, ".")[1]},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if _, _, err := u.parseToken(tt.token); err == nil {
+				t.Errorf("%q. parseToken() error = nil, want an error", tt.name)
+			}
+		})
+	}
+}
+
+// TestUnsubscribeHandler ensures only a POST records the unsubscribe, and
+// that the list survives a restart
+func TestUnsubscribeHandler(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "unsubscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u := newTestUnsubscribe(t, dir)
+	link := u.link("buyer@example.net", "news")
+	assert.True(t, strings.HasPrefix(link, "https://mail.example.org/unsubscribe?token="))
+
+	// Link scanners and people following the link get a confirmation form
+	rec := httptest.NewRecorder()
+	u.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, link, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `<form method="post">`)
+	assert.False(t, u.list.contains("buyer@example.net", "news"))
+
+	// One-click POST by the mail client
+	req := httptest.NewRequest(http.MethodPost, link, strings.NewReader("List-Unsubscribe=One-Click"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	u.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, u.list.contains("BUYER@example.net", "news"))
+	assert.False(t, u.list.contains("buyer@example.net", "invoices"))
+
+	// The form posts the token in the body
+	form := url.Values{"token": {u.token("second@example.net", "news")}}
+	req = httptest.NewRequest(http.MethodPost, "https://mail.example.org/unsubscribe", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	u.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	u.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "https://mail.example.org/unsubscribe?token=bad", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	u.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, link, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	reloaded, err := loadUnsubscribeList(filepath.Join(dir, "unsubscribed.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, reloaded.contains("buyer@example.net", "news"))
+	assert.True(t, reloaded.contains("second@example.net", "news"))
+}
+
+// TestSendMailUnsubscribe ensures categorized mails carry the unsubscribe
+// headers and are not sent to unsubscribed addresses.
+//
+// Not parallel, globConf is replaced for the duration of the test.
+func TestSendMailUnsubscribe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unsubscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := globConf.Unsubscribe
+	defer func() { globConf.Unsubscribe = saved }()
+	globConf.Unsubscribe = *newTestUnsubscribe(t, dir)
+	if err := globConf.Unsubscribe.list.add("second@example.org", "news"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newTestSMTPServer(t)
+	defer srv.Close()
+
+	settings := map[string]SMTPInfo{"notify_mail": srv.info()}
+	prop := map[string]string{
+		"SEND_MAIL_FROM":      "notify_mail",
+		"SEND_MAIL_TO":        "First@Example.org;Second <SECOND@example.org>",
+		"SEND_MAIL_SUBJECT":   "News",
+		"SEND_MAIL_BODY_HTML": "Our news",
+		"SEND_MAIL_CATEGORY":  "news",
+	}
+	assert.True(t, sendMail(&settings, &prop))
+	token := globConf.Unsubscribe.token("first@example.org", "news")
+
+	// A category is never sent without the unsubscribe headers
+	globConf.Unsubscribe = UnsubscribeInfo{}
+	assert.False(t, sendMail(&settings, &prop))
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	assert.Equal(t, [][]string{{"First@Example.org"}}, srv.rcpts)
+	if assert.Equal(t, 1, len(srv.messages)) {
+		assert.Contains(t, srv.messages[0], "List-Unsubscribe: <https://mail.example.org/unsubscribe?token="+token+">\n")
+		assert.Contains(t, srv.messages[0], "List-Unsubscribe-Post: List-Unsubscribe=One-Click\n")
+	}
+}